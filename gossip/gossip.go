@@ -60,6 +60,7 @@ import (
 	"flag"
 	"math"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -234,6 +235,85 @@ func (g *Gossip) Outgoing() []net.Addr {
 	return g.outgoing.asSlice()
 }
 
+// InfoStatus describes an info held by the local infostore, for
+// diagnosing the gossip network.
+type InfoStatus struct {
+	Key       string `json:"key"`
+	Timestamp int64  `json:"timestamp"` // Wall time at origination (Unix-nanos)
+	TTLStamp  int64  `json:"ttlStamp"`  // Wall time before info is discarded (Unix-nanos)
+	Hops      uint32 `json:"hops"`      // Number of hops from originator
+	NodeAddr  string `json:"nodeAddr"`  // Originating node
+	PeerAddr  string `json:"peerAddr"`  // Proximate peer; empty if originated locally
+}
+
+// Topology describes the local gossip node's view of the gossip
+// network: its peers, and the infos it knows along with where they
+// came from.
+type Topology struct {
+	NodeAddr   string       `json:"nodeAddr"`   // Empty until the gossip server is started
+	Connected  bool         `json:"connected"`  // True once the network has been connected
+	Bootstraps []string     `json:"bootstraps"` // Bootstrap host addresses
+	Incoming   []string     `json:"incoming"`   // Incoming client addresses
+	Outgoing   []string     `json:"outgoing"`   // Outgoing client addresses
+	MaxHops    uint32       `json:"maxHops"`    // Hops to the furthest info
+	Infos      []InfoStatus `json:"infos"`      // Sorted by key
+}
+
+// Topology returns the local gossip node's view of the gossip
+// network. Peer addresses are sorted.
+func (g *Gossip) Topology() Topology {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t := Topology{
+		NodeAddr:   addrString(g.is.NodeAddr),
+		Connected:  g.hasConnected,
+		Bootstraps: addrStrings(g.bootstraps.asSlice()),
+		Incoming:   addrStrings(g.incoming.asSlice()),
+		Outgoing:   addrStrings(g.outgoing.asSlice()),
+		MaxHops:    g.is.maxHops(),
+		Infos:      []InfoStatus{},
+	}
+	g.is.visitInfos(nil, func(i *info) error {
+		t.Infos = append(t.Infos, InfoStatus{
+			Key:       i.Key,
+			Timestamp: i.Timestamp,
+			TTLStamp:  i.TTLStamp,
+			Hops:      i.Hops,
+			NodeAddr:  addrString(i.NodeAddr),
+			PeerAddr:  addrString(i.peerAddr),
+		})
+		return nil
+	})
+	sort.Sort(infoStatuses(t.Infos))
+	return t
+}
+
+// infoStatuses sorts info statuses by key.
+type infoStatuses []InfoStatus
+
+func (s infoStatuses) Len() int           { return len(s) }
+func (s infoStatuses) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s infoStatuses) Less(i, j int) bool { return s[i].Key < s[j].Key }
+
+// addrString returns the string form of addr, or the empty string if
+// addr is nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// addrStrings returns the sorted string forms of addrs.
+func addrStrings(addrs []net.Addr) []string {
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	sort.Strings(strs)
+	return strs
+}
+
 // Start launches the gossip instance, which commences joining the
 // gossip network using the supplied rpc server and the gossip
 // bootstrap addresses specified via command-line flag: -gossip.
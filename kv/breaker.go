@@ -0,0 +1,114 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBreakerThreshold is the number of consecutive RPC
+	// failures after which a replica's circuit breaker opens.
+	defaultBreakerThreshold = 5
+	// defaultBreakerCoolDown is the duration for which an open
+	// circuit breaker short-circuits RPCs to its replica before
+	// allowing a probe through.
+	defaultBreakerCoolDown = 5 * time.Second
+)
+
+// A breakerOpenError indicates that RPCs were not sent because the
+// circuit breakers of all reachable replicas are open. It is not
+// retryable, so that clients fail fast instead of adding to the load
+// on failing replicas.
+type breakerOpenError struct{}
+
+// Error implements the error interface.
+func (b breakerOpenError) Error() string {
+	return "circuit breakers open for all replicas"
+}
+
+// CanRetry implements the Retryable interface.
+func (b breakerOpenError) CanRetry() bool { return false }
+
+// replicaBreaker tracks the consecutive RPC failures of a single
+// replica and, once open, the time of the last attempt.
+type replicaBreaker struct {
+	failures int
+	openedAt time.Time
+}
+
+// A breakerSet holds a circuit breaker for each replica, keyed by
+// network address. A replica's breaker opens after threshold
+// consecutive RPC failures. While open, RPCs to the replica are
+// short-circuited, except for a single probe each cool-down period;
+// the breaker closes again once an RPC succeeds.
+type breakerSet struct {
+	sync.Mutex
+	threshold int           // Zero to disable
+	coolDown  time.Duration // Time between probes of an open breaker
+	now       func() time.Time
+	breakers  map[string]*replicaBreaker
+}
+
+func newBreakerSet(threshold int, coolDown time.Duration) *breakerSet {
+	return &breakerSet{
+		threshold: threshold,
+		coolDown:  coolDown,
+		now:       time.Now,
+		breakers:  map[string]*replicaBreaker{},
+	}
+}
+
+// allow returns true if an RPC may be sent to the replica at addr:
+// its breaker is closed, or it is open and due to be probed.
+func (bs *breakerSet) allow(addr net.Addr) bool {
+	bs.Lock()
+	defer bs.Unlock()
+	b, ok := bs.breakers[addr.String()]
+	if !ok || bs.threshold == 0 || b.failures < bs.threshold {
+		return true
+	}
+	if now := bs.now(); now.Sub(b.openedAt) >= bs.coolDown {
+		b.openedAt = now
+		return true
+	}
+	return false
+}
+
+// recordSuccess closes the breaker of the replica at addr.
+func (bs *breakerSet) recordSuccess(addr net.Addr) {
+	bs.Lock()
+	defer bs.Unlock()
+	delete(bs.breakers, addr.String())
+}
+
+// recordFailure counts a failed RPC to the replica at addr, opening
+// its breaker if the threshold is reached.
+func (bs *breakerSet) recordFailure(addr net.Addr) {
+	bs.Lock()
+	defer bs.Unlock()
+	b, ok := bs.breakers[addr.String()]
+	if !ok {
+		b = &replicaBreaker{}
+		bs.breakers[addr.String()] = b
+	}
+	b.failures++
+	if b.failures == bs.threshold {
+		b.openedAt = bs.now()
+	}
+}
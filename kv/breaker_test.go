@@ -0,0 +1,83 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestBreakerSet verifies that a replica's circuit breaker opens
+// after consecutive failures, allows a single probe per cool-down
+// period and closes on success.
+func TestBreakerSet(t *testing.T) {
+	bs := newBreakerSet(3, time.Second)
+	now := time.Unix(0, 0)
+	bs.now = func() time.Time { return now }
+	a := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	b := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+
+	// A success resets the count of consecutive failures.
+	bs.recordFailure(a)
+	bs.recordFailure(a)
+	bs.recordSuccess(a)
+	bs.recordFailure(a)
+	bs.recordFailure(a)
+	if !bs.allow(a) {
+		t.Fatal("expected breaker to be closed below the threshold")
+	}
+	bs.recordFailure(a)
+	if bs.allow(a) {
+		t.Fatal("expected breaker to open at the threshold")
+	}
+	if !bs.allow(b) {
+		t.Error("expected breaker of other replica to be closed")
+	}
+
+	// After the cool-down, a single probe is allowed.
+	now = now.Add(time.Second)
+	if !bs.allow(a) {
+		t.Fatal("expected probe after cool-down")
+	}
+	if bs.allow(a) {
+		t.Fatal("expected a single probe per cool-down")
+	}
+	// A failed probe keeps the breaker open for another cool-down.
+	bs.recordFailure(a)
+	now = now.Add(time.Second / 2)
+	if bs.allow(a) {
+		t.Fatal("expected breaker to remain open after failed probe")
+	}
+	now = now.Add(time.Second / 2)
+	if !bs.allow(a) {
+		t.Fatal("expected probe after cool-down")
+	}
+	// A successful probe closes the breaker.
+	bs.recordSuccess(a)
+	if !bs.allow(a) || !bs.allow(a) {
+		t.Error("expected breaker to close after successful probe")
+	}
+
+	// A zero threshold disables the breakers.
+	bs = newBreakerSet(0, time.Second)
+	for i := 0; i < 10; i++ {
+		bs.recordFailure(a)
+	}
+	if !bs.allow(a) {
+		t.Error("expected disabled breaker to allow RPCs")
+	}
+}
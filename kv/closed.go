@@ -0,0 +1,81 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// replicaKey identifies a replica of a range.
+type replicaKey struct {
+	rangeID int64
+	nodeID  int32
+	storeID int32
+}
+
+// A closedTracker records the closed timestamp last reported by each
+// replica in reply to a read, used to route historical reads to
+// replicas known to be able to serve the read timestamp.
+type closedTracker struct {
+	sync.Mutex
+	closed map[replicaKey]proto.Timestamp
+}
+
+func newClosedTracker() *closedTracker {
+	return &closedTracker{
+		closed: map[replicaKey]proto.Timestamp{},
+	}
+}
+
+// record notes the closed timestamp reported by replica in reply, if
+// reply is a successful read. Closed timestamps never regress.
+func (ct *closedTracker) record(replica proto.Replica, reply interface{}) {
+	resp, ok := reply.(proto.Response)
+	if !ok || resp.Header().Error != nil {
+		return
+	}
+	ts := resp.Header().ClosedTimestamp
+	if ts.Equal(proto.MinTimestamp) {
+		return
+	}
+	key := replicaKey{replica.RangeID, replica.NodeID, replica.StoreID}
+	ct.Lock()
+	defer ct.Unlock()
+	if prev, ok := ct.closed[key]; !ok || prev.Less(ts) {
+		ct.closed[key] = ts
+	}
+}
+
+// order returns the replicas known to have closed timestamp first,
+// followed by the others; each retains its relative order in
+// replicas.
+func (ct *closedTracker) order(replicas []proto.Replica, timestamp proto.Timestamp) []proto.Replica {
+	ct.Lock()
+	defer ct.Unlock()
+	ordered := make([]proto.Replica, 0, len(replicas))
+	var behind []proto.Replica
+	for _, replica := range replicas {
+		ts, ok := ct.closed[replicaKey{replica.RangeID, replica.NodeID, replica.StoreID}]
+		if ok && !ts.Less(timestamp) {
+			ordered = append(ordered, replica)
+		} else {
+			behind = append(behind, replica)
+		}
+	}
+	return append(ordered, behind...)
+}
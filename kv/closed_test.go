@@ -0,0 +1,64 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// TestClosedTrackerOrder verifies that replicas known to have closed
+// a timestamp are ordered first, and that closed timestamps are only
+// learned from successful replies and never regress.
+func TestClosedTrackerOrder(t *testing.T) {
+	ct := newClosedTracker()
+	replicas := []proto.Replica{
+		{NodeID: 1, StoreID: 1, RangeID: 1},
+		{NodeID: 2, StoreID: 2, RangeID: 1},
+		{NodeID: 3, StoreID: 3, RangeID: 1},
+	}
+	reply := func(wallTime int64) *proto.GetResponse {
+		r := &proto.GetResponse{}
+		r.ClosedTimestamp = proto.Timestamp{WallTime: wallTime}
+		return r
+	}
+	ct.record(replicas[1], reply(5))
+	ct.record(replicas[1], reply(3))
+	ct.record(replicas[2], reply(10))
+	errReply := reply(20)
+	errReply.SetGoError(&proto.NotLeaderError{})
+	ct.record(replicas[0], errReply)
+
+	testCases := []struct {
+		wallTime int64
+		expected []int32
+	}{
+		{1, []int32{2, 3, 1}},
+		{5, []int32{2, 3, 1}},
+		{6, []int32{3, 1, 2}},
+		{20, []int32{1, 2, 3}},
+	}
+	for i, test := range testCases {
+		ordered := ct.order(replicas, proto.Timestamp{WallTime: test.wallTime})
+		for j, replica := range ordered {
+			if replica.NodeID != test.expected[j] {
+				t.Errorf("%d: expected order %v; got %+v", i, test.expected, ordered)
+				break
+			}
+		}
+	}
+}
@@ -29,16 +29,13 @@ import (
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
-const (
-	defaultHeartbeatInterval = 5 * time.Second
-)
-
 // This list filters the KV API into those operations which can be part of
 // transaction.
 var transactionalActions = map[string]struct{}{
 	storage.AccumulateTS:   struct{}{},
 	storage.ConditionalPut: struct{}{},
 	storage.Contains:       struct{}{},
+	storage.Count:          struct{}{},
 	storage.Delete:         struct{}{},
 	storage.DeleteRange:    struct{}{},
 	storage.EnqueueMessage: struct{}{},
@@ -119,7 +116,7 @@ func newCoordinator(db *DB, clock *hlc.Clock) *coordinator {
 	tc := &coordinator{
 		db:                db,
 		clock:             clock,
-		heartbeatInterval: defaultHeartbeatInterval,
+		heartbeatInterval: storage.DefaultHeartbeatInterval,
 		clientTimeout:     defaultClientTimeout,
 		txns:              map[string]*txnMetadata{},
 	}
@@ -254,6 +251,10 @@ func (tc *coordinator) heartbeat(txn *proto.Transaction, closer chan struct{}) {
 			}
 			request.Header().Timestamp = tc.clock.Now()
 			reply := <-tc.db.InternalHeartbeatTxn(request)
+			if reply.Error != nil {
+				log.Warningf("failed to heartbeat transaction %q: %v", txn.ID, reply.GoError())
+				continue
+			}
 			// If the transaction is not in pending state, then we can stop
 			// the heartbeat. It's either aborted or commited, and we resolve
 			// write intents accordingly.
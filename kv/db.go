@@ -135,6 +135,14 @@ func (db *DB) Scan(args *proto.ScanRequest) <-chan *proto.ScanResponse {
 	return replyChan
 }
 
+// Count counts the keys with values which fall between
+// args.Header.Key and args.Header.EndKey, without fetching the values.
+func (db *DB) Count(args *proto.CountRequest) <-chan *proto.CountResponse {
+	replyChan := make(chan *proto.CountResponse, 1)
+	go db.executeCmd(storage.Count, args, replyChan)
+	return replyChan
+}
+
 // BeginTransaction starts a transaction by initializing a new
 // Transaction proto using the contents of the request. Note that this
 // method does not call through to the key value interface but instead
@@ -169,10 +177,8 @@ func (db *DB) EndTransaction(args *proto.EndTransactionRequest) <-chan *proto.En
 			switch reply.Txn.Status {
 			case proto.COMMITTED:
 				db.coordinator.EndTxn(reply.Txn, true)
-				return
 			case proto.ABORTED:
 				db.coordinator.EndTxn(reply.Txn, false)
-				return
 			}
 		}
 		// Go ahead and return the result to the client.
@@ -241,3 +247,10 @@ func (db *DB) InternalSnapshotCopy(args *proto.InternalSnapshotCopyRequest) <-ch
 	go db.executeCmd(storage.InternalSnapshotCopy, args, replyChan)
 	return replyChan
 }
+
+// AdminSplit splits the range containing args.Key at args.SplitKey.
+func (db *DB) AdminSplit(args *proto.AdminSplitRequest) <-chan *proto.AdminSplitResponse {
+	replyChan := make(chan *proto.AdminSplitResponse, 1)
+	go db.executeCmd(storage.AdminSplit, args, replyChan)
+	return replyChan
+}
@@ -22,14 +22,17 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"sync"
 	"time"
 
+	gogoproto "code.google.com/p/gogoprotobuf/proto"
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
@@ -37,6 +40,7 @@ import (
 const (
 	defaultSendNextTimeout = 1 * time.Second
 	defaultRPCTimeout      = 15 * time.Second
+	maxRPCTimeout          = 10 * time.Minute
 	defaultClientTimeout   = 10 * time.Second
 	retryBackoff           = 1 * time.Second
 	maxRetryBackoff        = 30 * time.Second
@@ -44,6 +48,10 @@ const (
 	// Maximum number of ranges to return from an internal range lookup.
 	// TODO(mrtracy): This value should be configurable.
 	rangeLookupMaxRanges = 8
+
+	// Maximum number of ranges to which the RPCs of a multi-range
+	// command are sent in parallel.
+	defaultMultiRangeConcurrency = 8
 )
 
 // A firstRangeMissingError indicates that the first range has not yet
@@ -83,26 +91,206 @@ type DistKV struct {
 	gossip *gossip.Gossip
 	// rangeCache caches replica metadata for key ranges.
 	rangeCache *RangeMetadataCache
+	// txnDB sends commands for transactions begun via
+	// BeginTransaction. Its coordinator heartbeats those transactions
+	// and resolves their write intents.
+	txnDB *DB
+	// traceSink, if not nil, receives the trace of each command.
+	traceSink TraceSink
+	// latencies tracks replica response latency, used to adapt the
+	// timeout after which RPCs are sent to additional replicas.
+	latencies *latencyTracker
+	// breakers short-circuits RPCs to replicas which are failing
+	// persistently.
+	breakers *breakerSet
+	// selector orders the replicas of a range to which RPCs are sent.
+	selector ReplicaSelector
+	// localAttrs are the attributes of the local node, if any.
+	localAttrs proto.Attributes
+	// clock measures the staleness of data read.
+	clock *hlc.Clock
+	// closed tracks the closed timestamps reported by replicas, used
+	// to route historical reads.
+	closed *closedTracker
+	// concurrency bounds the number of ranges to which the RPCs of a
+	// multi-range command are sent in parallel.
+	concurrency int
+	// maxRequestSize, if positive, is the maximum encoded size in
+	// bytes of a request.
+	maxRequestSize int
+	// prober, if not nil, periodically probes the health of the
+	// replicas to which RPCs have been sent.
+	prober *replicaProber
 }
 
 // NewDistKV returns a key-value datastore client which connects to the
-// Cockroach cluster via the supplied gossip instance.
-func NewDistKV(gossip *gossip.Gossip) *DistKV {
+// Cockroach cluster via the supplied gossip instance. RPCs are sent to
+// the replicas of a range in the order determined by selector; if nil,
+// the replica last known to be the leader is preferred, followed by
+// the others in order of locality.
+func NewDistKV(gossip *gossip.Gossip, clock *hlc.Clock, selector ReplicaSelector) *DistKV {
+	if selector == nil {
+		selector = NewLeaderSelector(LocalitySelector{})
+	}
 	kv := &DistKV{
-		gossip: gossip,
+		gossip:      gossip,
+		latencies:   newLatencyTracker(),
+		breakers:    newBreakerSet(defaultBreakerThreshold, defaultBreakerCoolDown),
+		selector:    selector,
+		clock:       clock,
+		closed:      newClosedTracker(),
+		concurrency: defaultMultiRangeConcurrency,
 	}
 	kv.rangeCache = NewRangeMetadataCache(kv)
+	kv.txnDB = NewDB(kv, clock)
 	return kv
 }
 
-// verifyPermissions verifies that the requesting user (header.User)
+// BeginTransaction starts a new transaction using the parameters in
+// args and returns a handle through which to execute the
+// transaction's commands. The transaction record is heartbeat while
+// the transaction is in use. On Commit or Abort, the transaction's
+// write intents are resolved across all ranges they were written to.
+func (kv *DistKV) BeginTransaction(args *proto.BeginTransactionRequest) *Txn {
+	return newTxn(kv.txnDB, args)
+}
+
+// SetLocalAttributes sets the attributes of the local node, which are
+// passed to the replica selector. It must be called before any
+// commands are executed.
+func (kv *DistKV) SetLocalAttributes(attrs proto.Attributes) {
+	kv.localAttrs = attrs
+}
+
+// SetTraceSink sets a sink to receive the trace of each command
+// executed via ExecuteCmd. It must be called before any commands are
+// executed.
+func (kv *DistKV) SetTraceSink(sink TraceSink) {
+	kv.traceSink = sink
+}
+
+// SetCircuitBreaker configures the per-replica circuit breakers: a
+// replica's breaker opens after threshold consecutive RPC failures,
+// after which RPCs to it fail fast except for a single probe every
+// coolDown. A threshold of zero disables the breakers. It must be
+// called before any commands are executed.
+func (kv *DistKV) SetCircuitBreaker(threshold int, coolDown time.Duration) {
+	kv.breakers = newBreakerSet(threshold, coolDown)
+}
+
+// SetMultiRangeConcurrency sets the maximum number of ranges to which
+// the RPCs of a command spanning multiple ranges are sent in parallel.
+// A limit of one sends them to each range in turn. It must be called
+// before any commands are executed.
+func (kv *DistKV) SetMultiRangeConcurrency(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	kv.concurrency = limit
+}
+
+// SetMaxRequestSize sets the maximum encoded size in bytes of the
+// requests executed via ExecuteCmd; larger requests fail with an
+// error before any RPC is sent. A size of zero, the default, sets no
+// limit. It must be called before any commands are executed.
+func (kv *DistKV) SetMaxRequestSize(size int) {
+	kv.maxRequestSize = size
+}
+
+// StartHealthProbes starts probing the health of each replica to
+// which RPCs are sent by pinging it every interval. A failed probe
+// counts towards opening the replica's circuit breaker and a
+// successful one closes it, so that requests are routed around
+// replicas which are down before a request to them fails. It must be
+// called at most once, before any commands are executed.
+func (kv *DistKV) StartHealthProbes(interval time.Duration) {
+	tlsConfig := kv.gossip.TLSConfig()
+	kv.prober = newReplicaProber(interval, func(addr net.Addr) error {
+		return pingReplica(addr, tlsConfig, defaultHealthProbeTimeout)
+	}, func(addr net.Addr, _ time.Duration, err error) {
+		if err != nil {
+			kv.breakers.recordFailure(addr)
+		} else {
+			kv.breakers.recordSuccess(addr)
+		}
+	})
+	go kv.prober.start()
+}
+
+// Stats returns the health of each replica probed since
+// StartHealthProbes was called.
+func (kv *DistKV) Stats() Stats {
+	stats := Stats{Replicas: map[string]ReplicaHealth{}}
+	if kv.prober != nil {
+		stats.Replicas = kv.prober.replicaHealth()
+	}
+	return stats
+}
+
+// SetRangeCacheEvictionHook sets a hook to be invoked with each range
+// descriptor evicted from the range metadata cache. It must be called
+// before any commands are executed.
+func (kv *DistKV) SetRangeCacheEvictionHook(hook RangeCacheEvictionHook) {
+	kv.rangeCache.SetEvictionHook(hook)
+}
+
+// DumpRangeCache returns the range descriptors currently held in the
+// range metadata cache, ordered by key. It is intended for debugging
+// misrouted requests.
+func (kv *DistKV) DumpRangeCache() []proto.RangeDescriptor {
+	return kv.rangeCache.Dump()
+}
+
+// RangeCacheEvictions returns the number of evictions from the range
+// metadata cache of each cause and the most recent evictions. Many
+// stale evictions indicate that ranges are moving or splitting; many
+// transient ones, that replicas are unavailable.
+func (kv *DistKV) RangeCacheEvictions() RangeCacheEvictionStats {
+	return kv.rangeCache.Evictions()
+}
+
+// InvalidateRangeCache clears the range metadata cache, so that the
+// range of each key is looked up afresh. This is cheaper than
+// relearning the ranges one misrouted request at a time when much of
+// the cache is stale, e.g. after ranges have been widely rebalanced.
+func (kv *DistKV) InvalidateRangeCache() {
+	kv.rangeCache.Clear()
+}
+
+// LocateKey looks up the range containing key and returns its
+// descriptor along with the gossiped addresses of its replicas.
+// Replicas whose addresses have not been gossiped are omitted; an
+// error is returned if none of the replicas can be reached.
+func (kv *DistKV) LocateKey(key engine.Key) (proto.RangeDescriptor, []net.Addr, error) {
+	desc, err := kv.rangeCache.LookupRangeMetadata(key, nil)
+	if err != nil {
+		return proto.RangeDescriptor{}, nil, err
+	}
+	var addrs []net.Addr
+	for _, replica := range desc.Replicas {
+		addr, err := kv.nodeIDToAddr(replica.NodeID)
+		if err != nil {
+			log.V(1).Infof("node %d address is not gossipped", replica.NodeID)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return *desc, nil, noNodeAddrsAvailError{}
+	}
+	return *desc, addrs, nil
+}
+
+// VerifyPermissions verifies that the requesting user (header.User)
 // has permission to read/write (capabilities depend on method
 // name). In the event that multiple permission configs apply to the
 // key range implicated by the command, the lowest common denominator
 // for permission. For example, if a scan crosses two permission
 // configs, both configs must allow read permissions or the entire
-// scan will fail.
-func (kv *DistKV) verifyPermissions(method string, header *proto.RequestHeader) error {
+// scan will fail. A single-key command is checked against the config
+// covering its key. If no config covers the key range, permission is
+// denied.
+func (kv *DistKV) VerifyPermissions(method string, header *proto.RequestHeader) error {
 	// Get permissions map from gossip.
 	permMap, err := kv.gossip.GetInfo(gossip.KeyConfigPermission)
 	if err != nil {
@@ -115,21 +303,28 @@ func (kv *DistKV) verifyPermissions(method string, header *proto.RequestHeader)
 	//   - For each, verify each PermConfig allows reads or writes as method requires.
 	end := header.EndKey
 	if end == nil {
-		end = header.Key
+		end = engine.NextKey(header.Key)
 	}
-	return permMap.(storage.PrefixConfigMap).VisitPrefixes(
+	visited := false
+	err = permMap.(storage.PrefixConfigMap).VisitPrefixes(
 		header.Key, end, func(start, end engine.Key, config interface{}) error {
+			visited = true
 			perm := config.(*proto.PermConfig)
 			if storage.NeedReadPerm(method) && !perm.CanRead(header.User) {
 				return util.Errorf("user %q cannot read range %q-%q; permissions: %+v",
 					header.User, string(start), string(end), perm)
 			}
 			if storage.NeedWritePerm(method) && !perm.CanWrite(header.User) {
-				return util.Errorf("user %q cannot read range %q-%q; permissions: %+v",
+				return util.Errorf("user %q cannot write range %q-%q; permissions: %+v",
 					header.User, string(start), string(end), perm)
 			}
 			return nil
 		})
+	if err == nil && !visited {
+		err = util.Errorf("no permission config covers range %q-%q; cannot execute %s",
+			string(header.Key), string(end), method)
+	}
+	return err
 }
 
 // nodeIDToAddr uses the gossip network to translate from node ID
@@ -144,18 +339,24 @@ func (kv *DistKV) nodeIDToAddr(nodeID int32) (net.Addr, error) {
 }
 
 // internalRangeLookup dispatches an InternalRangeLookup request for the given
-// metadata key to the replicas of the given range.
-func (kv *DistKV) internalRangeLookup(key engine.Key,
-	info *proto.RangeDescriptor) ([]proto.RangeDescriptor, error) {
+// metadata key to the replicas of the given range. The lookup is
+// recorded in trace, which may be nil.
+func (kv *DistKV) internalRangeLookup(key engine.Key, reverse bool,
+	info *proto.RangeDescriptor, trace *Trace) ([]proto.RangeDescriptor, error) {
 	args := &proto.InternalRangeLookupRequest{
 		RequestHeader: proto.RequestHeader{
 			Key:  key,
 			User: storage.UserRoot,
 		},
 		MaxRanges: rangeLookupMaxRanges,
+		Reverse:   reverse,
+	}
+	if trace != nil {
+		args.TraceID = trace.ID
 	}
+	defer trace.Epoch(fmt.Sprintf("range lookup %q", key))()
 	replyChan := make(chan *proto.InternalRangeLookupResponse, len(info.Replicas))
-	if err := kv.sendRPC(info.Replicas, "Node.InternalRangeLookup", args, replyChan); err != nil {
+	if err := kv.sendRPC(info, "Node.InternalRangeLookup", args, replyChan); err != nil {
 		return nil, err
 	}
 	reply := <-replyChan
@@ -182,8 +383,10 @@ func (kv *DistKV) getFirstRangeDescriptor() (*proto.RangeDescriptor, error) {
 // set of consecutive ranges, the first which must contain the requested key.
 // The additional RangeDescriptors are returned with the intent of pre-caching
 // subsequent ranges which are likely to be requested soon by the current
-// workload.
-func (kv *DistKV) getRangeMetadata(key engine.Key) ([]proto.RangeDescriptor, error) {
+// workload. If reverse is true, the first instead contains the keys just
+// before the requested key. Lookups are recorded in trace, which may be
+// nil.
+func (kv *DistKV) getRangeMetadata(key engine.Key, reverse bool, trace *Trace) ([]proto.RangeDescriptor, error) {
 	var (
 		// metadataKey is sent to InternalRangeLookup to find the
 		// RangeDescriptor which contains key.
@@ -211,63 +414,614 @@ func (kv *DistKV) getRangeMetadata(key engine.Key) ([]proto.RangeDescriptor, err
 	} else {
 		// Look up metadataRange from the cache, which will recursively call
 		// into kv.getRangeMetadata if it is not cached.
-		metadataRange, err = kv.rangeCache.LookupRangeMetadata(metadataKey)
+		// The metadata key of KeyMax, under which the last range's
+		// metadata is stored, is only found by a reverse lookup.
+		if reverse && bytes.Equal(key, engine.KeyMax) {
+			metadataRange, err = kv.rangeCache.LookupRangeMetadataBefore(metadataKey, trace)
+		} else {
+			metadataRange, err = kv.rangeCache.LookupRangeMetadata(metadataKey, trace)
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return kv.internalRangeLookup(metadataKey, metadataRange)
+	return kv.internalRangeLookup(metadataKey, reverse, metadataRange, trace)
 }
 
-// sendRPC sends one or more RPCs to replicas from the supplied
-// proto.Replica slice. First, replicas which have gossipped
-// addresses are corraled and then sent via rpc.Send, with requirement
-// that one RPC to a server must succeed.
-func (kv *DistKV) sendRPC(replicas []proto.Replica, method string, args proto.Request, replyChan interface{}) error {
+// sendRPC sends one or more RPCs to the replicas of the range
+// described by desc. First, replicas which have gossipped addresses
+// are corraled and then sent via rpc.Send, with requirement that one
+// RPC to a server must succeed. Replicas whose circuit breakers are
+// open are skipped; if no replica remains as a result, a
+// non-retryable error is returned. Errors sending to the replicas are
+// returned as a *proto.RangeError identifying the range and the
+// replica addresses tried, which is retryable if the cause is.
+func (kv *DistKV) sendRPC(desc *proto.RangeDescriptor, method string, args proto.Request, replyChan interface{}) error {
+	replicas := desc.Replicas
 	if len(replicas) == 0 {
 		return util.Errorf("%s: replicas set is empty", method)
 	}
 	// Build a map from replica address (if gossipped) to args struct
-	// with replica set in header.
+	// with replica set in header, noting the order in which the replica
+	// selector prefers the replicas.
 	argsMap := map[net.Addr]interface{}{}
-	for _, replica := range replicas {
+	addrs := make([]net.Addr, 0, len(replicas))
+	addrReplicas := map[string]proto.Replica{}
+	breakersOpen := false
+	ordered := kv.selector.Order(replicas, kv.localAttrs)
+	if header := args.Header(); header.Historical {
+		// Prefer replicas known to be caught up to the read timestamp;
+		// the others, the leader first, serve as fallbacks.
+		ordered = kv.closed.order(ordered, header.Timestamp)
+	}
+	for _, replica := range ordered {
 		addr, err := kv.nodeIDToAddr(replica.NodeID)
 		if err != nil {
 			log.V(1).Infof("node %d address is not gossipped", replica.NodeID)
 			continue
 		}
+		if kv.prober != nil {
+			kv.prober.add(addr)
+		}
+		if !kv.breakers.allow(addr) {
+			log.V(1).Infof("circuit breaker for node %d at %s is open", replica.NodeID, addr)
+			breakersOpen = true
+			continue
+		}
 		// Copy the args value and set the replica in the header.
 		argsVal := reflect.New(reflect.TypeOf(args).Elem())
 		reflect.Indirect(argsVal).Set(reflect.Indirect(reflect.ValueOf(args)))
 		reflect.Indirect(argsVal).FieldByName("Replica").Set(reflect.ValueOf(replica))
 		argsMap[addr] = argsVal.Interface()
+		addrs = append(addrs, addr)
+		addrReplicas[addr.String()] = replica
 	}
 	if len(argsMap) == 0 {
-		return noNodeAddrsAvailError{}
+		if breakersOpen {
+			return proto.NewRangeError(breakerOpenError{}, desc, nil)
+		}
+		return proto.NewRangeError(noNodeAddrsAvailError{}, desc, nil)
 	}
 	rpcOpts := rpc.Options{
 		N:               1,
-		SendNextTimeout: defaultSendNextTimeout,
-		Timeout:         defaultRPCTimeout,
+		SendNextTimeout: kv.latencies.sendNextTimeout(addrs, defaultSendNextTimeout),
+		Timeout:         rpcTimeout(args.Header()),
+		RecordLatency: func(addr net.Addr, latency time.Duration) {
+			kv.latencies.record(addr, latency)
+			kv.breakers.recordSuccess(addr)
+		},
+		RecordError: func(addr net.Addr, err error) {
+			kv.breakers.recordFailure(addr)
+		},
+		RecordReply: func(addr net.Addr, reply interface{}) {
+			kv.recordLeader(addrReplicas[addr.String()], reply)
+			kv.closed.record(addrReplicas[addr.String()], reply)
+		},
+		Order: addrs,
+	}
+	if err := rpc.Send(argsMap, method, replyChan, rpcOpts, kv.gossip.TLSConfig()); err != nil {
+		addrStrs := make([]string, len(addrs))
+		for i, addr := range addrs {
+			addrStrs[i] = addr.String()
+		}
+		return proto.NewRangeError(err, desc, addrStrs)
+	}
+	return nil
+}
+
+// rpcTimeout returns the timeout of RPCs sent to serve the request
+// with the supplied header: its RPCTimeoutNanos if set, and
+// defaultRPCTimeout otherwise.
+func rpcTimeout(header *proto.RequestHeader) time.Duration {
+	if header.RPCTimeoutNanos != 0 {
+		return time.Duration(header.RPCTimeoutNanos)
+	}
+	return defaultRPCTimeout
+}
+
+// recordLeader informs the replica selector, if it tracks range
+// leaders, of the leader implied by a reply from replica: a replica
+// which serves a command is the leader of its range, whereas one
+// which isn't may know the leader and report it.
+func (kv *DistKV) recordLeader(replica proto.Replica, reply interface{}) {
+	recorder, ok := kv.selector.(leaderRecorder)
+	if !ok {
+		return
+	}
+	resp, ok := reply.(proto.Response)
+	if !ok {
+		return
+	}
+	switch err := resp.Header().GoError().(type) {
+	case nil:
+		recorder.RecordLeader(replica)
+	case *proto.NotLeaderError:
+		if err.Leader.NodeID != 0 {
+			recorder.RecordLeader(err.Leader)
+		}
+	}
+}
+
+// Staleness returns how old the data returned in reply to a read may
+// be: the time elapsed, according to the local clock, since the
+// closed timestamp of the replica which served the read. The data is
+// complete as of the reply's ClosedTimestamp. Clients with a bound on
+// the staleness they tolerate may retry reads exceeding it against
+// the leader.
+func (kv *DistKV) Staleness(reply proto.Response) time.Duration {
+	closed := reply.Header().ClosedTimestamp
+	staleness := time.Duration(kv.clock.Now().WallTime - closed.WallTime)
+	if staleness < 0 {
+		return 0
+	}
+	return staleness
+}
+
+// mergeClosedTimestamp sets the closed timestamp of a reply merged
+// from the replies of several ranges to the earliest of them, as the
+// data read is only as fresh as that of its stalest range.
+func mergeClosedTimestamp(reply, rangeReply *proto.ResponseHeader, first bool) {
+	if first || rangeReply.ClosedTimestamp.Less(reply.ClosedTimestamp) {
+		reply.ClosedTimestamp = rangeReply.ClosedTimestamp
 	}
-	return rpc.Send(argsMap, method, replyChan, rpcOpts, kv.gossip.TLSConfig())
 }
 
 // ExecuteCmd verifies permissions and looks up the appropriate range
 // based on the supplied key and sends the RPC according to the
 // specified options. executeRPC sends asynchronously and returns a
 // response value on the replyChan channel when the call is complete.
+//
+// Range lookups and RPC attempts made on behalf of the command are
+// recorded in a trace, whose ID is set in the request header if not
+// already specified. The trace is logged at verbosity level 2 and
+// passed to the trace sink, if any, once the command completes.
+//
+// Historical reads, at the explicit timestamp in their header, are
+// sent first to the replicas known from previous replies to have
+// closed that timestamp, falling back to the leader.
+//
+// Each RPC sent to a replica times out after the RPCTimeoutNanos of
+// the request header, if set, and defaultRPCTimeout otherwise.
 func (kv *DistKV) ExecuteCmd(method string, args proto.Request, replyChan interface{}) {
+	// Verify permissions.
+	if err := kv.VerifyPermissions(method, args.Header()); err != nil {
+		sendErrorReply(err, replyChan)
+		return
+	}
+
+	if args.Header().Historical {
+		if err := verifyHistorical(method, args.Header()); err != nil {
+			sendErrorReply(err, replyChan)
+			return
+		}
+	}
+	if err := verifyRPCTimeout(method, args.Header()); err != nil {
+		sendErrorReply(err, replyChan)
+		return
+	}
+	if err := verifyRequestSize(method, args, kv.maxRequestSize); err != nil {
+		sendErrorReply(err, replyChan)
+		return
+	}
+
 	// Augment method with "Node." prefix.
 	method = "Node." + method
 
-	// Verify permissions.
-	if err := kv.verifyPermissions(method, args.Header()); err != nil {
+	trace := newTrace(args.Header().TraceID)
+	args.Header().TraceID = trace.ID
+	defer kv.finishTrace(method, trace)
+
+	// Intent resolution over a key range may span multiple ranges.
+	if riArgs, ok := args.(*proto.InternalResolveIntentRequest); ok && len(riArgs.EndKey) > 0 {
+		kv.resolveIntentRange(method, riArgs, replyChan, trace)
+		return
+	}
+
+	// Scans may likewise span multiple ranges.
+	if scanArgs, ok := args.(*proto.ScanRequest); ok && len(scanArgs.EndKey) > 0 {
+		if scanArgs.Reverse {
+			kv.reverseScanRange(method, scanArgs, replyChan, trace)
+		} else {
+			kv.scanRange(method, scanArgs, replyChan, trace)
+		}
+		return
+	}
+
+	// Counts may likewise span multiple ranges; the count of each is summed.
+	if countArgs, ok := args.(*proto.CountRequest); ok && len(countArgs.EndKey) > 0 {
+		kv.countRange(method, countArgs, replyChan, trace)
+		return
+	}
+
+	if err := kv.routeRPC(method, args, replyChan, trace); err != nil {
 		sendErrorReply(err, replyChan)
+	}
+}
+
+// verifyHistorical checks that a request marked as a historical read
+// is a non-transactional read at an explicit timestamp.
+func verifyHistorical(method string, header *proto.RequestHeader) error {
+	if !storage.IsReadOnly(method) {
+		return util.Errorf("%s: only reads may be historical", method)
+	}
+	if header.Txn != nil {
+		return util.Errorf("%s: historical reads may not be transactional", method)
+	}
+	if header.Timestamp.Equal(proto.MinTimestamp) {
+		return util.Errorf("%s: historical reads require a timestamp", method)
+	}
+	return nil
+}
+
+// verifyRPCTimeout checks that the RPC timeout of a request is
+// neither negative nor longer than maxRPCTimeout. A zero timeout
+// selects the default.
+func verifyRPCTimeout(method string, header *proto.RequestHeader) error {
+	if timeout := time.Duration(header.RPCTimeoutNanos); timeout < 0 || timeout > maxRPCTimeout {
+		return util.Errorf("%s: RPC timeout %s may not be negative or exceed %s", method, timeout, maxRPCTimeout)
+	}
+	return nil
+}
+
+// verifyRequestSize checks that the encoded size of a request doesn't
+// exceed max, if positive. Requests are not split, so an oversized
+// request can only fail; it is rejected here with a clear error
+// rather than by the RPC layer.
+func verifyRequestSize(method string, args proto.Request, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	msg, ok := args.(gogoproto.Message)
+	if !ok {
+		return nil
+	}
+	data, err := gogoproto.Marshal(msg)
+	if err != nil {
+		return util.Errorf("%s: could not encode request: %s", method, err)
+	}
+	if len(data) > max {
+		return util.Errorf("%s: request of %d bytes exceeds the maximum request size of %d bytes",
+			method, len(data), max)
+	}
+	return nil
+}
+
+// scanRange splits a Scan request over the ranges which overlap its
+// key range, sending requests with keys bounded to each range until
+// MaxResults rows or MaxBytes bytes have been read. Requests are sent
+// to batches of up to kv.concurrency ranges in parallel and their
+// rows concatenated in key order. Scans with MaxResults, MaxBytes or
+// StopAtIntent set depend on the reply from each range to decide
+// whether to continue, so are sent to each range in turn, bounded by
+// the remaining limits; ranges are never asked for rows which would
+// be discarded, and so never record reads of them in their timestamp
+// caches. If a range ends its scan early because MaxBytes
+// was exceeded or, with StopAtIntent, at a write intent, its resume
+// key (and intent transaction) is returned in the reply. By default,
+// the first error encountered, in key order, is returned on
+// replyChan. If PartialResults is set, the scan instead continues
+// past ranges which fail, adding each failed key span and its error
+// to the reply's FailedSpans. Note that retryable errors are retried
+// by routeRPC and never result in a failed span.
+func (kv *DistKV) scanRange(method string, args *proto.ScanRequest, replyChan interface{}, trace *Trace) {
+	batchSize := kv.concurrency
+	if args.MaxResults > 0 || args.MaxBytes > 0 || args.StopAtIntent {
+		batchSize = 1
+	}
+	reply := &proto.ScanResponse{}
+	var size int64
+	first := true
+	for start := args.Key; bytes.Compare(start, args.EndKey) < 0; {
+		if args.MaxResults > 0 && int64(len(reply.Rows)) >= args.MaxResults {
+			break
+		}
+		if args.MaxBytes > 0 && size >= args.MaxBytes {
+			// The budget was used up by the rows of the previous range;
+			// sending the remainder as zero would leave it unbounded.
+			reply.ResumeKey = start
+			break
+		}
+		ranges, err := kv.lookupRanges(start, args.EndKey, batchSize, trace)
+		if err != nil {
+			if !args.PartialResults {
+				sendErrorReply(err, replyChan)
+				return
+			}
+			// Without range metadata, the remainder of the scan fails.
+			span := proto.FailedSpan{StartKey: start, EndKey: args.EndKey}
+			span.SetGoError(err)
+			reply.FailedSpans = append(reply.FailedSpans, span)
+			break
+		}
+		rangeArgs := make([]*proto.ScanRequest, len(ranges))
+		for i := range ranges {
+			rangeArgs[i] = gogoproto.Clone(args).(*proto.ScanRequest)
+			rangeArgs[i].Key, rangeArgs[i].EndKey = rangeBounds(start, args.EndKey, ranges, i)
+			if args.MaxResults > 0 {
+				rangeArgs[i].MaxResults = args.MaxResults - int64(len(reply.Rows))
+			}
+			if args.MaxBytes > 0 {
+				rangeArgs[i].MaxBytes = args.MaxBytes - size
+			}
+		}
+		rangeReplies := make([]*proto.ScanResponse, len(ranges))
+		errs := make([]error, len(ranges))
+		kv.parallelize(len(ranges), func(i int) {
+			rangeReplyChan := make(chan *proto.ScanResponse, 1)
+			if errs[i] = kv.routeRPC(method, rangeArgs[i], rangeReplyChan, trace); errs[i] == nil {
+				rangeReplies[i] = <-rangeReplyChan
+				errs[i] = rangeReplies[i].GoError()
+			}
+		})
+		for i, rangeReply := range rangeReplies {
+			if err := errs[i]; err != nil {
+				if !args.PartialResults {
+					sendErrorReply(err, replyChan)
+					return
+				}
+				span := proto.FailedSpan{StartKey: rangeArgs[i].Key, EndKey: rangeArgs[i].EndKey}
+				span.SetGoError(err)
+				reply.FailedSpans = append(reply.FailedSpans, span)
+				continue
+			}
+			reply.Rows = append(reply.Rows, rangeReply.Rows...)
+			for _, row := range rangeReply.Rows {
+				size += int64(len(row.Key) + len(row.Value.Bytes))
+			}
+			if reply.Timestamp.Less(rangeReply.Timestamp) {
+				reply.Timestamp = rangeReply.Timestamp
+			}
+			mergeClosedTimestamp(&reply.ResponseHeader, &rangeReply.ResponseHeader, first)
+			first = false
+			if rangeReply.ResumeKey != nil {
+				// Only possible with a batch of a single range.
+				reply.ResumeKey = rangeReply.ResumeKey
+				reply.IntentTxn = rangeReply.IntentTxn
+				reflect.ValueOf(replyChan).Send(reflect.ValueOf(reply))
+				return
+			}
+		}
+		start = ranges[len(ranges)-1].EndKey
+	}
+	reflect.ValueOf(replyChan).Send(reflect.ValueOf(reply))
+}
+
+// reverseScanRange splits a reverse Scan request over the ranges which
+// overlap its key range, visiting them in descending order from the
+// range containing the keys just below the end key back to the range
+// containing the start key, until MaxResults rows have been read. Each
+// range is looked up as the one containing the keys just before the
+// start key of the range visited last. The rows of each range are in
+// descending order, so the concatenated rows are too. A range which
+// has split since its metadata was looked up replies with a
+// RangeKeyMismatchError; its metadata is evicted from the cache and
+// looked up again. With StopAtIntent, a range which stops at a write
+// intent ends the scan, and the end key at which to resume and the
+// intent's transaction are returned in the reply. Otherwise, the first
+// error encountered is returned on replyChan.
+func (kv *DistKV) reverseScanRange(method string, args *proto.ScanRequest, replyChan interface{}, trace *Trace) {
+	if args.PartialResults || args.MaxBytes > 0 {
+		sendErrorReply(util.Errorf("reverse scans support neither PartialResults nor MaxBytes"), replyChan)
 		return
 	}
+	reply := &proto.ScanResponse{}
+	first := true
+	retryOpts := util.RetryOptions{
+		Tag:         fmt.Sprintf("routing %s rpc", method),
+		Backoff:     retryBackoff,
+		MaxBackoff:  maxRetryBackoff,
+		Constant:    2,
+		MaxAttempts: 0, // retry indefinitely
+	}
+	for end := args.EndKey; bytes.Compare(args.Key, end) < 0; {
+		if args.MaxResults > 0 && int64(len(reply.Rows)) >= args.MaxResults {
+			break
+		}
+		rangeArgs := gogoproto.Clone(args).(*proto.ScanRequest)
+		rangeArgs.EndKey = end
+		if args.MaxResults > 0 {
+			rangeArgs.MaxResults = args.MaxResults - int64(len(reply.Rows))
+		}
+		var rangeReply *proto.ScanResponse
+		attempt := 0
+		err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
+			attempt++
+			rangeMeta, err := kv.rangeCache.LookupRangeMetadataBefore(end, trace)
+			if err == nil {
+				rangeArgs.Key = args.Key
+				if bytes.Compare(rangeArgs.Key, rangeMeta.StartKey) < 0 {
+					rangeArgs.Key = rangeMeta.StartKey
+				}
+				rangeReplyChan := make(chan *proto.ScanResponse, 1)
+				endRPC := trace.Epoch(fmt.Sprintf("%s attempt %d", method, attempt))
+				err = kv.sendRPC(rangeMeta, method, rangeArgs, rangeReplyChan)
+				endRPC()
+				if err == nil {
+					rangeReply = <-rangeReplyChan
+					if _, ok := rangeReply.GoError().(*proto.RangeKeyMismatchError); !ok {
+						return true, nil
+					}
+					err = rangeReply.GoError()
+				}
+			}
+			// Range metadata might be out of date - evict it and look
+			// it up again. The range is the one which the lookup
+			// located, just before end; rangeArgs.Key may still be
+			// that of the range scanned last.
+			kv.rangeCache.EvictCachedRangeMetadataBefore(end, EvictionCause(err), err.Error())
+			if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
+				log.Warningf("failed to invoke %s: %v", method, err)
+				return false, nil
+			}
+			return true, err
+		})
+		if err == nil {
+			err = rangeReply.GoError()
+		}
+		if err != nil {
+			sendErrorReply(err, replyChan)
+			return
+		}
+		reply.Rows = append(reply.Rows, rangeReply.Rows...)
+		if reply.Timestamp.Less(rangeReply.Timestamp) {
+			reply.Timestamp = rangeReply.Timestamp
+		}
+		mergeClosedTimestamp(&reply.ResponseHeader, &rangeReply.ResponseHeader, first)
+		first = false
+		if rangeReply.IntentTxn != nil {
+			reply.ResumeKey = rangeReply.ResumeKey
+			reply.IntentTxn = rangeReply.IntentTxn
+			break
+		}
+		end = rangeArgs.Key
+	}
+	reflect.ValueOf(replyChan).Send(reflect.ValueOf(reply))
+}
 
+// lookupRanges returns the metadata of the ranges overlapping the key
+// range from key to endKey, in ascending order. If max is positive, at
+// most the first max ranges are returned. Ranges are looked up by the
+// keys they contain, and there is no key immediately preceding endKey
+// by which to look up the last of them directly, so they are walked
+// forwards from key; their metadata is usually cached or prefetched.
+func (kv *DistKV) lookupRanges(key, endKey engine.Key, max int, trace *Trace) ([]*proto.RangeDescriptor, error) {
+	var ranges []*proto.RangeDescriptor
+	for bytes.Compare(key, endKey) < 0 && (max <= 0 || len(ranges) < max) {
+		rangeMeta, err := kv.rangeCache.LookupRangeMetadata(key, trace)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, rangeMeta)
+		key = rangeMeta.EndKey
+	}
+	return ranges, nil
+}
+
+// rangeBounds returns the portion of the key range from key to endKey
+// which lies within the i-th of ranges, as returned by
+// lookupRanges(key, endKey, ...).
+func rangeBounds(key, endKey engine.Key, ranges []*proto.RangeDescriptor, i int) (engine.Key, engine.Key) {
+	if i > 0 {
+		key = ranges[i-1].EndKey
+	}
+	if bytes.Compare(ranges[i].EndKey, endKey) < 0 {
+		endKey = ranges[i].EndKey
+	}
+	return key, endKey
+}
+
+// parallelize invokes fn for each index from 0 to n-1, running up to
+// kv.concurrency invocations in parallel, and waits for all of them
+// to return. Invocations record their results by index, so that
+// callers can merge them in key order.
+func (kv *DistKV) parallelize(n int, fn func(i int)) {
+	sem := make(chan struct{}, kv.concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// countRange splits a Count request over the ranges which overlap its
+// key range, sending requests with keys bounded to each range, up to
+// kv.concurrency in parallel, and sums the counts. If the count is
+// limited by MaxResults, the ranges are instead counted one at a time
+// in key order, each limited to the keys still to be counted, until
+// the limit is reached. The first error encountered, in key order, is
+// returned on replyChan.
+func (kv *DistKV) countRange(method string, args *proto.CountRequest, replyChan interface{}, trace *Trace) {
+	ranges, err := kv.lookupRanges(args.Key, args.EndKey, 0, trace)
+	if err != nil {
+		sendErrorReply(err, replyChan)
+		return
+	}
+	rangeReplies := make([]*proto.CountResponse, len(ranges))
+	errs := make([]error, len(ranges))
+	countRange := func(i int, maxResults int64) {
+		rangeArgs := gogoproto.Clone(args).(*proto.CountRequest)
+		rangeArgs.Key, rangeArgs.EndKey = rangeBounds(args.Key, args.EndKey, ranges, i)
+		rangeArgs.MaxResults = maxResults
+		rangeReplyChan := make(chan *proto.CountResponse, 1)
+		if errs[i] = kv.routeRPC(method, rangeArgs, rangeReplyChan, trace); errs[i] == nil {
+			rangeReplies[i] = <-rangeReplyChan
+			errs[i] = rangeReplies[i].GoError()
+		}
+	}
+	if args.MaxResults > 0 {
+		remaining := args.MaxResults
+		for i := 0; i < len(ranges) && remaining > 0; i++ {
+			if countRange(i, remaining); errs[i] != nil {
+				break
+			}
+			remaining -= rangeReplies[i].Count
+		}
+	} else {
+		kv.parallelize(len(ranges), func(i int) { countRange(i, 0) })
+	}
+	reply := &proto.CountResponse{}
+	for i, rangeReply := range rangeReplies {
+		if errs[i] != nil {
+			sendErrorReply(errs[i], replyChan)
+			return
+		}
+		if rangeReply == nil {
+			break // the limit was reached before this range
+		}
+		reply.Count += rangeReply.Count
+		if reply.Timestamp.Less(rangeReply.Timestamp) {
+			reply.Timestamp = rangeReply.Timestamp
+		}
+		mergeClosedTimestamp(&reply.ResponseHeader, &rangeReply.ResponseHeader, i == 0)
+	}
+	reflect.ValueOf(replyChan).Send(reflect.ValueOf(reply))
+}
+
+// resolveIntentRange splits an InternalResolveIntent request over the
+// ranges which overlap its key range, sending requests with keys
+// bounded to each range, up to kv.concurrency in parallel. Intents are
+// resolved on every range even if some fail; the first error
+// encountered, in key order, is returned on replyChan.
+func (kv *DistKV) resolveIntentRange(method string, args *proto.InternalResolveIntentRequest,
+	replyChan interface{}, trace *Trace) {
+	ranges, err := kv.lookupRanges(args.Key, args.EndKey, 0, trace)
+	if err != nil {
+		sendErrorReply(err, replyChan)
+		return
+	}
+	errs := make([]error, len(ranges))
+	kv.parallelize(len(ranges), func(i int) {
+		rangeArgs := gogoproto.Clone(args).(*proto.InternalResolveIntentRequest)
+		rangeArgs.Key, rangeArgs.EndKey = rangeBounds(args.Key, args.EndKey, ranges, i)
+		rangeReplyChan := make(chan *proto.InternalResolveIntentResponse, 1)
+		if errs[i] = kv.routeRPC(method, rangeArgs, rangeReplyChan, trace); errs[i] == nil {
+			errs[i] = (<-rangeReplyChan).GoError()
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			sendErrorReply(err, replyChan)
+			return
+		}
+	}
+	reflect.ValueOf(replyChan).Send(reflect.ValueOf(&proto.InternalResolveIntentResponse{}))
+}
+
+// routeRPC looks up the range containing the key in the request header
+// and sends the RPC to its replicas, retrying with backoff on
+// retryable errors. Range metadata is evicted from the cache on error,
+// and on a reply which shows it to be stale. Each range lookup and RPC
+// attempt is recorded in trace.
+func (kv *DistKV) routeRPC(method string, args proto.Request, replyChan interface{}, trace *Trace) error {
 	// Retry logic for lookup of range by key and RPCs to range replicas.
 	retryOpts := util.RetryOptions{
 		Tag:         fmt.Sprintf("routing %s rpc", method),
@@ -276,14 +1030,23 @@ func (kv *DistKV) ExecuteCmd(method string, args proto.Request, replyChan interf
 		Constant:    2,
 		MaxAttempts: 0, // retry indefinitely
 	}
-	err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
-		rangeMeta, err := kv.rangeCache.LookupRangeMetadata(args.Header().Key)
+	attempt := 0
+	return util.RetryWithBackoff(retryOpts, func() (bool, error) {
+		attempt++
+		endLookup := trace.Epoch("range cache lookup")
+		rangeMeta, err := kv.rangeCache.LookupRangeMetadata(args.Header().Key, trace)
+		endLookup()
 		if err == nil {
-			err = kv.sendRPC(rangeMeta.Replicas, method, args, replyChan)
+			endRPC := trace.Epoch(fmt.Sprintf("%s attempt %d", method, attempt))
+			err = kv.sendRPC(rangeMeta, method, args, replyChan)
+			endRPC()
+			if err == nil {
+				kv.evictIfStale(args.Header().Key, replyChan)
+			}
 		}
 		if err != nil {
 			// Range metadata might be out of date - evict it.
-			kv.rangeCache.EvictCachedRangeMetadata(args.Header().Key)
+			kv.rangeCache.EvictCachedRangeMetadata(args.Header().Key, EvictionCause(err), err.Error())
 
 			// If retryable, allow outer loop to retry.
 			if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
@@ -293,13 +1056,42 @@ func (kv *DistKV) ExecuteCmd(method string, args proto.Request, replyChan interf
 		}
 		return true, err
 	})
-	if err != nil {
-		sendErrorReply(err, replyChan)
+}
+
+// evictIfStale evicts the range metadata for key from the cache if
+// the error in the header of the reply awaiting receipt on replyChan
+// shows it to be stale. The reply is left on replyChan for the caller.
+func (kv *DistKV) evictIfStale(key engine.Key, replyChan interface{}) {
+	chanVal := reflect.ValueOf(replyChan)
+	replyVal, ok := chanVal.TryRecv()
+	if !ok {
+		return
+	}
+	defer chanVal.Send(replyVal)
+	if err := replyVal.Interface().(proto.Response).Header().GoError(); err != nil && EvictionCause(err) == EvictionStale {
+		kv.rangeCache.EvictCachedRangeMetadata(key, EvictionStale, err.Error())
 	}
 }
 
-// Close is a noop for the distributed KV implementation.
-func (kv *DistKV) Close() {}
+// finishTrace logs the completed trace for a command and passes it
+// to the trace sink, if one is set.
+func (kv *DistKV) finishTrace(method string, trace *Trace) {
+	if log.V(2) {
+		log.Infof("%s %s", method, trace)
+	}
+	if kv.traceSink != nil {
+		kv.traceSink(method, trace)
+	}
+}
+
+// Close stops heartbeats for transactions begun via BeginTransaction
+// and health probes, if started.
+func (kv *DistKV) Close() {
+	kv.txnDB.coordinator.Close()
+	if kv.prober != nil {
+		kv.prober.stop()
+	}
+}
 
 // sendErrorReply instantiates a new reply value according to the
 // inner element type of replyChan and sets its ResponseHeader
@@ -0,0 +1,838 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/biogo.store/llrb"
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// TestVerifyPermissions verifies that single-key and range commands
+// are checked against each permission config covering their keys.
+func TestVerifyPermissions(t *testing.T) {
+	g := gossip.New(rpc.LoadInsecureTLSConfig())
+	kv := NewDistKV(g, hlc.NewClock(hlc.UnixNano), nil)
+	configs := []*storage.PrefixConfig{
+		{Prefix: engine.KeyMin, Config: &proto.PermConfig{
+			Read:  []string{"read", "rw"},
+			Write: []string{"write", "rw"},
+		}},
+		{Prefix: engine.Key("a"), Config: &proto.PermConfig{
+			Read:  []string{"read", "rw"},
+			Write: []string{"rw"},
+		}},
+	}
+	configMap, err := storage.NewPrefixConfigMap(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo(gossip.KeyConfigPermission, configMap, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		method      string
+		user        string
+		key, endKey engine.Key
+		expSuccess  bool
+	}{
+		{storage.Get, "read", engine.Key("a"), nil, true},
+		{storage.Get, "write", engine.Key("a"), nil, false},
+		{storage.Put, "write", engine.Key("0"), nil, true},
+		{storage.Put, "write", engine.Key("a"), nil, false},
+		{storage.Put, "rw", engine.Key("a"), nil, true},
+		// The range spans both configs; each must permit the write.
+		{storage.DeleteRange, "write", engine.Key("0"), engine.Key("b"), false},
+		{storage.DeleteRange, "rw", engine.Key("0"), engine.Key("b"), true},
+		{storage.Scan, "read", engine.Key("0"), engine.Key("b"), true},
+		{storage.Scan, "write", engine.Key("0"), engine.Key("b"), false},
+	}
+	for i, test := range testData {
+		err := kv.VerifyPermissions(test.method, &proto.RequestHeader{
+			Key:    test.key,
+			EndKey: test.endKey,
+			User:   test.user,
+		})
+		if err == nil != test.expSuccess {
+			t.Errorf("%d: expected success %t; got %v", i, test.expSuccess, err)
+		}
+	}
+}
+
+// TestVerifyPermissionsUncovered verifies that permission is denied
+// for keys not covered by any permission config.
+func TestVerifyPermissionsUncovered(t *testing.T) {
+	g := gossip.New(rpc.LoadInsecureTLSConfig())
+	kv := NewDistKV(g, hlc.NewClock(hlc.UnixNano), nil)
+	if err := g.AddInfo(gossip.KeyConfigPermission, storage.PrefixConfigMap{}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	header := &proto.RequestHeader{Key: engine.Key("a"), User: storage.UserRoot}
+	if err := kv.VerifyPermissions(storage.Get, header); err == nil {
+		t.Error("expected error verifying permissions for uncovered key")
+	}
+}
+
+// scanNode is an RPC service which serves Node.Scan requests over a
+// fixed set of keys, failing requests whose start key is failKey.
+// Requests spanning one of the keys in splits fail with a
+// RangeKeyMismatchError, as if sent to a range which has split. Each
+// request takes at least delay, and the maximum number of requests in
+// flight at once is recorded in maxInFlight.
+type scanNode struct {
+	keys      []engine.Key
+	failKey   engine.Key
+	splits    []engine.Key
+	intentKey engine.Key // Scans with StopAtIntent stop here
+	delay     time.Duration
+
+	mu          sync.Mutex // Protects inFlight and maxInFlight
+	inFlight    int
+	maxInFlight int
+}
+
+// begin records the start of a request, returning a function which
+// records its end after the node's delay.
+func (n *scanNode) begin() func() {
+	n.mu.Lock()
+	n.inFlight++
+	if n.inFlight > n.maxInFlight {
+		n.maxInFlight = n.inFlight
+	}
+	n.mu.Unlock()
+	return func() {
+		time.Sleep(n.delay)
+		n.mu.Lock()
+		n.inFlight--
+		n.mu.Unlock()
+	}
+}
+
+// resetMaxInFlight returns the maximum number of requests in flight
+// at once since the last reset, and resets it.
+func (n *scanNode) resetMaxInFlight() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	max := n.maxInFlight
+	n.maxInFlight = 0
+	return max
+}
+
+func (n *scanNode) Scan(args *proto.ScanRequest, reply *proto.ScanResponse) error {
+	defer n.begin()()
+	if bytes.Equal(args.Key, n.failKey) {
+		reply.SetGoError(util.Errorf("range starting at %q is unavailable", args.Key))
+		return nil
+	}
+	for _, split := range n.splits {
+		if bytes.Compare(args.Key, split) < 0 && bytes.Compare(split, args.EndKey) < 0 {
+			reply.SetGoError(proto.NewRangeKeyMismatchError(args.Key, args.EndKey, &proto.RangeMetadata{}))
+			return nil
+		}
+	}
+	keys := n.keys
+	if args.Reverse {
+		keys = make([]engine.Key, len(n.keys))
+		for i, key := range n.keys {
+			keys[len(keys)-1-i] = key
+		}
+	}
+	var size int64
+	for _, key := range keys {
+		if args.MaxResults > 0 && int64(len(reply.Rows)) == args.MaxResults {
+			break
+		}
+		if bytes.Compare(key, args.Key) >= 0 && bytes.Compare(key, args.EndKey) < 0 {
+			if args.MaxBytes > 0 && size > args.MaxBytes {
+				reply.ResumeKey = key
+				break
+			}
+			if args.StopAtIntent && bytes.Equal(key, n.intentKey) {
+				reply.ResumeKey = key
+				if args.Reverse {
+					reply.ResumeKey = key.Next()
+				}
+				reply.IntentTxn = &proto.Transaction{ID: []byte("txn")}
+				break
+			}
+			reply.Rows = append(reply.Rows, proto.KeyValue{Key: key, Value: proto.Value{Bytes: key}})
+			size += int64(2 * len(key))
+		}
+	}
+	return nil
+}
+
+// Count implements Node.Count over the same keys as Scan.
+func (n *scanNode) Count(args *proto.CountRequest, reply *proto.CountResponse) error {
+	defer n.begin()()
+	if bytes.Equal(args.Key, n.failKey) {
+		reply.SetGoError(util.Errorf("range starting at %q is unavailable", args.Key))
+		return nil
+	}
+	for _, key := range n.keys {
+		if args.MaxResults > 0 && reply.Count == args.MaxResults {
+			break
+		}
+		if bytes.Compare(key, args.Key) >= 0 && bytes.Compare(key, args.EndKey) < 0 {
+			reply.Count++
+		}
+	}
+	return nil
+}
+
+// startScanNode serves node on a new RPC server and returns the
+// server, which the caller must close, along with a DistKV whose
+// ranges [a, c), [c, d) and [d, ...) are all replicated on it.
+func startScanNode(t *testing.T, node *scanNode) (*rpc.Server, *DistKV) {
+	tlsConfig := rpc.LoadInsecureTLSConfig()
+	rpcServer := rpc.NewServer(util.MakeRawAddr("tcp", "127.0.0.1:0"), tlsConfig)
+	if err := rpcServer.RegisterName("Node", node); err != nil {
+		t.Fatal(err)
+	}
+	if err := rpcServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	g := gossip.New(tlsConfig)
+	if err := g.AddInfo(gossip.MakeNodeIDGossipKey(1), rpcServer.Addr(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	kv := NewDistKV(g, hlc.NewClock(hlc.UnixNano), nil)
+	db := newTestMetadataDB()
+	db.cache = NewRangeMetadataCache(db)
+	db.splitRange(t, engine.Key("c"))
+	db.splitRange(t, engine.Key("d"))
+	db.data.Do(func(c llrb.Comparable) bool {
+		c.(testMetadataNode).Replicas = []proto.Replica{{NodeID: 1}}
+		return false
+	})
+	kv.rangeCache = db.cache
+	return rpcServer, kv
+}
+
+// TestScanPartialResults verifies that a scan spanning multiple
+// ranges fails on the first failed range by default, and otherwise
+// returns the rows from other ranges along with the failed spans.
+func TestScanPartialResults(t *testing.T) {
+	rpcServer, kv := startScanNode(t, &scanNode{
+		keys:    []engine.Key{engine.Key("a"), engine.Key("b"), engine.Key("c"), engine.Key("d"), engine.Key("e")},
+		failKey: engine.Key("c"),
+	})
+	defer rpcServer.Close()
+
+	scan := func(partial bool) *proto.ScanResponse {
+		replyChan := make(chan *proto.ScanResponse, 1)
+		kv.scanRange("Node.Scan", &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.Key("a"),
+				EndKey: engine.Key("z"),
+				User:   storage.UserRoot,
+			},
+			MaxResults:     10,
+			PartialResults: partial,
+		}, replyChan, nil)
+		return <-replyChan
+	}
+
+	if reply := scan(false); reply.GoError() == nil {
+		t.Errorf("expected error from fail-fast scan; got %+v", reply)
+	}
+
+	reply := scan(true)
+	if err := reply.GoError(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, kv := range reply.Rows {
+		keys = append(keys, string(kv.Key))
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b", "d", "e"}) {
+		t.Errorf("expected rows from the available ranges; got %q", keys)
+	}
+	if len(reply.FailedSpans) != 1 {
+		t.Fatalf("expected one failed span; got %+v", reply.FailedSpans)
+	}
+	span := reply.FailedSpans[0]
+	if !bytes.Equal(span.StartKey, engine.Key("c")) || !bytes.Equal(span.EndKey, engine.Key("d")) {
+		t.Errorf("expected failed span [c, d); got [%q, %q)", span.StartKey, span.EndKey)
+	}
+	if err := span.GoError(); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("expected unavailable error in failed span; got %v", err)
+	}
+}
+
+// TestScanRangeMaxBytes verifies that a scan spanning multiple ranges
+// stops once MaxBytes has been read, including when a range's rows
+// use up the budget exactly, and returns the key at which to resume.
+func TestScanRangeMaxBytes(t *testing.T) {
+	rpcServer, kv := startScanNode(t, &scanNode{
+		keys: []engine.Key{engine.Key("a"), engine.Key("b"), engine.Key("c"), engine.Key("d"), engine.Key("e")},
+	})
+	defer rpcServer.Close()
+
+	// Each row is two bytes: its key and an identical value.
+	for _, test := range []struct {
+		maxBytes     int64
+		expKeys      []string
+		expResumeKey string
+	}{
+		{1, []string{"a"}, "b"},
+		{3, []string{"a", "b"}, "c"},
+		{4, []string{"a", "b"}, "c"},
+		{5, []string{"a", "b", "c"}, "d"},
+		{100, []string{"a", "b", "c", "d", "e"}, ""},
+	} {
+		replyChan := make(chan *proto.ScanResponse, 1)
+		kv.scanRange("Node.Scan", &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.Key("a"),
+				EndKey: engine.Key("z"),
+				User:   storage.UserRoot,
+			},
+			MaxResults: 10,
+			MaxBytes:   test.maxBytes,
+		}, replyChan, nil)
+		reply := <-replyChan
+		if err := reply.GoError(); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, kv := range reply.Rows {
+			keys = append(keys, string(kv.Key))
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) || string(reply.ResumeKey) != test.expResumeKey {
+			t.Errorf("max bytes %d: expected %q resuming at %q; got %q resuming at %q",
+				test.maxBytes, test.expKeys, test.expResumeKey, keys, reply.ResumeKey)
+		}
+	}
+}
+
+// TestReverseScanRange verifies that a reverse scan spanning multiple
+// ranges returns rows in descending order across range boundaries, up
+// to the maximum, and recovers from a range split discovered midway.
+func TestReverseScanRange(t *testing.T) {
+	node := &scanNode{
+		keys: []engine.Key{engine.Key("a"), engine.Key("b"), engine.Key("c"), engine.Key("d"), engine.Key("e")},
+	}
+	rpcServer, kv := startScanNode(t, node)
+	defer rpcServer.Close()
+
+	scan := func(key, endKey string, max int64) []string {
+		replyChan := make(chan *proto.ScanResponse, 1)
+		kv.reverseScanRange("Node.Scan", &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.Key(key),
+				EndKey: engine.Key(endKey),
+				User:   storage.UserRoot,
+			},
+			MaxResults: max,
+			Reverse:    true,
+		}, replyChan, nil)
+		reply := <-replyChan
+		if err := reply.GoError(); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, kv := range reply.Rows {
+			keys = append(keys, string(kv.Key))
+		}
+		return keys
+	}
+
+	for _, test := range []struct {
+		key, endKey string
+		max         int64
+		expKeys     []string
+	}{
+		{"a", "z", 10, []string{"e", "d", "c", "b", "a"}},
+		{"a", "z", 3, []string{"e", "d", "c"}},
+		{"b", "d", 10, []string{"c", "b"}},
+		{"a", "c", 1, []string{"b"}},
+		{"f", "z", 10, nil},
+	} {
+		if keys := scan(test.key, test.endKey, test.max); !reflect.DeepEqual(keys, test.expKeys) {
+			t.Errorf("expected %q reverse scanning [%s, %s); got %q", test.expKeys, test.key, test.endKey, keys)
+		}
+	}
+
+	// Split the first range at "b" without updating the cache. Scanning
+	// it with stale metadata fails, and the new ranges are looked up.
+	db := kv.rangeCache.db.(*testMetadataDB)
+	db.splitRange(t, engine.Key("b"))
+	db.data.Do(func(c llrb.Comparable) bool {
+		c.(testMetadataNode).Replicas = []proto.Replica{{NodeID: 1}}
+		return false
+	})
+	node.splits = []engine.Key{engine.Key("b")}
+	if keys := scan("a", "z", 10); !reflect.DeepEqual(keys, []string{"e", "d", "c", "b", "a"}) {
+		t.Errorf("expected all keys reverse scanning across a split; got %q", keys)
+	}
+}
+
+// TestReverseScanRangeLookupFailure verifies that when the lookup of
+// a range fails midway through a reverse scan, the metadata evicted
+// is that consulted by the lookup, not that of the range just
+// scanned.
+func TestReverseScanRangeLookupFailure(t *testing.T) {
+	rpcServer, kv := startScanNode(t, &scanNode{
+		keys: []engine.Key{engine.Key("a"), engine.Key("b"), engine.Key("c"), engine.Key("d"), engine.Key("e")},
+	})
+	defer rpcServer.Close()
+
+	// Cache every range and the metadata range, then drop [c, d) so that
+	// it must be looked up, which fails.
+	if _, err := kv.rangeCache.LookupRangeMetadata(engine.Key("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	kv.rangeCache.rangeCache.Del(rangeCacheKey(engine.RangeMetaKey(engine.Key("d"))))
+	kv.rangeCache.db.(*testMetadataDB).lookupErr = util.Errorf("lookup failed")
+	dropped := len(kv.RangeCacheEvictions().Recent)
+
+	replyChan := make(chan *proto.ScanResponse, 1)
+	kv.reverseScanRange("Node.Scan", &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.Key("a"),
+			EndKey: engine.Key("z"),
+			User:   storage.UserRoot,
+		},
+		Reverse: true,
+	}, replyChan, nil)
+	if err := (<-replyChan).GoError(); err == nil {
+		t.Fatal("expected error reverse scanning with failed lookup")
+	}
+
+	// Only the metadata range addressing "d" is evicted; the range
+	// [d, ...) scanned first remains cached.
+	evictions := kv.RangeCacheEvictions().Recent
+	evictions = evictions[:len(evictions)-dropped]
+	if len(evictions) != 1 || !bytes.HasPrefix(evictions[0].Desc.StartKey, engine.KeyMeta2Prefix) {
+		t.Errorf("expected eviction of the metadata range only; got %+v", evictions)
+	}
+	if _, desc := kv.rangeCache.getCachedRangeMetadata(engine.Key("d")); desc == nil {
+		t.Error("expected range scanned before the failed lookup to remain cached")
+	}
+}
+
+// TestReverseScanRangeStopAtIntent verifies that a reverse scan with
+// StopAtIntent ends at an intent in a lower range, returning the rows
+// above it and the end key at which to resume.
+func TestReverseScanRangeStopAtIntent(t *testing.T) {
+	rpcServer, kv := startScanNode(t, &scanNode{
+		keys:      []engine.Key{engine.Key("a"), engine.Key("b"), engine.Key("c"), engine.Key("d"), engine.Key("e")},
+		intentKey: engine.Key("b"),
+	})
+	defer rpcServer.Close()
+
+	replyChan := make(chan *proto.ScanResponse, 1)
+	kv.reverseScanRange("Node.Scan", &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.Key("a"),
+			EndKey: engine.Key("z"),
+			User:   storage.UserRoot,
+		},
+		MaxResults:   10,
+		StopAtIntent: true,
+		Reverse:      true,
+	}, replyChan, nil)
+	reply := <-replyChan
+	if err := reply.GoError(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, kv := range reply.Rows {
+		keys = append(keys, string(kv.Key))
+	}
+	if !reflect.DeepEqual(keys, []string{"e", "d", "c"}) {
+		t.Errorf("expected rows above the intent; got %q", keys)
+	}
+	if !bytes.Equal(reply.ResumeKey, engine.Key("b").Next()) || reply.IntentTxn == nil {
+		t.Errorf("expected to resume past intent at %q; got %q, %+v", "b", reply.ResumeKey, reply.IntentTxn)
+	}
+}
+
+// TestCountRange verifies that a count spanning multiple ranges sums
+// the counts of each range, up to the maximum number of results, and
+// fails if any range fails.
+func TestCountRange(t *testing.T) {
+	node := &scanNode{
+		keys: []engine.Key{engine.Key("a"), engine.Key("b"), engine.Key("c"), engine.Key("d"), engine.Key("e")},
+	}
+	rpcServer, kv := startScanNode(t, node)
+	defer rpcServer.Close()
+
+	count := func(key, endKey string, max int64) *proto.CountResponse {
+		replyChan := make(chan *proto.CountResponse, 1)
+		kv.countRange("Node.Count", &proto.CountRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.Key(key),
+				EndKey: engine.Key(endKey),
+				User:   storage.UserRoot,
+			},
+			MaxResults: max,
+		}, replyChan, nil)
+		return <-replyChan
+	}
+
+	for _, test := range []struct {
+		key, endKey string
+		max         int64
+		expCount    int64
+	}{
+		{"a", "z", 0, 5},
+		{"b", "d", 0, 2},
+		{"c", "e", 0, 2},
+		{"f", "z", 0, 0},
+		{"a", "z", 1, 1},
+		{"a", "z", 3, 3},
+		{"a", "z", 10, 5},
+	} {
+		reply := count(test.key, test.endKey, test.max)
+		if err := reply.GoError(); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Count != test.expCount {
+			t.Errorf("expected count of %d in [%s, %s); got %d", test.expCount, test.key, test.endKey, reply.Count)
+		}
+	}
+
+	node.failKey = engine.Key("c")
+	if reply := count("a", "z", 0); reply.GoError() == nil {
+		t.Errorf("expected error counting over a failed range; got %+v", reply)
+	}
+	// A limit reached before the failed range avoids the error.
+	if reply := count("a", "z", 2); reply.GoError() != nil || reply.Count != 2 {
+		t.Errorf("expected count of 2 before the failed range; got %+v", reply)
+	}
+}
+
+// TestMultiRangeConcurrency verifies that the RPCs of commands
+// spanning multiple ranges are sent in parallel up to the configured
+// limit, and that scan rows are returned in key order. Scans limited
+// to MaxResults are sent to each range in turn.
+func TestMultiRangeConcurrency(t *testing.T) {
+	node := &scanNode{
+		keys:  []engine.Key{engine.Key("a"), engine.Key("b"), engine.Key("c"), engine.Key("d"), engine.Key("e")},
+		delay: 50 * time.Millisecond,
+	}
+	rpcServer, kv := startScanNode(t, node)
+	defer rpcServer.Close()
+
+	for _, limit := range []int{1, 2, 3} {
+		kv.SetMultiRangeConcurrency(limit)
+		node.resetMaxInFlight()
+		replyChan := make(chan *proto.CountResponse, 1)
+		kv.countRange("Node.Count", &proto.CountRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.Key("a"),
+				EndKey: engine.Key("z"),
+				User:   storage.UserRoot,
+			},
+		}, replyChan, nil)
+		reply := <-replyChan
+		if err := reply.GoError(); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Count != 5 {
+			t.Errorf("limit %d: expected count of 5; got %d", limit, reply.Count)
+		}
+		if maxInFlight := node.resetMaxInFlight(); maxInFlight != limit {
+			t.Errorf("limit %d: expected %d counts in flight; got %d", limit, limit, maxInFlight)
+		}
+	}
+
+	for _, test := range []struct {
+		max         int64
+		expKeys     []string
+		maxInFlight int
+	}{
+		{0, []string{"a", "b", "c", "d", "e"}, 3},
+		{10, []string{"a", "b", "c", "d", "e"}, 1},
+		{3, []string{"a", "b", "c"}, 1},
+		{1, []string{"a"}, 1},
+	} {
+		replyChan := make(chan *proto.ScanResponse, 1)
+		kv.scanRange("Node.Scan", &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:    engine.Key("a"),
+				EndKey: engine.Key("z"),
+				User:   storage.UserRoot,
+			},
+			MaxResults: test.max,
+		}, replyChan, nil)
+		reply := <-replyChan
+		if err := reply.GoError(); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, kv := range reply.Rows {
+			keys = append(keys, string(kv.Key))
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) {
+			t.Errorf("expected %q scanning up to %d rows; got %q", test.expKeys, test.max, keys)
+		}
+		if maxInFlight := node.resetMaxInFlight(); maxInFlight != test.maxInFlight {
+			t.Errorf("expected %d scans in flight with max %d; got %d", test.maxInFlight, test.max, maxInFlight)
+		}
+	}
+}
+
+// TestLocateKey verifies that a key is resolved to the descriptor of
+// its range and the gossiped addresses of the range's replicas.
+func TestLocateKey(t *testing.T) {
+	rpcServer, kv := startScanNode(t, &scanNode{})
+	defer rpcServer.Close()
+
+	desc, addrs, err := kv.LocateKey(engine.Key("c1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(desc.StartKey, engine.Key("c")) || !bytes.Equal(desc.EndKey, engine.Key("d")) {
+		t.Errorf("expected range [c, d); got [%q, %q)", desc.StartKey, desc.EndKey)
+	}
+	if len(addrs) != 1 || addrs[0].String() != rpcServer.Addr().String() {
+		t.Errorf("expected address %s; got %v", rpcServer.Addr(), addrs)
+	}
+
+	// A range whose replicas have no gossiped addresses is unreachable.
+	desc.Replicas = []proto.Replica{{NodeID: 2}}
+	kv.rangeCache.rangeCache.Add(rangeCacheKey(engine.RangeMetadataLookupKey(&desc)), &desc)
+	if _, _, err := kv.LocateKey(engine.Key("c1")); err == nil {
+		t.Error("expected error locating key without replica addresses")
+	}
+}
+
+// TestRouteRPCEvictions verifies that routeRPC evicts range metadata
+// shown to be stale by the error in a reply, passing the reply on,
+// and records evictions due to failures to reach the replicas as
+// transient.
+func TestRouteRPCEvictions(t *testing.T) {
+	rpcServer, kv := startScanNode(t, &scanNode{splits: []engine.Key{engine.Key("b")}})
+	defer rpcServer.Close()
+
+	replyChan := make(chan *proto.ScanResponse, 1)
+	args := &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.Key("a"),
+			EndKey: engine.Key("c"),
+			User:   storage.UserRoot,
+		},
+	}
+	if err := kv.routeRPC("Node.Scan", args, replyChan, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := (<-replyChan).GoError().(*proto.RangeKeyMismatchError); !ok {
+		t.Error("expected range key mismatch error in reply")
+	}
+	counts := kv.RangeCacheEvictions().Counts
+	stale := counts["stale"]
+	if stale == 0 || counts["transient"] != 0 {
+		t.Errorf("expected only stale evictions; got %+v", counts)
+	}
+
+	// Open the replica's circuit breaker so that the command fails fast
+	// with a non-retryable RangeError.
+	kv.SetCircuitBreaker(1, time.Hour)
+	kv.breakers.recordFailure(rpcServer.Addr())
+	if err := kv.routeRPC("Node.Scan", args, replyChan, nil); err == nil {
+		t.Fatal("expected error with circuit breaker open")
+	}
+	if counts := kv.RangeCacheEvictions().Counts; counts["stale"] != stale || counts["transient"] == 0 {
+		t.Errorf("expected transient evictions; got %+v", counts)
+	}
+}
+
+// TestRangeErrorReply verifies that an error sending a command to a
+// range's replicas is returned to the client identifying the range
+// and the replica addresses tried.
+func TestRangeErrorReply(t *testing.T) {
+	rpcServer, kv := startScanNode(t, &scanNode{})
+	defer rpcServer.Close()
+	// Open the replica's circuit breaker so that the command fails fast
+	// with a non-retryable error.
+	kv.SetCircuitBreaker(1, time.Hour)
+	kv.breakers.recordFailure(rpcServer.Addr())
+
+	replyChan := make(chan *proto.ScanResponse, 1)
+	args := &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  engine.Key("c1"),
+			User: storage.UserRoot,
+		},
+		MaxResults: 10,
+	}
+	if err := kv.routeRPC("Node.Scan", args, replyChan, nil); err != nil {
+		sendErrorReply(err, replyChan)
+	}
+	reply := <-replyChan
+	rangeErr, ok := reply.GoError().(*proto.RangeError)
+	if !ok {
+		t.Fatalf("expected range error; got %v", reply.GoError())
+	}
+	if !bytes.Equal(rangeErr.Range.StartKey, engine.Key("c")) || !bytes.Equal(rangeErr.Range.EndKey, engine.Key("d")) {
+		t.Errorf("expected range [c, d); got [%q, %q)", rangeErr.Range.StartKey, rangeErr.Range.EndKey)
+	}
+	if rangeErr.CanRetry() {
+		t.Error("expected range error not to be retryable")
+	}
+
+	// Errors from rpc.Send name the replica addresses which were tried.
+	desc := &proto.RangeDescriptor{
+		StartKey: engine.Key("c"),
+		EndKey:   engine.Key("d"),
+		Replicas: []proto.Replica{{NodeID: 1}},
+	}
+	kv.SetCircuitBreaker(0, 0)
+	err := kv.sendRPC(desc, "Node.Unknown", args, make(chan *proto.ScanResponse, 1))
+	if rangeErr, ok = err.(*proto.RangeError); !ok {
+		t.Fatalf("expected range error; got %v", err)
+	}
+	if len(rangeErr.Addrs) != 1 || rangeErr.Addrs[0] != rpcServer.Addr().String() {
+		t.Errorf("expected address %s; got %v", rpcServer.Addr(), rangeErr.Addrs)
+	}
+}
+
+// TestStaleness verifies that the staleness of a read is measured
+// from the closed timestamp of its reply, and that replies merged
+// from several ranges are as stale as the stalest of them.
+func TestStaleness(t *testing.T) {
+	manual := hlc.ManualClock(10 * time.Second.Nanoseconds())
+	kv := NewDistKV(gossip.New(rpc.LoadInsecureTLSConfig()), hlc.NewClock(manual.UnixNano), nil)
+
+	reply := &proto.GetResponse{}
+	reply.ClosedTimestamp = proto.Timestamp{WallTime: 7 * time.Second.Nanoseconds()}
+	if staleness := kv.Staleness(reply); staleness != 3*time.Second {
+		t.Errorf("expected staleness of 3s; got %s", staleness)
+	}
+	// A replica with a clock ahead of ours serves data which isn't stale.
+	reply.ClosedTimestamp = proto.Timestamp{WallTime: 12 * time.Second.Nanoseconds()}
+	if staleness := kv.Staleness(reply); staleness != 0 {
+		t.Errorf("expected no staleness; got %s", staleness)
+	}
+
+	merged := &proto.ResponseHeader{}
+	for i, wallTime := range []int64{5, 2, 8} {
+		rangeReply := &proto.ResponseHeader{ClosedTimestamp: proto.Timestamp{WallTime: wallTime}}
+		mergeClosedTimestamp(merged, rangeReply, i == 0)
+	}
+	if merged.ClosedTimestamp.WallTime != 2 {
+		t.Errorf("expected merged closed timestamp of 2; got %+v", merged.ClosedTimestamp)
+	}
+}
+
+// TestVerifyHistorical verifies that only non-transactional reads at
+// an explicit timestamp may be historical.
+func TestVerifyHistorical(t *testing.T) {
+	ts := proto.Timestamp{WallTime: 1}
+	testCases := []struct {
+		method string
+		header proto.RequestHeader
+		ok     bool
+	}{
+		{"Get", proto.RequestHeader{Timestamp: ts}, true},
+		{"Scan", proto.RequestHeader{Timestamp: ts}, true},
+		{"Put", proto.RequestHeader{Timestamp: ts}, false},
+		{"Get", proto.RequestHeader{}, false},
+		{"Get", proto.RequestHeader{Timestamp: ts, Txn: &proto.Transaction{}}, false},
+	}
+	for i, test := range testCases {
+		if err := verifyHistorical(test.method, &test.header); (err == nil) != test.ok {
+			t.Errorf("%d: expected ok=%t; got error %v", i, test.ok, err)
+		}
+	}
+}
+
+// TestRPCTimeout verifies that a request's RPC timeout is validated
+// and overrides the default timeout of the RPCs sent to replicas.
+func TestRPCTimeout(t *testing.T) {
+	for i, test := range []struct {
+		timeout time.Duration
+		ok      bool
+	}{
+		{0, true},
+		{time.Millisecond, true},
+		{maxRPCTimeout, true},
+		{-time.Millisecond, false},
+		{maxRPCTimeout + 1, false},
+	} {
+		header := &proto.RequestHeader{RPCTimeoutNanos: int64(test.timeout)}
+		if err := verifyRPCTimeout("Get", header); (err == nil) != test.ok {
+			t.Errorf("%d: expected ok=%t; got error %v", i, test.ok, err)
+		}
+	}
+
+	rpcServer, kv := startScanNode(t, &scanNode{delay: 100 * time.Millisecond})
+	defer rpcServer.Close()
+	desc := &proto.RangeDescriptor{
+		StartKey: engine.Key("a"),
+		EndKey:   engine.Key("c"),
+		Replicas: []proto.Replica{{NodeID: 1}},
+	}
+	for _, test := range []struct {
+		timeout time.Duration
+		ok      bool
+	}{
+		{0, true},
+		{10 * time.Millisecond, false},
+	} {
+		args := &proto.ScanRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:             engine.Key("a"),
+				EndKey:          engine.Key("c"),
+				User:            storage.UserRoot,
+				RPCTimeoutNanos: int64(test.timeout),
+			},
+		}
+		err := kv.sendRPC(desc, "Node.Scan", args, make(chan *proto.ScanResponse, 1))
+		if (err == nil) != test.ok {
+			t.Errorf("timeout %s: expected ok=%t; got error %v", test.timeout, test.ok, err)
+		}
+	}
+}
+
+// TestVerifyRequestSize verifies that requests whose encoded size
+// exceeds the maximum are rejected, and that a maximum of zero sets no
+// limit.
+func TestVerifyRequestSize(t *testing.T) {
+	args := &proto.PutRequest{
+		RequestHeader: proto.RequestHeader{Key: engine.Key("a")},
+		Value:         proto.Value{Bytes: make([]byte, 1000)},
+	}
+	for i, test := range []struct {
+		max int
+		ok  bool
+	}{
+		{0, true},
+		{2000, true},
+		{1000, false},
+	} {
+		if err := verifyRequestSize("Put", args, test.max); (err == nil) != test.ok {
+			t.Errorf("%d: expected ok=%t; got error %v", i, test.ok, err)
+		}
+	}
+}
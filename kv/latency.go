@@ -0,0 +1,104 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyDecay is the weight given to each new latency sample in
+	// a replica's moving average.
+	latencyDecay = 0.2
+	// minLatencySamples is the number of samples required from a
+	// replica before its moving average is used to compute the
+	// send-next timeout.
+	minLatencySamples = 5
+	// sendNextLatencyMultiple is the multiple of observed replica
+	// latency after which an RPC is sent to the next replica.
+	sendNextLatencyMultiple = 3
+	// minSendNextTimeout and maxSendNextTimeout bound the adaptive
+	// send-next timeout.
+	minSendNextTimeout = 5 * time.Millisecond
+	maxSendNextTimeout = 10 * time.Second
+)
+
+// replicaLatency is an exponentially weighted moving average of the
+// response latency of a single replica.
+type replicaLatency struct {
+	avg     float64 // Nanoseconds
+	samples int
+}
+
+// A latencyTracker records the response latency of replicas, keyed
+// by network address, and uses it to compute the duration to wait
+// for a reply before sending an RPC to another replica.
+type latencyTracker struct {
+	sync.Mutex
+	latencies map[string]*replicaLatency
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		latencies: map[string]*replicaLatency{},
+	}
+}
+
+// record adds a latency sample for the replica at addr.
+func (lt *latencyTracker) record(addr net.Addr, latency time.Duration) {
+	lt.Lock()
+	defer lt.Unlock()
+	rl, ok := lt.latencies[addr.String()]
+	if !ok {
+		rl = &replicaLatency{avg: float64(latency)}
+		lt.latencies[addr.String()] = rl
+	} else {
+		rl.avg += latencyDecay * (float64(latency) - rl.avg)
+	}
+	rl.samples++
+}
+
+// sendNextTimeout returns the send-next timeout for an RPC to the
+// replicas at addrs: a multiple of the highest average latency of
+// those replicas with enough samples, within fixed bounds. If no
+// replica has enough samples, returns defaultTimeout.
+func (lt *latencyTracker) sendNextTimeout(addrs []net.Addr, defaultTimeout time.Duration) time.Duration {
+	lt.Lock()
+	defer lt.Unlock()
+	var maxAvg float64
+	found := false
+	for _, addr := range addrs {
+		if rl, ok := lt.latencies[addr.String()]; ok && rl.samples >= minLatencySamples {
+			found = true
+			if rl.avg > maxAvg {
+				maxAvg = rl.avg
+			}
+		}
+	}
+	if !found {
+		return defaultTimeout
+	}
+	timeout := time.Duration(maxAvg * sendNextLatencyMultiple)
+	if timeout < minSendNextTimeout {
+		return minSendNextTimeout
+	}
+	if timeout > maxSendNextTimeout {
+		return maxSendNextTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,75 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestLatencyTrackerSendNextTimeout verifies that the send-next
+// timeout falls back to the default until enough samples are
+// recorded, then follows the slowest sampled replica within bounds.
+func TestLatencyTrackerSendNextTimeout(t *testing.T) {
+	lt := newLatencyTracker()
+	a := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	b := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	addrs := []net.Addr{a, b}
+
+	for i := 0; i < minLatencySamples-1; i++ {
+		lt.record(a, 10*time.Millisecond)
+	}
+	if timeout := lt.sendNextTimeout(addrs, time.Second); timeout != time.Second {
+		t.Errorf("expected default timeout before enough samples; got %s", timeout)
+	}
+	lt.record(a, 10*time.Millisecond)
+	if timeout := lt.sendNextTimeout(addrs, time.Second); timeout != 30*time.Millisecond {
+		t.Errorf("expected 30ms timeout; got %s", timeout)
+	}
+
+	// A slower replica raises the timeout.
+	for i := 0; i < minLatencySamples; i++ {
+		lt.record(b, 100*time.Millisecond)
+	}
+	if timeout := lt.sendNextTimeout(addrs, time.Second); timeout != 300*time.Millisecond {
+		t.Errorf("expected 300ms timeout; got %s", timeout)
+	}
+	// But not for RPCs which can't be sent to it.
+	if timeout := lt.sendNextTimeout(addrs[:1], time.Second); timeout != 30*time.Millisecond {
+		t.Errorf("expected 30ms timeout; got %s", timeout)
+	}
+
+	// The moving average follows new samples.
+	lt.record(a, 60*time.Millisecond)
+	if timeout := lt.sendNextTimeout(addrs[:1], time.Second); timeout != 60*time.Millisecond {
+		t.Errorf("expected 60ms timeout; got %s", timeout)
+	}
+
+	// Timeouts are bounded.
+	for i := 0; i < 100; i++ {
+		lt.record(a, 0)
+	}
+	if timeout := lt.sendNextTimeout(addrs[:1], time.Second); timeout != minSendNextTimeout {
+		t.Errorf("expected minimum timeout; got %s", timeout)
+	}
+	for i := 0; i < 100; i++ {
+		lt.record(b, time.Minute)
+	}
+	if timeout := lt.sendNextTimeout(addrs, time.Second); timeout != maxSendNextTimeout {
+		t.Errorf("expected maximum timeout; got %s", timeout)
+	}
+}
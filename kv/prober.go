@@ -0,0 +1,185 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+const (
+	// DefaultHealthProbeInterval is the interval at which the health
+	// of known replicas is probed, once started via StartHealthProbes.
+	DefaultHealthProbeInterval = 5 * time.Second
+	// defaultHealthProbeTimeout is the duration after which a health
+	// probe which has not completed is considered failed.
+	defaultHealthProbeTimeout = 1 * time.Second
+)
+
+// ReplicaHealth describes the result of the most recent health probes
+// of a replica.
+type ReplicaHealth struct {
+	Healthy             bool          // True if the last probe succeeded
+	LastProbe           time.Time     // Time of the last probe
+	Latency             time.Duration // Round trip time of the last successful probe
+	ConsecutiveFailures int           // Number of failed probes since the last success
+}
+
+// Stats describes the state of a DistKV.
+type Stats struct {
+	// Replicas holds the health of each probed replica, keyed by
+	// network address.
+	Replicas map[string]ReplicaHealth
+}
+
+// A replicaProber periodically pings each replica address known to
+// DistKV with a heartbeat RPC, both to keep connections warm and to
+// learn that a replica is down before a request is sent to it. The
+// result of each probe is passed to record.
+type replicaProber struct {
+	interval time.Duration
+	ping     func(addr net.Addr) error
+	record   func(addr net.Addr, latency time.Duration, err error)
+	now      func() time.Time
+	stopper  chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex // Protects addrs and health
+	addrs  map[string]net.Addr
+	health map[string]ReplicaHealth
+}
+
+func newReplicaProber(interval time.Duration, ping func(net.Addr) error,
+	record func(net.Addr, time.Duration, error)) *replicaProber {
+	return &replicaProber{
+		interval: interval,
+		ping:     ping,
+		record:   record,
+		now:      time.Now,
+		stopper:  make(chan struct{}),
+		addrs:    map[string]net.Addr{},
+		health:   map[string]ReplicaHealth{},
+	}
+}
+
+// add registers the address of a replica to be probed.
+func (rp *replicaProber) add(addr net.Addr) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.addrs[addr.String()] = addr
+}
+
+// start probes the registered replicas every interval until stopped.
+func (rp *replicaProber) start() {
+	ticker := time.NewTicker(rp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rp.probeAll()
+		case <-rp.stopper:
+			return
+		}
+	}
+}
+
+// stop stops probing. It may be called more than once.
+func (rp *replicaProber) stop() {
+	rp.stopOnce.Do(func() { close(rp.stopper) })
+}
+
+// probeAll probes each registered replica in parallel, returning once
+// all probes have completed.
+func (rp *replicaProber) probeAll() {
+	rp.mu.Lock()
+	addrs := make([]net.Addr, 0, len(rp.addrs))
+	for _, addr := range rp.addrs {
+		addrs = append(addrs, addr)
+	}
+	rp.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(addrs))
+	for _, addr := range addrs {
+		go func(addr net.Addr) {
+			defer wg.Done()
+			rp.probe(addr)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// probe pings the replica at addr and records the result.
+func (rp *replicaProber) probe(addr net.Addr) {
+	start := rp.now()
+	err := rp.ping(addr)
+	latency := rp.now().Sub(start)
+
+	rp.mu.Lock()
+	h := rp.health[addr.String()]
+	h.LastProbe = start
+	if err == nil {
+		h.Healthy = true
+		h.Latency = latency
+		h.ConsecutiveFailures = 0
+	} else {
+		log.V(1).Infof("health probe of replica at %s failed: %s", addr, err)
+		h.Healthy = false
+		h.ConsecutiveFailures++
+	}
+	rp.health[addr.String()] = h
+	rp.mu.Unlock()
+
+	rp.record(addr, latency, err)
+}
+
+// replicaHealth returns a copy of the health of each probed replica.
+func (rp *replicaProber) replicaHealth() map[string]ReplicaHealth {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	health := make(map[string]ReplicaHealth, len(rp.health))
+	for addr, h := range rp.health {
+		health[addr] = h
+	}
+	return health
+}
+
+// pingReplica sends a heartbeat RPC to the node at addr, connecting
+// to it first if necessary, and returns an error if either doesn't
+// complete within timeout.
+func pingReplica(addr net.Addr, tlsConfig *rpc.TLSConfig, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	client := rpc.NewClient(addr, nil, tlsConfig)
+	select {
+	case <-client.Ready:
+	case <-client.Closed:
+		return util.Errorf("connection to %s closed", addr)
+	case <-deadline:
+		return util.Errorf("timed out connecting to %s", addr)
+	}
+	call := client.Go("Heartbeat.Ping", &rpc.PingRequest{}, &rpc.PingResponse{}, nil)
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-deadline:
+		return util.Errorf("heartbeat to %s timed out", addr)
+	}
+}
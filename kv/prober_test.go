@@ -0,0 +1,117 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReplicaProber verifies that the prober pings each registered
+// replica, tracks its health and feeds the results into the circuit
+// breakers.
+func TestReplicaProber(t *testing.T) {
+	a := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	b := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	var mu sync.Mutex
+	down := map[string]bool{b.String(): true}
+	bs := newBreakerSet(2, time.Hour)
+	rp := newReplicaProber(time.Hour, func(addr net.Addr) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if down[addr.String()] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, func(addr net.Addr, _ time.Duration, err error) {
+		if err != nil {
+			bs.recordFailure(addr)
+		} else {
+			bs.recordSuccess(addr)
+		}
+	})
+	rp.add(a)
+	rp.add(b)
+	rp.add(b)
+
+	rp.probeAll()
+	rp.probeAll()
+	health := rp.replicaHealth()
+	if len(health) != 2 {
+		t.Fatalf("expected health of 2 replicas; got %+v", health)
+	}
+	if h := health[a.String()]; !h.Healthy || h.ConsecutiveFailures != 0 || h.LastProbe.IsZero() {
+		t.Errorf("expected %s to be healthy; got %+v", a, h)
+	}
+	if h := health[b.String()]; h.Healthy || h.ConsecutiveFailures != 2 {
+		t.Errorf("expected %s to have failed twice; got %+v", b, h)
+	}
+	if !bs.allow(a) {
+		t.Errorf("expected breaker of %s to be closed", a)
+	}
+	if bs.allow(b) {
+		t.Errorf("expected breaker of %s to be open after failed probes", b)
+	}
+
+	// Once the replica is reachable again, a successful probe closes
+	// its breaker before any request is sent to it.
+	mu.Lock()
+	delete(down, b.String())
+	mu.Unlock()
+	rp.probeAll()
+	if h := rp.replicaHealth()[b.String()]; !h.Healthy || h.ConsecutiveFailures != 0 {
+		t.Errorf("expected %s to be healthy; got %+v", b, h)
+	}
+	if !bs.allow(b) {
+		t.Errorf("expected breaker of %s to be closed after a successful probe", b)
+	}
+}
+
+// TestReplicaProberStop verifies that a started prober probes
+// periodically and stops probing once stopped.
+func TestReplicaProberStop(t *testing.T) {
+	a := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	probed := make(chan struct{}, 10)
+	rp := newReplicaProber(time.Millisecond, func(addr net.Addr) error {
+		return nil
+	}, func(addr net.Addr, _ time.Duration, err error) {
+		select {
+		case probed <- struct{}{}:
+		default:
+		}
+	})
+	rp.add(a)
+	done := make(chan struct{})
+	go func() {
+		rp.start()
+		close(done)
+	}()
+	select {
+	case <-probed:
+	case <-time.After(time.Second):
+		t.Fatal("expected replica to be probed")
+	}
+	rp.stop()
+	rp.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected prober to stop")
+	}
+}
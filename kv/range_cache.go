@@ -20,6 +20,7 @@ package kv
 import (
 	"bytes"
 	"sync"
+	"time"
 
 	"code.google.com/p/biogo.store/llrb"
 	"github.com/cockroachdb/cockroach/proto"
@@ -31,6 +32,10 @@ const (
 	// rangeCacheSize is the number of entries held in the range cache.
 	// TODO(mrtracy): This value should be a command-line option.
 	rangeCacheSize = 1 << 20
+
+	// recentEvictionsSize is the number of the most recent evictions
+	// retained by the range cache for diagnosis.
+	recentEvictionsSize = 100
 )
 
 // rangeCacheKey is the key type used to store and sort values in the
@@ -58,8 +63,80 @@ type rangeMetadataDB interface {
 	// RangeDescriptors for a set of consecutive ranges, the first which must
 	// contain the requested key. The additional RangeDescriptors are returned
 	// with the intent of pre-caching subsequent ranges which are likely to be
-	// requested soon by the current workload.
-	getRangeMetadata(engine.Key) ([]proto.RangeDescriptor, error)
+	// requested soon by the current workload. If reverse is true, the
+	// first must instead contain the keys just before the requested
+	// key (see LookupRangeMetadataBefore). Lookups are recorded in the
+	// supplied trace, which may be nil.
+	getRangeMetadata(key engine.Key, reverse bool, trace *Trace) ([]proto.RangeDescriptor, error)
+}
+
+// A RangeCacheEvictionCause classifies the reason a range descriptor
+// was evicted from a RangeMetadataCache.
+type RangeCacheEvictionCause int
+
+const (
+	// EvictionStale indicates that the descriptor was found to be out
+	// of date, e.g. because the range has split or moved.
+	EvictionStale RangeCacheEvictionCause = iota
+	// EvictionTransient indicates that a request to the range failed,
+	// possibly only because a replica is temporarily unavailable.
+	EvictionTransient
+	// EvictionManual indicates that the cache was cleared on request.
+	EvictionManual
+	// EvictionCapacity indicates that the descriptor was evicted to
+	// bound the size of the cache.
+	EvictionCapacity
+	numEvictionCauses
+)
+
+var evictionCauseNames = [numEvictionCauses]string{"stale", "transient", "manual", "capacity"}
+
+// String returns the name of the cause.
+func (c RangeCacheEvictionCause) String() string {
+	if c < 0 || c >= numEvictionCauses {
+		return "unknown"
+	}
+	return evictionCauseNames[c]
+}
+
+// EvictionCause returns the cause of the eviction of range metadata
+// which was in use when err occurred. The errors in reply headers of
+// a RangeKeyMismatchError or RangeNotFoundError show the metadata to
+// be stale. A RangeError, which is returned when the replicas of the
+// range could not be reached, and other errors may be transient.
+func EvictionCause(err error) RangeCacheEvictionCause {
+	switch err.(type) {
+	case *proto.RangeKeyMismatchError, *proto.RangeNotFoundError:
+		return EvictionStale
+	}
+	return EvictionTransient
+}
+
+// A RangeCacheEvictionHook is invoked with each range descriptor
+// evicted from a RangeMetadataCache. For explicit evictions, key is
+// the key whose range metadata was found to be stale and reason
+// describes why; for evictions made to bound the size of the cache or
+// to clear it, key is nil. The hook is invoked with the cache locked
+// and must not call back into the cache.
+type RangeCacheEvictionHook func(key engine.Key, desc *proto.RangeDescriptor, cause RangeCacheEvictionCause,
+	reason string)
+
+// A RangeCacheEviction records the eviction of a range descriptor from
+// a RangeMetadataCache.
+type RangeCacheEviction struct {
+	Time   time.Time
+	Key    engine.Key // The key whose lookup prompted the eviction, if any
+	Desc   proto.RangeDescriptor
+	Cause  RangeCacheEvictionCause
+	Reason string
+}
+
+// RangeCacheEvictionStats summarizes the evictions from a
+// RangeMetadataCache: the number of evictions for each cause, keyed by
+// the cause's name, and the most recent evictions, newest first.
+type RangeCacheEvictionStats struct {
+	Counts map[string]int64
+	Recent []RangeCacheEviction
 }
 
 // RangeMetadataCache is used to retrieve range metadata for arbitrary keys.
@@ -75,20 +152,100 @@ type RangeMetadataCache struct {
 	rangeCache *util.OrderedCache
 	// rangeCacheMu protects rangeCache for concurrent access
 	rangeCacheMu sync.RWMutex
+	// onEvict, if not nil, is invoked with each evicted descriptor.
+	onEvict RangeCacheEvictionHook
+	// evictKey, evictCause and evictReason describe the explicit
+	// eviction in progress, if any, for onEvicted. Protected by
+	// rangeCacheMu.
+	evictKey    engine.Key
+	evictCause  RangeCacheEvictionCause
+	evictReason string
+	// evictionCounts counts the evictions of each cause, and
+	// recentEvictions holds the most recent, as a ring buffer whose
+	// next entry is at nextEviction. Protected by rangeCacheMu.
+	evictionCounts  [numEvictionCauses]int64
+	recentEvictions []RangeCacheEviction
+	nextEviction    int
+	// generation is incremented each time the cache is cleared, so that
+	// lookups in flight at the time don't cache the possibly stale
+	// descriptors they read. Protected by rangeCacheMu.
+	generation int64
 }
 
 // NewRangeMetadataCache returns a new RangeMetadataCache which uses the given
 // rangeMetadataDB as the underlying source of range metadata.
 func NewRangeMetadataCache(db rangeMetadataDB) *RangeMetadataCache {
-	return &RangeMetadataCache{
-		db: db,
-		rangeCache: util.NewOrderedCache(util.CacheConfig{
-			Policy:      util.CacheLRU,
-			ShouldEvict: rangeCacheShouldEvict,
-		}),
+	rmc := &RangeMetadataCache{db: db}
+	rmc.rangeCache = util.NewOrderedCache(util.CacheConfig{
+		Policy:      util.CacheLRU,
+		ShouldEvict: rangeCacheShouldEvict,
+		OnEvicted:   rmc.onEvicted,
+	})
+	return rmc
+}
+
+// SetEvictionHook sets a hook to be invoked with each range
+// descriptor evicted from the cache. It must be called before the
+// cache is used.
+func (rmc *RangeMetadataCache) SetEvictionHook(hook RangeCacheEvictionHook) {
+	rmc.onEvict = hook
+}
+
+// onEvicted is invoked by the underlying cache for each evicted entry,
+// with rangeCacheMu held. The eviction is counted and recorded before
+// the hook, if any, is invoked.
+func (rmc *RangeMetadataCache) onEvicted(k, v interface{}) {
+	cause, reason := rmc.evictCause, rmc.evictReason
+	if reason == "" {
+		cause, reason = EvictionCapacity, "cache full"
+	}
+	desc := v.(*proto.RangeDescriptor)
+	rmc.evictionCounts[cause]++
+	eviction := RangeCacheEviction{
+		Time:   time.Now(),
+		Key:    rmc.evictKey,
+		Desc:   *desc,
+		Cause:  cause,
+		Reason: reason,
+	}
+	if len(rmc.recentEvictions) < recentEvictionsSize {
+		rmc.recentEvictions = append(rmc.recentEvictions, eviction)
+	} else {
+		rmc.recentEvictions[rmc.nextEviction] = eviction
+	}
+	rmc.nextEviction = (rmc.nextEviction + 1) % recentEvictionsSize
+	if rmc.onEvict != nil {
+		rmc.onEvict(rmc.evictKey, desc, cause, reason)
 	}
 }
 
+// Evictions returns the number of evictions of each cause and the
+// most recent evictions.
+func (rmc *RangeMetadataCache) Evictions() RangeCacheEvictionStats {
+	rmc.rangeCacheMu.RLock()
+	defer rmc.rangeCacheMu.RUnlock()
+	stats := RangeCacheEvictionStats{Counts: map[string]int64{}}
+	for cause, count := range rmc.evictionCounts {
+		stats.Counts[RangeCacheEvictionCause(cause).String()] = count
+	}
+	for i := 1; i <= len(rmc.recentEvictions); i++ {
+		j := (rmc.nextEviction - i + recentEvictionsSize) % recentEvictionsSize
+		stats.Recent = append(stats.Recent, rmc.recentEvictions[j])
+	}
+	return stats
+}
+
+// Dump returns the cached range descriptors, ordered by key.
+func (rmc *RangeMetadataCache) Dump() []proto.RangeDescriptor {
+	rmc.rangeCacheMu.RLock()
+	defer rmc.rangeCacheMu.RUnlock()
+	var descs []proto.RangeDescriptor
+	rmc.rangeCache.Do(func(k, v interface{}) {
+		descs = append(descs, *v.(*proto.RangeDescriptor))
+	})
+	return descs
+}
+
 // LookupRangeMetadata attempts to locate metadata for the range containing the
 // given Key. This is done by querying the two-level lookup table of range
 // metadata which cockroach maintains.
@@ -100,20 +257,52 @@ func NewRangeMetadataCache(db rangeMetadataDB) *RangeMetadataCache {
 // descriptors retrieved during each search are cached for subsequent lookups.
 //
 // This method returns the RangeDescriptor for the range containing the key's
-// data, or an error if any occurred.
-func (rmc *RangeMetadataCache) LookupRangeMetadata(key engine.Key) (*proto.RangeDescriptor, error) {
-	_, r := rmc.getCachedRangeMetadata(key)
-	if r != nil {
+// data, or an error if any occurred. Lookups which miss the cache are
+// recorded in trace, which may be nil.
+func (rmc *RangeMetadataCache) LookupRangeMetadata(key engine.Key, trace *Trace) (*proto.RangeDescriptor, error) {
+	return rmc.lookupRangeMetadata(key, false, trace)
+}
+
+// LookupRangeMetadataBefore is like LookupRangeMetadata, but locates
+// metadata for the range containing the keys just before the given
+// key: the range whose start key is less than the key and whose end
+// key is greater than or equal to it. Reverse scans use it to visit
+// ranges in descending order, looking up the range ending at the
+// start key of the range last visited.
+func (rmc *RangeMetadataCache) LookupRangeMetadataBefore(key engine.Key, trace *Trace) (*proto.RangeDescriptor, error) {
+	return rmc.lookupRangeMetadata(key, true, trace)
+}
+
+// lookupRangeMetadata implements LookupRangeMetadata and, if reverse
+// is true, LookupRangeMetadataBefore.
+func (rmc *RangeMetadataCache) lookupRangeMetadata(key engine.Key, reverse bool, trace *Trace) (*proto.RangeDescriptor, error) {
+	if reverse {
+		if r := rmc.getCachedRangeMetadataBefore(key); r != nil {
+			return r, nil
+		}
+	} else if _, r := rmc.getCachedRangeMetadata(key); r != nil {
 		return r, nil
 	}
 
-	rs, err := rmc.db.getRangeMetadata(key)
+	rmc.rangeCacheMu.RLock()
+	generation := rmc.generation
+	rmc.rangeCacheMu.RUnlock()
+	rs, err := rmc.db.getRangeMetadata(key, reverse, trace)
 	if err != nil {
 		return nil, err
 	}
+	if len(rs) == 0 {
+		return nil, util.Errorf("no range metadata found for key %q", key)
+	}
+	// Cache every descriptor returned by the lookup, not just the one
+	// containing key, so that the ranges prefetched for sequential
+	// access don't require lookups of their own. If the cache was
+	// cleared during the lookup, the descriptors aren't cached at all.
 	rmc.rangeCacheMu.Lock()
-	for i := range rs {
-		rmc.rangeCache.Add(rangeCacheKey(engine.RangeMetadataLookupKey(&rs[i])), &rs[i])
+	if rmc.generation == generation {
+		for i := range rs {
+			rmc.rangeCache.Add(rangeCacheKey(engine.RangeMetadataLookupKey(&rs[i])), &rs[i])
+		}
 	}
 	rmc.rangeCacheMu.Unlock()
 	return &rs[0], nil
@@ -122,13 +311,43 @@ func (rmc *RangeMetadataCache) LookupRangeMetadata(key engine.Key) (*proto.Range
 // EvictCachedRangeMetadata will evict any cached metadata range descriptors for
 // the given key. It is intended that this method be called from a consumer of
 // RangeMetadataCache when the returned range metadata is discovered to be
-// stale.
-func (rmc *RangeMetadataCache) EvictCachedRangeMetadata(key engine.Key) {
+// stale or a request using it fails; cause classifies the eviction and
+// reason describes it in detail.
+func (rmc *RangeMetadataCache) EvictCachedRangeMetadata(key engine.Key, cause RangeCacheEvictionCause,
+	reason string) {
+	rmc.evictCachedRangeMetadata(key, false, cause, reason)
+}
+
+// EvictCachedRangeMetadataBefore is like EvictCachedRangeMetadata, but
+// evicts the metadata of the range containing the keys just before
+// the given key, as located by LookupRangeMetadataBefore.
+func (rmc *RangeMetadataCache) EvictCachedRangeMetadataBefore(key engine.Key, cause RangeCacheEvictionCause,
+	reason string) {
+	rmc.evictCachedRangeMetadata(key, true, cause, reason)
+}
+
+// evictCachedRangeMetadata implements EvictCachedRangeMetadata and, if
+// reverse is true, EvictCachedRangeMetadataBefore. Only the first
+// level of metadata is located in reverse; the metadata ranges above
+// it are those which a lookup of the key consults.
+func (rmc *RangeMetadataCache) evictCachedRangeMetadata(key engine.Key, reverse bool,
+	cause RangeCacheEvictionCause, reason string) {
+	evictKey := key
 	for {
-		k, _ := rmc.getCachedRangeMetadata(key)
+		var k rangeCacheKey
+		if reverse {
+			if rd := rmc.getCachedRangeMetadataBefore(key); rd != nil {
+				k = rangeCacheKey(engine.RangeMetadataLookupKey(rd))
+			}
+			reverse = false
+		} else {
+			k, _ = rmc.getCachedRangeMetadata(key)
+		}
 		if k != nil {
 			rmc.rangeCacheMu.Lock()
+			rmc.evictKey, rmc.evictCause, rmc.evictReason = evictKey, cause, reason
 			rmc.rangeCache.Del(k)
+			rmc.evictKey, rmc.evictReason = nil, ""
 			rmc.rangeCacheMu.Unlock()
 		}
 		// Retrieve the metadata range key for the next level of metadata, and
@@ -141,6 +360,24 @@ func (rmc *RangeMetadataCache) EvictCachedRangeMetadata(key engine.Key) {
 	}
 }
 
+// Clear evicts every cached range descriptor, invoking the eviction
+// hook, if any, for each. Descriptors read by lookups in progress are
+// not cached once they complete, as they may predate the clear.
+func (rmc *RangeMetadataCache) Clear() {
+	rmc.rangeCacheMu.Lock()
+	defer rmc.rangeCacheMu.Unlock()
+	rmc.generation++
+	var keys []interface{}
+	rmc.rangeCache.Do(func(k, v interface{}) {
+		keys = append(keys, k)
+	})
+	rmc.evictCause, rmc.evictReason = EvictionManual, "cache cleared"
+	for _, k := range keys {
+		rmc.rangeCache.Del(k)
+	}
+	rmc.evictReason = ""
+}
+
 // getCachedRangeMetadata is a helper function to retrieve the metadata
 // range which contains the given key, if present in the cache.
 func (rmc *RangeMetadataCache) getCachedRangeMetadata(key engine.Key) (
@@ -162,3 +399,24 @@ func (rmc *RangeMetadataCache) getCachedRangeMetadata(key engine.Key) (
 	}
 	return metaEndKey, rd
 }
+
+// getCachedRangeMetadataBefore is a helper function to retrieve the
+// metadata range which contains the keys just before the given key,
+// if present in the cache.
+func (rmc *RangeMetadataCache) getCachedRangeMetadataBefore(key engine.Key) *proto.RangeDescriptor {
+	metaKey := engine.RangeMetaKey(key)
+	rmc.rangeCacheMu.RLock()
+	defer rmc.rangeCacheMu.RUnlock()
+
+	// Ranges are cached by the metadata key of their end key, so the
+	// first at or after key's is the first whose end key isn't less.
+	_, v, ok := rmc.rangeCache.Ceil(rangeCacheKey(metaKey))
+	if !ok {
+		return nil
+	}
+	rd := v.(*proto.RangeDescriptor)
+	if bytes.Compare(rd.StartKey, key) >= 0 {
+		return nil
+	}
+	return rd
+}
@@ -24,12 +24,20 @@ import (
 	"code.google.com/p/biogo.store/llrb"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 type testMetadataDB struct {
 	data     llrb.Tree
 	cache    *RangeMetadataCache
 	hitCount int
+	// maxRanges is the number of descriptors returned per lookup;
+	// three if zero.
+	maxRanges int
+	// onLookup, if not nil, is invoked as each lookup completes.
+	onLookup func()
+	// lookupErr, if not nil, is returned by each lookup.
+	lookupErr error
 }
 
 type testMetadataNode struct {
@@ -42,12 +50,19 @@ func (a testMetadataNode) Compare(b llrb.Comparable) int {
 	return bytes.Compare(aKey, bKey)
 }
 
-func (db *testMetadataDB) getMetadata(key engine.Key) []proto.RangeDescriptor {
-	response := make([]proto.RangeDescriptor, 0, 3)
-	for i := 0; i < 3; i++ {
+func (db *testMetadataDB) getMetadata(key engine.Key, reverse bool) []proto.RangeDescriptor {
+	maxRanges := db.maxRanges
+	if maxRanges == 0 {
+		maxRanges = 3
+	}
+	response := make([]proto.RangeDescriptor, 0, maxRanges)
+	if !reverse {
+		key = engine.NextKey(key)
+	}
+	for i := 0; i < maxRanges; i++ {
 		v := db.data.Ceil(testMetadataNode{
 			&proto.RangeDescriptor{
-				EndKey: engine.NextKey(key),
+				EndKey: key,
 			},
 		})
 		if v == nil {
@@ -59,16 +74,22 @@ func (db *testMetadataDB) getMetadata(key engine.Key) []proto.RangeDescriptor {
 	return response
 }
 
-func (db *testMetadataDB) getRangeMetadata(key engine.Key) ([]proto.RangeDescriptor, error) {
+func (db *testMetadataDB) getRangeMetadata(key engine.Key, reverse bool, trace *Trace) ([]proto.RangeDescriptor, error) {
 	db.hitCount++
 	metadataKey := engine.RangeMetaKey(key)
 
 	// Recursively call into cache as the real DB would, terminating recursion
 	// when a meta1key is encountered.
 	if len(metadataKey) > 0 && !bytes.HasPrefix(metadataKey, engine.KeyMeta1Prefix) {
-		db.cache.LookupRangeMetadata(metadataKey)
+		db.cache.LookupRangeMetadata(metadataKey, trace)
+	}
+	if db.onLookup != nil {
+		db.onLookup()
 	}
-	return db.getMetadata(key), nil
+	if db.lookupErr != nil {
+		return nil, db.lookupErr
+	}
+	return db.getMetadata(key, reverse), nil
 }
 
 func (db *testMetadataDB) splitRange(t *testing.T, key engine.Key) {
@@ -119,7 +140,7 @@ func (db *testMetadataDB) assertHitCount(t *testing.T, expected int) {
 }
 
 func doLookup(t *testing.T, rc *RangeMetadataCache, key string) {
-	r, err := rc.LookupRangeMetadata(engine.Key(key))
+	r, err := rc.LookupRangeMetadata(engine.Key(key), nil)
 	if err != nil {
 		t.Fatalf("Unexpected error from LookupRangeMetadata: %s", err.Error())
 	}
@@ -176,9 +197,185 @@ func TestRangeCache(t *testing.T) {
 	db.assertHitCount(t, 0)
 
 	// Evict clears one level 1 and one level 2 cache
-	rangeCache.EvictCachedRangeMetadata(engine.Key("da"))
+	rangeCache.EvictCachedRangeMetadata(engine.Key("da"), EvictionStale, "test")
 	doLookup(t, rangeCache, "fa")
 	db.assertHitCount(t, 0)
 	doLookup(t, rangeCache, "da")
 	db.assertHitCount(t, 2)
 }
+
+// TestRangeCacheLookupBefore verifies that looking up the range
+// before a key finds the range ending at the key if it is a range
+// boundary, and the range containing it otherwise.
+func TestRangeCacheLookupBefore(t *testing.T) {
+	db := newTestMetadataDB()
+	db.splitRange(t, engine.Key("b"))
+	db.splitRange(t, engine.Key("c"))
+	rangeCache := NewRangeMetadataCache(db)
+	db.cache = rangeCache
+
+	for i, test := range []struct {
+		key, expStartKey, expEndKey engine.Key
+	}{
+		{engine.Key("c"), engine.Key("b"), engine.Key("c")},
+		{engine.Key("bb"), engine.Key("b"), engine.Key("c")},
+		{engine.Key("b"), engine.KeyMetaMax, engine.Key("b")},
+		{engine.KeyMax, engine.Key("c"), engine.KeyMax},
+	} {
+		// Look each key up twice, once missing and once hitting the cache.
+		for j := 0; j < 2; j++ {
+			r, err := rangeCache.LookupRangeMetadataBefore(test.key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(r.StartKey, test.expStartKey) || !bytes.Equal(r.EndKey, test.expEndKey) {
+				t.Errorf("%d.%d: expected range [%q, %q) before %q; got [%q, %q)",
+					i, j, test.expStartKey, test.expEndKey, test.key, r.StartKey, r.EndKey)
+			}
+		}
+	}
+}
+
+// TestRangeCacheDumpAndEvictionHook verifies that the cache contents
+// are dumped in key order and that explicit evictions are reported to
+// the eviction hook along with the key and reason.
+func TestRangeCacheDumpAndEvictionHook(t *testing.T) {
+	db := newTestMetadataDB()
+	db.splitRange(t, engine.Key("c"))
+	rangeCache := NewRangeMetadataCache(db)
+	db.cache = rangeCache
+	var evicted []*proto.RangeDescriptor
+	rangeCache.SetEvictionHook(func(key engine.Key, desc *proto.RangeDescriptor, cause RangeCacheEvictionCause,
+		reason string) {
+		if !bytes.Equal(key, engine.Key("d")) || cause != EvictionStale || reason != "stale" {
+			t.Errorf("unexpected eviction of %+v for key %q: %s", desc, key, reason)
+		}
+		evicted = append(evicted, desc)
+	})
+
+	doLookup(t, rangeCache, "a")
+	doLookup(t, rangeCache, "d")
+	descs := rangeCache.Dump()
+	if len(descs) == 0 {
+		t.Fatal("expected cached range descriptors")
+	}
+	for i := 1; i < len(descs); i++ {
+		if !engine.RangeMetadataLookupKey(&descs[i-1]).Less(engine.RangeMetadataLookupKey(&descs[i])) {
+			t.Errorf("expected descriptors in key order; got %+v", descs)
+		}
+	}
+
+	rangeCache.EvictCachedRangeMetadata(engine.Key("d"), EvictionStale, "stale")
+	if len(evicted) == 0 || !evicted[0].ContainsKey(engine.Key("d")) {
+		t.Errorf("expected eviction of range containing \"d\"; got %+v", evicted)
+	}
+	if len(rangeCache.Dump()) != len(descs)-len(evicted) {
+		t.Errorf("expected %d descriptors after eviction; got %+v", len(descs)-len(evicted), rangeCache.Dump())
+	}
+}
+
+// TestRangeCachePrefetch verifies that all of the descriptors
+// returned by a single lookup are cached, so that sequential access
+// across as many ranges as a lookup returns requires no further
+// lookups.
+func TestRangeCachePrefetch(t *testing.T) {
+	db := newTestMetadataDB()
+	db.maxRanges = rangeLookupMaxRanges
+	keys := "abcdefghijklmnopqrstuvwxyz"[:rangeLookupMaxRanges-1]
+	for _, char := range keys {
+		db.splitRange(t, engine.Key(string(char)))
+	}
+	rangeCache := NewRangeMetadataCache(db)
+	db.cache = rangeCache
+
+	// The first lookup requires one lookup of the meta1 range and one of
+	// the meta2 range; the remaining ranges are then served from the
+	// prefetched descriptors.
+	doLookup(t, rangeCache, "0")
+	db.assertHitCount(t, 2)
+	for _, char := range keys {
+		doLookup(t, rangeCache, string(char)+"a")
+	}
+	db.assertHitCount(t, 0)
+}
+
+// TestRangeCacheClear verifies that clearing the cache evicts every
+// descriptor and that descriptors read by a lookup in progress during
+// the clear are not cached.
+func TestRangeCacheClear(t *testing.T) {
+	db := newTestMetadataDB()
+	db.splitRange(t, engine.Key("c"))
+	rangeCache := NewRangeMetadataCache(db)
+	db.cache = rangeCache
+	evictions := 0
+	rangeCache.SetEvictionHook(func(key engine.Key, desc *proto.RangeDescriptor, cause RangeCacheEvictionCause,
+		reason string) {
+		if cause != EvictionManual || reason != "cache cleared" {
+			t.Errorf("unexpected eviction of %+v: %s", desc, reason)
+		}
+		evictions++
+	})
+
+	doLookup(t, rangeCache, "a")
+	doLookup(t, rangeCache, "d")
+	db.assertHitCount(t, 2)
+	cached := len(rangeCache.Dump())
+	rangeCache.Clear()
+	if len(rangeCache.Dump()) != 0 || evictions != cached {
+		t.Errorf("expected %d evictions and an empty cache; got %d evictions, %+v",
+			cached, evictions, rangeCache.Dump())
+	}
+	doLookup(t, rangeCache, "d")
+	db.assertHitCount(t, 2)
+
+	// Clear the cache while a lookup is in progress.
+	rangeCache.Clear()
+	db.onLookup = func() {
+		db.onLookup = nil
+		rangeCache.Clear()
+	}
+	doLookup(t, rangeCache, "a")
+	db.assertHitCount(t, 2)
+	if descs := rangeCache.Dump(); len(descs) != 0 {
+		t.Errorf("expected descriptors read before clear not to be cached; got %+v", descs)
+	}
+}
+
+// TestRangeCacheEvictions verifies that evictions are counted by cause
+// and the most recent are recorded, newest first.
+func TestRangeCacheEvictions(t *testing.T) {
+	db := newTestMetadataDB()
+	db.splitRange(t, engine.Key("c"))
+	rangeCache := NewRangeMetadataCache(db)
+	db.cache = rangeCache
+
+	doLookup(t, rangeCache, "a")
+	doLookup(t, rangeCache, "d")
+	rangeCache.EvictCachedRangeMetadata(engine.Key("a"), EvictionCause(&proto.RangeKeyMismatchError{}), "moved")
+	rangeCache.EvictCachedRangeMetadata(engine.Key("d"), EvictionCause(util.Errorf("unavailable")), "unavailable")
+	doLookup(t, rangeCache, "a")
+	remaining := len(rangeCache.Dump())
+	rangeCache.Clear()
+
+	stats := rangeCache.Evictions()
+	if stats.Counts["manual"] != int64(remaining) {
+		t.Errorf("expected %d manual evictions; got %+v", remaining, stats.Counts)
+	}
+	if stats.Counts["stale"] == 0 || stats.Counts["transient"] == 0 || stats.Counts["capacity"] != 0 {
+		t.Errorf("unexpected eviction counts %+v", stats.Counts)
+	}
+	var total int64
+	for _, count := range stats.Counts {
+		total += count
+	}
+	if int64(len(stats.Recent)) != total {
+		t.Fatalf("expected %d recent evictions; got %+v", total, stats.Recent)
+	}
+	first, last := stats.Recent[len(stats.Recent)-1], stats.Recent[0]
+	if first.Cause != EvictionStale || !bytes.Equal(first.Key, engine.Key("a")) || first.Reason != "moved" {
+		t.Errorf("unexpected first eviction %+v", first)
+	}
+	if last.Cause != EvictionManual || last.Key != nil {
+		t.Errorf("unexpected last eviction %+v", last)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// A ReplicaSelector determines the order in which the replicas of a
+// range are sent RPCs. RPCs are sent to the first replica and then,
+// on failure or timeout, to each of the others in turn.
+type ReplicaSelector interface {
+	// Order returns the replicas in order of preference, given the
+	// attributes of the local node.
+	Order(replicas []proto.Replica, local proto.Attributes) []proto.Replica
+}
+
+// A leaderRecorder is a ReplicaSelector which is informed of the
+// replica known to be the leader of its range.
+type leaderRecorder interface {
+	RecordLeader(leader proto.Replica)
+}
+
+// LocalitySelector orders replicas by the number of attributes they
+// share with the local node (e.g. datacenter and rack), most first.
+// Replicas sharing equally many attributes retain their order.
+type LocalitySelector struct{}
+
+// replicasByLocality sorts replicas by the number of attributes
+// shared with the local node.
+type replicasByLocality struct {
+	replicas []proto.Replica
+	shared   []int
+}
+
+func (r replicasByLocality) Len() int { return len(r.replicas) }
+func (r replicasByLocality) Swap(i, j int) {
+	r.replicas[i], r.replicas[j] = r.replicas[j], r.replicas[i]
+	r.shared[i], r.shared[j] = r.shared[j], r.shared[i]
+}
+func (r replicasByLocality) Less(i, j int) bool { return r.shared[i] > r.shared[j] }
+
+// Order implements the ReplicaSelector interface.
+func (LocalitySelector) Order(replicas []proto.Replica, local proto.Attributes) []proto.Replica {
+	localAttrs := map[string]struct{}{}
+	for _, attr := range local.Attrs {
+		localAttrs[attr] = struct{}{}
+	}
+	byLocality := replicasByLocality{
+		replicas: append([]proto.Replica(nil), replicas...),
+		shared:   make([]int, len(replicas)),
+	}
+	for i, replica := range replicas {
+		for _, attr := range replica.Attrs.Attrs {
+			if _, ok := localAttrs[attr]; ok {
+				byLocality.shared[i]++
+			}
+		}
+	}
+	sort.Stable(byLocality)
+	return byLocality.replicas
+}
+
+// LeaderSelector orders the replica last known to be the leader of
+// each range first, as only the leader can serve commands; the other
+// replicas follow in the order determined by the next selector. The
+// leader is learned from successful replies and from the leader
+// reported with NotLeaderErrors.
+type LeaderSelector struct {
+	next ReplicaSelector
+
+	mu      sync.Mutex              // Protects leaders
+	leaders map[int64]proto.Replica // Keyed by range ID
+}
+
+// NewLeaderSelector returns a LeaderSelector which orders the
+// replicas other than the leader using next.
+func NewLeaderSelector(next ReplicaSelector) *LeaderSelector {
+	return &LeaderSelector{
+		next:    next,
+		leaders: map[int64]proto.Replica{},
+	}
+}
+
+// RecordLeader records the replica known to be the leader of its
+// range.
+func (ls *LeaderSelector) RecordLeader(leader proto.Replica) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.leaders[leader.RangeID] = leader
+}
+
+// Order implements the ReplicaSelector interface.
+func (ls *LeaderSelector) Order(replicas []proto.Replica, local proto.Attributes) []proto.Replica {
+	ordered := append([]proto.Replica(nil), ls.next.Order(replicas, local)...)
+	if len(ordered) == 0 {
+		return ordered
+	}
+	ls.mu.Lock()
+	leader, ok := ls.leaders[ordered[0].RangeID]
+	ls.mu.Unlock()
+	if !ok {
+		return ordered
+	}
+	for i, replica := range ordered {
+		if replica.NodeID == leader.NodeID && replica.StoreID == leader.StoreID {
+			copy(ordered[1:i+1], ordered[:i])
+			ordered[0] = replica
+			break
+		}
+	}
+	return ordered
+}
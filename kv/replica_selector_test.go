@@ -0,0 +1,137 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+func makeReplicas(attrs ...[]string) []proto.Replica {
+	var replicas []proto.Replica
+	for i, a := range attrs {
+		replicas = append(replicas, proto.Replica{
+			NodeID:  int32(i + 1),
+			StoreID: int32(i + 1),
+			RangeID: 1,
+			Attrs:   proto.Attributes{Attrs: a},
+		})
+	}
+	return replicas
+}
+
+func nodeIDs(replicas []proto.Replica) []int32 {
+	var ids []int32
+	for _, r := range replicas {
+		ids = append(ids, r.NodeID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestLocalitySelector verifies that replicas sharing more attributes
+// with the local node are preferred, and that ties retain their order.
+func TestLocalitySelector(t *testing.T) {
+	replicas := makeReplicas(
+		[]string{"us-east", "rack1", "ssd"},
+		[]string{"us-west", "rack1", "ssd"},
+		[]string{"us-west", "rack2", "hdd"},
+		[]string{"us-east", "rack2", "hdd"},
+	)
+	testCases := []struct {
+		local  []string
+		expIDs []int32
+	}{
+		{nil, []int32{1, 2, 3, 4}},
+		{[]string{"us-west"}, []int32{2, 3, 1, 4}},
+		{[]string{"us-west", "rack2"}, []int32{3, 2, 4, 1}},
+		{[]string{"us-east", "rack2", "hdd"}, []int32{4, 3, 1, 2}},
+	}
+	for i, test := range testCases {
+		ordered := LocalitySelector{}.Order(replicas, proto.Attributes{Attrs: test.local})
+		if ids := nodeIDs(ordered); !equalIDs(ids, test.expIDs) {
+			t.Errorf("%d: expected order %v; got %v", i, test.expIDs, ids)
+		}
+	}
+	if ids := nodeIDs(replicas); !equalIDs(ids, []int32{1, 2, 3, 4}) {
+		t.Errorf("expected replicas to be unmodified; got %v", ids)
+	}
+}
+
+// TestLeaderSelector verifies that the last known leader of a range
+// is preferred over the order of the next selector.
+func TestLeaderSelector(t *testing.T) {
+	replicas := makeReplicas([]string{"a"}, []string{"b"}, []string{"c"})
+	local := proto.Attributes{Attrs: []string{"b"}}
+	ls := NewLeaderSelector(LocalitySelector{})
+	if ids := nodeIDs(ls.Order(replicas, local)); !equalIDs(ids, []int32{2, 1, 3}) {
+		t.Errorf("expected locality order without a known leader; got %v", ids)
+	}
+	ls.RecordLeader(replicas[2])
+	if ids := nodeIDs(ls.Order(replicas, local)); !equalIDs(ids, []int32{3, 2, 1}) {
+		t.Errorf("expected leader first; got %v", ids)
+	}
+	// The leader of another range doesn't affect the order.
+	other := replicas[0]
+	other.RangeID = 2
+	ls.RecordLeader(other)
+	if ids := nodeIDs(ls.Order(replicas, local)); !equalIDs(ids, []int32{3, 2, 1}) {
+		t.Errorf("expected leader first; got %v", ids)
+	}
+	if ids := nodeIDs(replicas); !equalIDs(ids, []int32{1, 2, 3}) {
+		t.Errorf("expected replicas to be unmodified; got %v", ids)
+	}
+}
+
+// TestDistKVRecordLeader verifies that replies from replicas inform
+// the replica selector of range leaders.
+func TestDistKVRecordLeader(t *testing.T) {
+	ls := NewLeaderSelector(LocalitySelector{})
+	kv := &DistKV{selector: ls}
+	replicas := makeReplicas(nil, nil, nil)
+
+	// A NotLeaderError naming the leader records it.
+	reply := &proto.GetResponse{}
+	reply.Header().SetGoError(&proto.NotLeaderError{Leader: replicas[1]})
+	kv.recordLeader(replicas[0], reply)
+	if ids := nodeIDs(ls.Order(replicas, proto.Attributes{})); ids[0] != 2 {
+		t.Errorf("expected node 2 first; got %v", ids)
+	}
+	// A successful reply records the replica which served it.
+	kv.recordLeader(replicas[2], &proto.GetResponse{})
+	if ids := nodeIDs(ls.Order(replicas, proto.Attributes{})); ids[0] != 3 {
+		t.Errorf("expected node 3 first; got %v", ids)
+	}
+	// A NotLeaderError without a leader records nothing.
+	reply = &proto.GetResponse{}
+	reply.Header().SetGoError(&proto.NotLeaderError{})
+	kv.recordLeader(replicas[0], reply)
+	if ids := nodeIDs(ls.Order(replicas, proto.Attributes{})); ids[0] != 3 {
+		t.Errorf("expected node 3 first; got %v", ids)
+	}
+}
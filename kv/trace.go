@@ -0,0 +1,90 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Span records the start time and duration of a single step in
+// the execution of a traced command, such as a range metadata lookup
+// or an RPC attempt.
+type Span struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+}
+
+// A Trace collects the spans recorded while routing a single command
+// through range lookups and RPCs to replicas. The trace ID is sent in
+// the header of each request issued on the command's behalf so that
+// the receiving nodes can continue the trace.
+type Trace struct {
+	ID int64
+
+	mu    sync.Mutex // Protects spans
+	spans []Span
+}
+
+// newTrace creates a new trace. If id is zero, a random non-zero ID
+// is chosen.
+func newTrace(id int64) *Trace {
+	for id == 0 {
+		id = rand.Int63()
+	}
+	return &Trace{ID: id}
+}
+
+// Epoch starts a new span with the given name and returns a function
+// which, when invoked, ends the span and adds it to the trace. It is
+// safe to invoke Epoch on a nil trace.
+func (t *Trace) Epoch(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.spans = append(t.spans, Span{Name: name, Start: start, Duration: time.Since(start)})
+	}
+}
+
+// Spans returns a copy of the spans recorded so far, in the order
+// in which they ended.
+func (t *Trace) Spans() []Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Span(nil), t.spans...)
+}
+
+// String formats the trace, one span per line.
+func (t *Trace) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "trace %d:", t.ID)
+	for _, s := range t.Spans() {
+		fmt.Fprintf(&buf, "\n  %s: %s", s.Name, s.Duration)
+	}
+	return buf.String()
+}
+
+// A TraceSink is invoked with the trace of each command executed via
+// DistKV once the command completes.
+type TraceSink func(method string, trace *Trace)
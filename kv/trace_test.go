@@ -0,0 +1,50 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestTraceEpoch verifies that spans are recorded in the order in
+// which they end and that a nil trace ignores spans.
+func TestTraceEpoch(t *testing.T) {
+	var nilTrace *Trace
+	nilTrace.Epoch("ignored")()
+
+	trace := newTrace(0)
+	if trace.ID == 0 {
+		t.Error("expected a non-zero trace ID")
+	}
+	if id := newTrace(5).ID; id != 5 {
+		t.Errorf("expected trace ID 5; got %d", id)
+	}
+	endOuter := trace.Epoch("outer")
+	trace.Epoch("inner")()
+	endOuter()
+
+	spans := trace.Spans()
+	if len(spans) != 2 || spans[0].Name != "inner" || spans[1].Name != "outer" {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+	if spans[1].Duration < spans[0].Duration {
+		t.Errorf("expected outer span to last at least as long as inner span: %+v", spans)
+	}
+	if s := trace.String(); !strings.Contains(s, "inner") || !strings.Contains(s, "outer") {
+		t.Errorf("expected both spans in trace string; got %q", s)
+	}
+}
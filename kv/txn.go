@@ -0,0 +1,119 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+
+	gogoproto "code.google.com/p/gogoprotobuf/proto"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A Txn is a client-side handle to an ongoing transaction. Commands
+// executed through the handle carry the transaction in their request
+// header and are tracked by the coordinator of the underlying DB,
+// which heartbeats the transaction record for as long as the handle
+// remains in use and resolves the transaction's write intents on
+// Commit or Abort.
+//
+// If the coordinator fails, heartbeats cease and the transaction
+// record expires (see storage.TxnExpiration). Expired transactions
+// can no longer be committed; their intents are aborted instead.
+type Txn struct {
+	db   *DB
+	user string
+
+	mu   sync.Mutex // Protects txn and done
+	txn  *proto.Transaction
+	done bool
+}
+
+// newTxn creates a new transaction using the parameters specified in
+// args. Commands are sent via the supplied DB.
+func newTxn(db *DB, args *proto.BeginTransactionRequest) *Txn {
+	return &Txn{
+		db:   db,
+		user: args.User,
+		txn:  storage.NewTransaction(args.Key, args.UserPriority, args.Isolation, db.coordinator.clock),
+	}
+}
+
+// Transaction returns a copy of the current transaction proto.
+func (t *Txn) Transaction() *proto.Transaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return gogoproto.Clone(t.txn).(*proto.Transaction)
+}
+
+// ExecuteCmd sets the transaction in the request header and executes
+// the command. Requests which don't specify a timestamp are executed
+// at the transaction's timestamp. The reply is sent on replyChan.
+func (t *Txn) ExecuteCmd(method string, args proto.Request, replyChan interface{}) {
+	t.mu.Lock()
+	done := t.done
+	t.mu.Unlock()
+	if done {
+		sendErrorReply(util.Errorf("transaction %q has already been ended", t.txn.ID), replyChan)
+		return
+	}
+	header := args.Header()
+	header.Txn = t.Transaction()
+	if header.Timestamp.WallTime == 0 && header.Timestamp.Logical == 0 {
+		header.Timestamp = header.Txn.Timestamp
+	}
+	t.db.executeCmd(method, args, replyChan)
+}
+
+// Commit commits the transaction. On success, the coordinator
+// resolves all write intents written through this handle.
+func (t *Txn) Commit() error {
+	return t.end(true)
+}
+
+// Abort aborts the transaction. The coordinator rolls back all write
+// intents written through this handle.
+func (t *Txn) Abort() error {
+	return t.end(false)
+}
+
+// end sends an EndTransaction command for the transaction and updates
+// the transaction proto with the reply.
+func (t *Txn) end(commit bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return util.Errorf("transaction %q has already been ended", t.txn.ID)
+	}
+	reply := <-t.db.EndTransaction(&proto.EndTransactionRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:       t.txn.ID,
+			User:      t.user,
+			Timestamp: t.txn.Timestamp,
+			Txn:       t.txn,
+		},
+		Commit: commit,
+	})
+	if reply.Txn != nil {
+		t.txn = reply.Txn
+	}
+	if reply.Error != nil {
+		return reply.GoError()
+	}
+	t.done = true
+	return nil
+}
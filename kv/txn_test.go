@@ -0,0 +1,104 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// newTestTxn begins a new transaction with the given base key.
+func newTestTxn(db *DB, key engine.Key) *Txn {
+	return newTxn(db, &proto.BeginTransactionRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  key,
+			User: storage.UserRoot,
+		},
+		Isolation: proto.SERIALIZABLE,
+	})
+}
+
+// txnPut writes a value for key through the transaction.
+func txnPut(t *testing.T, txn *Txn, key engine.Key, value []byte) {
+	replyChan := make(chan *proto.PutResponse, 1)
+	txn.ExecuteCmd(storage.Put, &proto.PutRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  key,
+			User: storage.UserRoot,
+		},
+		Value: proto.Value{Bytes: value},
+	}, replyChan)
+	if reply := <-replyChan; reply.Error != nil {
+		t.Fatal(reply.GoError())
+	}
+}
+
+// TestTxnCommit verifies that committing a transaction resolves its
+// write intents, making the written values visible.
+func TestTxnCommit(t *testing.T) {
+	db, _, _ := createTestDB(t)
+	defer db.Close()
+
+	key := engine.Key("a")
+	txn := newTestTxn(db, key)
+	txnPut(t, txn, key, []byte("value"))
+
+	// A non-transactional read encounters the write intent.
+	if gr := <-db.Get(&proto.GetRequest{RequestHeader: proto.RequestHeader{Key: key}}); gr.Error == nil {
+		t.Fatal("expected write intent error reading uncommitted value")
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if txn.Transaction().Status != proto.COMMITTED {
+		t.Errorf("expected committed transaction; got %s", txn.Transaction().Status)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		gr := <-db.Get(&proto.GetRequest{RequestHeader: proto.RequestHeader{Key: key}})
+		return gr.Error == nil && gr.Value != nil && bytes.Equal(gr.Value.Bytes, []byte("value"))
+	}, 50*time.Millisecond); err != nil {
+		t.Error("expected committed value to become visible")
+	}
+	if err := txn.Commit(); err == nil {
+		t.Error("expected error committing an ended transaction")
+	}
+}
+
+// TestTxnAbort verifies that aborting a transaction rolls back its
+// write intents.
+func TestTxnAbort(t *testing.T) {
+	db, _, _ := createTestDB(t)
+	defer db.Close()
+
+	key := engine.Key("a")
+	txn := newTestTxn(db, key)
+	txnPut(t, txn, key, []byte("value"))
+	if err := txn.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		gr := <-db.Get(&proto.GetRequest{RequestHeader: proto.RequestHeader{Key: key}})
+		return gr.Error == nil && gr.Value == nil
+	}, 50*time.Millisecond); err != nil {
+		t.Error("expected aborted value to be removed")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import "github.com/cockroachdb/cockroach/util/log"
+
+// StateMachine is implemented by applications which maintain a replicated state machine.
+// If a StateMachine is given in the Config, committed commands are passed to Apply instead
+// of being broadcast as EventCommandCommitted.
+type StateMachine interface {
+	// Apply applies a committed command to the state machine.  Commands are applied in log
+	// order for each group.  The log index is given so that applications can detect (and
+	// ignore) commands which they have already applied, e.g. before a restart.  Apply is
+	// invoked from a dedicated goroutine; it must not call back into MultiRaft.
+	Apply(groupID GroupID, index int, command []byte)
+}
+
+// applyRequest is a batch of committed entries for a group, along with the channels of
+// any barriers which are resolved once the entries have been applied.
+type applyRequest struct {
+	groupID  GroupID
+	entries  []*LogEntry
+	barriers []chan error
+}
+
+// applyTask manages a goroutine that applies committed commands to a StateMachine.
+type applyTask struct {
+	stateMachine StateMachine
+	stopper      chan struct{}
+
+	// Requests are applied in the order in which they are written to 'in'.
+	in chan *applyRequest
+}
+
+// newApplyTask creates an applyTask.  The caller should start the task after creating it.
+func newApplyTask(stateMachine StateMachine) *applyTask {
+	return &applyTask{
+		stateMachine: stateMachine,
+		stopper:      make(chan struct{}),
+		in:           make(chan *applyRequest, 100),
+	}
+}
+
+// start runs the apply loop.  Blocks until stopped, so should be run in a goroutine.
+func (a *applyTask) start() {
+	for {
+		var request *applyRequest
+		select {
+		case <-a.stopper:
+			return
+		case request = <-a.in:
+		}
+		for _, entry := range request.entries {
+			log.V(6).Infof("applying entry %v to group %v", entry.Index, request.groupID)
+			a.stateMachine.Apply(request.groupID, entry.Index, entry.Payload)
+		}
+		for _, ch := range request.barriers {
+			ch <- nil
+		}
+	}
+}
+
+// stop the running task.
+func (a *applyTask) stop() {
+	close(a.stopper)
+}
@@ -0,0 +1,137 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import "github.com/cockroachdb/cockroach/util"
+
+// GroupStatus describes the replication state of a group on this node, for debugging
+// groups whose commit index is stuck.  It accompanies the log entries returned by
+// DumpLog.
+type GroupStatus struct {
+	Role               Role
+	Term               int
+	CommitIndex        int
+	FirstLogIndex      int
+	LastLogIndex       int
+	PersistedLastIndex int
+	// NextIndex and MatchIndex hold the leader's view of each follower's log; they are
+	// empty unless this node is the leader.
+	NextIndex  map[NodeID]int
+	MatchIndex map[NodeID]int
+}
+
+// dumpLogOp requests the persisted log entries of a group from first to last inclusive.
+type dumpLogOp struct {
+	groupID     GroupID
+	first, last int
+	entries     []*LogEntry
+	ch          chan error
+}
+
+// groupStatusOp requests a snapshot of a group's replication state.
+type groupStatusOp struct {
+	groupID GroupID
+	ch      chan *GroupStatus
+}
+
+// DumpLog returns the persisted log entries of a group with indices from from to to
+// inclusive.  Entries beyond the end of the persisted log are omitted; a LogCompactedError
+// is returned if from is below the first index of the log.  The log is read
+// on the state goroutine, so it is consistent with the group's state at the time.
+func (m *MultiRaft) DumpLog(groupID GroupID, from, to int) ([]*LogEntry, error) {
+	op := &dumpLogOp{groupID: groupID, first: from, last: to, ch: make(chan error, 1)}
+	m.ops <- op
+	if err := <-op.ch; err != nil {
+		return nil, err
+	}
+	return op.entries, nil
+}
+
+// GroupStatus returns a snapshot of a group's replication state, or nil if this node
+// is not a member of the group.
+func (m *MultiRaft) GroupStatus(groupID GroupID) *GroupStatus {
+	op := &groupStatusOp{groupID, make(chan *GroupStatus, 1)}
+	m.ops <- op
+	return <-op.ch
+}
+
+// dumpLog responds to a dumpLogOp by reading the requested entries from storage.
+func (s *state) dumpLog(op *dumpLogOp) {
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
+	if op.first < 1 {
+		op.ch <- util.Errorf("invalid first log index %d", op.first)
+		return
+	}
+	if op.first < g.firstLogIndex {
+		op.ch <- &LogCompactedError{g.groupID, op.first, g.firstLogIndex}
+		return
+	}
+	last := op.last
+	if last > g.persistedLastIndex {
+		last = g.persistedLastIndex
+	}
+	if op.first > last {
+		op.ch <- nil
+		return
+	}
+	entries := make(chan *LogEntryState, 100)
+	go s.Storage.GetLogEntries(g.groupID, op.first, last, entries)
+	var err error
+	for entry := range entries {
+		if entry.Error != nil {
+			err = entry.Error
+			continue
+		}
+		e := entry.Entry
+		op.entries = append(op.entries, &e)
+	}
+	if err != nil {
+		op.entries = nil
+	}
+	op.ch <- err
+}
+
+// groupStatus responds to a groupStatusOp with a copy of the group's state.
+func (s *state) groupStatus(op *groupStatusOp) {
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- nil
+		return
+	}
+	status := &GroupStatus{
+		Role:               g.role,
+		Term:               g.electionState.CurrentTerm,
+		CommitIndex:        g.commitIndex,
+		FirstLogIndex:      g.firstLogIndex,
+		LastLogIndex:       g.lastLogIndex,
+		PersistedLastIndex: g.persistedLastIndex,
+		NextIndex:          map[NodeID]int{},
+		MatchIndex:         map[NodeID]int{},
+	}
+	if g.role == RoleLeader {
+		for id, index := range g.nextIndex {
+			status.NextIndex[id] = index
+		}
+		for id, index := range g.matchIndex {
+			status.MatchIndex[id] = index
+		}
+	}
+	op.ch <- status
+}
@@ -24,7 +24,60 @@ type EventLeaderElection struct {
 	NodeID  NodeID
 }
 
-// An EventCommandCommitted is broadcast whenever a command has been committed.
+// An EventLeadershipLost is broadcast when a node stops leading a group by calling
+// StepDown.
+type EventLeadershipLost struct {
+	GroupID GroupID
+	NodeID  NodeID
+}
+
+// An EventCommandCommitted is broadcast whenever a command has been committed, unless
+// the application has configured a StateMachine to apply commands instead.
 type EventCommandCommitted struct {
+	GroupID GroupID
+	// Index is the command's position in the group's log.
+	Index   int
 	Command []byte
 }
+
+// An EventMembershipChanged is broadcast once for each committed change to a group's
+// membership, with the membership resulting from the change.
+type EventMembershipChanged struct {
+	GroupID GroupID
+	// Index is the membership change's position in the group's log.
+	Index     int
+	Members   []NodeID
+	Observers []NodeID
+}
+
+// An EventCaughtUp is broadcast by a follower or observer when its commit index first
+// reaches the leader's, i.e. it has replayed the backlog of committed entries, and again
+// each time it catches up after an EventFellBehind.  Applications may use it to decide
+// when a replica can serve reads.  If a StateMachine is configured, the entries through
+// Index may not yet have been applied when the event is received.
+type EventCaughtUp struct {
+	GroupID GroupID
+	// Index is the commit index which reached the leader's.
+	Index int
+}
+
+// An EventFellBehind is broadcast by a follower or observer which had caught up when the
+// leader's commit index exceeds its own by more than the configured FellBehindThreshold.
+type EventFellBehind struct {
+	GroupID GroupID
+	// Index is the node's commit index.
+	Index int
+	// LeaderCommitIndex is the leader's commit index, as last reported by the leader.
+	LeaderCommitIndex int
+}
+
+// An EventSnapshotNeeded is broadcast by a group's leader when a node's log ends before
+// the first index of the leader's log, as the entries the node is missing have been
+// compacted.  The application must bring the node up to date with a snapshot of its
+// state as of FirstIndex-1 or later.
+type EventSnapshotNeeded struct {
+	GroupID GroupID
+	NodeID  NodeID
+	// FirstIndex is the index of the first entry remaining in the leader's log.
+	FirstIndex int
+}
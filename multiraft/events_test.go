@@ -21,8 +21,13 @@ package multiraft
 // channels for ease of testing.  It is not suitable for non-test use because
 // unconsumed channels can become backlogged and block.
 type eventDemux struct {
-	LeaderElection   chan *EventLeaderElection
-	CommandCommitted chan *EventCommandCommitted
+	LeaderElection    chan *EventLeaderElection
+	LeadershipLost    chan *EventLeadershipLost
+	CommandCommitted  chan *EventCommandCommitted
+	MembershipChanged chan *EventMembershipChanged
+	SnapshotNeeded    chan *EventSnapshotNeeded
+	CaughtUp          chan *EventCaughtUp
+	FellBehind        chan *EventFellBehind
 
 	events  <-chan interface{}
 	stopper chan struct{}
@@ -31,7 +36,12 @@ type eventDemux struct {
 func newEventDemux(events <-chan interface{}) *eventDemux {
 	return &eventDemux{
 		make(chan *EventLeaderElection, 1000),
+		make(chan *EventLeadershipLost, 1000),
 		make(chan *EventCommandCommitted, 1000),
+		make(chan *EventMembershipChanged, 1000),
+		make(chan *EventSnapshotNeeded, 1000),
+		make(chan *EventCaughtUp, 1000),
+		make(chan *EventFellBehind, 1000),
 		events,
 		make(chan struct{}),
 	}
@@ -46,8 +56,23 @@ func (e *eventDemux) start() {
 				case *EventLeaderElection:
 					e.LeaderElection <- event
 
+				case *EventLeadershipLost:
+					e.LeadershipLost <- event
+
 				case *EventCommandCommitted:
 					e.CommandCommitted <- event
+
+				case *EventMembershipChanged:
+					e.MembershipChanged <- event
+
+				case *EventSnapshotNeeded:
+					e.SnapshotNeeded <- event
+
+				case *EventCaughtUp:
+					e.CaughtUp <- event
+
+				case *EventFellBehind:
+					e.FellBehind <- event
 				}
 
 			case <-e.stopper:
@@ -0,0 +1,508 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import (
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// nodePair is a directed link between two nodes.
+type nodePair struct {
+	from, to NodeID
+}
+
+// FaultyTransport wraps a Transport and injects network faults into the requests
+// sent through it: requests may be dropped, delayed, or held and later delivered
+// out of order.  Responses are never affected except as a result of their
+// request being delayed or held.  Dropped requests are never answered, as if
+// lost by the network.
+type FaultyTransport struct {
+	Transport
+
+	mu      sync.Mutex
+	dropped map[nodePair]bool
+	delay   time.Duration
+	holding bool
+	held    []func()
+	drops   int
+}
+
+// Assert implementation of the Transport interface.
+var _ Transport = &FaultyTransport{}
+
+// NewFaultyTransport creates a FaultyTransport which passes requests through to
+// transport until faults are injected.
+func NewFaultyTransport(transport Transport) *FaultyTransport {
+	return &FaultyTransport{
+		Transport: transport,
+		dropped:   map[nodePair]bool{},
+	}
+}
+
+// Connect implements the Transport interface.
+func (f *FaultyTransport) Connect(id NodeID) (ClientInterface, error) {
+	conn, err := f.Transport.Connect(id)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyClient{conn, f}, nil
+}
+
+// Drop causes requests sent from one node to another to be dropped.
+func (f *FaultyTransport) Drop(from, to NodeID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropped[nodePair{from, to}] = true
+}
+
+// Partition drops all requests between node and each of the others, in both
+// directions.
+func (f *FaultyTransport) Partition(node NodeID, others ...NodeID) {
+	for _, other := range others {
+		f.Drop(node, other)
+		f.Drop(other, node)
+	}
+}
+
+// Heal undoes the effect of all previous calls to Drop and Partition.
+func (f *FaultyTransport) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropped = map[nodePair]bool{}
+}
+
+// Drops returns the number of requests dropped so far.
+func (f *FaultyTransport) Drops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.drops
+}
+
+// SetDelay causes each request to be sent only after the given delay.  A zero
+// delay sends requests immediately.
+func (f *FaultyTransport) SetDelay(delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delay = delay
+}
+
+// Hold causes requests to be held until Release is called.
+func (f *FaultyTransport) Hold() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.holding = true
+}
+
+// Release sends all held requests, in the order they were sent or, if reverse
+// is true, in the opposite order, and stops holding new requests.
+func (f *FaultyTransport) Release(reverse bool) {
+	f.mu.Lock()
+	held := f.held
+	f.held = nil
+	f.holding = false
+	f.mu.Unlock()
+	for i := range held {
+		if reverse {
+			i = len(held) - 1 - i
+		}
+		held[i]()
+	}
+}
+
+// requestHeader returns the header of a raft request, or nil if args is not a
+// raft request.
+func requestHeader(args interface{}) *RequestHeader {
+	switch req := args.(type) {
+	case *RequestVoteRequest:
+		return &req.RequestHeader
+	case *AppendEntriesRequest:
+		return &req.RequestHeader
+	}
+	return nil
+}
+
+// faultyClient is the ClientInterface returned by FaultyTransport.Connect.
+type faultyClient struct {
+	conn      ClientInterface
+	transport *FaultyTransport
+}
+
+// Go implements the ClientInterface interface.
+func (c *faultyClient) Go(serviceMethod string, args interface{}, reply interface{},
+	done chan *rpc.Call) *rpc.Call {
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	send := func() { c.conn.Go(serviceMethod, args, reply, done) }
+
+	f := c.transport
+	f.mu.Lock()
+	if header := requestHeader(args); header != nil &&
+		f.dropped[nodePair{header.SrcNode, header.DestNode}] {
+		f.drops++
+		f.mu.Unlock()
+		return call
+	}
+	if delay := f.delay; delay > 0 {
+		immediate := send
+		send = func() { time.AfterFunc(delay, immediate) }
+	}
+	if f.holding {
+		f.held = append(f.held, send)
+		f.mu.Unlock()
+		return call
+	}
+	f.mu.Unlock()
+	send()
+	return call
+}
+
+// Close implements the ClientInterface interface.
+func (c *faultyClient) Close() error {
+	return c.conn.Close()
+}
+
+// FaultyStorage wraps a Storage and injects write failures.  Reads are always
+// passed through.
+type FaultyStorage struct {
+	storage Storage
+
+	mu sync.Mutex
+	// err, if non-nil, is returned by all writes, which are not applied.
+	err error
+	// budget is the number of writes which may be applied before the storage
+	// crashes, or -1 if no crash is pending.  Each log entry counts as a write.
+	budget  int
+	crashed bool
+}
+
+// Assert implementation of the Storage interface.
+var _ Storage = &FaultyStorage{}
+
+// NewFaultyStorage creates a FaultyStorage which passes writes through to
+// storage until faults are injected.
+func NewFaultyStorage(storage Storage) *FaultyStorage {
+	return &FaultyStorage{storage: storage, budget: -1}
+}
+
+// FailWrites causes all writes to fail with err without being applied.  A nil
+// err allows writes to succeed again.
+func (f *FaultyStorage) FailWrites(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// CrashAfter causes the storage to crash once n more writes have been applied,
+// where each log entry counts as a write.  A call to AppendLogEntries which
+// exceeds the limit applies only the entries within it, simulating a crash in
+// the middle of a batch.  Once crashed, all writes fail until Recover is called.
+func (f *FaultyStorage) CrashAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.budget = n
+}
+
+// Crashed returns whether the storage has crashed.
+func (f *FaultyStorage) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// Recover undoes the effect of a crash, allowing writes to succeed again.
+func (f *FaultyStorage) Recover() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashed = false
+	f.budget = -1
+}
+
+// allow returns how many of the next n writes may be applied, and an error if
+// not all of them may be.  Must be called with the mutex held.
+func (f *FaultyStorage) allow(n int) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.crashed {
+		return 0, util.Errorf("storage has crashed")
+	}
+	if f.budget < 0 || n <= f.budget {
+		if f.budget >= 0 {
+			f.budget -= n
+		}
+		return n, nil
+	}
+	allowed := f.budget
+	f.budget = -1
+	f.crashed = true
+	return allowed, util.Errorf("storage crashed after %d of %d writes", allowed, n)
+}
+
+// LoadGroups implements the Storage interface.
+func (f *FaultyStorage) LoadGroups() <-chan *GroupPersistentState {
+	return f.storage.LoadGroups()
+}
+
+// SetGroupElectionState implements the Storage interface.
+func (f *FaultyStorage) SetGroupElectionState(groupID GroupID,
+	electionState *GroupElectionState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.allow(1); err != nil {
+		return err
+	}
+	return f.storage.SetGroupElectionState(groupID, electionState)
+}
+
+// SetGroupMembers implements the Storage interface.
+func (f *FaultyStorage) SetGroupMembers(groupID GroupID, members *GroupMembers) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.allow(1); err != nil {
+		return err
+	}
+	return f.storage.SetGroupMembers(groupID, members)
+}
+
+// AppendLogEntries implements the Storage interface.
+func (f *FaultyStorage) AppendLogEntries(groupID GroupID, entries []*LogEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	allowed, err := f.allow(len(entries))
+	if allowed > 0 {
+		if appendErr := f.storage.AppendLogEntries(groupID, entries[:allowed]); appendErr != nil {
+			return appendErr
+		}
+	}
+	return err
+}
+
+// TruncateLog implements the Storage interface.
+func (f *FaultyStorage) TruncateLog(groupID GroupID, lastIndex int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.allow(1); err != nil {
+		return err
+	}
+	return f.storage.TruncateLog(groupID, lastIndex)
+}
+
+// CompactLog implements the Storage interface.
+func (f *FaultyStorage) CompactLog(groupID GroupID, firstIndex int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.allow(1); err != nil {
+		return err
+	}
+	return f.storage.CompactLog(groupID, firstIndex)
+}
+
+// GetLogEntry implements the Storage interface.
+func (f *FaultyStorage) GetLogEntry(groupID GroupID, index int) (*LogEntry, error) {
+	return f.storage.GetLogEntry(groupID, index)
+}
+
+// GetLogEntries implements the Storage interface.
+func (f *FaultyStorage) GetLogEntries(groupID GroupID, firstIndex, lastIndex int,
+	ch chan<- *LogEntryState) {
+	f.storage.GetLogEntries(groupID, firstIndex, lastIndex, ch)
+}
+
+// recordingClient is a ClientInterface which records the requests sent through it.
+type recordingClient struct {
+	mu    sync.Mutex
+	calls []*rpc.Call
+	sent  chan struct{}
+}
+
+func (r *recordingClient) Go(serviceMethod string, args interface{}, reply interface{},
+	done chan *rpc.Call) *rpc.Call {
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.mu.Unlock()
+	r.sent <- struct{}{}
+	return call
+}
+
+func (r *recordingClient) Close() error {
+	return nil
+}
+
+// recordingTransport is a Transport whose clients are all the same recordingClient.
+type recordingTransport struct {
+	client *recordingClient
+}
+
+func (r *recordingTransport) Listen(id NodeID, server ServerInterface) error { return nil }
+func (r *recordingTransport) Stop(id NodeID)                                 {}
+func (r *recordingTransport) Connect(id NodeID) (ClientInterface, error)     { return r.client, nil }
+
+func TestFaultyTransport(t *testing.T) {
+	client := &recordingClient{sent: make(chan struct{}, 10)}
+	transport := NewFaultyTransport(&recordingTransport{client})
+	conn, err := transport.Connect(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(term int) {
+		req := &AppendEntriesRequest{RequestHeader: RequestHeader{1, 2}, Term: term}
+		conn.Go(appendEntriesName, req, &AppendEntriesResponse{}, nil)
+	}
+	terms := func() []int {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		var terms []int
+		for _, call := range client.calls {
+			terms = append(terms, call.Args.(*AppendEntriesRequest).Term)
+		}
+		return terms
+	}
+
+	// Requests are dropped only in the specified direction.
+	transport.Partition(3, 1)
+	transport.Drop(1, 2)
+	send(1)
+	transport.Drop(2, 1)
+	transport.Heal()
+	send(2)
+	<-client.sent
+	if transport.Drops() != 1 {
+		t.Errorf("expected 1 dropped request; got %d", transport.Drops())
+	}
+
+	// Held requests are delivered in reverse order.
+	transport.Hold()
+	send(3)
+	send(4)
+	send(5)
+	if len(terms()) != 1 {
+		t.Fatalf("expected held requests not to be sent; got terms %v", terms())
+	}
+	transport.Release(true)
+	for i := 0; i < 3; i++ {
+		<-client.sent
+	}
+	if expected, actual := []int{2, 5, 4, 3}, terms(); !intsEqual(expected, actual) {
+		t.Errorf("expected requests with terms %v; got %v", expected, actual)
+	}
+
+	// Delayed requests are sent only after the delay.
+	transport.SetDelay(10 * time.Millisecond)
+	start := time.Now()
+	send(6)
+	<-client.sent
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("expected request to be delayed; sent after %s", elapsed)
+	}
+}
+
+func intsEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFaultyStorage(t *testing.T) {
+	mem := NewMemoryStorage()
+	storage := NewFaultyStorage(mem)
+	groupID := GroupID(1)
+	entries := func(first, last int) []*LogEntry {
+		var entries []*LogEntry
+		for i := first; i <= last; i++ {
+			entries = append(entries, &LogEntry{Term: 1, Index: i})
+		}
+		return entries
+	}
+	lastIndex := func() int {
+		return len(mem.getGroup(groupID).entries) - 1
+	}
+
+	storage.FailWrites(util.Errorf("injected failure"))
+	if err := storage.AppendLogEntries(groupID, entries(1, 2)); err == nil {
+		t.Fatal("expected injected failure")
+	}
+	if err := storage.SetGroupElectionState(groupID, &GroupElectionState{1, 1}); err == nil {
+		t.Fatal("expected injected failure")
+	}
+	if lastIndex() != 0 || mem.getGroup(groupID).electionState.CurrentTerm != 0 {
+		t.Fatal("expected failed writes not to be applied")
+	}
+	storage.FailWrites(nil)
+
+	// Crash in the middle of a batch of entries.
+	storage.CrashAfter(3)
+	if err := storage.AppendLogEntries(groupID, entries(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AppendLogEntries(groupID, entries(3, 5)); err == nil {
+		t.Fatal("expected crash")
+	}
+	if !storage.Crashed() || lastIndex() != 3 {
+		t.Fatalf("expected crash after entry 3; crashed=%t, last index %d",
+			storage.Crashed(), lastIndex())
+	}
+	if err := storage.SetGroupMembers(groupID, &GroupMembers{Members: []NodeID{1}}); err == nil {
+		t.Fatal("expected writes to fail after crash")
+	}
+
+	// After recovering, writes resume from the last applied entry.
+	storage.Recover()
+	if err := storage.AppendLogEntries(groupID, entries(4, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Crashed() || lastIndex() != 5 {
+		t.Fatalf("expected recovery; crashed=%t, last index %d", storage.Crashed(), lastIndex())
+	}
+}
+
+func TestPartition(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+
+	// Isolate the third node; the others still form a majority.
+	cluster.transport.Partition(cluster.nodes[2].nodeID, cluster.nodes[0].nodeID,
+		cluster.nodes[1].nodeID)
+	cluster.waitForElection(0)
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+
+	for i := 0; i < 2; i++ {
+		commit := <-cluster.events[i].CommandCommitted
+		if string(commit.Command) != "command" {
+			t.Errorf("unexpected value in committed command: %v", commit.Command)
+		}
+	}
+	select {
+	case commit := <-cluster.events[2].CommandCommitted:
+		t.Errorf("unexpected commit on partitioned node: %v", commit)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if cluster.transport.Drops() == 0 {
+		t.Error("expected requests to the partitioned node to be dropped")
+	}
+}
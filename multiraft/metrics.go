@@ -0,0 +1,73 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package multiraft
+
+import "time"
+
+// Metrics contains counters describing the activity of a MultiRaft node across all of its
+// groups.  Counters are cumulative since the node was started.
+type Metrics struct {
+	// ElectionsStarted counts the times this node became a candidate.
+	ElectionsStarted int64
+	// ElectionsWon counts the times this node became a leader.
+	ElectionsWon int64
+	// VotesGranted and VotesDenied count the vote responses received by this node
+	// while a candidate.
+	VotesGranted int64
+	VotesDenied  int64
+	// AppendEntriesSent and AppendEntriesReceived count AppendEntries requests.
+	AppendEntriesSent     int64
+	AppendEntriesReceived int64
+	// Writes counts completed requests to the write task, and WriteLatency is their
+	// total duration.
+	Writes       int64
+	WriteLatency time.Duration
+	// PendingCalls is the number of RPCs currently waiting for persistence before a
+	// response can be sent.  Unlike the other fields, it is not cumulative.
+	PendingCalls int
+	// QuiescedGroups is the number of groups currently quiesced.  Like PendingCalls,
+	// it is not cumulative.
+	QuiescedGroups int
+	// WriteBacklog is the number of log entries currently awaiting persistence by the
+	// write task (see Config.MaxWriteBacklog).  It is not cumulative.
+	WriteBacklog int
+}
+
+// metricsOp requests a snapshot of the node's metrics.
+type metricsOp struct {
+	ch chan Metrics
+}
+
+// Metrics returns a snapshot of the node's metrics.  The snapshot is taken on the state
+// goroutine, so it is safe to call Metrics from any goroutine while the node is running.
+func (m *MultiRaft) Metrics() Metrics {
+	op := &metricsOp{make(chan Metrics, 1)}
+	m.ops <- op
+	return <-op.ch
+}
+
+// metrics responds to a metricsOp with a copy of the current metrics.
+func (s *state) metrics(op *metricsOp) {
+	metrics := s.counters
+	metrics.WriteBacklog = s.writeBacklog()
+	for _, g := range s.groups {
+		metrics.PendingCalls += g.pendingCalls.Len()
+		if g.quiesced {
+			metrics.QuiescedGroups++
+		}
+	}
+	op.ch <- metrics
+}
@@ -18,7 +18,10 @@
 package multiraft
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/gob"
+	"fmt"
 	"math"
 	"math/rand"
 	"net/rpc"
@@ -46,6 +49,13 @@ type Config struct {
 	Transport Transport
 	// Clock may be nil to use real time.
 	Clock Clock
+	// Rand is the source of randomness for election timeouts.  It may be nil to use a
+	// randomly seeded source; tests may supply a fixed seed to make elections reproducible.
+	// It is used only by the node's own goroutine and must not be shared between nodes.
+	Rand *rand.Rand
+	// StateMachine may be nil, in which case committed commands are broadcast as
+	// EventCommandCommitted on the Events channel.
+	StateMachine StateMachine
 
 	// A new election is called if the ElectionTimeout elapses with no contact from the leader.
 	// The actual ElectionTimeout is chosen randomly from the range [ElectionTimeoutMin,
@@ -56,9 +66,50 @@ type Config struct {
 	ElectionTimeoutMin time.Duration
 	ElectionTimeoutMax time.Duration
 
-	// If Strict is true, some warnings become fatal panics and additional (possibly expensive)
-	// sanity checks will be done.
-	Strict bool
+	// If EagerElection is true, a group created with CreateGroup holds its first election
+	// after a random delay in [0, ElectionTimeoutMax-ElectionTimeoutMin) instead of a full
+	// election timeout, reducing the time to elect a leader when a cluster is bootstrapped.
+	// The delay retains the randomization of the election timeout, so that split votes are
+	// no more likely than usual; later elections use the full timeout.  Groups restored
+	// after a restart always wait a full timeout, as they may already have a leader.
+	EagerElection bool
+
+	// If WriteBatchWindow is non-zero, changes to groups are accumulated for up to this long
+	// (in real time) after the first one so that they can be persisted in a single storage
+	// write, trading latency for throughput under load.  If WriteBatchEntries is also
+	// non-zero, the write begins as soon as that many log entries are pending, even if the
+	// window has not yet elapsed.
+	WriteBatchWindow  time.Duration
+	WriteBatchEntries int
+
+	// If MaxUncommittedEntries is non-zero, a leader accepts no more than this many entries
+	// beyond the last committed one in each group; further proposals fail with a
+	// GroupOverloadedError until earlier entries commit.  This bounds the memory used by a
+	// group whose followers cannot keep up.
+	MaxUncommittedEntries int
+
+	// If MaxWriteBacklog is non-zero, proposals to any group fail with a NodeBusyError
+	// while this many log entries are awaiting persistence by the write task.  This bounds
+	// the memory used by pending entries when storage cannot keep up; together with
+	// MaxUncommittedEntries, it pushes back on clients whenever either the followers or
+	// the local disk fall behind.
+	MaxWriteBacklog int
+
+	// A follower or observer always broadcasts an EventCaughtUp when its commit index
+	// first reaches the leader's.  If FellBehindThreshold is non-zero, it broadcasts an
+	// EventFellBehind once the leader's commit index exceeds its own by more than this
+	// many entries, and another EventCaughtUp when it catches up again.
+	FellBehindThreshold int
+
+	// If VerifyInvariants is true, additional (possibly expensive) sanity checks will be
+	// done, such as verifying that the log entries read back from storage to be committed
+	// are those expected.  Violations are logged as errors.
+	VerifyInvariants bool
+
+	// If FatalInvariants is true, invariant violations and some warnings become fatal
+	// panics instead of being logged as errors.  Tests typically set both this and
+	// VerifyInvariants; production nodes may verify invariants without risking a crash.
+	FatalInvariants bool
 }
 
 // Validate returns an error if any required elements of the Config are missing or invalid.
@@ -73,18 +124,32 @@ func (c *Config) Validate() error {
 	if c.ElectionTimeoutMin > c.ElectionTimeoutMax {
 		return util.Error("ElectionTimeoutMin must be <= ElectionTimeoutMax")
 	}
+	if c.WriteBatchWindow < 0 || c.WriteBatchEntries < 0 {
+		return util.Error("WriteBatch{Window,Entries} must not be negative")
+	}
+	if c.MaxUncommittedEntries < 0 {
+		return util.Error("MaxUncommittedEntries must not be negative")
+	}
+	if c.MaxWriteBacklog < 0 {
+		return util.Error("MaxWriteBacklog must not be negative")
+	}
+	if c.FellBehindThreshold < 0 {
+		return util.Error("FellBehindThreshold must not be negative")
+	}
 	return nil
 }
 
 // MultiRaft represents a local node in a raft cluster.  The owner is responsible for consuming
-// the Events channel in a timely manner.
+// the Events channel in a timely manner.  If a StateMachine is configured, committed
+// commands are applied to it and only other notifications are sent on the Events channel.
 type MultiRaft struct {
 	Config
-	Events   chan interface{}
-	nodeID   NodeID
-	ops      chan interface{}
-	requests chan *rpc.Call
-	stopped  chan struct{}
+	Events      chan interface{}
+	nodeID      NodeID
+	ops         chan interface{}
+	priorityOps chan interface{} // Proposals above PriorityNormal, handled ahead of ops
+	requests    chan *rpc.Call
+	stopped     chan struct{}
 }
 
 // NewMultiRaft creates a MultiRaft object.
@@ -102,12 +167,13 @@ func NewMultiRaft(nodeID NodeID, config *Config) (*MultiRaft, error) {
 	}
 
 	m := &MultiRaft{
-		Config:   *config,
-		nodeID:   nodeID,
-		Events:   make(chan interface{}, 1000),
-		ops:      make(chan interface{}, 100),
-		requests: make(chan *rpc.Call, 100),
-		stopped:  make(chan struct{}),
+		Config:      *config,
+		nodeID:      nodeID,
+		Events:      make(chan interface{}, 1000),
+		ops:         make(chan interface{}, 100),
+		priorityOps: make(chan interface{}, 100),
+		requests:    make(chan *rpc.Call, 100),
+		stopped:     make(chan struct{}),
 	}
 
 	err = m.Transport.Listen(nodeID, m)
@@ -143,7 +209,7 @@ func (m *MultiRaft) DoRPC(name string, req, resp interface{}) error {
 	case m.requests <- call:
 	default:
 		m.strictErrorLog("RPC request channel blocked")
-		// In non-strict mode, try again with blocking.
+		// If the error was not fatal, try again with blocking.
 		m.requests <- call
 	}
 	<-call.Done
@@ -151,10 +217,10 @@ func (m *MultiRaft) DoRPC(name string, req, resp interface{}) error {
 
 }
 
-// strictErrorLog panics in strict mode and logs an error otherwise.  Arguments are printf-style
-// and will be passed directly to either log.Errorf or log.Fatalf.
+// strictErrorLog panics if FatalInvariants is set and logs an error otherwise.  Arguments are
+// printf-style and will be passed directly to either log.Errorf or log.Fatalf.
 func (m *MultiRaft) strictErrorLog(format string, args ...interface{}) {
-	if m.Strict {
+	if m.FatalInvariants {
 		log.Fatalf(format, args...)
 	} else {
 		log.Errorf(format, args...)
@@ -175,27 +241,169 @@ func (m *MultiRaft) sendEvent(event interface{}) {
 // CreateGroup creates a new consensus group and joins it.  The application should
 // arrange to call CreateGroup on all nodes named in initialMembers.
 func (m *MultiRaft) CreateGroup(groupID GroupID, initialMembers []NodeID) error {
-	for _, id := range initialMembers {
-		if !id.isSet() {
-			return util.Error("Invalid NodeID")
+	return m.CreateGroupWithObservers(groupID, initialMembers, nil)
+}
+
+// CreateGroupWithObservers creates a new consensus group with the given voting members
+// and observers and joins it.  The application should arrange to call
+// CreateGroupWithObservers on all nodes named in either list.  If this node is one of
+// the observers, it joins the group in observer-only mode: it receives and applies the
+// group's committed entries (so it may serve local reads), but it never votes, starts
+// an election or becomes leader.
+func (m *MultiRaft) CreateGroupWithObservers(groupID GroupID, members, observers []NodeID) error {
+	// Quorum calculations assume that the members of a group are distinct.
+	seen := make(map[NodeID]struct{}, len(members)+len(observers))
+	for _, nodes := range [][]NodeID{members, observers} {
+		for _, id := range nodes {
+			if !id.isSet() {
+				return util.Error("Invalid NodeID")
+			}
+			if _, ok := seen[id]; ok {
+				return util.Errorf("duplicate NodeID %v in initial members and observers", id)
+			}
+			seen[id] = struct{}{}
 		}
 	}
-	op := &createGroupOp{newGroup(groupID, initialMembers), make(chan error)}
+	g := newGroup(groupID, members)
+	g.committedMembers.Observers = observers
+	if containsNode(observers, m.nodeID) {
+		g.role = RoleObserver
+	}
+	op := &createGroupOp{g, make(chan error)}
 	m.ops <- op
 	return <-op.ch
 }
 
+// GroupOverloadedError is returned when a command is proposed to a group which already has
+// Config.MaxUncommittedEntries uncommitted entries.  The error is retryable; callers should
+// back off to allow the group's followers to catch up.
+type GroupOverloadedError struct {
+	GroupID     GroupID
+	Uncommitted int
+}
+
+// Error implements the error interface.
+func (e *GroupOverloadedError) Error() string {
+	return fmt.Sprintf("group %v overloaded: %d uncommitted entries", e.GroupID, e.Uncommitted)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *GroupOverloadedError) CanRetry() bool {
+	return true
+}
+
+// NodeBusyError is returned when a command is proposed while Config.MaxWriteBacklog log
+// entries are awaiting persistence.  The error is retryable; callers should back off to
+// allow storage to catch up.
+type NodeBusyError struct {
+	Backlog int
+}
+
+// Error implements the error interface.
+func (e *NodeBusyError) Error() string {
+	return fmt.Sprintf("node busy: %d log entries awaiting persistence", e.Backlog)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *NodeBusyError) CanRetry() bool {
+	return true
+}
+
+// LeadershipLostError is returned to proposals still awaiting their outcome when this
+// node stops leading their group.  The error is retryable; callers should retry once
+// a new leader has been elected.
+type LeadershipLostError struct {
+	GroupID GroupID
+}
+
+// Error implements the error interface.
+func (e *LeadershipLostError) Error() string {
+	return fmt.Sprintf("lost leadership of group %v", e.GroupID)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *LeadershipLostError) CanRetry() bool {
+	return true
+}
+
+// ReadIndexTimeoutError is returned by ReadIndex when the leader's leadership is not
+// confirmed within the maximum election timeout, e.g. because it is partitioned from the
+// rest of the group.  The error is retryable.
+type ReadIndexTimeoutError struct {
+	GroupID GroupID
+}
+
+// Error implements the error interface.
+func (e *ReadIndexTimeoutError) Error() string {
+	return fmt.Sprintf("timed out confirming leadership of group %v for read index", e.GroupID)
+}
+
+// CanRetry implements the util.Retryable interface.
+func (e *ReadIndexTimeoutError) CanRetry() bool {
+	return true
+}
+
+// LogCompactedError is returned when log entries are requested from below the first
+// index of a group's log; the entries have been discarded by CompactLog.
+type LogCompactedError struct {
+	GroupID    GroupID
+	Index      int
+	FirstIndex int
+}
+
+// Error implements the error interface.
+func (e *LogCompactedError) Error() string {
+	return fmt.Sprintf("log entry %d of group %v has been compacted; first index is %d",
+		e.Index, e.GroupID, e.FirstIndex)
+}
+
+// A Priority orders a proposal relative to the other proposals to its group which are
+// awaiting persistence.  Proposals of higher priority are appended to the log ahead of
+// those of lower priority; proposals of equal priority are appended in the order they
+// were submitted.
+type Priority int
+
+const (
+	// PriorityNormal is the priority of ordinary commands.
+	PriorityNormal Priority = iota
+	// PriorityHigh is for latency-critical proposals, such as membership changes, which
+	// should not wait behind a backlog of ordinary commands.
+	PriorityHigh
+)
+
 // SubmitCommand sends a command (a binary blob) to the cluster.  This method returns
-// when the command has been successfully sent, not when it has been committed.
+// when the command has been successfully sent, not when it has been committed.  If the
+// group has too many uncommitted entries, a GroupOverloadedError is returned, and if
+// too many entries are awaiting persistence, a NodeBusyError.
 // TODO(bdarnell): should SubmitCommand wait until the commit?
 // TODO(bdarnell): what do we do if we lose leadership before a command we proposed commits?
 func (m *MultiRaft) SubmitCommand(groupID GroupID, command []byte) error {
-	op := &submitCommandOp{groupID, command, make(chan error, 1)}
-	m.ops <- op
+	return m.SubmitCommandWithPriority(groupID, command, PriorityNormal)
+}
+
+// SubmitCommandWithPriority is like SubmitCommand, but the command is ordered ahead of
+// any proposals of lower priority which have not yet been persisted.  The limits on
+// uncommitted entries and the write backlog apply regardless of priority.
+func (m *MultiRaft) SubmitCommandWithPriority(groupID GroupID, command []byte,
+	priority Priority) error {
+	op := &submitCommandOp{groupID, command, priority, make(chan error, 1)}
+	m.submitOp(op, priority)
 	return <-op.ch
 }
 
-// ChangeGroupMembership submits a proposed membership change to the cluster.
+// submitOp sends a proposal op to the state goroutine, bypassing the ops queue if the
+// proposal's priority is above normal.
+func (m *MultiRaft) submitOp(op interface{}, priority Priority) {
+	if priority > PriorityNormal {
+		m.priorityOps <- op
+	} else {
+		m.ops <- op
+	}
+}
+
+// ChangeGroupMembership submits a proposed membership change to the cluster.  Once the
+// change commits, an EventMembershipChanged is broadcast with the new membership.
+// Membership changes are proposed with PriorityHigh.
 // TODO(bdarnell): same concerns as SubmitCommand
 // TODO(bdarnell): do we expose ChangeMembershipAdd{Member,Observer} to the application
 // level or does MultiRaft take care of the non-member -> observer -> full member
@@ -207,6 +415,62 @@ func (m *MultiRaft) ChangeGroupMembership(groupID GroupID, changeOp ChangeMember
 		ChangeMembershipPayload{changeOp, nodeID},
 		make(chan error, 1),
 	}
+	m.submitOp(op, PriorityHigh)
+	return <-op.ch
+}
+
+// ReadIndex returns an index which is safe for a linearizable read of the group's state,
+// using the read-index protocol instead of a leader lease.  This node must be the group's
+// leader.  The leader records its commit index, then confirms that it is still leader by
+// exchanging a round of heartbeats with a majority of the group.  A newly elected leader
+// first commits a no-op entry of its own term, as until then its commit index may lag
+// that of its predecessor.  Once ReadIndex returns, a read reflects every write committed
+// before it was called as soon as the commands up to the returned index have been
+// applied.  A LeadershipLostError is returned if the node stops leading the group, and a
+// ReadIndexTimeoutError if its leadership isn't confirmed within ElectionTimeoutMax.
+func (m *MultiRaft) ReadIndex(groupID GroupID) (int, error) {
+	op := &readIndexOp{groupID: groupID, ch: make(chan error, 1)}
+	m.ops <- op
+	if err := <-op.ch; err != nil {
+		return 0, err
+	}
+	return op.index, nil
+}
+
+// Barrier returns once every command submitted to the group before the call has
+// committed and, if a StateMachine is configured, been applied.  This node must be the
+// group's leader.  A no-op entry is appended to the log and the barrier is resolved when
+// it commits; unlike ReadIndex, which only confirms leadership, Barrier waits for earlier
+// proposals which have not yet committed.  An error is returned if the no-op entry is
+// superseded by an entry of another leader.
+func (m *MultiRaft) Barrier(groupID GroupID) error {
+	op := &barrierOp{groupID: groupID, ch: make(chan error, 1)}
+	m.ops <- op
+	select {
+	case err := <-op.ch:
+		return err
+	case <-m.stopped:
+		return util.Errorf("node %v stopped", m.nodeID)
+	}
+}
+
+// StepDown relinquishes this node's leadership of the group, which it must lead.  The
+// node becomes a follower and stops proposing; pending Barrier and ReadIndex calls fail
+// with a LeadershipLostError and an EventLeadershipLost is broadcast.  A successor is
+// elected once an election timeout expires, on this node or another.
+func (m *MultiRaft) StepDown(groupID GroupID) error {
+	op := &stepDownOp{groupID, make(chan error, 1)}
+	m.ops <- op
+	return <-op.ch
+}
+
+// CompactLog discards the entries of the group's log before index, which must not
+// exceed the commit index: the application should call it only once the effects of the
+// discarded entries are captured in a snapshot of its state.  Followers whose logs end
+// before the new first index can no longer be caught up from the log; an
+// EventSnapshotNeeded is broadcast when one is found.
+func (m *MultiRaft) CompactLog(groupID GroupID, index int) error {
+	op := &compactLogOp{groupID, index, make(chan error, 1)}
 	m.ops <- op
 	return <-op.ch
 }
@@ -233,6 +497,24 @@ type pendingCall struct {
 	logIndex int
 }
 
+// A pendingBarrier is a Barrier waiting for its no-op entry to commit.
+type pendingBarrier struct {
+	entry *LogEntry
+	ch    chan error
+}
+
+// pendingRead is a ReadIndex request awaiting confirmation of the leader's leadership.
+// It is confirmed by a majority of responses to heartbeats sent in its read round (or
+// later).
+type pendingRead struct {
+	op       *readIndexOp
+	term     int
+	round    int
+	acks     map[NodeID]bool
+	minIndex int       // the commit index must reach the leader's first entry of term
+	deadline time.Time // the read fails if not confirmed by the deadline
+}
+
 // group represents the state of a consensus group.
 type group struct {
 	groupID GroupID
@@ -242,10 +524,12 @@ type group struct {
 	// and persisted data differ.
 	electionState             *GroupElectionState
 	committedMembers          *GroupMembers
+	firstLogIndex             int // entries before it have been compacted
 	lastLogIndex              int
 	lastLogTerm               int
 	persistedElectionState    *GroupElectionState
 	persistedCommittedMembers *GroupMembers
+	persistedFirstIndex       int
 	persistedLastIndex        int
 	persistedLastTerm         int
 
@@ -259,6 +543,14 @@ type group struct {
 	commitIndex      int
 	electionDeadline time.Time
 	votes            map[NodeID]bool
+	// quiesced is true while the group is idle: the leader has replicated and committed
+	// its entire log to every node, and followers lengthen their election timeouts (see
+	// quiescedTimeoutMultiple) until the leader proposes a new entry or an election is
+	// called.
+	quiesced bool
+	// caughtUp is true once commitIndex has reached leaderCommitIndex, until it falls
+	// more than FellBehindThreshold entries behind.
+	caughtUp bool
 
 	// Candidate/leader volatile state.  Reset on conversion to candidate.
 	// currentMembers is the cluster membership including any pending (uncommitted)
@@ -268,12 +560,27 @@ type group struct {
 	// Leader volatile state.  Reset on election.
 	nextIndex  map[NodeID]int // default: lastLogIndex + 1
 	matchIndex map[NodeID]int // default: 0
+	// snapshotNeeded holds the nodes that have been reported by an EventSnapshotNeeded
+	// and have not caught up since, so that each is reported only once.
+	snapshotNeeded map[NodeID]bool
+	// readRound is incremented for each heartbeat round started on behalf of ReadIndex
+	// requests, which wait in pendingReads until the round is acknowledged.
+	readRound    int
+	pendingReads []*pendingRead
+	// termStartIndex is the index of the first entry this leader proposed in its term.
+	termStartIndex int
 
 	// a List of *pendingCall
 	pendingCalls list.List
 
+	// Barriers whose entries have not yet committed, in log order.
+	pendingBarriers []*pendingBarrier
+
 	// LogEntries that have not been persisted.  The group is 'dirty' when this is non-empty.
 	pendingEntries []*LogEntry
+	// pendingPriorities holds the priority of each entry in pendingEntries proposed by
+	// this node above PriorityNormal.
+	pendingPriorities map[*LogEntry]Priority
 }
 
 func newGroup(groupID GroupID, members []NodeID) *group {
@@ -283,24 +590,49 @@ func newGroup(groupID GroupID, members []NodeID) *group {
 		committedMembers: &GroupMembers{
 			Members: members,
 		},
-		role:       RoleFollower,
-		nextIndex:  make(map[NodeID]int),
-		matchIndex: make(map[NodeID]int),
+		firstLogIndex:       1,
+		persistedFirstIndex: 1,
+		role:                RoleFollower,
+		nextIndex:           make(map[NodeID]int),
+		matchIndex:          make(map[NodeID]int),
+		snapshotNeeded:      make(map[NodeID]bool),
 	}
 }
 
+// hasElectionTimer returns true if the group's election deadline should be honored.  The
+// deadline of a quiesced leader is instead the time to renew its followers' quiescence.
+func (g *group) hasElectionTimer() bool {
+	return g.role != RoleObserver && (g.role != RoleLeader || g.quiesced)
+}
+
 // findQuorumIndex examines matchIndex to find the largest log index that a quorum has
-// agreed on.
+// agreed on. Members are assumed to be distinct. A group with no members (which may
+// happen transiently during a membership change) has no quorum, so zero is returned.
 func (g *group) findQuorumIndex() int {
+	if len(g.currentMembers.Members) == 0 {
+		return 0
+	}
 	var indices []int
 	for _, nodeID := range g.currentMembers.Members {
 		indices = append(indices, g.matchIndex[nodeID])
 	}
 	sort.Ints(indices)
-	quorumPos := len(indices)/2 + 1
+	// With the indices in ascending order, every member from quorumPos
+	// onwards (a majority) has an index at least as large as this one.
+	quorumPos := (len(indices) - 1) / 2
 	return indices[quorumPos]
 }
 
+// containsNode returns true if nodeID is present in nodes.
+func containsNode(nodes []NodeID, nodeID NodeID) bool {
+	for _, id := range nodes {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
 type stopOp struct{}
 
 type createGroupOp struct {
@@ -309,9 +641,10 @@ type createGroupOp struct {
 }
 
 type submitCommandOp struct {
-	groupID GroupID
-	command []byte
-	ch      chan error
+	groupID  GroupID
+	command  []byte
+	priority Priority
+	ch       chan error
 }
 
 type changeGroupMembershipOp struct {
@@ -320,6 +653,32 @@ type changeGroupMembershipOp struct {
 	ch      chan error
 }
 
+// stepDownOp relinquishes leadership of a group.
+type stepDownOp struct {
+	groupID GroupID
+	ch      chan error
+}
+
+// compactLogOp discards the entries of a group's log before index.
+type compactLogOp struct {
+	groupID GroupID
+	index   int
+	ch      chan error
+}
+
+// barrierOp appends a no-op entry; nil is sent on ch once it commits.
+type barrierOp struct {
+	groupID GroupID
+	ch      chan error
+}
+
+// readIndexOp requests a read index; index is set before a nil error is sent on ch.
+type readIndexOp struct {
+	groupID GroupID
+	index   int
+	ch      chan error
+}
+
 // node represents a connection to a remote node.
 type node struct {
 	nodeID   NodeID
@@ -339,18 +698,30 @@ type state struct {
 	electionTimer *time.Timer
 	responses     chan *rpc.Call
 	writeTask     *writeTask
+	applyTask     *applyTask // nil unless a StateMachine is configured
+	writeStart    time.Time  // Start of the outstanding write task request
+	writeEntries  int        // Number of log entries in the outstanding write task request
+	batchStart    time.Time  // Start of the current write batching window, if any
+	counters      Metrics
 }
 
 func newState(m *MultiRaft) *state {
-	return &state{
+	s := &state{
 		MultiRaft:   m,
-		rand:        util.NewPseudoRand(),
+		rand:        m.Rand,
 		groups:      make(map[GroupID]*group),
 		dirtyGroups: make(map[GroupID]*group),
 		nodes:       make(map[NodeID]*node),
 		responses:   make(chan *rpc.Call, 100),
 		writeTask:   newWriteTask(m.Storage),
 	}
+	if s.rand == nil {
+		s.rand = util.NewPseudoRand()
+	}
+	if m.StateMachine != nil {
+		s.applyTask = newApplyTask(m.StateMachine)
+	}
+	return s
 }
 
 func (s *state) updateElectionDeadline(g *group) {
@@ -358,10 +729,49 @@ func (s *state) updateElectionDeadline(g *group) {
 	g.electionDeadline = s.Clock.Now().Add(time.Duration(timeout))
 }
 
+// quiescedTimeoutMultiple is the factor by which the election timeout of a quiesced
+// follower exceeds the usual one.  The leader of a quiesced group renews its followers'
+// quiescence at half the shortest such timeout, so a quiesced follower calls an election
+// only if it has heard nothing from the leader for many election timeouts, e.g. because
+// the leader has failed.
+const quiescedTimeoutMultiple = 10
+
+// updateQuiescedDeadline sets the election deadline of a quiesced group: for a follower,
+// a randomized election timeout lengthened by quiescedTimeoutMultiple; for the leader,
+// the time at which it next renews its followers' quiescence.
+func (s *state) updateQuiescedDeadline(g *group) {
+	if g.role == RoleLeader {
+		g.electionDeadline = s.Clock.Now().Add(s.ElectionTimeoutMin * quiescedTimeoutMultiple / 2)
+		return
+	}
+	timeout := util.RandIntInRange(s.rand, int(s.ElectionTimeoutMin), int(s.ElectionTimeoutMax))
+	g.electionDeadline = s.Clock.Now().Add(time.Duration(timeout) * quiescedTimeoutMultiple)
+}
+
+// updateEagerElectionDeadline schedules the first election of a newly created group
+// after a random fraction of the usual spread of election timeouts (see
+// Config.EagerElection).
+func (s *state) updateEagerElectionDeadline(g *group) {
+	var delay time.Duration
+	if spread := int(s.ElectionTimeoutMax - s.ElectionTimeoutMin); spread > 0 {
+		delay = time.Duration(util.RandIntInRange(s.rand, 0, spread))
+	}
+	g.electionDeadline = s.Clock.Now().Add(delay)
+}
+
 func (s *state) nextElectionTimer() *time.Timer {
 	minTimeout := time.Duration(math.MaxInt64)
 	now := s.Clock.Now()
 	for _, g := range s.groups {
+		// Pending reads time out on the same timer.
+		for _, read := range g.pendingReads {
+			if timeout := read.deadline.Sub(now); timeout < minTimeout {
+				minTimeout = timeout
+			}
+		}
+		if !g.hasElectionTimer() {
+			continue
+		}
 		timeout := g.electionDeadline.Sub(now)
 		if timeout < minTimeout {
 			minTimeout = timeout
@@ -372,36 +782,48 @@ func (s *state) nextElectionTimer() *time.Timer {
 
 func (s *state) start() {
 	log.V(1).Infof("node %v starting", s.nodeID)
+	// Rejoin any groups persisted before a restart.
+	for groupState := range s.Storage.LoadGroups() {
+		if err := s.restoreGroup(groupState); err != nil {
+			s.strictErrorLog("node %v failed to restore group %v: %s", s.nodeID,
+				groupState.GroupID, err)
+		}
+	}
 	go s.writeTask.start()
+	if s.applyTask != nil {
+		go s.applyTask.start()
+	}
 	for {
+		// Proposals of high priority are handled ahead of any other pending work.
+		select {
+		case op := <-s.priorityOps:
+			s.handleOp(op)
+			continue
+		default:
+		}
 		electionTimer := s.nextElectionTimer()
 		var writeReady chan struct{}
+		var batchTimer *time.Timer
+		var batchTimeout <-chan time.Time
 		if len(s.dirtyGroups) > 0 {
-			writeReady = s.writeTask.ready
-		} else {
-			writeReady = nil
+			if wait := s.writeBatchWait(); wait > 0 {
+				batchTimer = time.NewTimer(wait)
+				batchTimeout = batchTimer.C
+			} else {
+				writeReady = s.writeTask.ready
+			}
 		}
 		log.V(8).Infof("node %v: selecting", s.nodeID)
 		select {
 		case op := <-s.ops:
-			log.V(6).Infof("node %v: got op %#v", s.nodeID, op)
-			switch op := op.(type) {
-			case *stopOp:
+			if _, ok := op.(*stopOp); ok {
 				s.stop()
 				return
-
-			case *createGroupOp:
-				s.createGroup(op)
-
-			case *submitCommandOp:
-				s.submitCommand(op)
-
-			case *changeGroupMembershipOp:
-				s.changeGroupMembership(op)
-
-			default:
-				s.strictErrorLog("unknown op: %#v", op)
 			}
+			s.handleOp(op)
+
+		case op := <-s.priorityOps:
+			s.handleOp(op)
 
 		case call := <-s.requests:
 			log.V(6).Infof("node %v: got request %v", s.nodeID, call)
@@ -426,7 +848,7 @@ func (s *state) start() {
 
 			case appendEntriesName:
 				s.appendEntriesResponse(call.Args.(*AppendEntriesRequest),
-					call.Reply.(*AppendEntriesResponse))
+					call.Reply.(*AppendEntriesResponse), call.Error)
 
 			default:
 				s.strictErrorLog("unknown rpc response: %#v", call.Reply)
@@ -435,6 +857,9 @@ func (s *state) start() {
 		case writeReady <- struct{}{}:
 			s.handleWriteReady()
 
+		case <-batchTimeout:
+			log.V(6).Infof("node %v: write batching window elapsed", s.nodeID)
+
 		case resp := <-s.writeTask.out:
 			s.handleWriteResponse(resp)
 
@@ -443,6 +868,48 @@ func (s *state) start() {
 			s.handleElectionTimers(now)
 		}
 		s.Clock.StopElectionTimer(electionTimer)
+		if batchTimer != nil {
+			batchTimer.Stop()
+		}
+	}
+}
+
+// handleOp handles an op other than a stopOp received on the ops or priorityOps channel.
+func (s *state) handleOp(op interface{}) {
+	log.V(6).Infof("node %v: got op %#v", s.nodeID, op)
+	switch op := op.(type) {
+	case *createGroupOp:
+		s.createGroup(op)
+
+	case *submitCommandOp:
+		s.submitCommand(op)
+
+	case *changeGroupMembershipOp:
+		s.changeGroupMembership(op)
+
+	case *readIndexOp:
+		s.readIndex(op)
+
+	case *barrierOp:
+		s.barrier(op)
+
+	case *compactLogOp:
+		s.compactLog(op)
+
+	case *stepDownOp:
+		s.stepDown(op)
+
+	case *metricsOp:
+		s.metrics(op)
+
+	case *dumpLogOp:
+		s.dumpLog(op)
+
+	case *groupStatusOp:
+		s.groupStatus(op)
+
+	default:
+		s.strictErrorLog("unknown op: %#v", op)
 	}
 }
 
@@ -454,39 +921,110 @@ func (s *state) stop() {
 			log.Warning("error stopping client:", err)
 		}
 	}
+	for _, g := range s.groups {
+		s.failPendingReads(g, util.Errorf("node %v stopped", s.nodeID))
+	}
 	s.writeTask.stop()
+	if s.applyTask != nil {
+		s.applyTask.stop()
+	}
 	close(s.stopped)
 }
 
 func (s *state) createGroup(op *createGroupOp) {
 	log.V(6).Infof("node %v creating group %v", s.nodeID, op.group.groupID)
-	if _, ok := s.groups[op.group.groupID]; ok {
-		op.ch <- util.Errorf("group %v already exists", op.group.groupID)
-		return
+	err := s.addGroup(op.group)
+	if err == nil && s.EagerElection && op.group.hasElectionTimer() {
+		s.updateEagerElectionDeadline(op.group)
 	}
-	for _, member := range op.group.committedMembers.Members {
-		if node, ok := s.nodes[member]; ok {
-			node.refCount++
-			continue
-		}
-		conn, err := s.Transport.Connect(member)
-		if err != nil {
-			op.ch <- err
-			return
+	op.ch <- err
+}
+
+// restoreGroup recreates a group from the state persisted before a restart.  The node
+// rejoins the group as a follower (or observer) and catches up with the leader.
+func (s *state) restoreGroup(groupState *GroupPersistentState) error {
+	log.V(6).Infof("node %v restoring group %v", s.nodeID, groupState.GroupID)
+	members := groupState.Members
+	electionState := groupState.ElectionState
+	persistedElectionState := groupState.ElectionState
+	g := newGroup(groupState.GroupID, members.Members)
+	g.committedMembers = &members
+	g.persistedCommittedMembers = &members
+	g.electionState = &electionState
+	g.persistedElectionState = &persistedElectionState
+	g.lastLogIndex = groupState.LastLogIndex
+	g.lastLogTerm = groupState.LastLogTerm
+	g.persistedLastIndex = groupState.LastLogIndex
+	g.persistedLastTerm = groupState.LastLogTerm
+	if groupState.FirstLogIndex > 1 {
+		// Compacted entries were committed and applied before the restart, so
+		// committing resumes with the first entry remaining in the log.
+		g.firstLogIndex = groupState.FirstLogIndex
+		g.persistedFirstIndex = groupState.FirstLogIndex
+		g.commitIndex = groupState.FirstLogIndex - 1
+	}
+	if containsNode(members.Observers, s.nodeID) {
+		g.role = RoleObserver
+	}
+	return s.addGroup(g)
+}
+
+// addGroup connects to the nodes of a new group and starts tracking it.
+func (s *state) addGroup(g *group) error {
+	if _, ok := s.groups[g.groupID]; ok {
+		return util.Errorf("group %v already exists", g.groupID)
+	}
+	members := g.committedMembers
+	for _, member := range append(append([]NodeID(nil), members.Members...), members.Observers...) {
+		if err := s.connectNode(member); err != nil {
+			return err
 		}
-		s.nodes[member] = &node{member, 1, &asyncClient{member, conn, s.responses}}
 	}
-	s.updateElectionDeadline(op.group)
-	s.groups[op.group.groupID] = op.group
-	op.ch <- nil
+	// Observers never start elections, so they have no election deadline.
+	if g.role != RoleObserver {
+		s.updateElectionDeadline(g)
+	}
+	s.groups[g.groupID] = g
+	s.updateDirtyStatus(g)
+	return nil
+}
+
+// connectNode connects to the given node, unless already connected, and counts a
+// reference to it.
+func (s *state) connectNode(nodeID NodeID) error {
+	if node, ok := s.nodes[nodeID]; ok {
+		node.refCount++
+		return nil
+	}
+	conn, err := s.Transport.Connect(nodeID)
+	if err != nil {
+		return err
+	}
+	s.nodes[nodeID] = &node{nodeID, 1, &asyncClient{nodeID, conn, s.responses}}
+	return nil
 }
 
-func (s *state) addLogEntry(groupID GroupID, entryType LogEntryType, payload []byte) error {
+// addLogEntry proposes a new entry to the group, of which this node must be the leader.
+// The entry is appended to the group's pending entries behind those of equal or higher
+// priority, renumbering any of lower priority which it is placed ahead of.
+func (s *state) addLogEntry(groupID GroupID, entryType LogEntryType, payload []byte,
+	priority Priority) (*LogEntry, error) {
 	g := s.groups[groupID]
 	if g.role != RoleLeader {
-		return util.Error("TODO(bdarnell): forward commands to leader")
+		return nil, util.Error("TODO(bdarnell): forward commands to leader")
+	}
+	if uncommitted := g.lastLogIndex - g.commitIndex; s.MaxUncommittedEntries > 0 &&
+		uncommitted >= s.MaxUncommittedEntries {
+		return nil, &GroupOverloadedError{groupID, uncommitted}
+	}
+	if s.MaxWriteBacklog > 0 {
+		if backlog := s.writeBacklog(); backlog >= s.MaxWriteBacklog {
+			return nil, &NodeBusyError{backlog}
+		}
 	}
 
+	// A new proposal wakes the group; the entry's broadcast unquiesces the followers.
+	g.quiesced = false
 	g.lastLogIndex++
 	entry := &LogEntry{
 		Term:    g.electionState.CurrentTerm,
@@ -494,21 +1032,318 @@ func (s *state) addLogEntry(groupID GroupID, entryType LogEntryType, payload []b
 		Type:    entryType,
 		Payload: payload,
 	}
-	g.pendingEntries = append(g.pendingEntries, entry)
+	// Find the position of the entry.  Pending entries have been neither persisted nor
+	// broadcast, so those of the current term, all of which were proposed by this node,
+	// may be renumbered.
+	pos := len(g.pendingEntries)
+	for pos > 0 {
+		prev := g.pendingEntries[pos-1]
+		if prev.Term != entry.Term || g.pendingPriorities[prev] >= priority {
+			break
+		}
+		pos--
+	}
+	g.pendingEntries = append(g.pendingEntries, nil)
+	copy(g.pendingEntries[pos+1:], g.pendingEntries[pos:])
+	g.pendingEntries[pos] = entry
+	for i := pos; i < len(g.pendingEntries); i++ {
+		g.pendingEntries[i].Index = g.lastLogIndex - len(g.pendingEntries) + 1 + i
+	}
+	if priority > PriorityNormal {
+		if g.pendingPriorities == nil {
+			g.pendingPriorities = map[*LogEntry]Priority{}
+		}
+		g.pendingPriorities[entry] = priority
+	}
 	s.updateDirtyStatus(g)
-	return nil
+	return entry, nil
 }
 
 func (s *state) submitCommand(op *submitCommandOp) {
 	log.V(6).Infof("node %v submitting command to group %v", s.nodeID, op.groupID)
-	op.ch <- s.addLogEntry(op.groupID, LogEntryCommand, op.command)
+	_, err := s.addLogEntry(op.groupID, LogEntryCommand, op.command, op.priority)
+	op.ch <- err
+}
+
+// barrier appends a no-op entry to the group, resolving op once it commits.  The entry
+// is of normal priority, so it follows every pending command.
+func (s *state) barrier(op *barrierOp) {
+	log.V(6).Infof("node %v appending barrier to group %v", s.nodeID, op.groupID)
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
+	entry, err := s.addLogEntry(op.groupID, LogEntryNoop, nil, PriorityNormal)
+	if err != nil {
+		op.ch <- err
+		return
+	}
+	g.pendingBarriers = append(g.pendingBarriers, &pendingBarrier{entry, op.ch})
+}
+
+// stepDown converts the group's leader to a follower.  The election deadline is reset,
+// giving the other members a chance to elect a successor first, and the group is woken,
+// as a quiesced group would otherwise never elect one.
+func (s *state) stepDown(op *stepDownOp) {
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
+	if g.role != RoleLeader {
+		op.ch <- util.Errorf("node %v is not the leader of group %v", s.nodeID, op.groupID)
+		return
+	}
+	log.V(1).Infof("node %v stepping down as leader of group %v", s.nodeID, op.groupID)
+	g.role = RoleFollower
+	g.quiesced = false
+	s.updateElectionDeadline(g)
+	lostErr := &LeadershipLostError{g.groupID}
+	s.failPendingReads(g, lostErr)
+	for _, b := range g.pendingBarriers {
+		b.ch <- lostErr
+	}
+	g.pendingBarriers = nil
+	s.sendEvent(&EventLeadershipLost{g.groupID, s.nodeID})
+	op.ch <- nil
+}
+
+// compactLog advances the group's first log index; the entries before it are discarded
+// from storage along with the group's next write.
+func (s *state) compactLog(op *compactLogOp) {
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
+	if op.index > g.commitIndex {
+		op.ch <- util.Errorf("cannot compact log of group %v before %v; commit index is %v",
+			op.groupID, op.index, g.commitIndex)
+		return
+	}
+	if op.index > g.firstLogIndex {
+		log.V(6).Infof("node %v compacting log of group %v before %v", s.nodeID, op.groupID,
+			op.index)
+		g.firstLogIndex = op.index
+		s.updateDirtyStatus(g)
+	}
+	op.ch <- nil
+}
+
+// committedBarriers removes the group's pending barriers for the committed entry and
+// returns their channels.
+func (s *state) committedBarriers(g *group, entry *LogEntry) []chan error {
+	var chs []chan error
+	var remaining []*pendingBarrier
+	for _, b := range g.pendingBarriers {
+		if b.entry.Index == entry.Index && b.entry.Term == entry.Term {
+			chs = append(chs, b.ch)
+		} else {
+			remaining = append(remaining, b)
+		}
+	}
+	g.pendingBarriers = remaining
+	return chs
+}
+
+// failSupersededBarriers fails the group's pending barriers at or below the commit
+// index, whose entries were replaced by those of another leader.
+func (s *state) failSupersededBarriers(g *group) {
+	var remaining []*pendingBarrier
+	for _, b := range g.pendingBarriers {
+		if b.entry.Index <= g.commitIndex {
+			b.ch <- util.Errorf("barrier at index %v of group %v was superseded by another leader",
+				b.entry.Index, g.groupID)
+		} else {
+			remaining = append(remaining, b)
+		}
+	}
+	g.pendingBarriers = remaining
 }
 
 func (s *state) changeGroupMembership(op *changeGroupMembershipOp) {
 	log.V(6).Infof("node %v proposing membership change to group %v", s.nodeID, op.groupID)
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
+	members := g.currentMembers
+	if members == nil {
+		members = g.committedMembers
+	}
+	switch op.payload.Operation {
+	case ChangeMembershipAddMember:
+		if containsNode(members.Members, op.payload.Node) {
+			op.ch <- util.Errorf("node %v is already a member of group %v", op.payload.Node,
+				op.groupID)
+			return
+		}
+	case ChangeMembershipAddObserver:
+		if containsNode(members.Members, op.payload.Node) ||
+			containsNode(members.Observers, op.payload.Node) {
+			op.ch <- util.Errorf("node %v is already in group %v", op.payload.Node, op.groupID)
+			return
+		}
+	}
 	// TODO(bdarnell): update currentMembers.  Should we disallow more than one
 	// membership change in flight at a time, and if so how?
-	op.ch <- s.addLogEntry(op.groupID, LogEntryChangeMembership, nil)
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&op.payload); err != nil {
+		op.ch <- err
+		return
+	}
+	_, err := s.addLogEntry(op.groupID, LogEntryChangeMembership, payload.Bytes(), PriorityHigh)
+	op.ch <- err
+}
+
+// changeMembership applies a committed membership change to the group and notifies
+// the application with an EventMembershipChanged.  Nodes joining the group are
+// connected to; this node leaves observer mode if it is made a member.
+func (s *state) changeMembership(g *group, entry *LogEntryState) {
+	var payload ChangeMembershipPayload
+	if err := gob.NewDecoder(bytes.NewReader(entry.Entry.Payload)).Decode(&payload); err != nil {
+		log.Fatalf("node %v: could not decode membership change %+v: %s", s.nodeID, entry, err)
+	}
+	members := g.committedMembers.Clone()
+	switch payload.Operation {
+	case ChangeMembershipAddObserver:
+		members.Observers = append(members.Observers, payload.Node)
+	case ChangeMembershipRemoveObserver:
+		members.Observers = removeNode(members.Observers, payload.Node)
+	case ChangeMembershipAddMember:
+		members.Observers = removeNode(members.Observers, payload.Node)
+		members.Members = append(members.Members, payload.Node)
+	case ChangeMembershipRemoveMember:
+		members.Members = removeNode(members.Members, payload.Node)
+	default:
+		log.Fatalf("node %v: committed unknown membership change %+v", s.nodeID, payload)
+	}
+	old := g.committedMembers
+	joined := !containsNode(old.Members, payload.Node) && !containsNode(old.Observers, payload.Node) &&
+		(containsNode(members.Members, payload.Node) || containsNode(members.Observers, payload.Node))
+	if joined {
+		if err := s.connectNode(payload.Node); err != nil {
+			log.Errorf("node %v: could not connect to node %v: %s", s.nodeID, payload.Node, err)
+		}
+	}
+	g.committedMembers = members
+	if g.currentMembers != nil {
+		g.currentMembers = members.Clone()
+	}
+	if g.role == RoleObserver && containsNode(members.Members, s.nodeID) {
+		g.role = RoleFollower
+		s.updateElectionDeadline(g)
+	}
+	s.updateDirtyStatus(g)
+	s.sendEvent(&EventMembershipChanged{
+		GroupID:   g.groupID,
+		Index:     entry.Index,
+		Members:   append([]NodeID(nil), members.Members...),
+		Observers: append([]NodeID(nil), members.Observers...),
+	})
+}
+
+// removeNode returns a copy of nodes without nodeID.
+func removeNode(nodes []NodeID, nodeID NodeID) []NodeID {
+	var result []NodeID
+	for _, id := range nodes {
+		if id != nodeID {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// readIndex records the group's commit index as the read index of op and starts a
+// heartbeat round to confirm that this node is still the leader.
+func (s *state) readIndex(op *readIndexOp) {
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
+	if g.role != RoleLeader {
+		op.ch <- util.Errorf("node %v is not the leader of group %v", s.nodeID, op.groupID)
+		return
+	}
+	// Every entry up to the commit index has been applied (or sent to the state machine)
+	// on the leader, so the read index is reached as soon as leadership is confirmed.
+	op.index = g.commitIndex
+	read := &pendingRead{
+		op:       op,
+		term:     g.electionState.CurrentTerm,
+		acks:     make(map[NodeID]bool),
+		deadline: s.Clock.Now().Add(s.ElectionTimeoutMax),
+	}
+	if g.commitIndex < g.termStartIndex {
+		// Until an entry of its own term commits, a new leader's commit index may lag
+		// that of its predecessor, so the read waits for one, proposing a no-op if
+		// nothing else has been proposed in this term.
+		if g.lastLogIndex < g.termStartIndex {
+			if _, err := s.addLogEntry(op.groupID, LogEntryNoop, nil, PriorityNormal); err != nil {
+				op.ch <- err
+				return
+			}
+		}
+		read.minIndex = g.termStartIndex
+	}
+	g.readRound++
+	read.round = g.readRound
+	g.pendingReads = append(g.pendingReads, read)
+	s.broadcastEntries(g, nil)
+}
+
+// confirmPendingReads records that the sender of an AppendEntries request has
+// acknowledged this node's leadership, and completes the reads confirmed by a majority
+// once the commit index has reached an entry of the leader's term.
+func (s *state) confirmPendingReads(g *group, req *AppendEntriesRequest,
+	resp *AppendEntriesResponse) {
+	if len(g.pendingReads) == 0 {
+		return
+	}
+	if resp.Term > g.electionState.CurrentTerm {
+		s.failPendingReads(g, &LeadershipLostError{g.groupID})
+		return
+	}
+	var remaining []*pendingRead
+	for _, read := range g.pendingReads {
+		if read.term == req.Term && read.round <= req.readRound {
+			read.acks[req.DestNode] = true
+		}
+		if !hasMajority(read.acks, g.currentMembers.Members) || g.commitIndex < read.minIndex {
+			remaining = append(remaining, read)
+			continue
+		}
+		if read.op.index < read.minIndex {
+			read.op.index = g.commitIndex
+		}
+		read.op.ch <- nil
+	}
+	g.pendingReads = remaining
+}
+
+// failExpiredReads fails the group's outstanding ReadIndex requests whose deadlines
+// have passed.
+func (s *state) failExpiredReads(g *group, now time.Time) {
+	var remaining []*pendingRead
+	for _, read := range g.pendingReads {
+		if now.Before(read.deadline) {
+			remaining = append(remaining, read)
+			continue
+		}
+		read.op.ch <- &ReadIndexTimeoutError{g.groupID}
+	}
+	g.pendingReads = remaining
+}
+
+// failPendingReads fails all of the group's outstanding ReadIndex requests with err.
+func (s *state) failPendingReads(g *group, err error) {
+	for _, read := range g.pendingReads {
+		read.op.ch <- err
+	}
+	g.pendingReads = nil
 }
 
 func (s *state) requestVoteRequest(req *RequestVoteRequest, resp *RequestVoteResponse,
@@ -519,7 +1354,12 @@ func (s *state) requestVoteRequest(req *RequestVoteRequest, resp *RequestVoteRes
 		call.Done <- call
 		return
 	}
-	if g.electionState.VotedFor.isSet() && g.electionState.VotedFor != req.CandidateID {
+	// An election wakes the group.
+	s.unquiesce(g)
+	if g.role == RoleObserver {
+		// Observers do not vote.
+		resp.VoteGranted = false
+	} else if g.electionState.VotedFor.isSet() && g.electionState.VotedFor != req.CandidateID {
 		resp.VoteGranted = false
 	} else {
 		// TODO: check log positions
@@ -533,6 +1373,8 @@ func (s *state) requestVoteRequest(req *RequestVoteRequest, resp *RequestVoteRes
 	s.updateDirtyStatus(g)
 }
 
+// hasMajority returns true if a majority of members have voted for
+// this node. Members are assumed to be distinct.
 func hasMajority(votes map[NodeID]bool, members []NodeID) bool {
 	voteCount := 0
 	for _, node := range members {
@@ -544,13 +1386,22 @@ func hasMajority(votes map[NodeID]bool, members []NodeID) bool {
 }
 
 func (s *state) requestVoteResponse(req *RequestVoteRequest, resp *RequestVoteResponse) {
-	g := s.groups[req.GroupID]
+	g, ok := s.groups[req.GroupID]
+	if !ok {
+		// The group was removed while the request was in flight.
+		log.V(1).Infof("node %v: dropping vote response for unknown group %v", s.nodeID,
+			req.GroupID)
+		return
+	}
 	if resp.Term < g.electionState.CurrentTerm {
 		return
 	}
 	log.V(2).Infof("node %v received vote %v from node %v", s.nodeID, resp.VoteGranted)
 	if resp.VoteGranted {
 		g.votes[req.DestNode] = resp.VoteGranted
+		s.counters.VotesGranted++
+	} else {
+		s.counters.VotesDenied++
 	}
 	s.countVotes(g)
 	s.updateDirtyStatus(g)
@@ -561,6 +1412,9 @@ func (s *state) countVotes(g *group) {
 	if g.role == RoleCandidate &&
 		hasMajority(g.votes, g.currentMembers.Members) {
 		g.role = RoleLeader
+		g.termStartIndex = g.lastLogIndex + 1
+		g.snapshotNeeded = make(map[NodeID]bool)
+		s.counters.ElectionsWon++
 		log.V(1).Infof("node %v becoming leader for group %v", s.nodeID, g.groupID)
 		s.sendEvent(&EventLeaderElection{g.groupID, s.nodeID})
 	}
@@ -578,13 +1432,34 @@ func (s *state) countVotes(g *group) {
 // min(leaderCommit, last log index)
 func (s *state) appendEntriesRequest(req *AppendEntriesRequest, resp *AppendEntriesResponse,
 	call *rpc.Call) {
-	g := s.groups[req.GroupID]
+	g, ok := s.groups[req.GroupID]
+	if !ok {
+		call.Error = util.Errorf("unknown group %v", req.GroupID)
+		call.Done <- call
+		return
+	}
+	s.counters.AppendEntriesReceived++
 	resp.Term = g.electionState.CurrentTerm
 	if req.Term < g.electionState.CurrentTerm {
 		resp.Success = false
 		call.Done <- call
 		return
 	}
+	// A leader only quiesces or wakes its followers; its own state is updated as it
+	// proposes entries.  Followers are woken only by new entries, as requests which
+	// merely advance the commit index may be delivered after the leader quiesced.  Each
+	// request to quiesce, including the leader's periodic renewals, extends the
+	// follower's lengthened election timeout.
+	if g.role != RoleLeader {
+		if req.Quiesce {
+			g.quiesced = true
+			if g.role != RoleObserver {
+				s.updateQuiescedDeadline(g)
+			}
+		} else if len(req.Entries) > 0 {
+			s.unquiesce(g)
+		}
+	}
 	// TODO(bdarnell): check prevLogIndex and terms
 	g.pendingEntries = append(g.pendingEntries, req.Entries...)
 	if len(g.pendingEntries) > 0 {
@@ -598,14 +1473,25 @@ func (s *state) appendEntriesRequest(req *AppendEntriesRequest, resp *AppendEntr
 	s.commitEntries(g, req.LeaderCommit)
 }
 
+// appendEntriesResponse handles the response to an AppendEntries request; err is the error
+// from the call, if any.
+//
 // From the Raft paper:
 // If successful: update nextIndex and matchIndex for follower (§5.3)
 // If AppendEntries fails because of log inconsistency: decrement nextIndex and retry (§5.3)
 // If there exists an N such that N > commitIndex, a majority of matchIndex[i] ≥ N, and
 // log[N].term == currentTerm: set commitIndex = N (§5.3, §5.4).
-func (s *state) appendEntriesResponse(req *AppendEntriesRequest, resp *AppendEntriesResponse) {
-	g := s.groups[req.GroupID]
+func (s *state) appendEntriesResponse(req *AppendEntriesRequest, resp *AppendEntriesResponse,
+	err error) {
+	g, ok := s.groups[req.GroupID]
+	if !ok {
+		// The group was removed while the request was in flight.
+		log.V(1).Infof("node %v: dropping append entries response for unknown group %v",
+			s.nodeID, req.GroupID)
+		return
+	}
 	if resp.Success {
+		delete(g.snapshotNeeded, req.DestNode)
 		if len(req.Entries) > 0 {
 			lastIndex := req.Entries[len(req.Entries)-1].Index
 			g.nextIndex[req.DestNode] = lastIndex + 1
@@ -613,13 +1499,97 @@ func (s *state) appendEntriesResponse(req *AppendEntriesRequest, resp *AppendEnt
 		}
 	} else {
 		g.nextIndex[req.DestNode]--
+		if g.nextIndex[req.DestNode] < g.firstLogIndex {
+			// The entries the follower is missing have been compacted, so it must be
+			// caught up from a snapshot.  The application is told once; the node keeps
+			// failing until the snapshot has been applied.
+			g.nextIndex[req.DestNode] = g.firstLogIndex
+			if !g.snapshotNeeded[req.DestNode] {
+				g.snapshotNeeded[req.DestNode] = true
+				s.sendEvent(&EventSnapshotNeeded{
+					GroupID:    g.groupID,
+					NodeID:     req.DestNode,
+					FirstIndex: g.firstLogIndex,
+				})
+			}
+		}
 	}
-
 	s.commitEntries(g, g.findQuorumIndex())
+	// Any response, successful or not, acknowledges the leader's term, but a failed call
+	// tells us nothing.  Reads are confirmed only after the commit index is updated, as
+	// those of a new leader also wait for an entry of its term to commit.
+	if err == nil {
+		s.confirmPendingReads(g, req, resp)
+	}
+	s.maybeQuiesce(g)
+}
+
+// maybeQuiesce quiesces the group if this node is its leader and every member and
+// observer has persisted the leader's entire log, which has been committed.  The
+// followers are told to quiesce by a final AppendEntries carrying the commit index.
+func (s *state) maybeQuiesce(g *group) {
+	if g.role != RoleLeader || g.quiesced || len(g.pendingEntries) > 0 ||
+		g.persistedLastIndex != g.lastLogIndex || g.commitIndex != g.lastLogIndex {
+		return
+	}
+	for _, nodes := range [][]NodeID{g.currentMembers.Members, g.currentMembers.Observers} {
+		for _, id := range nodes {
+			if g.matchIndex[id] != g.lastLogIndex {
+				return
+			}
+		}
+	}
+	log.V(6).Infof("node %v: quiescing group %v", s.nodeID, g.groupID)
+	g.quiesced = true
+	s.updateQuiescedDeadline(g)
+	s.broadcastEntries(g, nil)
+}
+
+// unquiesce wakes the group if it is quiesced, restarting its election timer.
+func (s *state) unquiesce(g *group) {
+	if !g.quiesced {
+		return
+	}
+	log.V(6).Infof("node %v: unquiescing group %v", s.nodeID, g.groupID)
+	g.quiesced = false
+	s.updateElectionDeadline(g)
+}
+
+// writeBatchWait returns how much longer changes to the dirty groups should be accumulated
+// before they are written, starting a new batching window if necessary.  Returns zero if the
+// write should begin as soon as the write task is ready.
+func (s *state) writeBatchWait() time.Duration {
+	if s.WriteBatchWindow == 0 {
+		return 0
+	}
+	if s.batchStart.IsZero() {
+		s.batchStart = time.Now()
+	}
+	if s.WriteBatchEntries > 0 {
+		entries := 0
+		for _, g := range s.dirtyGroups {
+			entries += len(g.pendingEntries)
+		}
+		if entries >= s.WriteBatchEntries {
+			return 0
+		}
+	}
+	return s.WriteBatchWindow - time.Since(s.batchStart)
+}
+
+// writeBacklog returns the number of log entries awaiting persistence: those pending in
+// dirty groups and those in the outstanding write task request.
+func (s *state) writeBacklog() int {
+	backlog := s.writeEntries
+	for _, g := range s.dirtyGroups {
+		backlog += len(g.pendingEntries)
+	}
+	return backlog
 }
 
 func (s *state) handleWriteReady() {
 	log.V(6).Infof("node %v write ready, preparing request", s.nodeID)
+	s.batchStart = time.Time{}
 	writeRequest := newWriteRequest()
 	for groupID, group := range s.dirtyGroups {
 		req := &groupWriteRequest{}
@@ -628,11 +1598,21 @@ func (s *state) handleWriteReady() {
 			copy := *group.electionState
 			req.electionState = &copy
 		}
+		if group.committedMembers != group.persistedCommittedMembers {
+			req.members = group.committedMembers
+		}
+		if group.firstLogIndex != group.persistedFirstIndex {
+			req.firstIndex = group.firstLogIndex
+		}
 		if len(group.pendingEntries) > 0 {
 			req.entries = group.pendingEntries
+			s.writeEntries += len(group.pendingEntries)
 			group.pendingEntries = nil
+			group.pendingPriorities = nil
 		}
 	}
+	// Latency is measured in real time regardless of the configured Clock.
+	s.writeStart = time.Now()
 	s.writeTask.in <- writeRequest
 }
 
@@ -648,6 +1628,7 @@ func (s *state) broadcastEntries(g *group, entries []*LogEntry) {
 func (s *state) broadcastEntriesToNodes(g *group, entries []*LogEntry, nodes []NodeID) {
 	for _, id := range nodes {
 		node := s.nodes[id]
+		s.counters.AppendEntriesSent++
 		node.client.appendEntries(&AppendEntriesRequest{
 			RequestHeader: RequestHeader{s.nodeID, id},
 			GroupID:       g.groupID,
@@ -657,17 +1638,28 @@ func (s *state) broadcastEntriesToNodes(g *group, entries []*LogEntry, nodes []N
 			PrevLogTerm:   g.persistedLastTerm,
 			LeaderCommit:  g.commitIndex,
 			Entries:       entries,
+			Quiesce:       g.quiesced,
+			readRound:     g.readRound,
 		})
 	}
 }
 
 func (s *state) handleWriteResponse(response *writeResponse) {
 	log.V(6).Infof("node %v got write response: %#v", s.nodeID, *response)
+	s.counters.Writes++
+	s.counters.WriteLatency += time.Since(s.writeStart)
+	s.writeEntries = 0
 	for groupID, persistedGroup := range response.groups {
 		g := s.groups[groupID]
 		if persistedGroup.electionState != nil {
 			g.persistedElectionState = persistedGroup.electionState
 		}
+		if persistedGroup.members != nil {
+			g.persistedCommittedMembers = persistedGroup.members
+		}
+		if persistedGroup.firstIndex != -1 {
+			g.persistedFirstIndex = persistedGroup.firstIndex
+		}
 		if persistedGroup.lastIndex != -1 {
 			log.V(6).Infof("node %v: updating persisted log index to %v", s.nodeID,
 				persistedGroup.lastIndex)
@@ -719,9 +1711,18 @@ func (s *state) resolvePendingCall(g *group, call *pendingCall) bool {
 
 func (s *state) handleElectionTimers(now time.Time) {
 	for _, g := range s.groups {
-		if !now.Before(g.electionDeadline) {
-			s.becomeCandidate(g)
+		s.failExpiredReads(g, now)
+		if !g.hasElectionTimer() || now.Before(g.electionDeadline) {
+			continue
+		}
+		if g.role == RoleLeader {
+			// Renew the quiescence of the followers, which would otherwise elect a new
+			// leader once their lengthened election timeouts elapse.
+			s.broadcastEntries(g, nil)
+			s.updateQuiescedDeadline(g)
+			continue
 		}
+		s.becomeCandidate(g)
 	}
 }
 
@@ -730,12 +1731,17 @@ func (s *state) becomeCandidate(g *group) {
 	if g.role == RoleLeader {
 		panic("cannot transition from leader to candidate")
 	}
+	if g.role == RoleObserver {
+		panic("cannot transition from observer to candidate")
+	}
 	g.role = RoleCandidate
+	g.quiesced = false
+	s.counters.ElectionsStarted++
 	g.electionState.CurrentTerm++
 	g.electionState.VotedFor = s.nodeID
 	g.votes = make(map[NodeID]bool)
 	// TODO(bdarnell): scan the uncommitted tail to find currentMembers.
-	g.currentMembers = g.committedMembers
+	g.currentMembers = g.committedMembers.Clone()
 	s.updateElectionDeadline(g)
 	for _, id := range g.currentMembers.Members {
 		// Note that we send ourselves a vote request instead of setting g.votes[s.nodeID]
@@ -774,31 +1780,126 @@ func (s *state) commitEntries(g *group, leaderCommitIndex int) {
 			s.nodeID, index, g.persistedLastIndex)
 		index = g.persistedLastIndex
 	}
+	if index == g.commitIndex {
+		// Nothing more has been persisted, so there is nothing to read from storage.
+		s.updateCaughtUp(g)
+		return
+	}
+	if g.commitIndex+1 < g.firstLogIndex {
+		// Only committed entries are compacted, so this should be impossible.
+		s.strictErrorLog("node %v: group %v cannot commit from %v; log was compacted before %v",
+			s.nodeID, g.groupID, g.commitIndex+1, g.firstLogIndex)
+		return
+	}
 	log.V(6).Infof("node %v advancing commit position for group %v from %v to %v",
 		s.nodeID, g.groupID, g.commitIndex, index)
 	// TODO(bdarnell): move storage access (incl. the channel iteration) to a goroutine
 	entries := make(chan *LogEntryState, 100)
 	go s.Storage.GetLogEntries(g.groupID, g.commitIndex+1, index, entries)
+	var commands []*LogEntry
+	next, failed := g.commitIndex+1, false
 	for entry := range entries {
 		log.V(6).Infof("node %v: committing %+v", s.nodeID, entry)
+		if s.VerifyInvariants {
+			if entry.Error != nil {
+				failed = true
+			} else {
+				if entry.Index != next {
+					s.strictErrorLog("node %v: group %v read entry %v from storage to commit; expected %v",
+						s.nodeID, g.groupID, entry.Index, next)
+				}
+				next = entry.Index + 1
+			}
+		}
 		switch entry.Entry.Type {
 		case LogEntryCommand:
-			s.sendEvent(&EventCommandCommitted{entry.Entry.Payload})
+			if s.applyTask != nil {
+				commands = append(commands, &entry.Entry)
+			} else {
+				s.sendEvent(&EventCommandCommitted{
+					GroupID: g.groupID,
+					Index:   entry.Index,
+					Command: entry.Entry.Payload,
+				})
+			}
+
+		case LogEntryChangeMembership:
+			// Commands committed before the change are applied first.
+			if len(commands) > 0 {
+				s.applyTask.in <- &applyRequest{g.groupID, commands, nil}
+				commands = nil
+			}
+			s.changeMembership(g, entry)
+
+		case LogEntryNoop:
+			// Barriers are resolved once the commands committed before them are applied.
+			barriers := s.committedBarriers(g, &entry.Entry)
+			if len(barriers) == 0 {
+				break
+			}
+			if s.applyTask != nil {
+				s.applyTask.in <- &applyRequest{g.groupID, commands, barriers}
+				commands = nil
+			} else {
+				for _, ch := range barriers {
+					ch <- nil
+				}
+			}
 
 		default:
 			log.Fatalf("node %v: committed unknown entry type %v", s.nodeID, entry.Entry.Type)
 		}
 	}
+	if s.VerifyInvariants && !failed && next != index+1 {
+		s.strictErrorLog("node %v: group %v read entries through %v from storage to commit; expected %v",
+			s.nodeID, g.groupID, next-1, index)
+	}
+	if len(commands) > 0 {
+		s.applyTask.in <- &applyRequest{g.groupID, commands, nil}
+	}
 	g.commitIndex = index
+	s.updateCaughtUp(g)
+	s.failSupersededBarriers(g)
 	s.broadcastEntries(g, nil)
 }
 
+// updateCaughtUp broadcasts an EventCaughtUp when a follower or observer's commit index
+// reaches the leader's, and an EventFellBehind when it later lags by more than
+// FellBehindThreshold entries.  A leader is caught up by definition.
+func (s *state) updateCaughtUp(g *group) {
+	if g.role == RoleLeader {
+		g.caughtUp = true
+		return
+	}
+	lag := g.leaderCommitIndex - g.commitIndex
+	if !g.caughtUp && lag == 0 {
+		g.caughtUp = true
+		s.sendEvent(&EventCaughtUp{
+			GroupID: g.groupID,
+			Index:   g.commitIndex,
+		})
+	} else if g.caughtUp && s.FellBehindThreshold > 0 && lag > s.FellBehindThreshold {
+		g.caughtUp = false
+		s.sendEvent(&EventFellBehind{
+			GroupID:           g.groupID,
+			Index:             g.commitIndex,
+			LeaderCommitIndex: g.leaderCommitIndex,
+		})
+	}
+}
+
 // updateDirtyStatus sets the dirty flag for the given group.
 func (s *state) updateDirtyStatus(g *group) {
 	dirty := false
 	if !g.electionState.Equal(g.persistedElectionState) {
 		dirty = true
 	}
+	if g.committedMembers != g.persistedCommittedMembers {
+		dirty = true
+	}
+	if g.firstLogIndex != g.persistedFirstIndex {
+		dirty = true
+	}
 	if len(g.pendingEntries) > 0 {
 		dirty = true
 	}
@@ -18,33 +18,63 @@
 package multiraft
 
 import (
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
 type testCluster struct {
-	t        *testing.T
-	nodes    []*state
-	clocks   []*manualClock
-	events   []*eventDemux
-	storages []*BlockableStorage
+	t         *testing.T
+	nodes     []*state
+	clocks    []*manualClock
+	events    []*eventDemux
+	storages  []*BlockableStorage
+	faults    []*FaultyStorage
+	transport *FaultyTransport
 }
 
 func newTestCluster(size int, t *testing.T) *testCluster {
-	transport := NewLocalRPCTransport()
-	cluster := &testCluster{t: t}
+	return newTestClusterWithStateMachines(size, nil, t)
+}
+
+// newTestClusterWithStateMachines creates a cluster in which node i applies committed
+// commands to stateMachines[i].  stateMachines may be nil.
+func newTestClusterWithStateMachines(size int, stateMachines []StateMachine,
+	t *testing.T) *testCluster {
+	return newTestClusterWithConfig(size, stateMachines, nil, t)
+}
+
+// newTestClusterWithConfig is like newTestClusterWithStateMachines, but additionally invokes
+// configure (if not nil) on each node's Config before the node is created.
+func newTestClusterWithConfig(size int, stateMachines []StateMachine, configure func(*Config),
+	t *testing.T) *testCluster {
+	transport := NewFaultyTransport(NewLocalRPCTransport())
+	cluster := &testCluster{t: t, transport: transport}
 	for i := 0; i < size; i++ {
 		clock := newManualClock()
-		storage := &BlockableStorage{storage: NewMemoryStorage()}
+		faults := NewFaultyStorage(NewMemoryStorage())
+		storage := &BlockableStorage{storage: faults}
 		config := &Config{
 			Transport:          transport,
 			Storage:            storage,
 			Clock:              clock,
+			Rand:               rand.New(rand.NewSource(int64(i + 1))),
 			ElectionTimeoutMin: 10 * time.Millisecond,
 			ElectionTimeoutMax: 20 * time.Millisecond,
-			Strict:             true,
+			VerifyInvariants:   true,
+			FatalInvariants:    true,
+		}
+		if stateMachines != nil {
+			config.StateMachine = stateMachines[i]
+		}
+		if configure != nil {
+			configure(config)
 		}
 		mr, err := NewMultiRaft(NodeID(i+1), config)
 		if err != nil {
@@ -57,6 +87,7 @@ func newTestCluster(size int, t *testing.T) *testCluster {
 		cluster.clocks = append(cluster.clocks, clock)
 		cluster.events = append(cluster.events, demux)
 		cluster.storages = append(cluster.storages, storage)
+		cluster.faults = append(cluster.faults, faults)
 	}
 	// Let all the states listen before starting any.
 	for _, node := range cluster.nodes {
@@ -200,3 +231,1022 @@ func TestMembershipChange(t *testing.T) {
 		}
 	}
 }
+
+// TestMembershipChangedEvent verifies that each committed membership change is reported
+// exactly once, with the membership resulting from the change.
+func TestMembershipChangedEvent(t *testing.T) {
+	cluster := newTestCluster(2, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 1)
+	cluster.waitForElection(0)
+
+	// Observers don't count towards the quorum, so the single member commits the
+	// changes by itself.
+	node0, node1 := cluster.nodes[0].nodeID, cluster.nodes[1].nodeID
+	changes := []struct {
+		op           ChangeMembershipOperation
+		expObservers []NodeID
+	}{
+		{ChangeMembershipAddObserver, []NodeID{node1}},
+		{ChangeMembershipRemoveObserver, []NodeID{}},
+	}
+	for i, change := range changes {
+		if err := cluster.nodes[0].ChangeGroupMembership(groupID, change.op, node1); err != nil {
+			t.Fatal(err)
+		}
+		event := <-cluster.events[0].MembershipChanged
+		if event.GroupID != groupID || !reflect.DeepEqual(event.Members, []NodeID{node0}) ||
+			len(event.Observers) != len(change.expObservers) ||
+			(len(event.Observers) > 0 && !reflect.DeepEqual(event.Observers, change.expObservers)) {
+			t.Errorf("%d: unexpected event %+v", i, event)
+		}
+	}
+	select {
+	case event := <-cluster.events[0].MembershipChanged:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestObserverGroup(t *testing.T) {
+	cluster := newTestCluster(4, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	members := []NodeID{cluster.nodes[0].nodeID, cluster.nodes[1].nodeID, cluster.nodes[2].nodeID}
+	observers := []NodeID{cluster.nodes[3].nodeID}
+	for _, node := range cluster.nodes {
+		if err := node.CreateGroupWithObservers(groupID, members, observers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cluster.waitForElection(0)
+
+	// The observer applies committed commands like any other replica.
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for i, events := range cluster.events {
+		log.Infof("waiting for event to be commited on node %v", i)
+		commit := <-events.CommandCommitted
+		if string(commit.Command) != "command" {
+			t.Errorf("unexpected value in committed command: %v", commit.Command)
+		}
+	}
+
+	// But its election timer never makes it a candidate.
+	cluster.clocks[3].triggerElection()
+	if metrics := cluster.nodes[3].Metrics(); metrics.ElectionsStarted != 0 {
+		t.Errorf("expected observer to start no elections; got %+v", metrics)
+	}
+
+	if err := cluster.nodes[0].CreateGroupWithObservers(GroupID(2), members, members[:1]); err == nil {
+		t.Error("expected error creating group with a node as both member and observer")
+	}
+}
+
+func TestRestoreGroups(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for _, events := range cluster.events {
+		<-events.CommandCommitted
+	}
+
+	// Restart the last node on top of its existing storage.
+	old := cluster.nodes[2]
+	old.Stop()
+	mr, err := NewMultiRaft(old.nodeID, &Config{
+		Transport:          old.Transport,
+		Storage:            cluster.storages[2],
+		Clock:              newManualClock(),
+		ElectionTimeoutMin: 10 * time.Millisecond,
+		ElectionTimeoutMax: 20 * time.Millisecond,
+		VerifyInvariants:   true,
+		FatalInvariants:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := newState(mr)
+	cluster.nodes[2] = node
+	go node.start()
+	// Wait for the restored groups to be loaded.
+	node.Metrics()
+
+	g, ok := node.groups[groupID]
+	if !ok {
+		t.Fatalf("expected group %v to be restored", groupID)
+	}
+	if g.role != RoleFollower {
+		t.Errorf("expected restored group to be a follower; got %v", g.role)
+	}
+	if g.electionState.CurrentTerm != 1 || g.lastLogIndex != 1 || g.lastLogTerm != 1 {
+		t.Errorf("unexpected restored state: term %v, last index %v, last term %v",
+			g.electionState.CurrentTerm, g.lastLogIndex, g.lastLogTerm)
+	}
+	if len(g.committedMembers.Members) != 3 {
+		t.Errorf("expected 3 restored members; got %v", g.committedMembers.Members)
+	}
+	if err := node.CreateGroup(groupID, g.committedMembers.Members); err == nil {
+		t.Error("expected error creating a restored group")
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for _, events := range cluster.events {
+		<-events.CommandCommitted
+	}
+
+	// Once the command is fully replicated, the idle group quiesces on every node.
+	if err := util.IsTrueWithin(func() bool {
+		for _, node := range cluster.nodes {
+			if node.Metrics().QuiescedGroups != 1 {
+				return false
+			}
+		}
+		return true
+	}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// A quiesced follower's election timeout is lengthened.
+	waitForElectionTimeout(t, cluster.clocks[1], 10*time.Millisecond*quiescedTimeoutMultiple)
+
+	// The leader's timer renews the quiescence of its followers rather than starting an
+	// election.
+	waitForElectionTimeout(t, cluster.clocks[0], 10*time.Millisecond*quiescedTimeoutMultiple/2)
+	cluster.clocks[0].triggerElection()
+	if metrics := cluster.nodes[0].Metrics(); metrics.ElectionsStarted != 1 || metrics.QuiescedGroups != 1 {
+		t.Errorf("expected quiesced leader to start no new elections; got %+v", metrics)
+	}
+
+	// A new proposal wakes the leader. Blocking its storage keeps it from quiescing
+	// again before we look.
+	cluster.storages[0].Block()
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command2"))
+	if metrics := cluster.nodes[0].Metrics(); metrics.QuiescedGroups != 0 {
+		t.Errorf("expected leader to unquiesce on a new proposal; got %+v", metrics)
+	}
+	cluster.storages[0].Unblock()
+}
+
+// waitForElectionTimeout waits until the clock's election timer is set to fire at least
+// timeout from now.
+func waitForElectionTimeout(t *testing.T, clock *manualClock, timeout time.Duration) {
+	if err := util.IsTrueWithin(func() bool {
+		clock.Lock()
+		defer clock.Unlock()
+		return clock.nextElection.Sub(clock.now) >= timeout
+	}, time.Second); err != nil {
+		t.Fatalf("expected election timeout of at least %s", timeout)
+	}
+}
+
+// TestQuiescedLeaderFailure verifies that a quiesced follower which hears nothing from
+// its leader calls an election once its lengthened election timeout elapses.
+func TestQuiescedLeaderFailure(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for _, events := range cluster.events {
+		<-events.CommandCommitted
+	}
+	if err := util.IsTrueWithin(func() bool {
+		return cluster.nodes[1].Metrics().QuiescedGroups == 1
+	}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitForElectionTimeout(t, cluster.clocks[1], 10*time.Millisecond*quiescedTimeoutMultiple)
+
+	// Cut the leader off; it can no longer renew its followers' quiescence.
+	cluster.transport.Partition(1, 2, 3)
+	cluster.clocks[1].triggerElection()
+	if metrics := cluster.nodes[1].Metrics(); metrics.ElectionsStarted != 1 || metrics.QuiescedGroups != 0 {
+		t.Errorf("expected follower to wake and start an election; got %+v", metrics)
+	}
+}
+
+func TestCreateGroupDuplicateMembers(t *testing.T) {
+	cluster := newTestCluster(1, t)
+	defer cluster.stop()
+
+	if err := cluster.nodes[0].CreateGroup(GroupID(1), []NodeID{1, 2, 2, 3}); err == nil {
+		t.Error("expected error creating group with duplicate members")
+	}
+}
+
+func TestMembershipChangeDuplicate(t *testing.T) {
+	cluster := newTestCluster(2, t)
+	defer cluster.stop()
+
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 1)
+	cluster.waitForElection(0)
+
+	// Node 1 is already a member; adding it again as either a member or
+	// an observer must fail.
+	nodeID := cluster.nodes[0].nodeID
+	if err := cluster.nodes[0].ChangeGroupMembership(groupID, ChangeMembershipAddMember,
+		nodeID); err == nil {
+		t.Error("expected error adding existing member")
+	}
+	if err := cluster.nodes[0].ChangeGroupMembership(groupID, ChangeMembershipAddObserver,
+		nodeID); err == nil {
+		t.Error("expected error adding existing member as observer")
+	}
+	if err := cluster.nodes[0].ChangeGroupMembership(groupID, ChangeMembershipAddMember,
+		cluster.nodes[1].nodeID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHasMajority(t *testing.T) {
+	members := []NodeID{1, 2, 3, 4}
+	testCases := []struct {
+		votes    map[NodeID]bool
+		expected bool
+	}{
+		{map[NodeID]bool{}, false},
+		{map[NodeID]bool{1: true, 2: true}, false},
+		{map[NodeID]bool{1: true, 2: true, 3: false}, false},
+		{map[NodeID]bool{1: true, 2: true, 3: true}, true},
+		// Votes from non-members are ignored.
+		{map[NodeID]bool{1: true, 2: true, 5: true}, false},
+	}
+	for i, test := range testCases {
+		if maj := hasMajority(test.votes, members); maj != test.expected {
+			t.Errorf("%d: expected majority %t; got %t", i, test.expected, maj)
+		}
+	}
+}
+
+func TestFindQuorumIndex(t *testing.T) {
+	testCases := []struct {
+		members    []NodeID
+		matchIndex map[NodeID]int
+		expected   int
+	}{
+		{[]NodeID{1}, map[NodeID]int{1: 5}, 5},
+		{[]NodeID{1, 2}, map[NodeID]int{1: 5, 2: 3}, 3},
+		{[]NodeID{1, 2, 3}, map[NodeID]int{1: 5, 2: 3, 3: 4}, 4},
+		{[]NodeID{1, 2, 3}, map[NodeID]int{1: 5, 2: 3, 3: 1}, 3},
+		{[]NodeID{1, 2, 3, 4}, map[NodeID]int{1: 5, 2: 3, 3: 4, 4: 1}, 3},
+		// Members without a matchIndex have not acknowledged any entries.
+		{[]NodeID{1, 2, 3}, map[NodeID]int{1: 5}, 0},
+		{[]NodeID{1, 2, 3, 4}, map[NodeID]int{1: 5, 2: 5, 3: 1, 4: 1}, 1},
+		// A group with no members has no quorum.
+		{[]NodeID{}, map[NodeID]int{}, 0},
+	}
+	for i, test := range testCases {
+		g := newGroup(GroupID(1), test.members)
+		g.currentMembers = g.committedMembers
+		g.matchIndex = test.matchIndex
+		if idx := g.findQuorumIndex(); idx != test.expected {
+			t.Errorf("%d: expected quorum index %d; got %d", i, test.expected, idx)
+		}
+	}
+}
+
+// testStateMachine sends each applied command on a channel.
+type testStateMachine struct {
+	applied chan *EventCommandCommitted
+}
+
+func (sm *testStateMachine) Apply(groupID GroupID, index int, command []byte) {
+	sm.applied <- &EventCommandCommitted{groupID, index, command}
+}
+
+func TestStateMachine(t *testing.T) {
+	var stateMachines []StateMachine
+	for i := 0; i < 3; i++ {
+		stateMachines = append(stateMachines,
+			&testStateMachine{make(chan *EventCommandCommitted, 10)})
+	}
+	cluster := newTestClusterWithStateMachines(3, stateMachines, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	if err := cluster.nodes[0].SubmitCommand(groupID, []byte("command")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each node applies the command at the same log index.
+	index := 0
+	for i, sm := range stateMachines {
+		applied := <-sm.(*testStateMachine).applied
+		if applied.GroupID != groupID || string(applied.Command) != "command" {
+			t.Errorf("node %d: expected command applied to group %v; got %+v", i, groupID, applied)
+		}
+		if applied.Index == 0 || (index != 0 && applied.Index != index) {
+			t.Errorf("node %d: unexpected index %d", i, applied.Index)
+		}
+		index = applied.Index
+	}
+
+	// Committed commands are not also broadcast as events.
+	for i, events := range cluster.events {
+		select {
+		case commit := <-events.CommandCommitted:
+			t.Errorf("node %d: unexpected commit event %+v", i, commit)
+		default:
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for _, events := range cluster.events {
+		<-events.CommandCommitted
+	}
+
+	leader := cluster.nodes[0].Metrics()
+	if leader.ElectionsStarted != 1 || leader.ElectionsWon != 1 {
+		t.Errorf("expected leader to start and win one election; got %+v", leader)
+	}
+	// The leader's own vote plus at least one other are needed to win.
+	if leader.VotesGranted < 2 || leader.VotesDenied != 0 {
+		t.Errorf("expected at least 2 votes granted and none denied; got %+v", leader)
+	}
+	if leader.AppendEntriesSent == 0 || leader.Writes == 0 {
+		t.Errorf("expected leader to send entries and write to storage; got %+v", leader)
+	}
+	for i := 1; i < 3; i++ {
+		follower := cluster.nodes[i].Metrics()
+		if follower.ElectionsStarted != 0 || follower.AppendEntriesReceived == 0 {
+			t.Errorf("node %d: expected no elections and received entries; got %+v", i, follower)
+		}
+	}
+}
+
+// TestResponseForUnknownGroup verifies that responses to requests for
+// groups which no longer exist are dropped.
+func TestResponseForUnknownGroup(t *testing.T) {
+	cluster := newTestCluster(1, t)
+	defer cluster.stop()
+	node := cluster.nodes[0]
+	groupID := GroupID(1)
+	node.responses <- &rpc.Call{
+		ServiceMethod: requestVoteName,
+		Args:          &RequestVoteRequest{GroupID: groupID},
+		Reply:         &RequestVoteResponse{},
+	}
+	node.responses <- &rpc.Call{
+		ServiceMethod: appendEntriesName,
+		Args:          &AppendEntriesRequest{GroupID: groupID},
+		Reply:         &AppendEntriesResponse{},
+	}
+	// The node is still running once the responses have been handled.
+	if metrics := node.Metrics(); metrics.VotesGranted != 0 {
+		t.Errorf("expected no votes to be counted; got %+v", metrics)
+	}
+}
+
+func TestWriteBatching(t *testing.T) {
+	const numCommands = 10
+	cluster := newTestClusterWithConfig(3, nil, func(config *Config) {
+		config.WriteBatchWindow = 50 * time.Millisecond
+		config.WriteBatchEntries = numCommands
+	}, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	writes := cluster.nodes[0].Metrics().Writes
+	for i := 0; i < numCommands; i++ {
+		if err := cluster.nodes[0].SubmitCommand(groupID, []byte("command")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, events := range cluster.events {
+		for i := 0; i < numCommands; i++ {
+			<-events.CommandCommitted
+		}
+	}
+	// The commands are submitted well within the batching window, so the leader should
+	// persist them in far fewer writes than one per command.
+	if writes = cluster.nodes[0].Metrics().Writes - writes; writes >= numCommands {
+		t.Errorf("expected commands to be batched into fewer than %d writes; got %d",
+			numCommands, writes)
+	}
+}
+
+// TestEagerElection verifies that with EagerElection, newly created groups schedule
+// their first election well before a full election timeout has elapsed.
+func TestEagerElection(t *testing.T) {
+	for _, eager := range []bool{false, true} {
+		cluster := newTestClusterWithConfig(3, nil, func(config *Config) {
+			config.EagerElection = eager
+		}, t)
+		cluster.createGroup(1, 3)
+		for i, node := range cluster.nodes {
+			// Metrics is processed by the node's goroutine, so the election timer has
+			// been computed with the new group by the time it returns.
+			node.Metrics()
+			clock := cluster.clocks[i]
+			clock.Lock()
+			delay := clock.nextElection.Sub(clock.now)
+			clock.Unlock()
+			if early := delay < node.ElectionTimeoutMin; early != eager {
+				t.Errorf("eager=%t: node %d scheduled election after %s", eager, i, delay)
+			}
+		}
+		cluster.waitForElection(0)
+		cluster.stop()
+	}
+}
+
+// TestGroupMembersEqualAndClone verifies that a cloned GroupMembers is equal to the
+// original and that modifying it leaves the original unchanged.
+func TestGroupMembersEqualAndClone(t *testing.T) {
+	members := &GroupMembers{Members: []NodeID{1, 2, 3}, Observers: []NodeID{4}}
+	clone := members.Clone()
+	if !members.Equal(clone) {
+		t.Fatalf("expected clone %+v to equal %+v", clone, members)
+	}
+	clone.Members[0] = 5
+	clone.Observers = append(clone.Observers, 6)
+	if members.Equal(clone) {
+		t.Errorf("expected modified clone %+v not to equal %+v", clone, members)
+	}
+	if members.Members[0] != 1 || len(members.Observers) != 1 {
+		t.Errorf("modifying clone modified original: %+v", members)
+	}
+	if members.Equal(nil) || !(*GroupMembers)(nil).Equal(nil) {
+		t.Error("unexpected result comparing with nil members")
+	}
+}
+
+// TestDeterministicElectionTimeouts verifies that nodes configured with identically
+// seeded sources of randomness choose the same election timeouts.
+func TestDeterministicElectionTimeouts(t *testing.T) {
+	transport := NewLocalRPCTransport()
+	var deadlines [2][]time.Time
+	for i := range deadlines {
+		clock := newManualClock()
+		mr, err := NewMultiRaft(NodeID(i+1), &Config{
+			Transport:          transport,
+			Storage:            NewMemoryStorage(),
+			Clock:              clock,
+			Rand:               rand.New(rand.NewSource(42)),
+			ElectionTimeoutMin: 10 * time.Millisecond,
+			ElectionTimeoutMax: 20 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newState(mr)
+		g := newGroup(GroupID(1), []NodeID{mr.nodeID})
+		for j := 0; j < 10; j++ {
+			s.updateElectionDeadline(g)
+			deadlines[i] = append(deadlines[i], g.electionDeadline)
+		}
+	}
+	for j := range deadlines[0] {
+		if !deadlines[0][j].Equal(deadlines[1][j]) {
+			t.Errorf("%d: election deadlines differ: %s != %s", j, deadlines[0][j], deadlines[1][j])
+		}
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for _, events := range cluster.events {
+		<-events.CommandCommitted
+	}
+
+	index, err := cluster.nodes[0].ReadIndex(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Errorf("expected read index 1; got %d", index)
+	}
+	if _, err := cluster.nodes[1].ReadIndex(groupID); err == nil {
+		t.Error("expected error requesting read index from a follower")
+	}
+	if _, err := cluster.nodes[0].ReadIndex(GroupID(2)); err == nil {
+		t.Error("expected error requesting read index of an unknown group")
+	}
+}
+
+// TestReadIndexNewLeader verifies that a leader which has committed no entry of its own
+// term commits a no-op before returning a read index.
+func TestReadIndexNewLeader(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	index, err := cluster.nodes[0].ReadIndex(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Errorf("expected read index of the leader's no-op entry 1; got %d", index)
+	}
+	entries, err := cluster.nodes[0].DumpLog(groupID, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Type != LogEntryNoop {
+		t.Errorf("expected a no-op entry; got %+v", entries)
+	}
+}
+
+// TestReadIndexTimeout verifies that a read index request fails if a majority of the
+// group doesn't confirm the leader's leadership within the election timeout.
+func TestReadIndexTimeout(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for _, events := range cluster.events {
+		<-events.CommandCommitted
+	}
+
+	cluster.transport.Partition(1, 2, 3)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := cluster.nodes[0].ReadIndex(groupID)
+		errCh <- err
+	}()
+	// Wait for the read's deadline to become the leader's next timer.
+	if err := util.IsTrueWithin(func() bool {
+		clock := cluster.clocks[0]
+		clock.Lock()
+		defer clock.Unlock()
+		return clock.nextElection.Sub(clock.now) == 20*time.Millisecond
+	}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	cluster.clocks[0].triggerElection()
+	if err := <-errCh; err == nil {
+		t.Fatal("expected read index to time out")
+	} else if _, ok := err.(*ReadIndexTimeoutError); !ok {
+		t.Errorf("expected ReadIndexTimeoutError; got %v", err)
+	}
+}
+
+func TestDumpLog(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+	for _, command := range []string{"command1", "command2"} {
+		cluster.nodes[0].SubmitCommand(groupID, []byte(command))
+		for _, events := range cluster.events {
+			<-events.CommandCommitted
+		}
+	}
+
+	entries, err := cluster.nodes[1].DumpLog(groupID, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries; got %+v", entries)
+	}
+	for i, entry := range entries {
+		if entry.Index != i+1 || entry.Type != LogEntryCommand ||
+			string(entry.Payload) != fmt.Sprintf("command%d", i+1) {
+			t.Errorf("%d: unexpected entry %+v", i, entry)
+		}
+	}
+	if entries, err = cluster.nodes[1].DumpLog(groupID, 2, 2); err != nil || len(entries) != 1 {
+		t.Errorf("expected a single entry; got %+v, %v", entries, err)
+	}
+	if _, err := cluster.nodes[1].DumpLog(groupID, 0, 2); err == nil {
+		t.Error("expected error dumping log from index 0")
+	}
+	if _, err := cluster.nodes[1].DumpLog(GroupID(2), 1, 2); err == nil {
+		t.Error("expected error dumping log of unknown group")
+	}
+
+	// The leader reports the progress of each member.
+	status := cluster.nodes[0].GroupStatus(groupID)
+	if status == nil || status.Role != RoleLeader || status.CommitIndex != 2 {
+		t.Fatalf("unexpected leader status %+v", status)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		status := cluster.nodes[0].GroupStatus(groupID)
+		for _, node := range cluster.nodes {
+			if status.MatchIndex[node.nodeID] != 2 || status.NextIndex[node.nodeID] != 3 {
+				return false
+			}
+		}
+		return true
+	}, time.Second); err != nil {
+		t.Errorf("expected all members to match the leader's log: %+v", cluster.nodes[0].GroupStatus(groupID))
+	}
+	if status := cluster.nodes[1].GroupStatus(groupID); status == nil || len(status.MatchIndex) != 0 {
+		t.Errorf("expected follower status without match indices; got %+v", status)
+	}
+	if status := cluster.nodes[1].GroupStatus(GroupID(2)); status != nil {
+		t.Errorf("expected no status for unknown group; got %+v", status)
+	}
+}
+
+func TestMaxUncommittedEntries(t *testing.T) {
+	cluster := newTestClusterWithConfig(3, nil, func(config *Config) {
+		config.MaxUncommittedEntries = 2
+		config.WriteBatchWindow = 100 * time.Millisecond
+	}, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	// The commands are submitted well within the batching window, so none of them can
+	// commit before the limit is reached.
+	for i := 0; i < 2; i++ {
+		if err := cluster.nodes[0].SubmitCommand(groupID, []byte("command")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	if overloaded, ok := err.(*GroupOverloadedError); !ok || !overloaded.CanRetry() ||
+		overloaded.Uncommitted != 2 {
+		t.Fatalf("expected retryable GroupOverloadedError; got %v", err)
+	}
+
+	// Once the entries commit, the leader accepts proposals again.
+	for i := 0; i < 2; i++ {
+		<-cluster.events[0].CommandCommitted
+	}
+	if err := cluster.nodes[0].SubmitCommand(groupID, []byte("command")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxWriteBacklog(t *testing.T) {
+	cluster := newTestClusterWithConfig(3, nil, func(config *Config) {
+		config.MaxWriteBacklog = 2
+	}, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	// With the leader's storage blocked, its entries accumulate in the backlog.
+	cluster.storages[0].Block()
+	for i := 0; i < 2; i++ {
+		if err := cluster.nodes[0].SubmitCommand(groupID, []byte("command")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backlog := cluster.nodes[0].Metrics().WriteBacklog; backlog != 2 {
+		t.Errorf("expected write backlog of 2; got %d", backlog)
+	}
+	err := cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	if busy, ok := err.(*NodeBusyError); !ok || !busy.CanRetry() || busy.Backlog != 2 {
+		t.Fatalf("expected retryable NodeBusyError; got %v", err)
+	}
+
+	// Once storage catches up, the leader accepts proposals again.
+	cluster.storages[0].Unblock()
+	if err := util.IsTrueWithin(func() bool {
+		return cluster.nodes[0].Metrics().WriteBacklog == 0
+	}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.nodes[0].SubmitCommand(groupID, []byte("command")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmitCommandWithPriority(t *testing.T) {
+	cluster := newTestClusterWithConfig(3, nil, func(config *Config) {
+		config.WriteBatchWindow = 100 * time.Millisecond
+	}, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	// The commands are submitted well within the batching window, so all of them are
+	// pending together and the high-priority ones are ordered ahead of the others.
+	for _, proposal := range []struct {
+		command  string
+		priority Priority
+	}{
+		{"normal1", PriorityNormal},
+		{"high1", PriorityHigh},
+		{"normal2", PriorityNormal},
+		{"high2", PriorityHigh},
+	} {
+		if err := cluster.nodes[0].SubmitCommandWithPriority(groupID, []byte(proposal.command),
+			proposal.priority); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var prevIndex int
+	for _, expected := range []string{"high1", "high2", "normal1", "normal2"} {
+		event := <-cluster.events[0].CommandCommitted
+		if string(event.Command) != expected {
+			t.Errorf("expected command %q to commit; got %q", expected, event.Command)
+		}
+		if event.Index <= prevIndex {
+			t.Errorf("expected index after %d; got %d", prevIndex, event.Index)
+		}
+		prevIndex = event.Index
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	var stateMachines []StateMachine
+	for i := 0; i < 3; i++ {
+		stateMachines = append(stateMachines,
+			&testStateMachine{make(chan *EventCommandCommitted, 10)})
+	}
+	cluster := newTestClusterWithConfig(3, stateMachines, func(config *Config) {
+		config.WriteBatchWindow = 50 * time.Millisecond
+	}, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	// The commands are still pending when the barrier is appended, so the barrier can't
+	// return until they have been applied.
+	for i := 0; i < 3; i++ {
+		if err := cluster.nodes[0].SubmitCommand(groupID, []byte("command")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cluster.nodes[0].Barrier(groupID); err != nil {
+		t.Fatal(err)
+	}
+	if applied := len(stateMachines[0].(*testStateMachine).applied); applied != 3 {
+		t.Errorf("expected 3 commands applied before the barrier returned; got %d", applied)
+	}
+
+	// Only the leader can append a barrier.
+	if err := cluster.nodes[1].Barrier(groupID); err == nil {
+		t.Error("expected barrier on a follower to fail")
+	}
+}
+
+func TestStepDown(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+
+	// Only the leader can step down.
+	if err := cluster.nodes[1].StepDown(groupID); err == nil {
+		t.Error("expected follower to fail to step down")
+	}
+
+	// Block the followers' storage so that a barrier is replicated but remains pending.
+	// (The barrier's entry must reach the followers: conflicting log entries aren't
+	// yet truncated, so an entry only in the old leader's log would never commit.)
+	cluster.storages[1].Block()
+	cluster.storages[2].Block()
+	barrierErr := make(chan error, 1)
+	go func() {
+		barrierErr <- cluster.nodes[0].Barrier(groupID)
+	}()
+	if err := util.IsTrueWithin(func() bool {
+		return cluster.nodes[0].GroupStatus(groupID).PersistedLastIndex == 1
+	}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.nodes[0].StepDown(groupID); err != nil {
+		t.Fatal(err)
+	}
+	err := <-barrierErr
+	if _, ok := err.(*LeadershipLostError); !ok {
+		t.Errorf("expected LeadershipLostError; got %v", err)
+	}
+	if event := <-cluster.events[0].LeadershipLost; event.GroupID != groupID ||
+		event.NodeID != cluster.nodes[0].nodeID {
+		t.Errorf("unexpected leadership lost event %+v", event)
+	}
+	if status := cluster.nodes[0].GroupStatus(groupID); status.Role != RoleFollower {
+		t.Errorf("expected former leader to be a follower; got %v", status.Role)
+	}
+	if err := cluster.nodes[0].SubmitCommand(groupID, []byte("command")); err == nil {
+		t.Error("expected former leader to stop proposing")
+	}
+	cluster.storages[1].Unblock()
+	cluster.storages[2].Unblock()
+
+	// Another node can then be elected and commit commands.
+	cluster.waitForElection(1)
+	if err := cluster.nodes[1].SubmitCommand(groupID, []byte("command")); err != nil {
+		t.Fatal(err)
+	}
+	for _, events := range cluster.events {
+		if event := <-events.CommandCommitted; string(event.Command) != "command" {
+			t.Errorf("unexpected command %+v", event)
+		}
+	}
+}
+
+func TestCompactLog(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+	for _, command := range []string{"command1", "command2", "command3"} {
+		cluster.nodes[0].SubmitCommand(groupID, []byte(command))
+		for _, events := range cluster.events {
+			<-events.CommandCommitted
+		}
+	}
+
+	node := cluster.nodes[1]
+	if err := node.CompactLog(groupID, 4); err == nil {
+		t.Error("expected error compacting uncommitted entries")
+	}
+	if err := node.CompactLog(GroupID(2), 1); err == nil {
+		t.Error("expected error compacting log of unknown group")
+	}
+	if err := node.CompactLog(groupID, 3); err != nil {
+		t.Fatal(err)
+	}
+	if status := node.GroupStatus(groupID); status.FirstLogIndex != 3 {
+		t.Errorf("expected first log index 3; got %+v", status)
+	}
+
+	// Reads below the first index fail; reads from it succeed.
+	_, err := node.DumpLog(groupID, 2, 3)
+	if lcErr, ok := err.(*LogCompactedError); !ok || lcErr.FirstIndex != 3 {
+		t.Errorf("expected LogCompactedError; got %v", err)
+	}
+	entries, err := node.DumpLog(groupID, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Payload) != "command3" {
+		t.Errorf("expected only the third entry; got %+v", entries)
+	}
+
+	// Commits continue past the compacted prefix.
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command4"))
+	for _, events := range cluster.events {
+		if event := <-events.CommandCommitted; event.Index != 4 {
+			t.Errorf("expected command at index 4; got %+v", event)
+		}
+	}
+
+	// The compaction was persisted before the new entry, after which storage
+	// refuses to read the discarded entries.  Storage is blocked while it is
+	// inspected.
+	cluster.storages[1].Block()
+	defer cluster.storages[1].Unblock()
+	storage := cluster.storages[1].storage
+	for groupState := range storage.LoadGroups() {
+		if groupState.GroupID == groupID && groupState.FirstLogIndex != 3 {
+			t.Errorf("expected persisted first log index 3; got %+v", groupState)
+		}
+	}
+	ch := make(chan *LogEntryState, 10)
+	go storage.GetLogEntries(groupID, 1, 3, ch)
+	if entry := <-ch; entry.Error == nil {
+		t.Errorf("expected error reading compacted entry; got %+v", entry)
+	}
+}
+
+// TestSnapshotNeededOnce verifies that a follower whose log ends before the leader's
+// first index is reported once, and again only after it has caught up.
+func TestSnapshotNeededOnce(t *testing.T) {
+	mr, err := NewMultiRaft(NodeID(1), &Config{
+		Transport:          NewLocalRPCTransport(),
+		Storage:            NewMemoryStorage(),
+		ElectionTimeoutMin: 10 * time.Millisecond,
+		ElectionTimeoutMax: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newState(mr)
+	groupID := GroupID(1)
+	g := newGroup(groupID, []NodeID{1, 2})
+	g.currentMembers = g.committedMembers
+	g.role = RoleLeader
+	g.firstLogIndex = 5
+	g.lastLogIndex = 8
+	g.persistedLastIndex = 8
+	g.nextIndex[2] = 5
+	s.groups[groupID] = g
+
+	countEvents := func() int {
+		count := 0
+		for {
+			select {
+			case event := <-mr.Events:
+				if e, ok := event.(*EventSnapshotNeeded); ok && e.NodeID == 2 && e.FirstIndex == g.firstLogIndex {
+					count++
+				}
+			default:
+				return count
+			}
+		}
+	}
+	fail := func() {
+		s.appendEntriesResponse(&AppendEntriesRequest{
+			RequestHeader: RequestHeader{1, 2},
+			GroupID:       groupID,
+		}, &AppendEntriesResponse{}, nil)
+	}
+
+	for i := 0; i < 3; i++ {
+		fail()
+	}
+	if count := countEvents(); count != 1 {
+		t.Errorf("expected one snapshot needed event; got %d", count)
+	}
+
+	// Once the follower catches up, falling behind the first index again is reported.
+	s.appendEntriesResponse(&AppendEntriesRequest{
+		RequestHeader: RequestHeader{1, 2},
+		GroupID:       groupID,
+		Entries:       []*LogEntry{{Index: 5}},
+	}, &AppendEntriesResponse{Success: true}, nil)
+	g.firstLogIndex = 7
+	fail()
+	fail()
+	if count := countEvents(); count != 1 {
+		t.Errorf("expected one snapshot needed event after catching up; got %d", count)
+	}
+}
+
+func TestCaughtUpAndFellBehind(t *testing.T) {
+	cluster := newTestClusterWithConfig(3, nil, func(config *Config) {
+		config.FellBehindThreshold = 1
+	}, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.waitForElection(0)
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command1"))
+	for _, events := range cluster.events {
+		<-events.CommandCommitted
+	}
+	// Each follower catches up once it commits the leader's first entry.
+	for i := 1; i < 3; i++ {
+		if event := <-cluster.events[i].CaughtUp; event.GroupID != groupID || event.Index != 1 {
+			t.Errorf("node %d: unexpected caught up event %+v", i, event)
+		}
+	}
+
+	// A follower whose storage is blocked falls behind as the others commit.
+	cluster.storages[2].Block()
+	for _, command := range []string{"command2", "command3"} {
+		cluster.nodes[0].SubmitCommand(groupID, []byte(command))
+		for _, events := range cluster.events[:2] {
+			<-events.CommandCommitted
+		}
+	}
+	if event := <-cluster.events[2].FellBehind; event.GroupID != groupID || event.Index != 1 ||
+		event.LeaderCommitIndex != 3 {
+		t.Errorf("unexpected fell behind event %+v", event)
+	}
+
+	// It catches up again once its storage is unblocked.
+	cluster.storages[2].Unblock()
+	if event := <-cluster.events[2].CaughtUp; event.GroupID != groupID || event.Index != 3 {
+		t.Errorf("unexpected caught up event %+v", event)
+	}
+	for _, events := range cluster.events {
+		select {
+		case event := <-events.FellBehind:
+			t.Errorf("unexpected fell behind event %+v", event)
+		case event := <-events.CaughtUp:
+			t.Errorf("unexpected caught up event %+v", event)
+		default:
+		}
+	}
+}
@@ -30,6 +30,8 @@ type LogEntryType int8
 const (
 	LogEntryCommand LogEntryType = iota
 	LogEntryChangeMembership
+	// LogEntryNoop entries have no payload; they are appended by MultiRaft.Barrier.
+	LogEntryNoop
 )
 
 // LogEntry represents a persistent log entry.  Payloads are interpreted according to
@@ -87,7 +89,8 @@ func (g *GroupElectionState) Equal(other *GroupElectionState) bool {
 	return other != nil && g.CurrentTerm == other.CurrentTerm && g.VotedFor == other.VotedFor
 }
 
-// GroupMembers maintains the members of the group.
+// GroupMembers maintains the members of the group.  A GroupMembers is not modified
+// once it has been assigned to a group; membership changes replace it.
 type GroupMembers struct {
 	// Members contains the current members of the group and is always non-empty.
 	Members []NodeID
@@ -98,12 +101,47 @@ type GroupMembers struct {
 	Observers []NodeID
 }
 
+// Equal returns whether g and o have the same members and observers, in the same order.
+func (g *GroupMembers) Equal(o *GroupMembers) bool {
+	if g == nil || o == nil {
+		return g == o
+	}
+	return nodeIDsEqual(g.Members, o.Members) && nodeIDsEqual(g.Observers, o.Observers)
+}
+
+// Clone returns a deep copy of g, which may be modified without affecting g.
+func (g *GroupMembers) Clone() *GroupMembers {
+	if g == nil {
+		return nil
+	}
+	return &GroupMembers{
+		Members:   append([]NodeID(nil), g.Members...),
+		Observers: append([]NodeID(nil), g.Observers...),
+	}
+}
+
+func nodeIDsEqual(a, b []NodeID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // GroupPersistentState is a unified view of the readable data (except for log entries)
 // about a group; used by Storage.LoadGroups.
 type GroupPersistentState struct {
 	GroupID       GroupID
 	ElectionState GroupElectionState
 	Members       GroupMembers
+	// FirstLogIndex is the index of the first entry remaining in the log; the entries
+	// before it have been discarded by CompactLog.  Zero is treated as 1, the first
+	// index of a log which has never been compacted.
+	FirstLogIndex int
 	LastLogIndex  int
 	LastLogTerm   int
 }
@@ -126,6 +164,9 @@ type Storage interface {
 	// SetGroupElectionState is called to update the election state for the given group.
 	SetGroupElectionState(groupID GroupID, electionState *GroupElectionState) error
 
+	// SetGroupMembers is called to update the committed membership of the given group.
+	SetGroupMembers(groupID GroupID, members *GroupMembers) error
+
 	// AppendLogEntries is called to add entries to the log.  The entries will always span
 	// a contiguous range of indices just after the current end of the log.
 	AppendLogEntries(groupID GroupID, entries []*LogEntry) error
@@ -133,6 +174,12 @@ type Storage interface {
 	// TruncateLog is called to delete all log entries with index > lastIndex.
 	TruncateLog(groupID GroupID, lastIndex int) error
 
+	// CompactLog is called to discard all log entries with index < firstIndex.  The
+	// discarded entries have been committed and their effects captured by the
+	// application, so they are never read again; reads below firstIndex should fail
+	// with a LogCompactedError.
+	CompactLog(groupID GroupID, firstIndex int) error
+
 	// GetLogEntry is called to synchronously retrieve an entry from the log.
 	GetLogEntry(groupID GroupID, index int) (*LogEntry, error)
 
@@ -145,7 +192,11 @@ type Storage interface {
 
 type memoryGroup struct {
 	electionState GroupElectionState
-	entries       []*LogEntry
+	members       GroupMembers
+	// entries is indexed by log index.  Entries before firstIndex have been discarded
+	// by CompactLog and are nil.
+	entries    []*LogEntry
+	firstIndex int
 }
 
 // MemoryStorage is an in-memory implementation of Storage for testing.
@@ -163,8 +214,20 @@ func NewMemoryStorage() *MemoryStorage {
 
 // LoadGroups implements the Storage interface.
 func (m *MemoryStorage) LoadGroups() <-chan *GroupPersistentState {
-	// TODO(bdarnell): replay the group state.
-	ch := make(chan *GroupPersistentState)
+	ch := make(chan *GroupPersistentState, len(m.groups))
+	for groupID, g := range m.groups {
+		state := &GroupPersistentState{
+			GroupID:       groupID,
+			ElectionState: g.electionState,
+			Members:       g.members,
+			FirstLogIndex: g.firstIndex,
+			LastLogIndex:  len(g.entries) - 1,
+		}
+		if lastEntry := g.entries[len(g.entries)-1]; lastEntry != nil {
+			state.LastLogTerm = lastEntry.Term
+		}
+		ch <- state
+	}
 	close(ch)
 	return ch
 }
@@ -176,6 +239,12 @@ func (m *MemoryStorage) SetGroupElectionState(groupID GroupID,
 	return nil
 }
 
+// SetGroupMembers implements the Storage interface.
+func (m *MemoryStorage) SetGroupMembers(groupID GroupID, members *GroupMembers) error {
+	m.getGroup(groupID).members = *members
+	return nil
+}
+
 // AppendLogEntries implements the Storage interface.
 func (m *MemoryStorage) AppendLogEntries(groupID GroupID, entries []*LogEntry) error {
 	g := m.getGroup(groupID)
@@ -194,6 +263,22 @@ func (m *MemoryStorage) TruncateLog(groupID GroupID, lastIndex int) error {
 	panic("unimplemented")
 }
 
+// CompactLog implements the Storage interface.
+func (m *MemoryStorage) CompactLog(groupID GroupID, firstIndex int) error {
+	g := m.getGroup(groupID)
+	if firstIndex >= len(g.entries) {
+		return util.Errorf("cannot compact log through %v; last index is %v", firstIndex-1,
+			len(g.entries)-1)
+	}
+	for i := g.firstIndex; i < firstIndex; i++ {
+		g.entries[i] = nil
+	}
+	if firstIndex > g.firstIndex {
+		g.firstIndex = firstIndex
+	}
+	return nil
+}
+
 // GetLogEntry implements the Storage interface.
 func (m *MemoryStorage) GetLogEntry(groupID GroupID, index int) (*LogEntry, error) {
 	panic("unimplemented")
@@ -203,6 +288,11 @@ func (m *MemoryStorage) GetLogEntry(groupID GroupID, index int) (*LogEntry, erro
 func (m *MemoryStorage) GetLogEntries(groupID GroupID, firstIndex, lastIndex int,
 	ch chan<- *LogEntryState) {
 	g := m.getGroup(groupID)
+	if firstIndex < g.firstIndex {
+		ch <- &LogEntryState{Index: firstIndex, Error: &LogCompactedError{groupID, firstIndex, g.firstIndex}}
+		close(ch)
+		return
+	}
 	for i := firstIndex; i <= lastIndex; i++ {
 		ch <- &LogEntryState{i, *g.entries[i], nil}
 	}
@@ -215,7 +305,8 @@ func (m *MemoryStorage) getGroup(groupID GroupID) *memoryGroup {
 	if !ok {
 		g = &memoryGroup{
 			// Start with a dummy entry because the raft paper uses 1-based indexing.
-			entries: []*LogEntry{nil},
+			entries:    []*LogEntry{nil},
+			firstIndex: 1,
 		}
 		m.groups[groupID] = g
 	}
@@ -225,7 +316,10 @@ func (m *MemoryStorage) getGroup(groupID GroupID) *memoryGroup {
 // groupWriteRequest represents a set of changes to make to a group.
 type groupWriteRequest struct {
 	electionState *GroupElectionState
+	members       *GroupMembers
 	entries       []*LogEntry
+	// firstIndex, if non-zero, is the index before which the log is to be compacted.
+	firstIndex int
 }
 
 // writeRequest is a collection of groupWriteRequests.
@@ -239,11 +333,13 @@ func newWriteRequest() *writeRequest {
 }
 
 // groupWriteResponse represents the final state of a persistent group.
-// metadata may be nil and lastIndex and lastTerm may be -1 if the respective
-// state was not changed (which may be because there were no changes in the request
-// or due to an error)
+// electionState and members may be nil and firstIndex, lastIndex and lastTerm may be -1 if the
+// respective state was not changed (which may be because there were no changes in the
+// request or due to an error)
 type groupWriteResponse struct {
 	electionState *GroupElectionState
+	members       *GroupMembers
+	firstIndex    int
 	lastIndex     int
 	lastTerm      int
 	entries       []*LogEntry
@@ -294,8 +390,15 @@ func (w *writeTask) start() {
 		response := &writeResponse{make(map[GroupID]*groupWriteResponse)}
 
 		for groupID, groupReq := range request.groups {
-			groupResp := &groupWriteResponse{nil, -1, -1, groupReq.entries}
+			groupResp := &groupWriteResponse{nil, nil, -1, -1, -1, groupReq.entries}
 			response.groups[groupID] = groupResp
+			if groupReq.members != nil {
+				err := w.storage.SetGroupMembers(groupID, groupReq.members)
+				if err != nil {
+					continue
+				}
+				groupResp.members = groupReq.members
+			}
 			if groupReq.electionState != nil {
 				err := w.storage.SetGroupElectionState(groupID, groupReq.electionState)
 				if err != nil {
@@ -311,6 +414,13 @@ func (w *writeTask) start() {
 				groupResp.lastIndex = groupReq.entries[len(groupReq.entries)-1].Index
 				groupResp.lastTerm = groupReq.entries[len(groupReq.entries)-1].Term
 			}
+			if groupReq.firstIndex > 0 {
+				err := w.storage.CompactLog(groupID, groupReq.firstIndex)
+				if err != nil {
+					continue
+				}
+				groupResp.firstIndex = groupReq.firstIndex
+			}
 		}
 		w.out <- response
 	}
@@ -42,6 +42,11 @@ func (b *BlockableStorage) SetGroupElectionState(groupID GroupID,
 	return b.storage.SetGroupElectionState(groupID, electionState)
 }
 
+func (b *BlockableStorage) SetGroupMembers(groupID GroupID, members *GroupMembers) error {
+	b.wait()
+	return b.storage.SetGroupMembers(groupID, members)
+}
+
 func (b *BlockableStorage) AppendLogEntries(groupID GroupID, entries []*LogEntry) error {
 	b.wait()
 	return b.storage.AppendLogEntries(groupID, entries)
@@ -52,6 +57,11 @@ func (b *BlockableStorage) TruncateLog(groupID GroupID, lastIndex int) error {
 	return b.storage.TruncateLog(groupID, lastIndex)
 }
 
+func (b *BlockableStorage) CompactLog(groupID GroupID, firstIndex int) error {
+	b.wait()
+	return b.storage.CompactLog(groupID, firstIndex)
+}
+
 func (b *BlockableStorage) GetLogEntry(groupID GroupID, index int) (*LogEntry, error) {
 	b.wait()
 	return b.storage.GetLogEntry(groupID, index)
@@ -136,6 +136,13 @@ type AppendEntriesRequest struct {
 	PrevLogTerm  int
 	Entries      []*LogEntry
 	LeaderCommit int
+	// Quiesce is set by a leader whose group is idle.  The follower suppresses its
+	// election timer until it receives new entries or a vote request.
+	Quiesce bool
+
+	// readRound is the leader's ReadIndex heartbeat round when the request was sent.
+	// It is not transmitted; the leader consults it when handling the response.
+	readRound int
 }
 
 // AppendEntriesResponse is a part of the Raft protocol.  It is public so it can be used
@@ -74,6 +74,8 @@ func (rh *ResponseHeader) GoError() error {
 		return rh.Error.TransactionStatus
 	case rh.Error.TransactionRetry != nil:
 		return rh.Error.TransactionRetry
+	case rh.Error.RangeError != nil:
+		return rh.Error.RangeError
 	default:
 		return nil
 	}
@@ -97,6 +99,8 @@ func (rh *ResponseHeader) SetGoError(err error) {
 		rh.Error = &Error{TransactionStatus: t}
 	case *TransactionRetryError:
 		rh.Error = &Error{TransactionRetry: t}
+	case *RangeError:
+		rh.Error = &Error{RangeError: t}
 	default:
 		var canRetry bool
 		if r, ok := err.(util.Retryable); ok {
@@ -111,6 +115,19 @@ func (rh *ResponseHeader) SetGoError(err error) {
 	}
 }
 
+// GoError converts the Error field of the failed span to a Go error.
+func (fs *FailedSpan) GoError() error {
+	return (&ResponseHeader{Error: fs.Error}).GoError()
+}
+
+// SetGoError sets the Error field of the failed span from the
+// specified Go error, as for ResponseHeader.SetGoError.
+func (fs *FailedSpan) SetGoError(err error) {
+	rh := &ResponseHeader{}
+	rh.SetGoError(err)
+	fs.Error = rh.Error
+}
+
 // Verify verifies the integrity of the get response value.
 func (gr *GetResponse) Verify(req Request) error {
 	if gr.Value != nil {
@@ -52,3 +52,18 @@ func TestResponseHeaderSetGoError(t *testing.T) {
 		t.Error("expected generic error to be retryable")
 	}
 }
+
+// TestResponseHeaderSetGoErrorRangeError verifies that a RangeError
+// is preserved, along with its range and replica addresses.
+func TestResponseHeaderSetGoErrorRangeError(t *testing.T) {
+	desc := &RangeDescriptor{StartKey: []byte("a"), EndKey: []byte("b")}
+	rh := ResponseHeader{}
+	rh.SetGoError(NewRangeError(&testError{}, desc, []string{"host:1"}))
+	err, ok := rh.GoError().(*RangeError)
+	if !ok {
+		t.Fatalf("expected set error to be type RangeError; got %s", reflect.TypeOf(rh.GoError()))
+	}
+	if !err.CanRetry() || !err.Range.Equal(desc) || !reflect.DeepEqual(err.Addrs, []string{"host:1"}) {
+		t.Errorf("unexpected range error %+v", err)
+	}
+}
@@ -63,10 +63,11 @@ func (r *RangeDescriptor) ContainsKey(key []byte) bool {
 }
 
 // ContainsKeyRange returns whether this RangeDescriptor contains the specified
-// key range from start to end.
+// key range from start to end. If end is empty, the single key start is
+// checked.
 func (r *RangeDescriptor) ContainsKeyRange(start, end []byte) bool {
 	if len(end) == 0 {
-		end = start
+		return r.ContainsKey(start)
 	}
 	if bytes.Compare(end, start) < 0 {
 		panic(fmt.Sprintf("start key is larger than end key %q > %q", string(start), string(end)))
@@ -74,6 +75,115 @@ func (r *RangeDescriptor) ContainsKeyRange(start, end []byte) bool {
 	return bytes.Compare(start, r.StartKey) >= 0 && bytes.Compare(r.EndKey, end) >= 0
 }
 
+// Equal returns whether the replica is equal to o, including its
+// attributes.
+func (r Replica) Equal(o Replica) bool {
+	if r.NodeID != o.NodeID || r.StoreID != o.StoreID || r.RangeID != o.RangeID ||
+		len(r.Attrs.Attrs) != len(o.Attrs.Attrs) {
+		return false
+	}
+	for i, attr := range r.Attrs.Attrs {
+		if attr != o.Attrs.Attrs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a deep copy of the replica, which shares no
+// attributes with the original.
+func (r Replica) Clone() Replica {
+	return Replica{
+		NodeID:  r.NodeID,
+		StoreID: r.StoreID,
+		RangeID: r.RangeID,
+		Attrs:   Attributes{Attrs: append([]string(nil), r.Attrs.Attrs...)},
+	}
+}
+
+// Compare orders replicas by node ID and then by store ID, returning
+// -1, 0 or 1 as the replica sorts before, with or after o. Replicas
+// comparing equal are on the same store.
+func (r Replica) Compare(o Replica) int {
+	switch {
+	case r.NodeID < o.NodeID:
+		return -1
+	case r.NodeID > o.NodeID:
+		return 1
+	case r.StoreID < o.StoreID:
+		return -1
+	case r.StoreID > o.StoreID:
+		return 1
+	}
+	return 0
+}
+
+// replicaSlice implements sort.Interface, ordering replicas by
+// Replica.Compare.
+type replicaSlice []Replica
+
+func (rs replicaSlice) Len() int           { return len(rs) }
+func (rs replicaSlice) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs replicaSlice) Less(i, j int) bool { return rs[i].Compare(rs[j]) < 0 }
+
+// NormalizeReplicas sorts the replicas by node and store ID and
+// removes duplicates, keeping the first of any replicas on the same
+// store. Normalized descriptors with the same replicas compare Equal
+// regardless of the order in which the replicas were added. The
+// replicas are copied before sorting, so slices shared with other
+// descriptors are left untouched.
+func (r *RangeDescriptor) NormalizeReplicas() {
+	replicas := append([]Replica(nil), r.Replicas...)
+	sort.Stable(replicaSlice(replicas))
+	n := 0
+	for i, replica := range replicas {
+		if i > 0 && replica.Compare(replicas[n-1]) == 0 {
+			continue
+		}
+		replicas[n] = replica
+		n++
+	}
+	r.Replicas = replicas[:n]
+}
+
+// Equal returns whether the RangeDescriptor has the same key range
+// as o and the same replicas, in the same order. Descriptors should
+// be normalized with NormalizeReplicas before comparison.
+func (r *RangeDescriptor) Equal(o *RangeDescriptor) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	if !bytes.Equal(r.StartKey, o.StartKey) || !bytes.Equal(r.EndKey, o.EndKey) ||
+		len(r.Replicas) != len(o.Replicas) {
+		return false
+	}
+	for i, replica := range r.Replicas {
+		if !replica.Equal(o.Replicas[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a deep copy of the RangeDescriptor, which may be
+// modified without affecting the original.
+func (r *RangeDescriptor) Clone() *RangeDescriptor {
+	if r == nil {
+		return nil
+	}
+	c := &RangeDescriptor{
+		StartKey: append([]byte(nil), r.StartKey...),
+		EndKey:   append([]byte(nil), r.EndKey...),
+	}
+	if r.Replicas != nil {
+		c.Replicas = make([]Replica, len(r.Replicas))
+		for i, replica := range r.Replicas {
+			c.Replicas[i] = replica.Clone()
+		}
+	}
+	return c
+}
+
 // CanRead does a linear search for user to verify read permission.
 func (p *PermConfig) CanRead(user string) bool {
 	for _, u := range p.Read {
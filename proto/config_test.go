@@ -101,6 +101,98 @@ func TestRangeDescriptorContains(t *testing.T) {
 			}
 		}
 	}
+	// An empty end key checks only the start key.
+	if desc.ContainsKeyRange([]byte("b"), nil) {
+		t.Error("expected range end key not to be contained")
+	}
+}
+
+// TestRangeDescriptorEqualAndClone verifies that a cloned descriptor
+// is equal to the original and shares none of its slices.
+func TestRangeDescriptorEqualAndClone(t *testing.T) {
+	desc := &RangeDescriptor{
+		StartKey: []byte("a"),
+		EndKey:   []byte("b"),
+		Replicas: []Replica{
+			{NodeID: 1, StoreID: 1, RangeID: 1, Attrs: Attributes{Attrs: []string{"ssd"}}},
+			{NodeID: 2, StoreID: 2, RangeID: 1, Attrs: Attributes{Attrs: []string{"hdd"}}},
+		},
+	}
+	clone := desc.Clone()
+	if !desc.Equal(clone) || !clone.Equal(desc) {
+		t.Fatalf("expected clone %+v to equal %+v", clone, desc)
+	}
+	clone.StartKey[0] = 'x'
+	clone.Replicas[0].NodeID = 3
+	clone.Replicas[1].Attrs.Attrs[0] = "ssd"
+	if !bytes.Equal(desc.StartKey, []byte("a")) || desc.Replicas[0].NodeID != 1 ||
+		desc.Replicas[1].Attrs.Attrs[0] != "hdd" {
+		t.Errorf("modifying clone modified original: %+v", desc)
+	}
+
+	testCases := []func(d *RangeDescriptor){
+		func(d *RangeDescriptor) { d.EndKey = []byte("c") },
+		func(d *RangeDescriptor) { d.Replicas = d.Replicas[:1] },
+		func(d *RangeDescriptor) { d.Replicas[0].StoreID = 3 },
+		func(d *RangeDescriptor) { d.Replicas[1].Attrs.Attrs = nil },
+	}
+	for i, modify := range testCases {
+		clone := desc.Clone()
+		modify(clone)
+		if desc.Equal(clone) {
+			t.Errorf("%d: expected %+v not to equal %+v", i, clone, desc)
+		}
+	}
+	if desc.Equal(nil) || !(*RangeDescriptor)(nil).Equal(nil) {
+		t.Error("unexpected result comparing with nil descriptor")
+	}
+}
+
+func TestNormalizeReplicas(t *testing.T) {
+	desc := &RangeDescriptor{
+		Replicas: []Replica{
+			{NodeID: 2, StoreID: 1, Attrs: Attributes{Attrs: []string{"first"}}},
+			{NodeID: 1, StoreID: 2},
+			{NodeID: 2, StoreID: 1, Attrs: Attributes{Attrs: []string{"dup"}}},
+			{NodeID: 1, StoreID: 1},
+			{NodeID: 1, StoreID: 2},
+		},
+	}
+	original := desc.Replicas
+	first := original[0]
+	desc.NormalizeReplicas()
+	if len(original) != 5 || !original[0].Equal(first) {
+		t.Errorf("expected original replicas to be left untouched; got %+v", original)
+	}
+	expected := []Replica{
+		{NodeID: 1, StoreID: 1},
+		{NodeID: 1, StoreID: 2},
+		{NodeID: 2, StoreID: 1, Attrs: Attributes{Attrs: []string{"first"}}},
+	}
+	if len(desc.Replicas) != len(expected) {
+		t.Fatalf("expected replicas %+v; got %+v", expected, desc.Replicas)
+	}
+	for i, replica := range expected {
+		if !replica.Equal(desc.Replicas[i]) {
+			t.Errorf("%d: expected replica %+v; got %+v", i, replica, desc.Replicas[i])
+		}
+	}
+
+	testCases := []struct {
+		a, b     Replica
+		expected int
+	}{
+		{Replica{NodeID: 1, StoreID: 1}, Replica{NodeID: 1, StoreID: 1}, 0},
+		{Replica{NodeID: 1, StoreID: 2}, Replica{NodeID: 2, StoreID: 1}, -1},
+		{Replica{NodeID: 2, StoreID: 1}, Replica{NodeID: 1, StoreID: 2}, 1},
+		{Replica{NodeID: 1, StoreID: 1}, Replica{NodeID: 1, StoreID: 2}, -1},
+		{Replica{NodeID: 1, StoreID: 2, RangeID: 1}, Replica{NodeID: 1, StoreID: 2, RangeID: 2}, 0},
+	}
+	for i, test := range testCases {
+		if c := test.a.Compare(test.b); c != test.expected {
+			t.Errorf("%d: expected %+v.Compare(%+v) = %d; got %d", i, test.a, test.b, test.expected, c)
+		}
+	}
 }
 
 var testConfig = ZoneConfig{
@@ -44,10 +44,42 @@ func (t Timestamp) Equal(s Timestamp) bool {
 	return t.WallTime == s.WallTime && t.Logical == s.Logical
 }
 
+// InBounds returns whether each component of the timestamp lies
+// within the bounds given by MinTimestamp and MaxTimestamp.
+func (t Timestamp) InBounds() bool {
+	return t.WallTime >= MinTimestamp.WallTime && t.WallTime <= MaxTimestamp.WallTime &&
+		t.Logical >= MinTimestamp.Logical && t.Logical <= MaxTimestamp.Logical
+}
+
+// Sanitized returns the timestamp unchanged if it's in bounds and
+// otherwise returns an error. Timestamps arriving via RPC or derived
+// by arithmetic should be sanitized before use as MVCC versions.
+func (t Timestamp) Sanitized() (Timestamp, error) {
+	if !t.InBounds() {
+		return Timestamp{}, util.Errorf("timestamp %+v out of bounds: components must lie between %+v and %+v",
+			t, MinTimestamp, MaxTimestamp)
+	}
+	return t, nil
+}
+
+// Clamped is a lenient variant of Sanitized which, instead of
+// returning an error, replaces each negative component of the
+// timestamp with the corresponding component of MinTimestamp.
+func (t Timestamp) Clamped() Timestamp {
+	if t.WallTime < MinTimestamp.WallTime {
+		t.WallTime = MinTimestamp.WallTime
+	}
+	if t.Logical < MinTimestamp.Logical {
+		t.Logical = MinTimestamp.Logical
+	}
+	return t
+}
+
 // InitChecksum initializes a checksum based on the provided key and
 // the contents of the value. If the value contains a byte slice, the
 // checksum includes it directly; if the value contains an integer,
 // the checksum includes the integer as 8 bytes in big-endian order.
+// Any tags follow, in order.
 func (v *Value) InitChecksum(key []byte) {
 	if v.Checksum == nil {
 		v.Checksum = gogoproto.Uint32(v.computeChecksum(key))
@@ -74,6 +106,8 @@ func (v *Value) Verify(key []byte) error {
 // the contents of the value. If the value contains a byte slice, the
 // checksum includes it directly; if the value contains an integer,
 // the checksum includes the integer as 8 bytes in big-endian order.
+// Each tag's key and value follow, each prefixed by its length, so
+// that the checksums of untagged values are unchanged.
 func (v *Value) computeChecksum(key []byte) uint32 {
 	c := encoding.NewCRC32Checksum(key)
 	if v.Bytes != nil {
@@ -81,5 +115,22 @@ func (v *Value) computeChecksum(key []byte) uint32 {
 	} else if v.Integer != nil {
 		c.Write(encoding.EncodeUint64(nil, uint64(v.GetInteger())))
 	}
+	for _, tag := range v.Tags {
+		for _, s := range []string{tag.Key, tag.Value} {
+			c.Write(encoding.EncodeUint32(nil, uint32(len(s))))
+			c.Write([]byte(s))
+		}
+	}
 	return c.Sum32()
 }
+
+// GetTag returns the value of the tag with the specified key and
+// whether the tag is present.
+func (v *Value) GetTag(key string) (string, bool) {
+	for _, tag := range v.Tags {
+		if tag.Key == key {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
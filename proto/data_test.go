@@ -63,6 +63,35 @@ func TestEqual(t *testing.T) {
 	}
 }
 
+func TestTimestampBounds(t *testing.T) {
+	testCases := []struct {
+		ts       Timestamp
+		inBounds bool
+		clamped  Timestamp
+	}{
+		{MinTimestamp, true, MinTimestamp},
+		{MaxTimestamp, true, MaxTimestamp},
+		{makeTS(1, 1), true, makeTS(1, 1)},
+		{makeTS(-1, 0), false, makeTS(0, 0)},
+		{makeTS(1, -1), false, makeTS(1, 0)},
+		{makeTS(-1, -1), false, MinTimestamp},
+	}
+	for i, test := range testCases {
+		if inBounds := test.ts.InBounds(); inBounds != test.inBounds {
+			t.Errorf("%d: expected in bounds %t; got %t", i, test.inBounds, inBounds)
+		}
+		ts, err := test.ts.Sanitized()
+		if test.inBounds && (err != nil || !ts.Equal(test.ts)) {
+			t.Errorf("%d: expected %+v; got %+v, %v", i, test.ts, ts, err)
+		} else if !test.inBounds && err == nil {
+			t.Errorf("%d: expected error sanitizing %+v", i, test.ts)
+		}
+		if clamped := test.ts.Clamped(); !clamped.Equal(test.clamped) {
+			t.Errorf("%d: expected clamped %+v; got %+v", i, test.clamped, clamped)
+		}
+	}
+}
+
 func TestValueBothBytesAndIntegerSet(t *testing.T) {
 	k := []byte("key")
 	v := Value{Bytes: []byte("a"), Integer: gogoproto.Int64(0)}
@@ -105,6 +134,38 @@ func TestValueChecksumWithBytes(t *testing.T) {
 	}
 }
 
+func TestValueChecksumWithTags(t *testing.T) {
+	k := []byte("key")
+	untagged := Value{Bytes: []byte("abc")}
+	untagged.InitChecksum(k)
+	v := Value{Bytes: []byte("abc"), Tags: []ValueTag{
+		{Key: "content-type", Value: "text/plain"},
+		{Key: "version", Value: "2"},
+	}}
+	v.InitChecksum(k)
+	if err := v.Verify(k); err != nil {
+		t.Error(err)
+	}
+	if v.GetChecksum() == untagged.GetChecksum() {
+		t.Error("expected tags to change the checksum")
+	}
+	if tag, ok := v.GetTag("version"); !ok || tag != "2" {
+		t.Errorf("expected tag version=2; got %q, %t", tag, ok)
+	}
+	if _, ok := v.GetTag("missing"); ok {
+		t.Error("expected missing tag to be absent")
+	}
+	// Mess with a tag; moving bytes between key and value should also fail.
+	v.Tags[1].Value = "3"
+	if err := v.Verify(k); err == nil {
+		t.Error("expected checksum verification failure on different tag")
+	}
+	v.Tags[1] = ValueTag{Key: "version2"}
+	if err := v.Verify(k); err == nil {
+		t.Error("expected checksum verification failure on different tag")
+	}
+}
+
 func TestValueChecksumWithInteger(t *testing.T) {
 	k := []byte("key")
 	testValues := []int64{0, 1, -1, math.MinInt64, math.MaxInt64}
@@ -17,7 +17,12 @@
 
 package proto
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/util"
+)
 
 // Error implements the Go error interface.
 func (ge *GenericError) Error() string {
@@ -100,3 +105,29 @@ func (e *TransactionRetryError) Error() string {
 func (e *TransactionRetryError) CanRetry() bool {
 	return true
 }
+
+// NewRangeError initializes a new RangeError for err, which occurred
+// sending a command to the replicas at addrs of the range described
+// by desc. The RangeError is retryable if err is.
+func NewRangeError(err error, desc *RangeDescriptor, addrs []string) *RangeError {
+	e := &RangeError{
+		Message: err.Error(),
+		Range:   *desc,
+		Addrs:   addrs,
+	}
+	if r, ok := err.(util.Retryable); ok {
+		e.Retryable = r.CanRetry()
+	}
+	return e
+}
+
+// Error formats error.
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("range %q-%q (replicas tried: [%s]): %s",
+		string(e.Range.StartKey), string(e.Range.EndKey), strings.Join(e.Addrs, " "), e.Message)
+}
+
+// CanRetry indicates whether or not this RangeError can be retried.
+func (e *RangeError) CanRetry() bool {
+	return e.Retryable
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"net"
+	"net/rpc"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A PermissionCheck is invoked with the method and header of each
+// request received over TLS from a client other than a cluster node,
+// after the header's user has been set from the client certificate.
+// Returning an error rejects the request.
+type PermissionCheck func(method string, header *proto.RequestHeader) error
+
+// headerRequest is implemented by requests carrying a RequestHeader.
+type headerRequest interface {
+	Header() *proto.RequestHeader
+}
+
+// authenticateUser verifies the user in header against the peer's
+// verified certificate. Peers presenting a certificate with the same
+// subject as the node certificate are cluster nodes and may issue
+// requests on behalf of any user; the header is left unchanged and
+// false is returned. Any other peer is identified by the common name
+// of its certificate's subject: the header's user is set to it if
+// empty, and the request is rejected if it names a different user.
+// Returns true if the peer is a client rather than a cluster node.
+func authenticateUser(nodeSubject []byte, peer *x509.Certificate, header *proto.RequestHeader) (bool, error) {
+	if nodeSubject != nil && bytes.Equal(peer.RawSubject, nodeSubject) {
+		return false, nil
+	}
+	user := peer.Subject.CommonName
+	if user == "" {
+		return true, util.Errorf("client certificate does not identify a user")
+	}
+	if header.User == "" {
+		header.User = user
+	} else if header.User != user {
+		return true, util.Errorf("request user %q does not match certificate user %q", header.User, user)
+	}
+	return true, nil
+}
+
+// nodeSubject returns the raw subject of the node certificate, or nil
+// if TLS is disabled or the certificate cannot be parsed.
+func (c *TLSConfig) nodeSubject() []byte {
+	cfg := c.Config()
+	if cfg == nil || len(cfg.Certificates) == 0 || len(cfg.Certificates[0].Certificate) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return cert.RawSubject
+}
+
+// serverCodec is a gob rpc.ServerCodec, as used by rpc.ServeConn,
+// which additionally authenticates the user of each request received
+// over a TLS connection before it is dispatched.
+type serverCodec struct {
+	conn        net.Conn
+	dec         *gob.Decoder
+	enc         *gob.Encoder
+	encBuf      *bufio.Writer
+	closed      bool
+	nodeSubject []byte
+	check       PermissionCheck
+	method      string // Method of the request being read
+}
+
+func newServerCodec(conn net.Conn, nodeSubject []byte, check PermissionCheck) *serverCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{
+		conn:        conn,
+		dec:         gob.NewDecoder(conn),
+		enc:         gob.NewEncoder(buf),
+		encBuf:      buf,
+		nodeSubject: nodeSubject,
+		check:       check,
+	}
+}
+
+// ReadRequestHeader implements rpc.ServerCodec.
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.method = r.ServiceMethod
+	return nil
+}
+
+// ReadRequestBody implements rpc.ServerCodec. An error returned
+// after the body has been decoded is sent to the client in reply to
+// the request.
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	args, ok := body.(headerRequest)
+	if !ok {
+		return nil
+	}
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		// Without TLS, the header is trusted as is.
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return util.Errorf("%s: no client certificate presented", c.method)
+	}
+	client, err := authenticateUser(c.nodeSubject, state.PeerCertificates[0], args.Header())
+	if err != nil {
+		return err
+	}
+	if client && c.check != nil {
+		return c.check(c.method, args.Header())
+	}
+	return nil
+}
+
+// WriteResponse implements rpc.ServerCodec.
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header; shut down the connection.
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+// Close implements rpc.ServerCodec.
+func (c *serverCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// TestAuthenticateUser verifies that cluster nodes may issue requests
+// on behalf of any user, while other clients are identified by their
+// certificate's common name.
+func TestAuthenticateUser(t *testing.T) {
+	nodeSubject := []byte("node subject")
+	node := &x509.Certificate{RawSubject: nodeSubject, Subject: pkix.Name{CommonName: "node"}}
+	client := &x509.Certificate{RawSubject: []byte("client subject"), Subject: pkix.Name{CommonName: "alice"}}
+	anonymous := &x509.Certificate{RawSubject: []byte("anonymous subject")}
+
+	testCases := []struct {
+		peer       *x509.Certificate
+		user       string
+		expClient  bool
+		expUser    string
+		expSuccess bool
+	}{
+		{node, "", false, "", true},
+		{node, "bob", false, "bob", true},
+		{client, "", true, "alice", true},
+		{client, "alice", true, "alice", true},
+		{client, "bob", true, "bob", false},
+		{anonymous, "", true, "", false},
+	}
+	for i, test := range testCases {
+		header := &proto.RequestHeader{User: test.user}
+		isClient, err := authenticateUser(nodeSubject, test.peer, header)
+		if (err == nil) != test.expSuccess {
+			t.Errorf("%d: expected success=%t; got %v", i, test.expSuccess, err)
+		}
+		if isClient != test.expClient {
+			t.Errorf("%d: expected client=%t; got %t", i, test.expClient, isClient)
+		}
+		if header.User != test.expUser {
+			t.Errorf("%d: expected user %q; got %q", i, test.expUser, header.User)
+		}
+	}
+}
+
+// TestNodeSubject verifies that the node certificate's subject is
+// extracted from the TLS config, and that none is returned when TLS
+// is disabled.
+func TestNodeSubject(t *testing.T) {
+	tlsConfig, err := LoadTestTLSConfig("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(tlsConfig.config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := tlsConfig.nodeSubject(); string(subject) != string(cert.RawSubject) {
+		t.Errorf("expected node subject %q; got %q", cert.RawSubject, subject)
+	}
+	if subject := LoadInsecureTLSConfig().nodeSubject(); subject != nil {
+		t.Errorf("expected no node subject without TLS; got %q", subject)
+	}
+}
@@ -20,10 +20,12 @@ package rpc
 import (
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"net/rpc"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/cockroachdb/cockroach/proto"
@@ -43,6 +45,21 @@ type Options struct {
 	// Timeout is the maximum duration of an RPC before failure.
 	// 0 for no timeout.
 	Timeout time.Duration
+	// RecordLatency, if not nil, is invoked with the address of each
+	// replica which replies successfully and the time it took to reply.
+	RecordLatency func(addr net.Addr, latency time.Duration)
+	// RecordError, if not nil, is invoked with the address of each
+	// replica to which the RPC fails, either with an error from the
+	// RPC system or a timeout, and the error.
+	RecordError func(addr net.Addr, err error)
+	// RecordReply, if not nil, is invoked with the address of each
+	// replica which replies successfully and its reply.
+	RecordReply func(addr net.Addr, reply interface{})
+	// Order, if not nil, specifies the order of preference in which
+	// replicas are sent RPCs. Replicas whose clients are known to be
+	// unhealthy are still tried only after the healthy ones. If nil,
+	// replicas are tried in random order.
+	Order []net.Addr
 }
 
 // An rpcError indicates a failure to send the RPC. rpcErrors are
@@ -102,18 +119,18 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 		}
 	}
 
-	// Randomly permute order, but keep known-unhealthy clients
-	// separate.
-	// TODO(spencer): going to need to also sort by affinity; closest
-	// ping time should win. Makes sense to have the rpc client/server
-	// heartbeat measure ping times. With a bit of seasoning, each
-	// node will be able to order the healthy replicas based on latency.
+	// Order clients as specified, or else randomly permute order, but
+	// keep known-unhealthy clients separate.
 	var clients []*Client
-	for _, idx := range rand.Perm(len(healthy)) {
-		clients = append(clients, healthy[idx])
-	}
-	for _, idx := range rand.Perm(len(unhealthy)) {
-		clients = append(clients, unhealthy[idx])
+	if opts.Order != nil {
+		clients = append(orderClients(healthy, opts.Order), orderClients(unhealthy, opts.Order)...)
+	} else {
+		for _, idx := range rand.Perm(len(healthy)) {
+			clients = append(clients, healthy[idx])
+		}
+		for _, idx := range rand.Perm(len(unhealthy)) {
+			clients = append(clients, unhealthy[idx])
+		}
 	}
 
 	// Send RPCs to replicas as necessary to achieve opts.N successes.
@@ -135,7 +152,7 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 			if log.V(1) {
 				log.Infof("%s: sending request to %s: %+v", method, clients[index].Addr(), args)
 			}
-			go sendOne(clients[index], opts.Timeout, method, args, reply, helperChan)
+			go sendOne(clients[index], opts, method, args, reply, helperChan)
 		}
 		// Wait for completions.
 		select {
@@ -179,11 +196,55 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 	}
 }
 
+// clientsByOrder sorts clients by the position of their addresses in
+// an order of preference. Clients whose addresses don't appear in the
+// order sort last.
+type clientsByOrder struct {
+	clients  []*Client
+	position map[string]int
+}
+
+func (c clientsByOrder) Len() int      { return len(c.clients) }
+func (c clientsByOrder) Swap(i, j int) { c.clients[i], c.clients[j] = c.clients[j], c.clients[i] }
+func (c clientsByOrder) Less(i, j int) bool {
+	return c.pos(c.clients[i]) < c.pos(c.clients[j])
+}
+
+func (c clientsByOrder) pos(client *Client) int {
+	if i, ok := c.position[client.Addr().String()]; ok {
+		return i
+	}
+	return math.MaxInt32
+}
+
+// orderClients sorts clients by the position of their addresses in
+// order and returns them.
+func orderClients(clients []*Client, order []net.Addr) []*Client {
+	position := make(map[string]int, len(order))
+	for i, addr := range order {
+		if _, ok := position[addr.String()]; !ok {
+			position[addr.String()] = i
+		}
+	}
+	sort.Stable(clientsByOrder{clients, position})
+	return clients
+}
+
 // sendOne invokes the specified RPC on the supplied client when the
 // client is ready. On success, the reply is sent on the channel;
-// otherwise an error is sent.
-func sendOne(client *Client, timeout time.Duration, method string, args, reply interface{}, c chan interface{}) {
+// otherwise an error is sent. Successful replies are passed to
+// opts.RecordLatency, if set, along with the duration of the call;
+// failed calls are passed to opts.RecordError, if set.
+func sendOne(client *Client, opts Options, method string, args, reply interface{}, c chan interface{}) {
+	timeout := opts.Timeout
+	fail := func(err error) {
+		if opts.RecordError != nil {
+			opts.RecordError(client.Addr(), err)
+		}
+		c <- err
+	}
 	<-client.Ready
+	start := time.Now()
 	call := client.Go(method, args, reply, nil)
 	select {
 	case <-call.Done:
@@ -193,10 +254,10 @@ func sendOne(client *Client, timeout time.Duration, method string, args, reply i
 			case rpc.ErrShutdown: // client connection fails: rpc/client.go
 				fallthrough
 			case io.ErrUnexpectedEOF: // server connection fails: rpc/client.go
-				c <- rpcError{call.Error.Error()}
+				fail(rpcError{call.Error.Error()})
 			default:
 				// Otherwise, not retryable; just return error.
-				c <- call.Error
+				fail(call.Error)
 			}
 		} else {
 			// Verify response data integrity if this is a proto response.
@@ -208,11 +269,17 @@ func sendOne(client *Client, timeout time.Duration, method string, args, reply i
 					}
 				}
 			}
+			if opts.RecordLatency != nil {
+				opts.RecordLatency(client.Addr(), time.Since(start))
+			}
+			if opts.RecordReply != nil {
+				opts.RecordReply(client.Addr(), reply)
+			}
 			c <- reply
 		}
 	case <-client.Closed:
-		c <- rpcError{fmt.Sprintf("rpc to %s failed as client connection was closed", method)}
+		fail(rpcError{fmt.Sprintf("rpc to %s failed as client connection was closed", method)})
 	case <-time.After(timeout):
-		c <- rpcError{fmt.Sprintf("rpc to %s timed out after %s", method, timeout)}
+		fail(rpcError{fmt.Sprintf("rpc to %s timed out after %s", method, timeout)})
 	}
 }
@@ -37,7 +37,8 @@ type Server struct {
 	*rpc.Server              // Embedded RPC server instance
 	listener    net.Listener // Server listener
 
-	tlsConfig *TLSConfig // The config we need for tls.Listen
+	tlsConfig *TLSConfig      // The config we need for tls.Listen
+	check     PermissionCheck // Checks requests from clients; may be nil
 
 	mu             sync.RWMutex          // Mutex protects the fields below
 	addr           net.Addr              // Server address; may change if picking unused port
@@ -57,6 +58,14 @@ func NewServer(addr net.Addr, tlsConfig *TLSConfig) *Server {
 	return s
 }
 
+// SetPermissionCheck sets a check to be invoked on each request
+// received over TLS from a client other than a cluster node, after
+// the user in the request header has been verified against the
+// client certificate. It must be called before the server is started.
+func (s *Server) SetPermissionCheck(check PermissionCheck) {
+	s.check = check
+}
+
 // AddCloseCallback adds a callback to the closeCallbacks slice to
 // be invoked when a connection is closed.
 func (s *Server) AddCloseCallback(cb func(conn net.Conn)) {
@@ -162,10 +171,12 @@ func (s *Server) Close() {
 	}
 }
 
-// serveConn synchronously serves a single connection. When the
-// connection is closed, close callbacks are invoked.
+// serveConn synchronously serves a single connection. Requests
+// received over TLS are authenticated against the client certificate
+// (see authenticateUser). When the connection is closed, close
+// callbacks are invoked.
 func (s *Server) serveConn(conn net.Conn) {
-	s.ServeConn(conn)
+	s.ServeCodec(newServerCodec(conn, s.tlsConfig.nodeSubject(), s.check))
 	s.mu.Lock()
 	if s.closeCallbacks != nil {
 		for _, cb := range s.closeCallbacks {
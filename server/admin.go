@@ -18,14 +18,19 @@
 package server
 
 import (
+	"encoding/json"
 	_ "expvar"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage"
 )
 
@@ -38,8 +43,27 @@ const (
 	debugKeyPrefix = "/debug/"
 	// healthzKey is the healthz endpoint.
 	healthzKey = adminKeyPrefix + "healthz"
+	// readyKey is the readiness endpoint.
+	readyKey = adminKeyPrefix + "ready"
 	// zoneKeyPrefix is the prefix for zone configuration changes.
 	zoneKeyPrefix = adminKeyPrefix + "zones"
+	// splitKeyPrefix is the prefix for manual range splits.
+	splitKeyPrefix = adminKeyPrefix + "split"
+	// rangeCacheKey is the endpoint which dumps and clears the range
+	// metadata cache.
+	rangeCacheKey = adminKeyPrefix + "rangecache"
+	// rangeCacheEvictionsKey is the endpoint which reports evictions
+	// from the range metadata cache.
+	rangeCacheEvictionsKey = rangeCacheKey + "/evictions"
+	// maintenanceKey is the endpoint which reports and toggles
+	// read-only maintenance mode.
+	maintenanceKey = adminKeyPrefix + "maintenance"
+	// decommissionStatusKey is the endpoint which reports the number of
+	// replicas remaining on each node.
+	decommissionStatusKey = adminKeyPrefix + "decommission-status"
+	// drainKeyPrefix is the prefix for setting and clearing the drain
+	// flags of nodes being decommissioned.
+	drainKeyPrefix = adminKeyPrefix + "drain"
 )
 
 // A actionHandler is an interface which provides Get, Put & Delete
@@ -50,19 +74,38 @@ type actionHandler interface {
 	Delete(path string, r *http.Request) error
 }
 
+// A rangeCache is the node's range metadata cache, as inspected and
+// cleared by the admin endpoints. It is implemented by kv.DistKV.
+type rangeCache interface {
+	DumpRangeCache() []proto.RangeDescriptor
+	InvalidateRangeCache()
+	RangeCacheEvictions() kv.RangeCacheEvictionStats
+}
+
 // A adminServer provides a RESTful HTTP API to administration of
 // the cockroach cluster.
 type adminServer struct {
-	db   storage.DB // Key-value database client
-	zone *zoneHandler
+	db         storage.DB       // Key-value database client
+	ready      func() error     // Returns nil if the node is ready to serve
+	rangeCache rangeCache       // The node's range metadata cache
+	maint      *maintenanceMode // The node's maintenance mode
+	zone       *zoneHandler
+	split      *splitHandler
 }
 
 // newAdminServer allocates and returns a new REST server for
-// administrative APIs.
-func newAdminServer(db storage.DB) *adminServer {
+// administrative APIs. The ready function reports whether the node
+// is ready to serve traffic, rangeCache is the node's range metadata
+// cache and maint is toggled by the maintenance endpoint.
+func newAdminServer(db storage.DB, ready func() error, rangeCache rangeCache,
+	maint *maintenanceMode) *adminServer {
 	return &adminServer{
-		db:   db,
-		zone: &zoneHandler{db: db},
+		db:         db,
+		ready:      ready,
+		rangeCache: rangeCache,
+		maint:      maint,
+		zone:       &zoneHandler{db: db},
+		split:      &splitHandler{db: db},
 	}
 }
 
@@ -73,8 +116,15 @@ func (s *adminServer) RegisterHandlers(mux *http.ServeMux) {
 	// get exported variables and pprof tools.
 	mux.HandleFunc(debugKeyPrefix, s.handleDebug)
 	mux.HandleFunc(healthzKey, s.handleHealthz)
+	mux.HandleFunc(readyKey, s.handleReady)
+	mux.HandleFunc(rangeCacheKey, s.handleRangeCache)
+	mux.HandleFunc(rangeCacheEvictionsKey, s.handleRangeCacheEvictions)
+	mux.HandleFunc(maintenanceKey, s.handleMaintenance)
+	mux.HandleFunc(decommissionStatusKey, s.handleDecommissionStatus)
+	mux.HandleFunc(drainKeyPrefix+"/", s.handleDrainAction)
 	mux.HandleFunc(zoneKeyPrefix, s.handleZoneAction)
 	mux.HandleFunc(zoneKeyPrefix+"/", s.handleZoneAction)
+	mux.HandleFunc(splitKeyPrefix+"/", s.handleSplitAction)
 }
 
 // handleHealthz responds to health requests from monitoring services.
@@ -83,6 +133,179 @@ func (s *adminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "ok")
 }
 
+// handleReady responds to readiness requests from load balancers and
+// orchestration systems. Whereas healthz reports only that the
+// process is live, ready returns "ok" only once the node can serve
+// traffic and otherwise responds with 503 Service Unavailable and
+// the reason.
+func (s *adminServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := s.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleRangeCache responds with the range descriptors in the node's
+// range metadata cache, ordered by key, as a JSON array. This is the
+// place to start when requests are routed to the wrong node. DELETE
+// clears the cache, e.g. to stop a storm of misrouted requests after
+// ranges have been widely rebalanced.
+func (s *adminServer) handleRangeCache(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		s.rangeCache.InvalidateRangeCache()
+		newRequestLogger(r).Infof("range metadata cache cleared")
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "ok")
+		return
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	ranges := []rangeDesc{}
+	for _, desc := range s.rangeCache.DumpRangeCache() {
+		ranges = append(ranges, newRangeDesc(&desc))
+	}
+	b, err := json.Marshal(ranges)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// A rangeCacheEviction is the JSON-formatted description of an
+// eviction from the range metadata cache.
+type rangeCacheEviction struct {
+	Time   time.Time `json:"time"`
+	Key    string    `json:"key,omitempty"`
+	Range  rangeDesc `json:"range"`
+	Cause  string    `json:"cause"`
+	Reason string    `json:"reason"`
+}
+
+// handleRangeCacheEvictions responds with the number of evictions
+// from the node's range metadata cache of each cause (stale,
+// transient, manual or capacity) and the most recent evictions, newest
+// first, as JSON. Whether requests are misrouted because ranges are
+// moving or because replicas are unavailable can be told from the
+// causes.
+func (s *adminServer) handleRangeCacheEvictions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	stats := s.rangeCache.RangeCacheEvictions()
+	out := struct {
+		Counts map[string]int64     `json:"counts"`
+		Recent []rangeCacheEviction `json:"recent"`
+	}{Counts: stats.Counts, Recent: []rangeCacheEviction{}}
+	for i := range stats.Recent {
+		e := &stats.Recent[i]
+		out.Recent = append(out.Recent, rangeCacheEviction{
+			Time:   e.Time,
+			Key:    url.QueryEscape(string(e.Key)),
+			Range:  newRangeDesc(&e.Desc),
+			Cause:  e.Cause.String(),
+			Reason: e.Reason,
+		})
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleMaintenance reports whether the node is in read-only
+// maintenance mode in response to GET and, in response to PUT or
+// POST, enables or disables it according to the boolean request body
+// (e.g. "true" or "false"). While enabled, writes received by the
+// node are rejected and the readiness endpoint reports the node as
+// unavailable.
+func (s *adminServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		defer r.Body.Close()
+		enabled, err := strconv.ParseBool(strings.TrimSpace(string(b)))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid maintenance mode %q: %s", b, err), http.StatusBadRequest)
+			return
+		}
+		s.maint.setEnabled(enabled)
+		newRequestLogger(r).Infof("maintenance mode enabled: %t", enabled)
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, s.maint.isEnabled())
+}
+
+// handleDecommissionStatus responds with the number of ranges in the
+// cluster and the number of replicas placed on each node, as JSON,
+// along with whether each node is draining and, if so, when it is
+// estimated to be empty. Operators removing a node watch its count
+// fall to zero, at which point it can be shut down.
+func (s *adminServer) handleDecommissionStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	status, err := readDecommissionStatus(s.db, time.Now())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleDrainAction sets the drain flag of the node whose ID is
+// specified by the request path in response to PUT or POST, and
+// clears it in response to DELETE. Responds with whether the node is
+// draining.
+func (s *adminServer) handleDrainAction(w http.ResponseWriter, r *http.Request) {
+	nodeID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, drainKeyPrefix+"/"), 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid node ID: %s", err), http.StatusBadRequest)
+		return
+	}
+	var draining bool
+	switch r.Method {
+	case "PUT", "POST":
+		draining = true
+	case "DELETE":
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if err := setNodeDraining(s.db, int32(nodeID), draining, time.Now()); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	newRequestLogger(r).Infof("node %d draining: %t", nodeID, draining)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, draining)
+}
+
 // handleDebug passes requests with the debugKeyPrefix onto the default
 // serve mux, which is preconfigured (by import of expvar and net/http/pprof)
 // to serve endpoints which access exported variables and pprof tools.
@@ -105,6 +328,27 @@ func (s *adminServer) handleZoneAction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleSplitAction splits the range containing the key specified by
+// the request path at that key. Only PUT and POST are supported.
+func (s *adminServer) handleSplitAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" && r.Method != "POST" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	path, err := unescapePath(r.URL.Path, splitKeyPrefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, contentType, err := s.split.Split(path)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	fmt.Fprintf(w, "%s", string(b))
+}
+
 func unescapePath(path, prefix string) (string, error) {
 	result, err := url.QueryUnescape(strings.TrimPrefix(path, prefix))
 	if err != nil {
@@ -121,12 +365,12 @@ func (s *adminServer) handlePutAction(handler actionHandler, w http.ResponseWrit
 	}
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	defer r.Body.Close()
 	if err = handler.Put(path, b, r); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -140,7 +384,7 @@ func (s *adminServer) handleGetAction(handler actionHandler, w http.ResponseWrit
 	}
 	b, contentType, err := handler.Get(path, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", contentType)
@@ -154,7 +398,7 @@ func (s *adminServer) handleDeleteAction(handler actionHandler, w http.ResponseW
 		return
 	}
 	if err = handler.Delete(path, r); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -19,16 +19,20 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
@@ -41,7 +45,7 @@ func startAdminServer() *httptest.Server {
 	if err != nil {
 		log.Fatal(err)
 	}
-	admin := newAdminServer(db)
+	admin := newAdminServer(db, func() error { return nil }, nil, &maintenanceMode{})
 	mux := http.NewServeMux()
 	admin.RegisterHandlers(mux)
 	httpServer := httptest.NewServer(mux)
@@ -108,3 +112,295 @@ func TestAdminDebugPprof(t *testing.T) {
 		t.Errorf("expected match: %t; err nil: %v", matches, err)
 	}
 }
+
+// TestAdminReady verifies that the readiness endpoint responds with
+// 503 Service Unavailable and the reason until the node is ready.
+func TestAdminReady(t *testing.T) {
+	var readyErr error
+	admin := newAdminServer(nil, func() error { return readyErr }, nil, &maintenanceMode{})
+	mux := http.NewServeMux()
+	admin.RegisterHandlers(mux)
+
+	readyErr = util.Error("not connected to gossip network")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: readyKey}})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d; got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "gossip") {
+		t.Errorf("expected reason in body; got %q", w.Body.String())
+	}
+
+	readyErr = nil
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: readyKey}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ok") {
+		t.Errorf("expected ok; got %d: %q", w.Code, w.Body.String())
+	}
+}
+
+// TestAdminMaintenance verifies that the maintenance endpoint reports
+// and toggles maintenance mode, and rejects malformed requests.
+func TestAdminMaintenance(t *testing.T) {
+	var maint maintenanceMode
+	admin := newAdminServer(nil, nil, nil, &maint)
+	mux := http.NewServeMux()
+	admin.RegisterHandlers(mux)
+
+	testCases := []struct {
+		method, body string
+		expCode      int
+		expEnabled   bool
+	}{
+		{"GET", "", http.StatusOK, false},
+		{"PUT", "true", http.StatusOK, true},
+		{"GET", "", http.StatusOK, true},
+		{"POST", "bogus", http.StatusBadRequest, true},
+		{"DELETE", "", http.StatusBadRequest, true},
+		{"POST", "false\n", http.StatusOK, false},
+	}
+	for i, test := range testCases {
+		r, err := http.NewRequest(test.method, "http://localhost"+maintenanceKey, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != test.expCode {
+			t.Errorf("%d: expected status %d; got %d: %q", i, test.expCode, w.Code, w.Body.String())
+		}
+		if maint.isEnabled() != test.expEnabled {
+			t.Errorf("%d: expected maintenance mode enabled=%t", i, test.expEnabled)
+		}
+		if w.Code == http.StatusOK && strings.TrimSpace(w.Body.String()) != fmt.Sprint(test.expEnabled) {
+			t.Errorf("%d: expected body %t; got %q", i, test.expEnabled, w.Body.String())
+		}
+	}
+}
+
+// TestAdminSplit verifies that a range can be split via the admin
+// split endpoint and that the resulting ranges are returned.
+func TestAdminSplit(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+
+	req, err := http.NewRequest("PUT", s.URL+splitKeyPrefix+"/m", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	var ranges map[string]rangeDesc
+	if err := json.Unmarshal(body, &ranges); err != nil {
+		t.Fatal(err)
+	}
+	if ranges["left"].EndKey != "m" || ranges["right"].StartKey != "m" {
+		t.Errorf("expected ranges split at \"m\"; got %+v", ranges)
+	}
+
+	// Splitting a second time at the same key fails.
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("expected error splitting twice at the same key")
+	}
+
+	// GET is not supported.
+	resp, err = http.Get(s.URL + splitKeyPrefix + "/n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request for GET; got %d", resp.StatusCode)
+	}
+}
+
+// TestAdminDecommissionStatus verifies that the decommission status
+// endpoint counts the replicas on each node, including those of
+// ranges created by a split, and reports the nodes whose drain flags
+// are set via the drain endpoint.
+func TestAdminDecommissionStatus(t *testing.T) {
+	s := startAdminServer()
+	defer s.Close()
+
+	var status decommissionStatus
+	getStatus := func() {
+		body, err := getText(s.URL + decommissionStatusKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(body, &status); err != nil {
+			t.Fatalf("unable to parse %q: %s", body, err)
+		}
+	}
+	getStatus()
+	if status.Ranges != 1 || len(status.Nodes) != 1 || status.Nodes[0].Replicas != 1 {
+		t.Fatalf("expected one replica of one range; got %+v", status)
+	}
+	nodeID := status.Nodes[0].NodeID
+
+	req, err := http.NewRequest("PUT", s.URL+splitKeyPrefix+"/m", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	getStatus()
+	if status.Ranges != 2 || len(status.Nodes) != 1 || status.Nodes[0].NodeID != nodeID ||
+		status.Nodes[0].Replicas != 2 || status.Nodes[0].Draining {
+		t.Errorf("expected two replicas on node %d after split; got %+v", nodeID, status)
+	}
+
+	drain := func(method string, nodeID int32) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s/%d", s.URL, drainKeyPrefix, nodeID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s drain of node %d failed: %s", method, nodeID, resp.Status)
+		}
+	}
+	// A draining node which has yet to shed replicas has no estimate;
+	// one without replicas is listed as complete.
+	drain("PUT", nodeID)
+	drain("PUT", nodeID+1)
+	getStatus()
+	if len(status.Nodes) != 2 || !status.Nodes[0].Draining || status.Nodes[0].EstimatedCompletion != nil ||
+		!status.Nodes[1].Draining || status.Nodes[1].Replicas != 0 || status.Nodes[1].EstimatedCompletion == nil {
+		t.Errorf("expected nodes %d and %d to be draining; got %+v", nodeID, nodeID+1, status)
+	}
+	drain("DELETE", nodeID)
+	drain("DELETE", nodeID+1)
+	getStatus()
+	if len(status.Nodes) != 1 || status.Nodes[0].Draining {
+		t.Errorf("expected node %d not to be draining; got %+v", nodeID, status)
+	}
+}
+
+// TestEstimateDrainCompletion verifies that drain completion is
+// estimated from the average rate at which replicas have been shed.
+func TestEstimateDrainCompletion(t *testing.T) {
+	now := time.Unix(1000, 0)
+	drain := nodeDrain{Started: now.Add(-10 * time.Second), Replicas: 10}
+	testCases := []struct {
+		replicas int
+		expected time.Duration // From now; negative for no estimate
+	}{
+		{10, -1},
+		{12, -1},
+		{8, 40 * time.Second},
+		{5, 10 * time.Second},
+		{0, 0},
+	}
+	for i, test := range testCases {
+		completion := estimateDrainCompletion(drain, test.replicas, now)
+		if test.expected < 0 {
+			if completion != nil {
+				t.Errorf("%d: expected no estimate; got %s", i, completion)
+			}
+		} else if completion == nil || !completion.Equal(now.Add(test.expected)) {
+			t.Errorf("%d: expected completion in %s; got %v", i, test.expected, completion)
+		}
+	}
+}
+
+// testRangeCache implements the rangeCache interface, returning a
+// fixed set of descriptors and evictions.
+type testRangeCache struct {
+	descs     []proto.RangeDescriptor
+	evictions kv.RangeCacheEvictionStats
+	cleared   bool
+}
+
+func (c *testRangeCache) DumpRangeCache() []proto.RangeDescriptor         { return c.descs }
+func (c *testRangeCache) InvalidateRangeCache()                           { c.cleared = true }
+func (c *testRangeCache) RangeCacheEvictions() kv.RangeCacheEvictionStats { return c.evictions }
+
+// TestAdminRangeCache verifies that the range cache endpoint returns
+// the cached range descriptors.
+func TestAdminRangeCache(t *testing.T) {
+	descs := []proto.RangeDescriptor{
+		{StartKey: engine.KeyMin, EndKey: engine.Key("m"), Replicas: []proto.Replica{{NodeID: 1}}},
+		{StartKey: engine.Key("m"), EndKey: engine.KeyMax, Replicas: []proto.Replica{{NodeID: 2}}},
+	}
+	cache := &testRangeCache{descs: descs}
+	admin := newAdminServer(nil, nil, cache, &maintenanceMode{})
+	mux := http.NewServeMux()
+	admin.RegisterHandlers(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: rangeCacheKey}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var ranges []rangeDesc
+	if err := json.Unmarshal(w.Body.Bytes(), &ranges); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0].EndKey != "m" || ranges[1].StartKey != "m" ||
+		ranges[1].Replicas[0].NodeID != 2 {
+		t.Errorf("unexpected cached ranges: %+v", ranges)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, &http.Request{Method: "DELETE", URL: &url.URL{Path: rangeCacheKey}})
+	if w.Code != http.StatusOK || !cache.cleared {
+		t.Errorf("expected cache to be cleared; got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// TestAdminRangeCacheEvictions verifies that the range cache evictions
+// endpoint reports the eviction counts and recent evictions.
+func TestAdminRangeCacheEvictions(t *testing.T) {
+	cache := &testRangeCache{evictions: kv.RangeCacheEvictionStats{
+		Counts: map[string]int64{"stale": 1, "transient": 0},
+		Recent: []kv.RangeCacheEviction{{
+			Key:    engine.Key("d"),
+			Desc:   proto.RangeDescriptor{StartKey: engine.Key("c"), EndKey: engine.Key("m")},
+			Cause:  kv.EvictionStale,
+			Reason: "range moved",
+		}},
+	}}
+	admin := newAdminServer(nil, nil, cache, &maintenanceMode{})
+	mux := http.NewServeMux()
+	admin.RegisterHandlers(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: rangeCacheEvictionsKey}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var out struct {
+		Counts map[string]int64     `json:"counts"`
+		Recent []rangeCacheEviction `json:"recent"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Counts["stale"] != 1 || len(out.Recent) != 1 || out.Recent[0].Key != "d" ||
+		out.Recent[0].Cause != "stale" || out.Recent[0].Range.StartKey != "c" {
+		t.Errorf("unexpected evictions: %+v", out)
+	}
+}
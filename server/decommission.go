@@ -0,0 +1,192 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"strconv"
+	"time"
+
+	gogoproto "code.google.com/p/gogoprotobuf/proto"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// A nodeDrain is the drain flag of a node being decommissioned, as
+// stored under engine.KeyNodeDrainPrefix. It records when the drain
+// began and how many replicas were then on the node, from which the
+// completion of the drain is estimated.
+type nodeDrain struct {
+	Started  time.Time
+	Replicas int
+}
+
+// A nodeReplicas is the JSON-formatted count of the replicas placed
+// on a node, as reported by the decommission status endpoint. For a
+// draining node which has shed replicas since its drain began, the
+// time by which it is estimated to be empty is included.
+type nodeReplicas struct {
+	NodeID              int32      `json:"node_id"`
+	Replicas            int        `json:"replicas"`
+	Draining            bool       `json:"draining"`
+	EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+}
+
+// A decommissionStatus is the JSON-formatted response of the
+// decommission status endpoint.
+type decommissionStatus struct {
+	Ranges int            `json:"ranges"`
+	Nodes  []nodeReplicas `json:"nodes"`
+}
+
+// nodesByID sorts nodeReplicas by node ID.
+type nodesByID []nodeReplicas
+
+func (n nodesByID) Len() int           { return len(n) }
+func (n nodesByID) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesByID) Less(i, j int) bool { return n[i].NodeID < n[j].NodeID }
+
+// makeNodeDrainKey returns the key of the drain flag of nodeID.
+func makeNodeDrainKey(nodeID int32) engine.Key {
+	return engine.MakeKey(engine.KeyNodeDrainPrefix, engine.Key(strconv.FormatInt(int64(nodeID), 10)))
+}
+
+// readDecommissionStatus counts the replicas placed on each node, as
+// recorded by the range descriptors in the meta2 addressing records,
+// and notes which nodes are draining. A node being removed from the
+// cluster is safe to shut down once no replicas remain on it. Nodes
+// which neither hold replicas nor are draining are not listed.
+func readDecommissionStatus(db storage.DB, now time.Time) (*decommissionStatus, error) {
+	sr := <-db.Scan(&proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.KeyMeta2Prefix,
+			EndKey: engine.KeyMetaMax,
+			User:   storage.UserRoot,
+		},
+	})
+	if sr.Error != nil {
+		return nil, sr.GoError()
+	}
+	counts := map[int32]int{}
+	for _, kv := range sr.Rows {
+		desc := &proto.RangeDescriptor{}
+		if err := gogoproto.Unmarshal(kv.Value.Bytes, desc); err != nil {
+			return nil, err
+		}
+		for _, replica := range desc.Replicas {
+			counts[replica.NodeID]++
+		}
+	}
+	drains, err := readNodeDrains(db)
+	if err != nil {
+		return nil, err
+	}
+	for nodeID := range drains {
+		if _, ok := counts[nodeID]; !ok {
+			counts[nodeID] = 0
+		}
+	}
+	status := &decommissionStatus{Ranges: len(sr.Rows), Nodes: []nodeReplicas{}}
+	for nodeID, count := range counts {
+		n := nodeReplicas{NodeID: nodeID, Replicas: count}
+		if drain, ok := drains[nodeID]; ok {
+			n.Draining = true
+			n.EstimatedCompletion = estimateDrainCompletion(drain, count, now)
+		}
+		status.Nodes = append(status.Nodes, n)
+	}
+	sort.Sort(nodesByID(status.Nodes))
+	return status, nil
+}
+
+// readNodeDrains returns the drain flags of the draining nodes, by
+// node ID.
+func readNodeDrains(db storage.DB) (map[int32]nodeDrain, error) {
+	sr := <-db.Scan(&proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:    engine.KeyNodeDrainPrefix,
+			EndKey: engine.KeyNodeDrainPrefix.PrefixEnd(),
+			User:   storage.UserRoot,
+		},
+	})
+	if sr.Error != nil {
+		return nil, sr.GoError()
+	}
+	drains := map[int32]nodeDrain{}
+	for _, kv := range sr.Rows {
+		nodeID, err := strconv.ParseInt(string(kv.Key[len(engine.KeyNodeDrainPrefix):]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		var drain nodeDrain
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&drain); err != nil {
+			return nil, err
+		}
+		drains[int32(nodeID)] = drain
+	}
+	return drains, nil
+}
+
+// setNodeDraining sets or clears the drain flag of nodeID. A node
+// already draining keeps the start of its drain.
+func setNodeDraining(db storage.DB, nodeID int32, draining bool, now time.Time) error {
+	key := makeNodeDrainKey(nodeID)
+	if !draining {
+		dr := <-db.Delete(&proto.DeleteRequest{
+			RequestHeader: proto.RequestHeader{
+				Key:  key,
+				User: storage.UserRoot,
+			},
+		})
+		return dr.GoError()
+	}
+	var drain nodeDrain
+	if ok, _, err := storage.GetI(db, key, &drain); err != nil || ok {
+		return err
+	}
+	status, err := readDecommissionStatus(db, now)
+	if err != nil {
+		return err
+	}
+	drain.Started = now
+	for _, n := range status.Nodes {
+		if n.NodeID == nodeID {
+			drain.Replicas = n.Replicas
+		}
+	}
+	return storage.PutI(db, key, drain, proto.Timestamp{})
+}
+
+// estimateDrainCompletion returns the time by which a node with the
+// given number of replicas remaining is estimated to be empty,
+// assuming that it continues to shed replicas at the average rate
+// since its drain began. A node without replicas is complete now.
+// Returns nil if the node hasn't shed any replicas yet.
+func estimateDrainCompletion(drain nodeDrain, replicas int, now time.Time) *time.Time {
+	if replicas == 0 {
+		return &now
+	}
+	shed := drain.Replicas - replicas
+	elapsed := now.Sub(drain.Started)
+	if shed <= 0 || elapsed <= 0 {
+		return nil
+	}
+	completion := now.Add(elapsed * time.Duration(replicas) / time.Duration(shed))
+	return &completion
+}
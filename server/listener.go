@@ -0,0 +1,83 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener returns a listener which accepts at most max
+// simultaneous connections from ln; Accept blocks while max
+// connections are open. If max is not positive, ln is returned
+// unchanged.
+func limitListener(ln net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return ln
+	}
+	return &limitedListener{
+		Listener: ln,
+		sem:      make(chan struct{}, max),
+		done:     make(chan struct{}),
+	}
+}
+
+// A limitedListener limits the number of open connections it accepts
+// using a semaphore, a slot of which is held by each connection until
+// it is closed.
+type limitedListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{} // Closed when the listener is closed
+	closeOnce sync.Once
+}
+
+// Accept waits for a free connection slot and then for the next
+// connection.
+func (l *limitedListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		// Let the underlying listener return its error.
+		return l.Listener.Accept()
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+// Close closes the listener, unblocking any waiting Accept calls.
+func (l *limitedListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// A limitedConn releases its listener's connection slot when closed.
+type limitedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+// Close closes the connection and releases its slot.
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/kv/rest"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// maintenanceExemptMethods are the writes permitted in maintenance
+// mode, so that transactions in flight when it is enabled may still
+// finish and have their intents resolved.
+var maintenanceExemptMethods = map[string]struct{}{
+	storage.EndTransaction:        struct{}{},
+	storage.InternalHeartbeatTxn:  struct{}{},
+	storage.InternalResolveIntent: struct{}{},
+}
+
+// maintenanceMode records whether the node is in maintenance mode,
+// in which it serves reads but rejects new writes. The zero value is
+// not in maintenance mode.
+type maintenanceMode struct {
+	mu      sync.Mutex // Protects enabled
+	enabled bool
+}
+
+// setEnabled enables or disables maintenance mode.
+func (m *maintenanceMode) setEnabled(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enabled = enabled
+}
+
+// isEnabled returns whether maintenance mode is enabled.
+func (m *maintenanceMode) isEnabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.enabled
+}
+
+// checkMethod returns an error if maintenance mode is enabled and
+// the specified kv method is a write, as classified by
+// storage.NeedWritePerm, other than one of maintenanceExemptMethods.
+func (m *maintenanceMode) checkMethod(method string) error {
+	if _, ok := maintenanceExemptMethods[method]; ok || !storage.NeedWritePerm(method) {
+		return nil
+	}
+	if m.isEnabled() {
+		return util.Errorf("%s rejected: node is in read-only maintenance mode", method)
+	}
+	return nil
+}
+
+// restMethod returns the kv method invoked by a request to the kv or
+// structured REST APIs. GETs are reads, including those of counters,
+// which increment them by zero.
+func restMethod(r *http.Request) string {
+	if r.Method != "GET" && strings.HasPrefix(r.URL.Path, rest.CounterPrefix) {
+		return storage.Increment
+	}
+	switch r.Method {
+	case "PUT", "POST":
+		return storage.Put
+	case "DELETE":
+		return storage.Delete
+	case "HEAD":
+		return storage.Contains
+	}
+	return storage.Get
+}
+
+// gate returns a handler which responds to requests to the kv or
+// structured REST APIs which would write with 503 Service Unavailable
+// while maintenance mode is enabled, passing all others to handler.
+func (m *maintenanceMode) gate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.checkMethod(restMethod(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/kv/rest"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/structured"
+)
+
+// TestMaintenanceGate verifies that in maintenance mode, REST requests
+// which would write are refused with 503 Service Unavailable while
+// reads are passed through.
+func TestMaintenanceGate(t *testing.T) {
+	var m maintenanceMode
+	handled := 0
+	gate := m.gate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	}))
+
+	testCases := []struct {
+		method, path string
+		write        bool
+	}{
+		{"GET", rest.EntryPrefix + "a", false},
+		{"HEAD", rest.EntryPrefix + "a", false},
+		{"PUT", rest.EntryPrefix + "a", true},
+		{"POST", rest.EntryPrefix + "a", true},
+		{"DELETE", rest.EntryPrefix + "a", true},
+		{"GET", rest.CounterPrefix + "a", false},
+		{"POST", rest.CounterPrefix + "a", true},
+		{"GET", structured.StructuredKeyPrefix + "schema", false},
+		{"PUT", structured.StructuredKeyPrefix + "schema", true},
+		{"DELETE", structured.StructuredKeyPrefix + "schema", true},
+	}
+	for _, enabled := range []bool{false, true} {
+		m.setEnabled(enabled)
+		for i, test := range testCases {
+			r, err := http.NewRequest(test.method, "http://localhost"+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handled = 0
+			w := httptest.NewRecorder()
+			gate.ServeHTTP(w, r)
+			if rejected := enabled && test.write; rejected {
+				if w.Code != http.StatusServiceUnavailable || handled != 0 ||
+					!strings.Contains(w.Body.String(), "maintenance") {
+					t.Errorf("%d: expected %s %s to be rejected; got %d: %q", i, test.method, test.path,
+						w.Code, w.Body.String())
+				}
+			} else if handled != 1 {
+				t.Errorf("%d: expected %s %s to be handled; got %d: %q", i, test.method, test.path,
+					w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+// TestMaintenanceExecuteCmd verifies that a node in maintenance mode
+// rejects new writes but not reads or the writes which finish
+// transactions in flight.
+func TestMaintenanceExecuteCmd(t *testing.T) {
+	node := NewNode(nil, nil)
+	node.maintenance.setEnabled(true)
+	reply := &proto.PutResponse{}
+	if err := node.executeCmd(storage.Put, &proto.PutRequest{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := reply.GoError(); err == nil || !strings.Contains(err.Error(), "maintenance") {
+		t.Errorf("expected maintenance mode error; got %v", err)
+	}
+	// Reads and exempt writes proceed to the store lookup, which fails
+	// as the node has no stores.
+	testCases := []struct {
+		method string
+		args   proto.Request
+		reply  proto.Response
+	}{
+		{storage.Get, &proto.GetRequest{}, &proto.GetResponse{}},
+		{storage.EndTransaction, &proto.EndTransactionRequest{}, &proto.EndTransactionResponse{}},
+		{storage.InternalHeartbeatTxn, &proto.InternalHeartbeatTxnRequest{}, &proto.InternalHeartbeatTxnResponse{}},
+		{storage.InternalResolveIntent, &proto.InternalResolveIntentRequest{}, &proto.InternalResolveIntentResponse{}},
+	}
+	for _, test := range testCases {
+		if err := node.executeCmd(test.method, test.args, test.reply); err == nil ||
+			strings.Contains(err.Error(), "maintenance") {
+			t.Errorf("expected %s to reach the store lookup; got %v", test.method, err)
+		}
+	}
+}
@@ -63,7 +63,11 @@ type Node struct {
 	localKV    *kv.LocalKV            // Local KV impl. for access to node-local stores
 	closer     chan struct{}
 
+	engineCount int // Number of engines with which the node was started
+
 	maxAvailPrefix string // Prefix for max avail capacity gossip topic
+
+	maintenance maintenanceMode // Rejects writes while enabled
 }
 
 // allocateNodeID increments the node id generator key to allocate
@@ -208,6 +212,7 @@ func (n *Node) initDescriptor(addr net.Addr, attrs proto.Attributes) {
 func (n *Node) start(rpcServer *rpc.Server, clock *hlc.Clock,
 	engines []engine.Engine, attrs proto.Attributes) error {
 	n.initDescriptor(rpcServer.Addr(), attrs)
+	n.engineCount = len(engines)
 	rpcServer.RegisterName("Node", n)
 
 	// Initialize stores, including bootstrapping new ones.
@@ -225,6 +230,32 @@ func (n *Node) stop() {
 	n.localKV.Close()
 }
 
+// ready returns nil if the node is ready to serve traffic: it has
+// connected to the gossip network, initialized a store for each of
+// its engines and instantiated every range stored on them. A node in
+// maintenance mode is ready, as it continues to serve reads.
+// Otherwise, returns an error describing what the node is waiting on.
+func (n *Node) ready() error {
+	select {
+	case <-n.gossip.Connected:
+	default:
+		return util.Error("not connected to gossip network")
+	}
+	if count := n.localKV.GetStoreCount(); count < n.engineCount {
+		return util.Errorf("initialized %d of %d stores", count, n.engineCount)
+	}
+	return n.localKV.VisitStores(func(s *storage.Store) error {
+		loaded, stored, err := s.RangeCounts()
+		if err != nil {
+			return err
+		}
+		if loaded < stored {
+			return util.Errorf("store %s is serving %d of %d ranges", s, loaded, stored)
+		}
+		return nil
+	})
+}
+
 // initStores initializes the Stores map from id to Store. Stores are
 // added to the localKV if already bootstrapped. A bootstrapped Store
 // has a valid ident with cluster, node and Store IDs set. If the
@@ -406,8 +437,13 @@ func (n *Node) gossipCapacities() {
 }
 
 // executeCmd looks up the store specified by header.Replica, and runs
-// Store.ExecuteCmd.
+// Store.ExecuteCmd. New writes are rejected while the node is in
+// maintenance mode.
 func (n *Node) executeCmd(method string, args proto.Request, reply proto.Response) error {
+	if err := n.maintenance.checkMethod(method); err != nil {
+		reply.Header().SetGoError(err)
+		return nil
+	}
 	store, err := n.localKV.GetStore(&args.Header().Replica)
 	if err != nil {
 		return err
@@ -458,6 +494,11 @@ func (n *Node) Scan(args *proto.ScanRequest, reply *proto.ScanResponse) error {
 	return n.executeCmd(storage.Scan, args, reply)
 }
 
+// Count .
+func (n *Node) Count(args *proto.CountRequest, reply *proto.CountResponse) error {
+	return n.executeCmd(storage.Count, args, reply)
+}
+
 // BeginTransaction .
 func (n *Node) BeginTransaction(args *proto.BeginTransactionRequest, reply *proto.BeginTransactionResponse) error {
 	return n.executeCmd(storage.BeginTransaction, args, reply)
@@ -507,3 +548,8 @@ func (n *Node) InternalResolveIntent(args *proto.InternalResolveIntentRequest, r
 func (n *Node) InternalSnapshotCopy(args *proto.InternalSnapshotCopyRequest, reply *proto.InternalSnapshotCopyResponse) error {
 	return n.executeCmd(storage.InternalSnapshotCopy, args, reply)
 }
+
+// AdminSplit .
+func (n *Node) AdminSplit(args *proto.AdminSplitRequest, reply *proto.AdminSplitResponse) error {
+	return n.executeCmd(storage.AdminSplit, args, reply)
+}
@@ -61,7 +61,7 @@ func createTestNode(addr net.Addr, engines []engine.Engine, gossipBS net.Addr, t
 		g.Start(rpcServer)
 	}
 	clock := hlc.NewClock(hlc.UnixNano)
-	db := kv.NewDB(kv.NewDistKV(g), clock)
+	db := kv.NewDB(kv.NewDistKV(g, clock, nil), clock)
 	node := NewNode(db, g)
 	if err := node.start(rpcServer, clock, engines, proto.Attributes{}); err != nil {
 		t.Fatal(err)
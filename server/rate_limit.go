@@ -0,0 +1,147 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statusTooManyRequests is the HTTP status returned to clients
+	// which exceed their request rate (RFC 6585).
+	statusTooManyRequests = 429
+	// maxRateLimitBuckets is the number of clients tracked before idle
+	// clients, whose buckets have refilled, are forgotten.
+	maxRateLimitBuckets = 10000
+)
+
+// A tokenBucket holds the tokens available to a single client as of
+// the last time it was updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// A rateLimiter limits the rate of HTTP requests made by each client
+// using a token bucket per client: each request consumes a token,
+// and tokens are replenished at rate per second up to burst. Clients
+// are identified by the common name of their TLS client certificate,
+// if any, or else by IP address. Requests for paths with an exempt
+// prefix are never limited.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	exempt []string
+	now    func() time.Time
+
+	mu      sync.Mutex // Protects buckets
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a rate limiter allowing each client rate
+// requests per second with bursts of up to burst requests, except
+// for paths with one of the comma-separated exempt prefixes. Returns
+// nil if rate is not positive, in which case requests are not limited.
+func newRateLimiter(rate float64, burst int, exempt string) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	rl := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}
+	for _, prefix := range strings.Split(exempt, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			rl.exempt = append(rl.exempt, prefix)
+		}
+	}
+	return rl
+}
+
+// clientKey returns the key identifying the client which made r.
+func clientKey(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if user := r.TLS.PeerCertificates[0].Subject.CommonName; user != "" {
+			return "user=" + user
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// allow returns whether request r may proceed, consuming a token from
+// its client's bucket if so.
+func (rl *rateLimiter) allow(r *http.Request) bool {
+	for _, prefix := range rl.exempt {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	key := clientKey(r)
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= maxRateLimitBuckets {
+			rl.forgetIdle(now)
+		}
+		b = &tokenBucket{tokens: rl.burst, updated: now}
+		rl.buckets[key] = b
+	}
+	rl.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens accrued by b since it was last updated.
+func (rl *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rl.rate
+		if b.tokens > rl.burst {
+			b.tokens = rl.burst
+		}
+		b.updated = now
+	}
+}
+
+// forgetIdle removes the buckets of clients which have been idle long
+// enough for their buckets to refill; they are indistinguishable from
+// new clients.
+func (rl *rateLimiter) forgetIdle(now time.Time) {
+	for key, b := range rl.buckets {
+		rl.refill(b, now)
+		if b.tokens >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
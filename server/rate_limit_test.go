@@ -0,0 +1,101 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRequest(t *testing.T, path, remoteAddr string) *http.Request {
+	r, err := http.NewRequest("GET", "http://localhost"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+// TestRateLimiter verifies that each client may make a burst of
+// requests, after which requests are allowed at the configured rate,
+// and that exempt paths, by default the health and readiness checks,
+// are never limited.
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0, 10, "") != nil {
+		t.Fatal("expected no rate limiter with zero rate")
+	}
+	rl := newRateLimiter(2, 3, *httpRateExempt)
+	now := time.Unix(0, 0)
+	rl.now = func() time.Time { return now }
+
+	a := newTestRequest(t, "/kv/rest/entry/a", "10.0.0.1:1234")
+	for i := 0; i < 3; i++ {
+		if !rl.allow(a) {
+			t.Fatalf("%d: expected request within burst to be allowed", i)
+		}
+	}
+	if rl.allow(a) {
+		t.Error("expected request in excess of burst to be refused")
+	}
+	// Another port on the same host is the same client; another host is not.
+	if rl.allow(newTestRequest(t, "/kv/rest/entry/a", "10.0.0.1:5678")) {
+		t.Error("expected request from same host to be refused")
+	}
+	if !rl.allow(newTestRequest(t, "/kv/rest/entry/a", "10.0.0.2:1234")) {
+		t.Error("expected request from another host to be allowed")
+	}
+	// Health and readiness checks are exempt.
+	for _, path := range []string{healthzKey, readyKey} {
+		if !rl.allow(newTestRequest(t, path, "10.0.0.1:1234")) {
+			t.Errorf("expected %s to be allowed", path)
+		}
+	}
+
+	// At 2 requests per second, one token accrues every 500ms.
+	now = now.Add(500 * time.Millisecond)
+	if !rl.allow(a) {
+		t.Error("expected request to be allowed after refill")
+	}
+	if rl.allow(a) {
+		t.Error("expected second request to be refused")
+	}
+	// The bucket refills only up to the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !rl.allow(a) {
+			t.Fatalf("%d: expected request within burst to be allowed", i)
+		}
+	}
+	if rl.allow(a) {
+		t.Error("expected request in excess of burst to be refused")
+	}
+}
+
+// TestServeHTTPRateLimited verifies that the server refuses requests
+// in excess of the rate limit with 429 Too Many Requests.
+func TestServeHTTPRateLimited(t *testing.T) {
+	s := &server{mux: http.NewServeMux(), limiter: newRateLimiter(1, 1, "")}
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for i, expCode := range []int{http.StatusOK, statusTooManyRequests} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, newTestRequest(t, "/", "10.0.0.1:1234"))
+		if w.Code != expCode {
+			t.Errorf("%d: expected status %d; got %d", i, expCode, w.Code)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// reloadableFlags are the flags whose changes in the config file are
+// applied to a running server on SIGHUP. Changes to any other flag
+// require a restart.
+var reloadableFlags = map[string]struct{}{
+	"v":                {},
+	"vmodule":          {},
+	"max_drift":        {},
+	"http_rate":        {},
+	"http_burst":       {},
+	"http_rate_exempt": {},
+	"http_access_log":  {},
+}
+
+// parseConfig parses flag settings, one "name = value" per line.
+// Blank lines and lines starting with '#' are ignored. Every name must
+// be a defined flag.
+func parseConfig(r io.Reader) (map[string]string, error) {
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i == -1 {
+			return nil, util.Errorf("line %d: expected \"name = value\": %q", lineNum, line)
+		}
+		name := strings.TrimLeft(strings.TrimSpace(line[:i]), "-")
+		if flag.Lookup(name) == nil {
+			return nil, util.Errorf("line %d: unknown flag %q", lineNum, name)
+		}
+		settings[name] = strings.TrimSpace(line[i+1:])
+	}
+	return settings, scanner.Err()
+}
+
+// readConfigFile reads the flag settings from the file at path.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings, err := parseConfig(f)
+	if err != nil {
+		return nil, util.Errorf("%s: %s", path, err)
+	}
+	return settings, nil
+}
+
+// applyConfig sets each flag to its value in settings, logging the
+// flags which change. If reloading, flags which aren't reloadable are
+// left unchanged and returned, sorted by name, as requiring a restart.
+func applyConfig(settings map[string]string, reloading bool) ([]string, error) {
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var restart []string
+	for _, name := range names {
+		value, old := settings[name], flag.Lookup(name).Value.String()
+		if value == old {
+			continue
+		}
+		if _, ok := reloadableFlags[name]; reloading && !ok {
+			restart = append(restart, name)
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return restart, util.Errorf("invalid value %q for flag -%s: %s", value, name, err)
+		}
+		log.Infof("config: -%s changed from %q to %q", name, old, value)
+	}
+	return restart, nil
+}
+
+// loadConfigFile applies the flag settings in the file at path before
+// the server is created.
+func loadConfigFile(path string) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = applyConfig(settings, false)
+	return err
+}
+
+// reloadConfigFile re-reads the file at path and applies changes to
+// reloadable flags to the running server. Changes to other flags are
+// logged as requiring a restart.
+func (s *server) reloadConfigFile(path string) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	rate, burst, exempt := *httpRate, *httpBurst, *httpRateExempt
+	restart, err := applyConfig(settings, true)
+	for _, name := range restart {
+		log.Warningf("config: change to -%s requires a restart", name)
+	}
+	// Apply the reloadable settings even if a setting was invalid, as
+	// earlier settings may have been changed. Log verbosity takes
+	// effect as soon as its flag is set.
+	s.clock.SetMaxDrift(*maxDrift)
+	if rate != *httpRate || burst != *httpBurst || exempt != *httpRateExempt {
+		s.mu.Lock()
+		s.limiter = newRateLimiter(*httpRate, *httpBurst, *httpRateExempt)
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.accessLog = *httpAccessLog
+	s.mu.Unlock()
+	return err
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+func TestParseConfig(t *testing.T) {
+	testCases := []struct {
+		config   string
+		expected map[string]string
+		expErr   bool
+	}{
+		{"", map[string]string{}, false},
+		{"# comment\n\nhttp_rate = 5\n  -max_drift=1s  \n", map[string]string{"http_rate": "5", "max_drift": "1s"}, false},
+		{"http_rate_exempt = /healthz,/_admin/\n", map[string]string{"http_rate_exempt": "/healthz,/_admin/"}, false},
+		{"http_rate\n", nil, true},
+		{"no_such_flag = 1\n", nil, true},
+	}
+	for i, test := range testCases {
+		settings, err := parseConfig(strings.NewReader(test.config))
+		if test.expErr {
+			if err == nil {
+				t.Errorf("%d: expected error; got %v", i, settings)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+		} else if !reflect.DeepEqual(settings, test.expected) {
+			t.Errorf("%d: expected %v; got %v", i, test.expected, settings)
+		}
+	}
+}
+
+// TestReloadConfigFile verifies that reloading the config file
+// applies changes to reloadable flags to the server and leaves other
+// flags unchanged.
+func TestReloadConfigFile(t *testing.T) {
+	for _, name := range []string{"http_rate", "max_drift", "stores"} {
+		defer flag.Set(name, flag.Lookup(name).Value.String())
+	}
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("http_rate = 5\nmax_drift = 1s\nstores = mem=1000\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s := &server{clock: hlc.NewClock(hlc.UnixNano)}
+	if err := s.reloadConfigFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if s.limiter == nil || s.limiter.rate != 5 {
+		t.Errorf("expected rate limiter with rate 5; got %+v", s.limiter)
+	}
+	if s.clock.MaxDrift() != time.Second {
+		t.Errorf("expected max drift of 1s; got %s", s.clock.MaxDrift())
+	}
+	if *stores == "mem=1000" {
+		t.Error("expected -stores not to be reloaded")
+	}
+
+	// An invalid value is an error.
+	if err := ioutil.WriteFile(f.Name(), []byte("http_rate = fast\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadConfigFile(f.Name()); err == nil {
+		t.Error("expected error reloading invalid value")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// userHeader is the HTTP header which identifies the user on whose
+// behalf a request is made, if any.
+const userHeader = "X-Cockroach-User"
+
+// A requestLogger logs via util/log on behalf of an HTTP handler,
+// tagging each line with the method, path and user of the request
+// being served. All lines for a request can then be found with grep,
+// e.g. for "[PUT /_admin/zones/db1".
+type requestLogger struct {
+	prefix string
+}
+
+// newRequestLogger returns a logger for lines about request r.
+func newRequestLogger(r *http.Request) requestLogger {
+	prefix := fmt.Sprintf("[%s %s", r.Method, r.URL.Path)
+	if user := r.Header.Get(userHeader); user != "" {
+		prefix += " user=" + user
+	}
+	return requestLogger{prefix: prefix + "] "}
+}
+
+// Infof logs to the INFO log.
+func (l requestLogger) Infof(format string, args ...interface{}) {
+	log.Infof(l.prefix+format, args...)
+}
+
+// Warningf logs to the INFO and WARNING logs.
+func (l requestLogger) Warningf(format string, args ...interface{}) {
+	log.Warningf(l.prefix+format, args...)
+}
+
+// Errorf logs to the INFO, WARNING, and ERROR logs.
+func (l requestLogger) Errorf(format string, args ...interface{}) {
+	log.Errorf(l.prefix+format, args...)
+}
+
+// serverError logs err on behalf of request r and responds with 500
+// Internal Server Error.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	newRequestLogger(r).Errorf("%s", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// An accessLogWriter wraps an http.ResponseWriter, recording the
+// status code and number of bytes of the response for the access log.
+// When the response is gzipped, the writer it wraps is written the
+// compressed bytes, which are those counted.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// newAccessLogWriter returns a writer which records the response
+// written to w.
+func newAccessLogWriter(w http.ResponseWriter) *accessLogWriter {
+	return &accessLogWriter{ResponseWriter: w}
+}
+
+// WriteHeader records the status code and passes it on.
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written, recording the implicit 200 OK
+// status if no status was written first.
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// log logs an access line for request r, served in duration d.
+func (w *accessLogWriter) log(r *http.Request, d time.Duration) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	newRequestLogger(r).Infof("%d %d bytes in %s from %s", status, w.bytes, d, r.RemoteAddr)
+}
@@ -19,18 +19,21 @@
 package server
 
 import (
+	"bytes"
 	"compress/gzip"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	commander "code.google.com/p/go-commander"
@@ -50,19 +53,31 @@ import (
 var (
 	rpcAddr  = flag.String("rpc", ":0", "host:port to bind for RPC traffic; 0 to pick unused port")
 	httpAddr = flag.String("http", ":8080", "host:port to bind for HTTP traffic; 0 to pick unused port")
+	// adminAddr optionally restricts the admin and debug endpoints to a
+	// separate listener, e.g. one bound only to localhost.
+	adminAddr = flag.String("admin_addr", "", "host:port to bind for admin and debug HTTP "+
+		"traffic; if empty, admin and debug endpoints are served with all other HTTP traffic "+
+		"via -http")
+	// adminSocket optionally serves the admin and debug endpoints over a
+	// Unix domain socket, keeping them off the network entirely.
+	adminSocket = flag.String("admin_socket", "", "path of a Unix domain socket on which to "+
+		"serve admin and debug HTTP traffic; if set and -admin_addr is empty, admin and debug "+
+		"endpoints are not served via -http")
 
 	certDir = flag.String("certs", "", "directory containing RSA key and x509 certs")
 
 	// stores is specified to enable durable storage via RocksDB-backed
 	// key-value stores. Memory-backed key value stores may be
-	// optionally specified via mem=<integer byte size>.
+	// optionally specified via mem=<byte size>.
 	stores = flag.String("stores", "", "specify a comma-separated list of stores, "+
 		"specified by a colon-separated list of device attributes followed by '=' and "+
-		"either a filepath for a persistent store or an integer size in bytes for an "+
-		"in-memory store. Device attributes typically include whether the store is "+
-		"flash (ssd), spinny disk (hdd), fusion-io (fio), in-memory (mem); device "+
-		"attributes might also include speeds and other specs (7200rpm, 200kiops, etc.). "+
-		"For example, -store=hdd:7200rpm=/mnt/hda1,ssd=/mnt/ssd01,ssd=/mnt/ssd02,mem=1073741824")
+		"either a filepath for a persistent store, optionally followed by ':' and the "+
+		"maximum capacity of the store, or a size for an in-memory store. Sizes are in "+
+		"bytes, optionally followed by a unit (KiB, MiB, GiB or TiB). Device attributes "+
+		"typically include whether the store is flash (ssd), spinny disk (hdd), "+
+		"fusion-io (fio), in-memory (mem); device attributes might also include speeds "+
+		"and other specs (7200rpm, 200kiops, etc.). For example, "+
+		"-store=hdd:7200rpm=/mnt/hda1,ssd=/mnt/ssd01:500GiB,ssd=/mnt/ssd02,mem=1GiB")
 
 	// attrs specifies node topography or machine capabilities, used to
 	// match capabilities or location preferences specified in zone configs.
@@ -78,11 +93,61 @@ var (
 		"node-to-node links and if any node notices it has clock drift in excess "+
 		"of -max_drift, it will commit suicide.")
 
+	// httpRate, httpBurst and httpRateExempt configure the limit on the
+	// rate of HTTP requests made by each client.
+	httpRate = flag.Float64("http_rate", 0, "maximum sustained rate of HTTP requests per "+
+		"second from each client, identified by IP address or TLS client certificate; "+
+		"requests in excess of the rate are refused with 429 Too Many Requests. 0 to "+
+		"disable rate limiting")
+	httpBurst = flag.Int("http_burst", 100, "maximum number of HTTP requests a client may "+
+		"make in a burst in excess of -http_rate")
+	httpRateExempt = flag.String("http_rate_exempt", healthzKey+","+readyKey, "comma-separated "+
+		"list of HTTP path prefixes exempt from rate limiting; by default the health and "+
+		"readiness checks, so that probes aren't refused while the node is busy")
+
+	// httpAccessLog enables logging a line for every HTTP request served.
+	httpAccessLog = flag.Bool("http_access_log", false, "log the method, path, user, status "+
+		"code, bytes written and duration of every HTTP request at the INFO level")
+
+	// httpReadTimeout, httpWriteTimeout, httpIdleTimeout,
+	// httpMaxHeaderBytes and httpMaxConns bound the resources a single
+	// HTTP client or a flood of connections may hold. The read and
+	// write timeouts apply to every request, including long-running
+	// KV scans and transactions, so are disabled by default.
+	httpReadTimeout = flag.Duration("http_read_timeout", 0, "maximum "+
+		"duration for reading an entire HTTP request, including the body; 0 for no timeout")
+	httpWriteTimeout = flag.Duration("http_write_timeout", 0, "maximum "+
+		"duration before timing out writes of an HTTP response; 0 for no timeout")
+	httpIdleTimeout = flag.Duration("http_idle_timeout", 2*time.Minute, "maximum "+
+		"duration an idle keep-alive HTTP connection is kept open; 0 to use -http_read_timeout")
+	httpMaxHeaderBytes = flag.Int("http_max_header_bytes", 1<<20, "maximum size in bytes "+
+		"of the headers of an HTTP request")
+	httpMaxConns = flag.Int("http_max_conns", 0, "maximum number of concurrent HTTP "+
+		"connections accepted on each HTTP listener; further connections wait until one "+
+		"is closed. 0 for no limit")
+
+	// healthProbeInterval is the interval at which the health of
+	// replicas is probed by the node's DistKV.
+	healthProbeInterval = flag.Duration("health_probe_interval", kv.DefaultHealthProbeInterval,
+		"interval at which each replica is pinged to detect nodes which are down; 0 to disable")
+
+	// maxRequestSize limits the encoded size of KV requests routed by
+	// the node's DistKV.
+	maxRequestSize = flag.Int("max_request_size", 0, "maximum encoded size in bytes of a KV "+
+		"request routed by this node; larger requests fail before being sent. 0 for no limit")
+
+	// configFile optionally specifies a file of flag settings, which is
+	// re-read when the server receives SIGHUP.
+	configFile = flag.String("config", "", "path of a file of flag settings, one \"name = value\" "+
+		"per line, which override the command line; the file is re-read on SIGHUP, applying "+
+		"changes to log verbosity, -max_drift, -http_access_log and the -http_rate flags")
+
 	bootstrapOnly = flag.Bool("bootstrap_only", false, "specify --bootstrap_only "+
 		"to avoid starting the server after bootstrapping with the init command.")
 
-	// Regular expression for capturing data directory specifications.
-	storesRE = regexp.MustCompile(`([^=]+)=([^,]+)(,|$)`)
+	// Regular expression for capturing data directory specifications:
+	// attributes, a path or in-memory size and an optional capacity.
+	storesRE = regexp.MustCompile(`([^=,]+)=([^,:]+)(?::([^,:]+))?(,|$)`)
 )
 
 var cmdStartLongDescription = `
@@ -97,7 +162,9 @@ approach is to use a single host for -gossip and round-robin DNS.
 Each node exports data from one or more physical devices. These
 devices are specified via the -stores command line flag. This is a
 comma-separated list of paths to storage directories or for in-memory
-stores, the number of bytes. Although the paths should be specified to
+stores, the number of bytes. A path may be followed by the maximum
+capacity of its store (e.g. /mnt/ssd01:500GiB) to keep the store from
+filling a shared disk. Although the paths should be specified to
 correspond uniquely to physical devices, this requirement isn't
 strictly enforced.
 
@@ -105,13 +172,23 @@ A node exports an HTTP API with the following endpoints:
 
   Health check:           /healthz
   Key-value REST:         ` + rest.APIPrefix + `
-  Structured Schema REST: ` + structured.StructuredKeyPrefix
+  Structured Schema REST: ` + structured.StructuredKeyPrefix + `
+
+If -admin_addr is specified, the admin (` + adminKeyPrefix + `) and
+debug (` + debugKeyPrefix + `) endpoints are served only on that address.
+If -admin_socket is specified, they are also served on that Unix domain
+socket, and, unless -admin_addr is also specified, on no TCP address.
+
+If -config is specified, the flag settings in that file are applied at
+startup and re-read on SIGHUP. Changes to log verbosity, -max_drift and
+the -http_rate flags take effect immediately; changes to other flags
+are logged as requiring a restart.`
 
 // A CmdInit command initializes a new Cockroach cluster.
 var CmdInit = &commander.Command{
 	UsageLine: "init -gossip=host1:port1[,host2:port2...] " +
 		"-certs=<cert-dir>" +
-		"-stores=(ssd=<data-dir>,hdd|7200rpm=<data-dir>,mem=<capacity-in-bytes>)[,...]",
+		"-stores=(ssd=<data-dir>[:<capacity>],hdd:7200rpm=<data-dir>[:<capacity>],mem=<capacity>)[,...]",
 	Short: "init new Cockroach cluster and start server",
 	Long: `
 Initialize a new Cockroach cluster on this node using the first
@@ -170,7 +247,7 @@ func runInit(cmd *commander.Command, args []string) {
 var CmdStart = &commander.Command{
 	UsageLine: "start -gossip=host1:port1[,host2:port2...] " +
 		"-certs=<cert-dir>" +
-		"-stores=(ssd=<data-dir>,hdd|7200rpm=<data-dir>|mem=<capacity-in-bytes>)[,...]",
+		"-stores=(ssd=<data-dir>[:<capacity>],hdd:7200rpm=<data-dir>[:<capacity>],mem=<capacity>)[,...]",
 	Short: "start node by joining the gossip network",
 	Long:  cmdStartLongDescription,
 	Run:   runStart,
@@ -180,6 +257,7 @@ var CmdStart = &commander.Command{
 type server struct {
 	host           string
 	mux            *http.ServeMux
+	adminMux       *http.ServeMux // same as mux unless -admin_addr or -admin_socket is set
 	clock          *hlc.Clock
 	rpc            *rpc.Server
 	gossip         *gossip.Gossip
@@ -190,7 +268,12 @@ type server struct {
 	status         *statusServer
 	structuredDB   structured.DB
 	structuredREST *structured.RESTServer
+	mu             sync.Mutex    // Protects limiter and accessLog
+	limiter        *rateLimiter  // nil unless -http_rate is set
+	accessLog      bool          // true if -http_access_log is set
 	httpListener   *net.Listener // holds http endpoint information
+	adminListener  *net.Listener // holds admin http endpoint information, if any
+	adminSocketLn  net.Listener  // admin Unix domain socket listener, if any
 }
 
 // runStart starts the cockroach node using -stores as the list of
@@ -199,6 +282,12 @@ type server struct {
 // cluster via the gossip network.
 func runStart(cmd *commander.Command, args []string) {
 	log.Info("Starting cockroach cluster")
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile); err != nil {
+			log.Errorf("Failed to load config file: %v", err)
+			return
+		}
+	}
 	s, err := newServer()
 	if err != nil {
 		log.Errorf("Failed to start Cockroach server: %v", err)
@@ -224,10 +313,23 @@ func runStart(cmd *commander.Command, args []string) {
 	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGHUP)
 
-	// Block until one of the signals above is received.
-	<-c
+	// Block until one of the signals above other than SIGHUP, which
+	// reloads the config file, is received.
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			return
+		}
+		if *configFile == "" {
+			log.Warning("received SIGHUP, but no config file was specified via -config")
+			continue
+		}
+		log.Infof("received SIGHUP; reloading config file %s", *configFile)
+		if err := s.reloadConfigFile(*configFile); err != nil {
+			log.Errorf("Failed to reload config file: %v", err)
+		}
+	}
 }
 
 // parseAttributes parses a colon-separated list of strings,
@@ -255,12 +357,13 @@ func initEngines(stores string) ([]engine.Engine, error) {
 
 	engines := []engine.Engine{}
 	for _, store := range storeSpecs {
-		if len(store) != 4 {
+		if len(store) != 5 {
 			return nil, util.Errorf("unable to parse attributes and path from store %q", store[0])
 		}
-		// There are two matches for each store specification: the colon-separated
-		// list of attributes and the path.
-		engine, err := initEngine(store[1], store[2])
+		// There are three matches for each store specification: the
+		// colon-separated list of attributes, the path and the optional
+		// capacity.
+		engine, err := initEngine(store[1], store[2], store[3])
 		if err != nil {
 			return nil, util.Errorf("unable to init engine for store %q: %v", store[0], err)
 		}
@@ -272,19 +375,33 @@ func initEngines(stores string) ([]engine.Engine, error) {
 
 // initEngine parses the store attributes as a colon-separated list
 // and instantiates an engine based on the dir parameter. If dir parses
-// to an integer, it's taken to mean an in-memory engine; otherwise,
-// dir is treated as a path and a RocksDB engine is created.
-func initEngine(attrsStr, path string) (engine.Engine, error) {
+// to a byte size, it's taken to mean an in-memory engine; otherwise,
+// dir is treated as a path and a RocksDB engine is created, with its
+// capacity capped at capacityStr bytes if specified.
+func initEngine(attrsStr, path, capacityStr string) (engine.Engine, error) {
 	attrs := parseAttributes(attrsStr)
-	if size, err := strconv.ParseUint(path, 10, 64); err == nil {
+	var capacity int64
+	if capacityStr != "" {
+		var err error
+		if capacity, err = util.ParseBytes(capacityStr); err != nil {
+			return nil, err
+		}
+		if capacity == 0 {
+			return nil, util.Errorf("unable to initialize a store with capacity 0")
+		}
+	}
+	if size, err := util.ParseBytes(path); err == nil {
+		if capacityStr != "" {
+			return nil, util.Errorf("the capacity of an in-memory store is its size")
+		}
 		if size == 0 {
 			return nil, util.Errorf("unable to initialize an in-memory store with capacity 0")
 		}
-		return engine.NewInMem(attrs, int64(size)), nil
+		return engine.NewInMem(attrs, size), nil
 		// TODO(spencer): should be using rocksdb for in-memory stores and
 		// relegate the InMem engine to usage only from unittests.
 	}
-	return engine.NewRocksDB(attrs, path), nil
+	return engine.NewRocksDB(attrs, path, capacity), nil
 }
 
 func newServer() (*server, error) {
@@ -314,19 +431,47 @@ func newServer() (*server, error) {
 	}
 
 	s := &server{
-		host:  host,
-		mux:   http.NewServeMux(),
-		clock: hlc.NewClock(hlc.UnixNano),
-		rpc:   rpc.NewServer(util.MakeRawAddr("tcp", *rpcAddr), tlsConfig),
+		host:      host,
+		mux:       http.NewServeMux(),
+		clock:     hlc.NewClock(hlc.UnixNano),
+		rpc:       rpc.NewServer(util.MakeRawAddr("tcp", *rpcAddr), tlsConfig),
+		limiter:   newRateLimiter(*httpRate, *httpBurst, *httpRateExempt),
+		accessLog: *httpAccessLog,
 	}
 	s.clock.SetMaxDrift(*maxDrift)
+	s.adminMux = s.mux
+	if *adminAddr != "" || *adminSocket != "" {
+		s.adminMux = http.NewServeMux()
+	}
 
 	s.gossip = gossip.New(tlsConfig)
-	s.kvDB = kv.NewDB(kv.NewDistKV(s.gossip), s.clock)
+	distKV := kv.NewDistKV(s.gossip, s.clock, nil)
+	distKV.SetLocalAttributes(parseAttributes(*attrs))
+	distKV.SetMaxRequestSize(*maxRequestSize)
+	distKV.SetRangeCacheEvictionHook(func(key engine.Key, desc *proto.RangeDescriptor,
+		cause kv.RangeCacheEvictionCause, reason string) {
+		log.V(1).Infof("evicted range [%q, %q) from range cache for key %q (%s): %s",
+			desc.StartKey, desc.EndKey, key, cause, reason)
+	})
+	if *healthProbeInterval > 0 {
+		distKV.StartHealthProbes(*healthProbeInterval)
+	}
+	// Requests received over TLS from clients other than cluster nodes
+	// are issued by the user named in the client certificate and are
+	// subject to the same permission checks as requests routed via
+	// DistKV. Internal methods are reserved for cluster nodes.
+	s.rpc.SetPermissionCheck(func(method string, header *proto.RequestHeader) error {
+		method = strings.TrimPrefix(method, "Node.")
+		if strings.HasPrefix(method, "Internal") {
+			return util.Errorf("user %q cannot execute %s: reserved for cluster nodes", header.User, method)
+		}
+		return distKV.VerifyPermissions(method, header)
+	})
+	s.kvDB = kv.NewDB(distKV, s.clock)
 	s.kvREST = rest.NewRESTServer(s.kvDB)
 	s.node = NewNode(s.kvDB, s.gossip)
-	s.admin = newAdminServer(s.kvDB)
-	s.status = newStatusServer(s.kvDB, s.gossip)
+	s.admin = newAdminServer(s.kvDB, s.node.ready, distKV, &s.node.maintenance)
+	s.status = newStatusServer(s.kvDB, s.gossip, s.node)
 	s.structuredDB = structured.NewDB(s.kvDB)
 	s.structuredREST = structured.NewRESTServer(s.structuredDB)
 
@@ -368,36 +513,126 @@ func (s *server) start(engines []engine.Engine, selfBootstrap bool) error {
 	log.Infof("Initialized %d storage engine(s)", len(engines))
 
 	s.initHTTP()
-	if strings.HasPrefix(*httpAddr, ":") {
-		*httpAddr = s.host + *httpAddr
-	}
-	ln, err := net.Listen("tcp", *httpAddr)
+	ln, err := s.listenHTTP(httpAddr)
 	if err != nil {
-		return util.Errorf("could not listen on %s: %s", *httpAddr, err)
+		return err
 	}
+	ln = limitListener(ln, *httpMaxConns)
 	// Obtaining the http end point listener is difficult using
 	// http.ListenAndServe(), so we are storing it with the server.
 	s.httpListener = &ln
 	log.Infof("Starting HTTP server at %s", ln.Addr())
-	go http.Serve(ln, s)
+	go newHTTPServer(s).Serve(ln)
+
+	if *adminAddr != "" {
+		adminLn, err := s.listenHTTP(adminAddr)
+		if err != nil {
+			return err
+		}
+		s.adminListener = &adminLn
+		log.Infof("Starting admin HTTP server at %s", adminLn.Addr())
+		go s.serveAdmin(adminLn)
+	}
+	if *adminSocket != "" {
+		if err := s.startAdminSocket(*adminSocket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveAdmin serves the admin and debug endpoints on ln.
+func (s *server) serveAdmin(ln net.Listener) {
+	newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveLogged(w, r, func(w http.ResponseWriter) {
+			serveGzip(s.adminMux, w, r)
+		})
+	})).Serve(limitListener(ln, *httpMaxConns))
+}
+
+// newHTTPServer returns an HTTP server for handler configured with
+// the timeouts and maximum header size specified by the -http_*
+// flags.
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:        handler,
+		ReadTimeout:    *httpReadTimeout,
+		WriteTimeout:   *httpWriteTimeout,
+		IdleTimeout:    *httpIdleTimeout,
+		MaxHeaderBytes: *httpMaxHeaderBytes,
+	}
+}
+
+// startAdminSocket serves the admin and debug endpoints on a Unix
+// domain socket at path. A socket file left at path, e.g. by a node
+// which was killed, is removed first; any other file is an error.
+func (s *server) startAdminSocket(path string) error {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return util.Errorf("could not listen on %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return util.Errorf("could not remove stale socket %s: %s", path, err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return util.Errorf("could not listen on %s: %s", path, err)
+	}
+	s.adminSocketLn = ln
+	log.Infof("Starting admin HTTP server at unix socket %s", path)
+	go s.serveAdmin(ln)
 	return nil
 }
 
+// stopAdminSocket closes the admin Unix domain socket, if any, and
+// removes its file.
+func (s *server) stopAdminSocket() {
+	if s.adminSocketLn == nil {
+		return
+	}
+	path := s.adminSocketLn.Addr().String()
+	s.adminSocketLn.Close()
+	s.adminSocketLn = nil
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Warningf("could not remove admin socket %s: %s", path, err)
+	}
+}
+
+// listenHTTP binds a listener to the address specified by addr. If
+// the address includes no host component, the server's hostname is
+// used and addr is updated accordingly.
+func (s *server) listenHTTP(addr *string) (net.Listener, error) {
+	if strings.HasPrefix(*addr, ":") {
+		*addr = s.host + *addr
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return nil, util.Errorf("could not listen on %s: %s", *addr, err)
+	}
+	return ln, nil
+}
+
+// initHTTP registers HTTP handlers. Admin and debug handlers are
+// registered with the admin mux; all others with the main mux. The
+// two are the same unless -admin_addr or -admin_socket is specified.
 func (s *server) initHTTP() {
 	// TODO(shawn) pretty "/" landing page
 
 	// Admin handlers.
-	s.admin.RegisterHandlers(s.mux)
+	s.admin.RegisterHandlers(s.adminMux)
 
 	// Status endpoints:
 	s.status.RegisterHandlers(s.mux)
 
 	// TODO(andybons): all servers should satisfy the http.Handler interface.
-	s.mux.HandleFunc(rest.APIPrefix, s.kvREST.HandleAction)
-	s.mux.Handle(structured.StructuredKeyPrefix, s.structuredREST)
+	// Writes via the REST APIs are refused in maintenance mode.
+	s.mux.Handle(rest.APIPrefix, s.node.maintenance.gate(http.HandlerFunc(s.kvREST.HandleAction)))
+	s.mux.Handle(structured.StructuredKeyPrefix, s.node.maintenance.gate(s.structuredREST))
 }
 
 func (s *server) stop() {
+	s.stopAdminSocket()
 	s.node.stop()
 	s.gossip.Stop()
 	s.rpc.Close()
@@ -420,13 +655,96 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 
 // ServeHTTP is necessary to implement the http.Handler interface. It
 // will gzip a response if the appropriate request headers are set.
+// Requests from clients exceeding -http_rate are refused.
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serveLogged(w, r, func(w http.ResponseWriter) {
+		s.mu.Lock()
+		limiter := s.limiter
+		s.mu.Unlock()
+		if limiter != nil && !limiter.allow(r) {
+			newRequestLogger(r).Warningf("rate limit exceeded by %s", r.RemoteAddr)
+			http.Error(w, "rate limit exceeded", statusTooManyRequests)
+			return
+		}
+		serveGzip(s.mux, w, r)
+	})
+}
+
+// serveLogged calls serve with w, first wrapping w to log an access
+// line for the request once served if -http_access_log is set.
+func (s *server) serveLogged(w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter)) {
+	s.mu.Lock()
+	accessLog := s.accessLog
+	s.mu.Unlock()
+	if !accessLog {
+		serve(w)
+		return
+	}
+	alw := newAccessLogWriter(w)
+	start := time.Now()
+	serve(alw)
+	alw.log(r, time.Since(start))
+}
+
+// serveGzip passes the request to the supplied mux, gzipping the
+// response if the appropriate request headers are set. Request
+// bodies with gzip content encoding are decompressed before the
+// request is dispatched; a malformed body yields 400 Bad Request and
+// one which decompresses to more than maxDecompressedRequestSize
+// bytes yields 413 Request Entity Too Large.
+func serveGzip(mux *http.ServeMux, w http.ResponseWriter, r *http.Request) {
+	if log.V(2) {
+		newRequestLogger(r).Infof("serving request from %s", r.RemoteAddr)
+	}
+	if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+		if err := decompressRequestBody(r); err == errRequestBodyTooLarge {
+			newRequestLogger(r).Warningf("%s", err)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			newRequestLogger(r).Warningf("malformed gzip request body: %s", err)
+			http.Error(w, fmt.Sprintf("malformed gzip request body: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
 	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		s.mux.ServeHTTP(w, r)
+		mux.ServeHTTP(w, r)
 		return
 	}
 	w.Header().Set("Content-Encoding", "gzip")
 	gzw := newGzipResponseWriter(w)
 	defer gzw.Close()
-	s.mux.ServeHTTP(gzw, r)
+	mux.ServeHTTP(gzw, r)
+}
+
+// maxDecompressedRequestSize is the maximum size in bytes to which a
+// gzipped request body may decompress.
+var maxDecompressedRequestSize int64 = 64 << 20 // 64M
+
+// errRequestBodyTooLarge is returned by decompressRequestBody for a
+// body which decompresses to more than maxDecompressedRequestSize.
+var errRequestBodyTooLarge = util.Error("decompressed request body is too large")
+
+// decompressRequestBody replaces the gzipped body of the request with
+// its decompressed contents. The body is decompressed in full so that
+// malformed input is detected before the request is dispatched; no
+// more than maxDecompressedRequestSize bytes are decompressed.
+func decompressRequestBody(r *http.Request) error {
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(gz, maxDecompressedRequestSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) > maxDecompressedRequestSize {
+		return errRequestBodyTooLarge
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	r.Header.Del("Content-Encoding")
+	return nil
 }
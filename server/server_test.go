@@ -18,11 +18,15 @@
 package server
 
 import (
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -107,12 +111,18 @@ func TestInitEngine(t *testing.T) {
 		{fmt.Sprintf("mem=%s", tmp[2]), proto.Attributes{Attrs: []string{"mem"}}, false, false},
 		{fmt.Sprintf("abc=%s", tmp[3]), proto.Attributes{Attrs: []string{"abc"}}, false, false},
 		{fmt.Sprintf("hdd:7200rpm=%s", tmp[4]), proto.Attributes{Attrs: []string{"hdd", "7200rpm"}}, false, false},
+		{"mem=1GiB", proto.Attributes{Attrs: []string{"mem"}}, false, true},
+		{fmt.Sprintf("ssd=%s:500GiB", tmp[0]), proto.Attributes{Attrs: []string{"ssd"}}, false, false},
+		{fmt.Sprintf("ssd=%s:1024", tmp[0]), proto.Attributes{Attrs: []string{"ssd"}}, false, false},
 		{"", proto.Attributes{}, true, false},
 		{"  ", proto.Attributes{}, true, false},
 		{"arbitrarystring", proto.Attributes{}, true, false},
 		{"mem=", proto.Attributes{}, true, false},
 		{"ssd=", proto.Attributes{}, true, false},
 		{"hdd=", proto.Attributes{}, true, false},
+		{"mem=1GiB:1GiB", proto.Attributes{}, true, false},
+		{fmt.Sprintf("ssd=%s:0", tmp[0]), proto.Attributes{}, true, false},
+		{fmt.Sprintf("ssd=%s:lots", tmp[0]), proto.Attributes{}, true, false},
 	}
 	for _, spec := range testCases {
 		engines, err := initEngines(spec.key)
@@ -143,7 +153,7 @@ func TestInitEngines(t *testing.T) {
 	tmp := createTempDirs(2, t)
 	defer resetTestData(tmp)
 
-	stores := fmt.Sprintf("mem=1000,mem:ddr3=1000,ssd=%s,hdd:7200rpm=%s", tmp[0], tmp[1])
+	stores := fmt.Sprintf("mem=1000,mem:ddr3=1MiB,ssd=%s:1GiB,hdd:7200rpm=%s", tmp[0], tmp[1])
 	expEngines := []struct {
 		attrs proto.Attributes
 		isMem bool
@@ -192,6 +202,25 @@ func TestHealthz(t *testing.T) {
 	}
 }
 
+// TestReady verifies that /_admin/ready returns "ok" once the node
+// has connected to gossip and is serving its ranges.
+func TestReady(t *testing.T) {
+	startServer()
+	url := "http://" + *httpAddr + "/_admin/ready"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error requesting ready at %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), "ok") {
+		t.Errorf("expected ok; got %d: %q", resp.StatusCode, string(b))
+	}
+}
+
 // TestGzip hits the /_admin/healthz endpoint while explicitly disabling
 // decompression on a custom client's Transport and setting it
 // conditionally via the request's Accept-Encoding headers.
@@ -239,3 +268,205 @@ func TestGzip(t *testing.T) {
 		t.Errorf("expected body to contain %q, got %q", expected, string(b))
 	}
 }
+
+// TestGzipRequestBody verifies that gzipped request bodies are
+// decompressed before dispatch and that malformed or oversized ones
+// are rejected.
+func TestGzipRequestBody(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	})
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte("compressed body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		body    []byte
+		expCode int
+		expBody string
+	}{
+		{buf.Bytes(), http.StatusOK, "compressed body"},
+		{[]byte("not gzipped"), http.StatusBadRequest, "malformed gzip"},
+		{buf.Bytes()[:buf.Len()-4], http.StatusBadRequest, "malformed gzip"},
+		{buf.Bytes(), http.StatusRequestEntityTooLarge, "too large"},
+	}
+	defer func(size int64) { maxDecompressedRequestSize = size }(maxDecompressedRequestSize)
+	for i, test := range testCases {
+		if test.expCode == http.StatusRequestEntityTooLarge {
+			maxDecompressedRequestSize = int64(len("compressed body") - 1)
+		}
+		req, err := http.NewRequest("POST", "/echo", bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		serveGzip(mux, w, req)
+		if w.Code != test.expCode || !strings.Contains(w.Body.String(), test.expBody) {
+			t.Errorf("%d: expected %d %q; got %d %q", i, test.expCode, test.expBody, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestAdminAddr verifies that when -admin_addr is specified, admin
+// endpoints are served only via the admin mux.
+func TestAdminAddr(t *testing.T) {
+	origAdminAddr := *adminAddr
+	*adminAddr = "127.0.0.1:0"
+	defer func() { *adminAddr = origAdminAddr }()
+
+	s, err := newServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.kvDB.Close()
+	if s.adminMux == s.mux {
+		t.Fatal("expected separate admin mux")
+	}
+	s.initHTTP()
+
+	testCases := []struct {
+		mux      *http.ServeMux
+		expected int
+	}{
+		{s.mux, http.StatusNotFound},
+		{s.adminMux, http.StatusOK},
+	}
+	for i, test := range testCases {
+		req, err := http.NewRequest("GET", healthzKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		test.mux.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%d: expected status %d; got %d", i, test.expected, w.Code)
+		}
+	}
+}
+
+// TestAdminSocket verifies that the admin endpoints are served on the
+// Unix domain socket specified via -admin_socket, and that the socket
+// file is removed when it's closed.
+func TestAdminSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin_socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+
+	origAdminSocket := *adminSocket
+	*adminSocket = path
+	defer func() { *adminSocket = origAdminSocket }()
+
+	s, err := newServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.kvDB.Close()
+	if s.adminMux == s.mux {
+		t.Fatal("expected separate admin mux")
+	}
+	s.initHTTP()
+	// A file which isn't a socket is never replaced.
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.startAdminSocket(path); err == nil {
+		t.Error("expected error listening on a regular file")
+	}
+	os.Remove(path)
+	if err := s.startAdminSocket(path); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) { return net.Dial("unix", path) },
+	}}
+	resp, err := client.Get("http://admin" + healthzKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	s.stopAdminSocket()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected socket file to be removed; got %v", err)
+	}
+}
+
+// TestRequestLoggerPrefix verifies that request log lines are tagged
+// with the request's method and path, and with its user if one is
+// specified.
+func TestRequestLoggerPrefix(t *testing.T) {
+	r, err := http.NewRequest("PUT", "http://localhost/_admin/zones/db1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := newRequestLogger(r); l.prefix != "[PUT /_admin/zones/db1] " {
+		t.Errorf("unexpected prefix %q", l.prefix)
+	}
+	r.Header.Set(userHeader, "root")
+	if l := newRequestLogger(r); l.prefix != "[PUT /_admin/zones/db1 user=root] " {
+		t.Errorf("unexpected prefix %q", l.prefix)
+	}
+}
+
+// TestAccessLogWriter verifies that the access log writer records the
+// status code and the number of bytes written to the client, which
+// are the compressed bytes when the response is gzipped.
+func TestAccessLogWriter(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 1000)))
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	testCases := []struct {
+		path      string
+		gzip      bool
+		expStatus int
+	}{
+		{"/ok", false, http.StatusOK},
+		{"/ok", true, http.StatusOK},
+		{"/missing", false, http.StatusNotFound},
+	}
+	for i, test := range testCases {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.gzip {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		alw := newAccessLogWriter(w)
+		serveGzip(mux, alw, req)
+		alw.log(req, 0)
+		if alw.status != test.expStatus {
+			t.Errorf("%d: expected status %d; got %d", i, test.expStatus, alw.status)
+		}
+		if alw.bytes != int64(w.Body.Len()) {
+			t.Errorf("%d: expected %d bytes; got %d", i, w.Body.Len(), alw.bytes)
+		}
+		if test.gzip && alw.bytes >= 1000 {
+			t.Errorf("%d: expected compressed byte count; got %d", i, alw.bytes)
+		}
+	}
+}
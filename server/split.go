@@ -0,0 +1,79 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A rangeDesc is the JSON-formatted description of a range, such as
+// one resulting from a split. Keys are URL-escaped.
+type rangeDesc struct {
+	StartKey string          `json:"start_key"`
+	EndKey   string          `json:"end_key"`
+	Replicas []proto.Replica `json:"replicas"`
+}
+
+func newRangeDesc(desc *proto.RangeDescriptor) rangeDesc {
+	return rangeDesc{
+		StartKey: url.QueryEscape(string(desc.StartKey)),
+		EndKey:   url.QueryEscape(string(desc.EndKey)),
+		Replicas: desc.Replicas,
+	}
+}
+
+// A splitHandler splits ranges at operator-specified keys.
+type splitHandler struct {
+	db storage.DB // Key-value database client
+}
+
+// Split splits the range containing the key specified by path at that
+// key. The leading "/" path delimiter is stripped. The split updates
+// the range addressing records along with the ranges. On success, the
+// body result contains the JSON-formatted descriptors of the two
+// resulting ranges.
+func (sh *splitHandler) Split(path string) (body []byte, contentType string, err error) {
+	if len(path) <= 1 {
+		err = util.Errorf("no split key specified")
+		return
+	}
+	splitKey := engine.Key(path[1:])
+	reply := <-sh.db.AdminSplit(&proto.AdminSplitRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:  splitKey,
+			User: storage.UserRoot,
+		},
+		SplitKey: splitKey,
+	})
+	if reply.Error != nil {
+		err = reply.GoError()
+		return
+	}
+	contentType = "application/json"
+	if body, err = json.Marshal(map[string]rangeDesc{
+		"left":  newRangeDesc(&reply.Left),
+		"right": newRangeDesc(&reply.Right),
+	}); err != nil {
+		err = util.Errorf("unable to format split ranges: %v", err)
+	}
+	return
+}
@@ -21,11 +21,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"runtime"
+	"sort"
 
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/server/status"
 	"github.com/cockroachdb/cockroach/storage"
-	"github.com/cockroachdb/cockroach/util/log"
 )
 
 const (
@@ -38,6 +38,10 @@ const (
 	// statusGossipKeyPrefix exposes a view of the gossip network.
 	statusGossipKeyPrefix = statusKeyPrefix + "gossip"
 
+	// statusGossipTopologyKey exposes the local gossip node's view of
+	// the gossip network: its peers and the origin of each info.
+	statusGossipTopologyKey = statusGossipKeyPrefix + "/topology"
+
 	// statusLocalKeyPrefix exposes the status of the node serving the request.
 	// This is equivalent to GETing statusNodesKeyPrefix/<current-node-id>.
 	// Useful for debugging nodes that aren't communicating with the cluster properly.
@@ -46,6 +50,10 @@ const (
 	// statusLocalStacksKey exposes stack traces of running goroutines.
 	statusLocalStacksKey = statusLocalKeyPrefix + "stacks"
 
+	// statusLocalCapacityKey exposes the capacity and usage of each of
+	// the local node's stores, along with their sum for the node.
+	statusLocalCapacityKey = statusLocalKeyPrefix + "capacity"
+
 	// statusNodesKeyPrefix exposes status for each of the nodes the cluster.
 	// GETing statusNodesKeyPrefix will list all nodes.
 	// Individual node status can be queried at statusNodesKeyPrefix/NodeID.
@@ -62,13 +70,16 @@ const (
 type statusServer struct {
 	db     storage.DB
 	gossip *gossip.Gossip
+	node   *Node
 }
 
-// newStatusServer allocates and returns a statusServer.
-func newStatusServer(db storage.DB, gossip *gossip.Gossip) *statusServer {
+// newStatusServer allocates and returns a statusServer which reports
+// the status of the stores of node.
+func newStatusServer(db storage.DB, gossip *gossip.Gossip, node *Node) *statusServer {
 	return &statusServer{
 		db:     db,
 		gossip: gossip,
+		node:   node,
 	}
 }
 
@@ -77,8 +88,10 @@ func newStatusServer(db storage.DB, gossip *gossip.Gossip) *statusServer {
 func (s *statusServer) RegisterHandlers(mux *http.ServeMux) {
 	mux.HandleFunc(statusKeyPrefix, s.handleStatus)
 	mux.HandleFunc(statusGossipKeyPrefix, s.handleGossipStatus)
+	mux.HandleFunc(statusGossipTopologyKey, s.handleGossipTopology)
 	mux.HandleFunc(statusLocalKeyPrefix, s.handleLocalStatus)
 	mux.HandleFunc(statusLocalStacksKey, s.handleLocalStacks)
+	mux.HandleFunc(statusLocalCapacityKey, s.handleLocalCapacity)
 	mux.HandleFunc(statusNodesKeyPrefix, s.handleNodeStatus)
 	mux.HandleFunc(statusStoresKeyPrefix, s.handleStoresStatus)
 	mux.HandleFunc(statusTransactionsKeyPrefix, s.handleTransactionStatus)
@@ -94,7 +107,7 @@ func (s *statusServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 
 	b, err := json.Marshal(cluster)
 	if err != nil {
-		log.Error(err)
+		newRequestLogger(r).Errorf("%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -106,12 +119,26 @@ func (s *statusServer) handleGossipStatus(w http.ResponseWriter, r *http.Request
 	w.Header().Set("Content-Type", "application/json")
 	b, err := s.gossip.GetInfosAsJSON()
 	if err != nil {
-		log.Error(err)
+		newRequestLogger(r).Errorf("%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 	w.Write(b)
 }
 
+// handleGossipTopology handles GET requests for the local gossip
+// node's view of the gossip network, for diagnosing nodes which fail
+// to join the cluster.
+func (s *statusServer) handleGossipTopology(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	b, err := json.Marshal(s.gossip.Topology())
+	if err != nil {
+		newRequestLogger(r).Errorf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
 // handleLocalStatus handles GET requests for local-node status.
 func (s *statusServer) handleLocalStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -137,6 +164,58 @@ func (s *statusServer) handleLocalStacks(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// handleLocalCapacity handles GET requests for the capacity of the
+// local node's stores. The bytes used by each store are those reported
+// by its engine.
+func (s *statusServer) handleLocalCapacity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	nodeCap := &status.NodeCapacity{
+		NodeID: s.node.Descriptor.NodeID,
+		Stores: []status.StoreCapacity{},
+	}
+	err := s.node.localKV.VisitStores(func(store *storage.Store) error {
+		capacity, err := store.Capacity()
+		if err != nil {
+			return err
+		}
+		storeCap := status.StoreCapacity{
+			StoreID:   store.Ident.StoreID,
+			Attrs:     store.Attrs().Attrs,
+			Capacity:  capacity.Capacity,
+			Available: capacity.Available,
+			Used:      capacity.Used,
+		}
+		nodeCap.Capacity += storeCap.Capacity
+		nodeCap.Available += storeCap.Available
+		nodeCap.Used += storeCap.Used
+		nodeCap.Stores = append(nodeCap.Stores, storeCap)
+		return nil
+	})
+	if err != nil {
+		newRequestLogger(r).Errorf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Stores are visited in random order.
+	sort.Sort(storeCapacities(nodeCap.Stores))
+
+	b, err := json.Marshal(nodeCap)
+	if err != nil {
+		newRequestLogger(r).Errorf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// storeCapacities sorts store capacities by store ID.
+type storeCapacities []status.StoreCapacity
+
+func (s storeCapacities) Len() int           { return len(s) }
+func (s storeCapacities) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s storeCapacities) Less(i, j int) bool { return s[i].StoreID < s[j].StoreID }
+
 // handleNodeStatus handles GET requests for node status.
 func (s *statusServer) handleNodeStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -147,7 +226,7 @@ func (s *statusServer) handleNodeStatus(w http.ResponseWriter, r *http.Request)
 
 	b, err := json.Marshal(nodes)
 	if err != nil {
-		log.Error(err)
+		newRequestLogger(r).Errorf("%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -34,3 +34,22 @@ type NodeSummary struct {
 
 // Node represents an individual node within the cluster.
 type Node struct{}
+
+// StoreCapacity reports the capacity of a store's engine and the
+// bytes used by its data.
+type StoreCapacity struct {
+	StoreID   int32    `json:"storeID"`
+	Attrs     []string `json:"attrs"`
+	Capacity  int64    `json:"capacity"`
+	Available int64    `json:"available"`
+	Used      int64    `json:"used"`
+}
+
+// NodeCapacity sums the capacity of each of a node's stores.
+type NodeCapacity struct {
+	NodeID    int32           `json:"nodeID"`
+	Capacity  int64           `json:"capacity"`
+	Available int64           `json:"available"`
+	Used      int64           `json:"used"`
+	Stores    []StoreCapacity `json:"stores"`
+}
@@ -18,28 +18,42 @@
 package server
 
 import (
+	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/server/status"
+	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // startStatusServer launches a new status server using minimal engine
-// and local database setup. Returns the new http test server, which
-// should be cleaned up by caller via httptest.Server.Close(). The
-// Cockroach KV client address is set to the address of the test server.
-func startStatusServer() *httptest.Server {
+// and local database setup. The status server reports on node, which
+// has no stores and whose gossip instance is not started. Returns the
+// new http test server, which should be cleaned up by caller via
+// httptest.Server.Close(), and the node. The Cockroach KV client
+// address is set to the address of the test server.
+func startStatusServer() (*httptest.Server, *Node) {
 	db, err := BootstrapCluster("cluster-1", engine.NewInMem(proto.Attributes{}, 1<<20))
 	if err != nil {
 		log.Fatal(err)
 	}
-	status := newStatusServer(db, nil)
+	g := gossip.New(rpc.LoadInsecureTLSConfig())
+	node := NewNode(db, g)
+	status := newStatusServer(db, g, node)
 	mux := http.NewServeMux()
 	status.RegisterHandlers(mux)
 	httpServer := httptest.NewServer(mux)
@@ -48,13 +62,14 @@ func startStatusServer() *httptest.Server {
 	} else if strings.HasPrefix(httpServer.URL, "https://") {
 		*kv.Addr = strings.TrimPrefix(httpServer.URL, "https://")
 	}
-	return httpServer
+	return httpServer, node
 }
 
 // TestStatusStacks verifies that goroutine stack traces are available
 // via the /_status/stacks endpoint.
 func TestStatusStacks(t *testing.T) {
-	s := startStatusServer()
+	s, _ := startStatusServer()
+	defer s.Close()
 	body, err := getText(s.URL + statusLocalStacksKey)
 	if err != nil {
 		t.Fatal(err)
@@ -64,3 +79,111 @@ func TestStatusStacks(t *testing.T) {
 		t.Errorf("expected match: %t; err nil: %v", matches, err)
 	}
 }
+
+// TestStatusLocalCapacity verifies that the capacity and usage of each
+// of the local node's stores, and their sums, are available via the
+// /_status/local/capacity endpoint.
+func TestStatusLocalCapacity(t *testing.T) {
+	s, node := startStatusServer()
+	defer s.Close()
+	node.Descriptor.NodeID = 1
+	clock := hlc.NewClock(hlc.UnixNano)
+	for i, attrs := range [][]string{{"ssd"}, {"hdd"}} {
+		store := storage.NewStore(clock, engine.NewInMem(proto.Attributes{Attrs: attrs}, 1<<20), nil)
+		if err := store.Bootstrap(proto.StoreIdent{ClusterID: "cluster-1", NodeID: 1, StoreID: int32(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Init(); err != nil {
+			t.Fatal(err)
+		}
+		node.localKV.AddStore(store)
+	}
+
+	// Write to a range of the first store so that it uses some space.
+	store, err := node.localKV.GetStore(&proto.Replica{StoreID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(engine.KeyMin, engine.KeyMax, []proto.Replica{{NodeID: 1, StoreID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rng.Stop()
+	args := &proto.PutRequest{
+		RequestHeader: proto.RequestHeader{Key: engine.Key("a"), Timestamp: clock.Now()},
+		Value:         proto.Value{Bytes: []byte("value")},
+	}
+	if err := rng.ReadWriteCmd(storage.Put, args, &proto.PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := getText(s.URL + statusLocalCapacityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeCap := &status.NodeCapacity{}
+	if err := json.Unmarshal(body, nodeCap); err != nil {
+		t.Fatal(err)
+	}
+	if nodeCap.NodeID != 1 || len(nodeCap.Stores) != 2 {
+		t.Fatalf("expected capacity of node 1 with 2 stores; got %+v", nodeCap)
+	}
+	var capacity, available, used int64
+	for i, storeCap := range nodeCap.Stores {
+		if storeCap.StoreID != int32(i+1) || storeCap.Capacity != 1<<20 ||
+			storeCap.Used+storeCap.Available != storeCap.Capacity {
+			t.Errorf("unexpected capacity of store %d: %+v", i+1, storeCap)
+		}
+		capacity += storeCap.Capacity
+		available += storeCap.Available
+		used += storeCap.Used
+	}
+	if !reflect.DeepEqual(nodeCap.Stores[0].Attrs, []string{"ssd"}) {
+		t.Errorf("expected attributes of store 1; got %+v", nodeCap.Stores[0])
+	}
+	if nodeCap.Stores[0].Used <= nodeCap.Stores[1].Used {
+		t.Errorf("expected store 1 to use more space than store 2; got %+v", nodeCap.Stores)
+	}
+	if nodeCap.Capacity != capacity || nodeCap.Available != available || nodeCap.Used != used {
+		t.Errorf("expected node capacity to sum store capacities; got %+v", nodeCap)
+	}
+}
+
+// TestStatusGossipTopology verifies that the local gossip node's
+// peers and infos are available via the /_status/gossip/topology
+// endpoint.
+func TestStatusGossipTopology(t *testing.T) {
+	s, node := startStatusServer()
+	defer s.Close()
+	node.gossip.SetBootstrap([]net.Addr{util.MakeRawAddr("tcp", "127.0.0.1:26257")})
+	for _, key := range []string{"b", "a"} {
+		if err := node.gossip.AddInfo(key, key, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body, err := getText(s.URL + statusGossipTopologyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology := &gossip.Topology{}
+	if err := json.Unmarshal(body, topology); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(topology.Bootstraps, []string{"127.0.0.1:26257"}) {
+		t.Errorf("expected bootstrap address; got %+v", topology.Bootstraps)
+	}
+	if len(topology.Incoming) != 0 || len(topology.Outgoing) != 0 || topology.Connected {
+		t.Errorf("expected no peers; got %+v", topology)
+	}
+	var keys []string
+	for _, info := range topology.Infos {
+		keys = append(keys, info.Key)
+		if info.Hops != 0 || info.PeerAddr != "" || info.Timestamp == 0 {
+			t.Errorf("expected locally originated info; got %+v", info)
+		}
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("expected infos sorted by key; got %q", keys)
+	}
+}
@@ -44,6 +44,7 @@ type DB interface {
 	Delete(args *proto.DeleteRequest) <-chan *proto.DeleteResponse
 	DeleteRange(args *proto.DeleteRangeRequest) <-chan *proto.DeleteRangeResponse
 	Scan(args *proto.ScanRequest) <-chan *proto.ScanResponse
+	Count(args *proto.CountRequest) <-chan *proto.CountResponse
 	BeginTransaction(args *proto.BeginTransactionRequest) <-chan *proto.BeginTransactionResponse
 	EndTransaction(args *proto.EndTransactionRequest) <-chan *proto.EndTransactionResponse
 	AccumulateTS(args *proto.AccumulateTSRequest) <-chan *proto.AccumulateTSResponse
@@ -53,6 +54,7 @@ type DB interface {
 	InternalHeartbeatTxn(args *proto.InternalHeartbeatTxnRequest) <-chan *proto.InternalHeartbeatTxnResponse
 	InternalResolveIntent(args *proto.InternalResolveIntentRequest) <-chan *proto.InternalResolveIntentResponse
 	InternalSnapshotCopy(args *proto.InternalSnapshotCopyRequest) <-chan *proto.InternalSnapshotCopyResponse
+	AdminSplit(args *proto.AdminSplitRequest) <-chan *proto.AdminSplitResponse
 }
 
 // GetI fetches the value at the specified key and gob-deserializes it
@@ -144,8 +146,10 @@ func putInternal(db DB, key engine.Key, value proto.Value, timestamp proto.Times
 }
 
 // BootstrapRangeDescriptor sets meta1 and meta2 values for KeyMax,
-// using the provided replica.
+// using the provided replica. The descriptor's replicas are
+// normalized before it is written.
 func BootstrapRangeDescriptor(db DB, desc *proto.RangeDescriptor, timestamp proto.Timestamp) error {
+	desc.NormalizeReplicas()
 	// Write meta1.
 	if err := PutProto(db, engine.MakeKey(engine.KeyMeta1Prefix, engine.KeyMax), desc, timestamp); err != nil {
 		return err
@@ -200,10 +204,12 @@ func BootstrapConfigs(db DB, timestamp proto.Timestamp) error {
 // UpdateRangeDescriptor updates the range locations metadata for the
 // range specified by the meta parameter. This always involves a write
 // to "meta2", and may require a write to "meta1", in the event that
-// meta.EndKey is a "meta2" key (prefixed by KeyMeta2Prefix).
+// meta.EndKey is a "meta2" key (prefixed by KeyMeta2Prefix). The
+// descriptor's replicas are normalized before it is written.
 func UpdateRangeDescriptor(db DB, meta proto.RangeMetadata,
 	desc *proto.RangeDescriptor, timestamp proto.Timestamp) error {
 	// TODO(spencer): a lot more work here to actually implement this.
+	desc.NormalizeReplicas()
 
 	// Write meta2.
 	key := engine.MakeKey(engine.KeyMeta2Prefix, meta.EndKey)
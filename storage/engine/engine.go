@@ -31,9 +31,11 @@ import (
 )
 
 // StoreCapacity contains capacity information for a storage device.
+// Used is the number of bytes used by the engine's data.
 type StoreCapacity struct {
 	Capacity  int64
 	Available int64
+	Used      int64
 }
 
 // PercentAvail computes the percentage of disk space that is available.
@@ -176,7 +178,8 @@ func GetProto(engine Engine, key Key, msg gogoproto.Message) (bool, error) {
 
 // Increment fetches the varint encoded int64 value specified by key
 // and adds "inc" to it then re-encodes as varint. The newly incremented
-// value is returned.
+// value is returned. If the new value would overflow an int64, an
+// *IncrementOverflowError is returned.
 func Increment(engine Engine, key Key, inc int64) (int64, error) {
 	// First retrieve existing value.
 	val, err := engine.Get(key)
@@ -198,7 +201,7 @@ func Increment(engine Engine, key Key, inc int64) (int64, error) {
 
 	// Check for overflow and underflow.
 	if encoding.WillOverflow(int64Val, inc) {
-		return 0, util.Errorf("key %q with value %d incremented by %d results in overflow", key, int64Val, inc)
+		return 0, &IncrementOverflowError{Key: key, Value: int64Val, Increment: inc}
 	}
 
 	if inc == 0 {
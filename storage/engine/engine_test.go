@@ -55,7 +55,7 @@ func runWithAllEngines(test func(e Engine, t *testing.T), t *testing.T) {
 	inMem := NewInMem(proto.Attributes{}, 10<<20)
 
 	loc := fmt.Sprintf("%s/data_%d", os.TempDir(), time.Now().UnixNano())
-	rocksdb := NewRocksDB(proto.Attributes{Attrs: []string{"ssd"}}, loc)
+	rocksdb := NewRocksDB(proto.Attributes{Attrs: []string{"ssd"}}, loc, 0)
 	err := rocksdb.Start()
 	if err != nil {
 		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
@@ -363,6 +363,8 @@ func TestEngineIncrement(t *testing.T) {
 		// Increment same key by max int64 value to cause overflow; should return error.
 		if val, err = Increment(engine, Key("a"), math.MaxInt64); err == nil {
 			t.Error("expected an overflow error")
+		} else if _, ok := err.(*IncrementOverflowError); !ok {
+			t.Errorf("expected IncrementOverflowError; got %v", err)
 		}
 		if val, err = Increment(engine, Key("a"), 0); err != nil {
 			t.Fatal(err)
@@ -65,11 +65,33 @@ func (gc *GarbageCollector) Filter(keys []Key, values [][]byte) []bool {
 	if policy == nil || policy.TTLSeconds <= 0 {
 		return nil
 	}
-	toDelete := make([]bool, len(keys))
 	expiration := gc.now
 	expiration.WallTime -= int64(policy.TTLSeconds) * 1E9
+	return filterVersions(keys, values, expiration)
+}
 
-	var survivors bool
+// filterVersions decides which of the MVCC metadata and versioned
+// values for a single key to delete, given the expiration timestamp
+// before which versions may be removed. keys[0] must be the metadata
+// key, followed by the versioned keys from newest to oldest.
+//
+// Versions older than the expiration are deleted, with the exception
+// of the most recent version, which is always kept while it holds a
+// live value. Deletion tombstones follow a separate policy:
+//
+//   - A tombstone which is the most recent version is kept until the
+//     expiration is above its timestamp, both to shadow older values
+//     and to serve reads beneath the delete. Once expired, the key is
+//     removed altogether: the tombstone, any older versions and the
+//     metadata.
+//   - A tombstone with a live value above it is an ordinary version,
+//     deleted once older than the expiration.
+//
+// A most recent version written with an expiration (see
+// MVCC.PutWithExpiration) which has itself expired before the GC
+// expiration is treated as an expired tombstone, and the key removed.
+func filterVersions(keys []Key, values [][]byte, expiration proto.Timestamp) []bool {
+	toDelete := make([]bool, len(keys))
 	for i, key := range keys {
 		_, ts, isValue := mvccDecodeKey(key)
 		if i == 0 {
@@ -89,24 +111,18 @@ func (gc *GarbageCollector) Filter(keys []Key, values [][]byte) []bool {
 			return make([]bool, len(keys))
 		}
 		if i == 1 {
-			// If the first value isn't a deletion tombstone, set survivors to true.
-			if !mvccVal.Deleted {
-				survivors = true
-			}
-		} else {
-			if ts.Less(expiration) {
-				// If we encounter a version older than our GC timestamp, mark for deletion.
-				toDelete[i] = true
-			} else if !mvccVal.Deleted {
-				// Otherwise, if not marked for GC and not a tombstone, set survivors true.
-				survivors = true
+			// If the most recent version is an expired tombstone or an
+			// expired value, remove the key altogether, including the MVCC
+			// metadata entry.
+			if (mvccVal.Deleted && ts.Less(expiration)) ||
+				(mvccVal.Expiration != nil && mvccVal.Expiration.Less(expiration)) {
+				for j := range keys {
+					toDelete[j] = true
+				}
+				return toDelete
 			}
-		}
-	}
-	// If there are no remaining non-deleted, versioned entries, mark
-	// all keys for deletion, including the MVCC metadata entry.
-	if !survivors {
-		for i := range keys {
+		} else if ts.Less(expiration) {
+			// If we encounter a version older than our GC timestamp, mark for deletion.
 			toDelete[i] = true
 		}
 	}
@@ -98,6 +98,12 @@ func TestGarbageCollectorFilter(t *testing.T) {
 	e := []byte{}
 	n := serializedMVCCValue(false, t)
 	d := serializedMVCCValue(true, t)
+	// x is a value which expires at 2.5s.
+	expiration := makeTS(25E8, 0)
+	x, err := gogoproto.Marshal(&proto.MVCCValue{Value: &proto.Value{Bytes: []byte("x")}, Expiration: &expiration})
+	if err != nil {
+		t.Fatal(err)
+	}
 	testData := []struct {
 		time      proto.Timestamp
 		keys      []Key
@@ -105,9 +111,9 @@ func TestGarbageCollectorFilter(t *testing.T) {
 		expDelete []bool
 	}{
 		{makeTS(0, 0), aKeys, [][]byte{e, n, n, n}, []bool{false, false, false, false}},
-		{makeTS(0, 0), aKeys, [][]byte{e, d, d, d}, []bool{true, true, true, true}},
+		{makeTS(0, 0), aKeys, [][]byte{e, d, d, d}, []bool{false, false, false, false}},
 		{makeTS(0, 0), bKeys, [][]byte{e, n, n}, []bool{false, false, false}},
-		{makeTS(0, 0), bKeys, [][]byte{e, d, d}, []bool{true, true, true}},
+		{makeTS(0, 0), bKeys, [][]byte{e, d, d}, []bool{false, false, false}},
 		{makeTS(0, 0), cKeys, [][]byte{n}, nil},
 		{makeTS(1E9, 0), aKeys, [][]byte{e, n, n, n}, []bool{false, false, false, false}},
 		{makeTS(1E9, 0), bKeys, [][]byte{e, n, n}, []bool{false, false, false}},
@@ -116,12 +122,15 @@ func TestGarbageCollectorFilter(t *testing.T) {
 		{makeTS(2E9, 0), bKeys, [][]byte{e, n, n}, []bool{false, false, false}},
 		{makeTS(2E9, 0), cKeys, [][]byte{n}, nil},
 		{makeTS(3E9, 0), aKeys, [][]byte{e, n, n, n}, []bool{false, false, true, true}},
-		{makeTS(3E9, 0), aKeys, [][]byte{e, d, n, n}, []bool{true, true, true, true}},
+		{makeTS(3E9, 0), aKeys, [][]byte{e, d, n, n}, []bool{false, false, true, true}},
+		{makeTS(3E9, 0), aKeys, [][]byte{e, n, d, n}, []bool{false, false, true, true}},
+		{makeTS(3E9, 0), aKeys, [][]byte{e, x, n, n}, []bool{false, false, true, true}},
 		{makeTS(3E9, 0), bKeys, [][]byte{e, n, n}, []bool{false, false, false}},
 		{makeTS(3E9, 0), cKeys, [][]byte{n}, nil},
 		{makeTS(4E9, 0), aKeys, [][]byte{e, n, n, n}, []bool{false, false, true, true}},
+		{makeTS(4E9, 0), aKeys, [][]byte{e, x, n, n}, []bool{true, true, true, true}},
 		{makeTS(4E9, 0), bKeys, [][]byte{e, n, n}, []bool{false, false, true}},
-		{makeTS(4E9, 0), bKeys, [][]byte{e, d, n}, []bool{true, true, true}},
+		{makeTS(4E9, 0), bKeys, [][]byte{e, d, n}, []bool{false, false, true}},
 		{makeTS(4E9, 0), cKeys, [][]byte{n}, nil},
 		{makeTS(5E9, 0), aKeys, [][]byte{e, n, n, n}, []bool{false, false, true, true}},
 		{makeTS(5E9, 0), bKeys, [][]byte{e, n, n}, []bool{false, false, true}},
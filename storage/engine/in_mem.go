@@ -302,6 +302,7 @@ func (in *InMem) Capacity() (StoreCapacity, error) {
 	return StoreCapacity{
 		Capacity:  in.maxBytes,
 		Available: in.maxBytes - in.usedBytes,
+		Used:      in.usedBytes,
 	}, nil
 }
 
@@ -35,7 +35,47 @@ type KeyRange struct {
 
 // Less implements the util.Ordered interface.
 func (k Key) Less(l Key) bool {
-	return bytes.Compare(k, l) == -1
+	return k.Compare(l) < 0
+}
+
+// Compare returns an integer comparing k to l lexicographically: 0 if
+// k == l, -1 if k < l and +1 if k > l.
+func (k Key) Compare(l Key) int {
+	return bytes.Compare(k, l)
+}
+
+// Next returns a new Key that sorts immediately after k; that is, k
+// with a zero byte appended. No special behaviour applies for KeyMax.
+// nil is treated like the empty key.
+func (k Key) Next() Key {
+	return MakeKey(k, Key{0})
+}
+
+// PrefixEnd returns the key that sorts precisely behind all keys
+// having k as a prefix: "1" is added to the final byte and the carry
+// propagated. The special cases of nil and KeyMin ("") always return
+// KeyMax ("\xff"). A key consisting entirely of "\xff" bytes is
+// returned unchanged.
+func (k Key) PrefixEnd() Key {
+	if len(k) == 0 {
+		return KeyMax
+	}
+	end := make([]byte, len(k))
+	copy(end, k)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i] = end[i] + 1
+		if end[i] != 0 {
+			return end
+		}
+	}
+	// This statement will only be reached if the key is already a
+	// maximal byte string (i.e. already \xff...).
+	return k
+}
+
+// IsPrefixOf returns whether k is a prefix of l.
+func (k Key) IsPrefixOf(l Key) bool {
+	return bytes.HasPrefix(l, k)
 }
 
 // Value specifies the value at a key. Multiple values at the same key
@@ -70,32 +110,16 @@ func MakeKey(prefix Key, keys ...Key) Key {
 	return Key(bytes.Join([][]byte{prefix, suffix}, []byte{}))
 }
 
-// PrefixEndKey determines the end key given a start key as a prefix,
-// that is the key that sorts precisely behind all keys starting with
-// prefix: "1" is added to the final byte and the carry propagated.
-// The special cases of nil and KeyMin ("") always returns KeyMax ("\xff").
+// PrefixEndKey determines the end key given a start key as a prefix.
+// It is equivalent to prefix.PrefixEnd().
 func PrefixEndKey(prefix Key) Key {
-	if bytes.Equal(prefix, KeyMin) || len(prefix) == 0 {
-		return KeyMax
-	}
-	end := make([]byte, len(prefix))
-	copy(end, prefix)
-	for i := len(end) - 1; i >= 0; i-- {
-		end[i] = end[i] + 1
-		if end[i] != 0 {
-			return end
-		}
-	}
-	// This statement will only be reached if the key is already a
-	// maximal byte string (i.e. already \xff...).
-	return prefix
+	return prefix.PrefixEnd()
 }
 
 // NextKey returns a new Key that sorts immediately after the given
-// key. No special behaviour applies for KeyMax. nil is treated like
-// the empty key.
+// key. It is equivalent to k.Next().
 func NextKey(k Key) Key {
-	return MakeKey(k, Key{0})
+	return k.Next()
 }
 
 // RangeMetaKey returns a range metadata key for the given key.  For ordinary
@@ -188,6 +212,10 @@ var (
 	// prefix is duplicated in rocksdb_compaction.cc and must be kept in sync
 	// if modified here.
 	KeyLocalRangeResponseCachePrefix = MakeKey(KeyLocalPrefix, Key("respcache-"))
+	// KeyLocalRangeClosedTimestampPrefix is the prefix for keys storing
+	// the closed timestamp of each range (see Range.closeTimestamp).
+	// The value is a Timestamp.
+	KeyLocalRangeClosedTimestampPrefix = MakeKey(KeyLocalPrefix, Key("closedts-"))
 	// KeyLocalTransactionPrefix specifies the key prefix for
 	// transaction records. The suffix is the transaction id. This key
 	// prefix is duplicated in rocksdb_compaction.cc and must be kept in
@@ -224,6 +252,9 @@ var (
 	// KeyConfigZonePrefix specifies the key prefix for zone
 	// configurations. The suffix is the affected key prefix.
 	KeyConfigZonePrefix = MakeKey(KeySystemPrefix, Key("zone"))
+	// KeyNodeDrainPrefix specifies the key prefix for the drain flags
+	// of nodes being decommissioned. The suffix is the node ID.
+	KeyNodeDrainPrefix = MakeKey(KeySystemPrefix, Key("drain-"))
 	// KeyNodeIDGenerator contains a sequence generator for node IDs.
 	KeyNodeIDGenerator = MakeKey(KeySystemPrefix, Key("node-idgen"))
 	// KeySchemaPrefix specifies key prefixes for schema definitions.
@@ -58,6 +58,51 @@ func TestNextKey(t *testing.T) {
 	}
 }
 
+// TestKeyPrefixEnd verifies the end keys computed for prefixes,
+// including the special cases of the empty and maximal keys.
+func TestKeyPrefixEnd(t *testing.T) {
+	testCases := []struct {
+		key, end Key
+	}{
+		{nil, KeyMax},
+		{Key(""), KeyMax},
+		{Key("a"), Key("b")},
+		{Key("a\xff"), Key("b\x00")},
+		{Key("a\xff\xff"), Key("b\x00\x00")},
+		{Key("\xff\xff"), Key("\xff\xff")},
+	}
+	for i, c := range testCases {
+		if end := c.key.PrefixEnd(); !bytes.Equal(end, c.end) {
+			t.Errorf("%d: expected prefix end of %q to be %q; got %q", i, c.key, c.end, end)
+		}
+	}
+}
+
+// TestKeyCompareAndIsPrefixOf verifies key comparison and prefix
+// matching.
+func TestKeyCompareAndIsPrefixOf(t *testing.T) {
+	testCases := []struct {
+		a, b     Key
+		cmp      int
+		isPrefix bool
+	}{
+		{Key(""), Key("a"), -1, true},
+		{Key("a"), Key("a"), 0, true},
+		{Key("a"), Key("ab"), -1, true},
+		{Key("ab"), Key("a"), 1, false},
+		{Key("b"), Key("ab"), 1, false},
+		{Key("a"), Key("a").Next(), -1, true},
+	}
+	for i, c := range testCases {
+		if cmp := c.a.Compare(c.b); cmp != c.cmp {
+			t.Errorf("%d: expected %q.Compare(%q) = %d; got %d", i, c.a, c.b, c.cmp, cmp)
+		}
+		if isPrefix := c.a.IsPrefixOf(c.b); isPrefix != c.isPrefix {
+			t.Errorf("%d: expected %q.IsPrefixOf(%q) = %t; got %t", i, c.a, c.b, c.isPrefix, isPrefix)
+		}
+	}
+}
+
 func TestMakeKey(t *testing.T) {
 	if !bytes.Equal(MakeKey(Key("A"), Key("B")), Key("AB")) ||
 		!bytes.Equal(MakeKey(Key("A")), Key("A")) ||
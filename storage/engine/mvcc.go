@@ -20,7 +20,11 @@ package engine
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"runtime/debug"
+	"strconv"
 
 	gogoproto "code.google.com/p/gogoprotobuf/proto"
 	"github.com/cockroachdb/cockroach/proto"
@@ -34,11 +38,41 @@ const (
 	splitReservoirSize = 100
 	// How many keys are read at once when scanning for a split key.
 	splitScanRowCount = int64(1 << 8)
+	// The number of increment records retained per key by IncrementWithID.
+	maxIncrementRecords = 8
+	// The number of keys written per engine batch by IngestSorted.
+	ingestBatchSize = 1000
 )
 
 // MVCC wraps the mvcc operations of a key/value store.
+//
+// MVCC does not track reads. A read served on behalf of a client must
+// also be registered, by key span and timestamp, in the timestamp
+// cache of the range serving it (see storage.Range.ReadOnlyCmd), so
+// that a later write beneath the read timestamp is pushed.
 type MVCC struct {
-	engine Engine // The underlying key-value store
+	engine Engine     // The underlying key-value store
+	buffer *txnBuffer // Per-txn write buffer; nil unless enabled
+	checks bool       // Verify metadata references on reads
+}
+
+// MVCCStats describes the change in the size and number of keys and
+// versions stored by MVCC as a result of a write. Counts may be
+// negative, e.g. if an intent is replaced. Callers aggregate these
+// deltas to maintain per-range counters without rescanning.
+type MVCCStats struct {
+	KeyBytes int64 // Bytes of metadata and versioned keys
+	ValBytes int64 // Bytes of metadata and versioned values
+	KeyCount int64 // Number of keys (i.e. metadata entries)
+	ValCount int64 // Number of versions, including deletion tombstones
+}
+
+// Add adds the counts in o to ms.
+func (ms *MVCCStats) Add(o MVCCStats) {
+	ms.KeyBytes += o.KeyBytes
+	ms.ValBytes += o.ValBytes
+	ms.KeyCount += o.KeyCount
+	ms.ValCount += o.ValCount
 }
 
 // writeIntentError is a trivial implementation of error.
@@ -46,9 +80,36 @@ type writeIntentError struct {
 	Txn *proto.Transaction
 }
 
+// writeTooOldError indicates a write which arrived out of order with
+// respect to the existing version of a key: either the write's
+// transaction epoch precedes that of the existing intent, or the
+// write's timestamp precedes that of the existing version.
 type writeTooOldError struct {
-	Timestamp proto.Timestamp
-	Txn       *proto.Transaction
+	Timestamp proto.Timestamp    // Timestamp of existing version
+	Txn       *proto.Transaction // Txn of existing intent, if any
+	// WriteTimestamp and WriteEpoch are the timestamp and, if the
+	// write is transactional, txn epoch of the rejected write.
+	WriteTimestamp proto.Timestamp
+	WriteEpoch     int32
+	// StaleEpoch is true if the write was rejected because of its
+	// epoch; otherwise, it was rejected because of its timestamp.
+	StaleEpoch bool
+}
+
+// IncrementOverflowError indicates that incrementing the integer
+// value of a key would overflow or underflow an int64. The value is
+// left unchanged. Callers may treat it as a normal condition, e.g. by
+// wrapping the value around.
+type IncrementOverflowError struct {
+	Key       Key
+	Value     int64 // The current value
+	Increment int64 // The increment which would overflow
+}
+
+// Error implements the error interface.
+func (e *IncrementOverflowError) Error() string {
+	return fmt.Sprintf("key %q with value %d incremented by %d results in overflow",
+		e.Key, e.Value, e.Increment)
 }
 
 func (e *writeIntentError) Error() string {
@@ -56,10 +117,39 @@ func (e *writeIntentError) Error() string {
 }
 
 func (e *writeTooOldError) Error() string {
+	if e.StaleEpoch {
+		return fmt.Sprintf("cannot write with txn epoch %d older than epoch %d of existing intent: %+v",
+			e.WriteEpoch, e.Txn.Epoch, e.Txn)
+	}
 	if e.Txn != nil {
-		return fmt.Sprintf("cannot write with a timestamp older than %+v, or older txn epoch: %+v", e.Timestamp, e.Txn)
+		return fmt.Sprintf("cannot write at timestamp %+v older than existing intent at %+v: %+v",
+			e.WriteTimestamp, e.Timestamp, e.Txn)
+	}
+	return fmt.Sprintf("cannot write at timestamp %+v older than existing version at %+v",
+		e.WriteTimestamp, e.Timestamp)
+}
+
+// checkWriteOrder verifies that a write at timestamp, by txn if not
+// nil, may replace the existing version of a key described by meta.
+// The caller must already have verified that any existing intent
+// belongs to txn. A write from an earlier epoch of the intent's
+// transaction is rejected whatever its timestamp; otherwise, a write
+// is rejected only if its timestamp precedes the existing version.
+// Rejected writes are likely older RPCs arriving out of order.
+func checkWriteOrder(meta *proto.MVCCMetadata, timestamp proto.Timestamp, txn *proto.Transaction) error {
+	var epoch int32
+	if txn != nil {
+		epoch = txn.Epoch
+	}
+	if meta.Txn != nil && epoch < meta.Txn.Epoch {
+		return &writeTooOldError{Timestamp: meta.Timestamp, Txn: meta.Txn,
+			WriteTimestamp: timestamp, WriteEpoch: epoch, StaleEpoch: true}
 	}
-	return fmt.Sprintf("cannot write with a timestamp older than %+v", e.Timestamp)
+	if timestamp.Less(meta.Timestamp) {
+		return &writeTooOldError{Timestamp: meta.Timestamp, Txn: meta.Txn,
+			WriteTimestamp: timestamp, WriteEpoch: epoch}
+	}
+	return nil
 }
 
 // NewMVCC returns a new instance of MVCC.
@@ -69,6 +159,36 @@ func NewMVCC(engine Engine) *MVCC {
 	}
 }
 
+// EnableTxnBuffer enables buffering of transactional writes. Each
+// transactional Put or Delete is written to the engine as an intent
+// as usual and additionally recorded in a per-transaction buffer, so
+// that subsequent reads by the same transaction (at the same epoch)
+// are served from memory. Buffered writes are dropped as their
+// intents are resolved, or all at once via DiscardTxnBuffer. At most
+// maxTxnBufferEntries writes are buffered at a time. It must be called
+// before the MVCC is used.
+func (mvcc *MVCC) EnableTxnBuffer() {
+	mvcc.buffer = newTxnBuffer()
+}
+
+// EnableConsistencyChecks causes reads to verify that the version
+// referenced by a key's metadata exists. Without checks, a read of
+// metadata whose latest version is missing (e.g. as left by a crash
+// part way through a non-atomic write) returns nil as if the key were
+// absent; with checks, it returns an error. It must be called before
+// the MVCC is used.
+func (mvcc *MVCC) EnableConsistencyChecks() {
+	mvcc.checks = true
+}
+
+// DiscardTxnBuffer discards all writes buffered for txn. It should be
+// invoked when the transaction commits or aborts.
+func (mvcc *MVCC) DiscardTxnBuffer(txn *proto.Transaction) {
+	if mvcc.buffer != nil && txn != nil {
+		mvcc.buffer.discard(txn)
+	}
+}
+
 // GetProto fetches the value at the specified key and unmarshals it
 // using a protobuf decoder. Returns true on success or false if the
 // key was not found.
@@ -88,6 +208,25 @@ func (mvcc *MVCC) GetProto(key Key, timestamp proto.Timestamp, txn *proto.Transa
 	return true, nil
 }
 
+// GetProtoTS is like GetProto, but additionally returns the timestamp
+// of the version read, for use as the expected timestamp of a later
+// ConditionalPutTS. The timestamp is zero if the key was not found.
+func (mvcc *MVCC) GetProtoTS(key Key, timestamp proto.Timestamp, txn *proto.Transaction, msg gogoproto.Message) (bool, proto.Timestamp, error) {
+	value, err := mvcc.Get(key, timestamp, txn)
+	if err != nil {
+		return false, proto.Timestamp{}, err
+	}
+	if value == nil || len(value.Bytes) == 0 {
+		return false, proto.Timestamp{}, nil
+	}
+	if msg != nil {
+		if err := gogoproto.Unmarshal(value.Bytes, msg); err != nil {
+			return true, *value.Timestamp, err
+		}
+	}
+	return true, *value.Timestamp, nil
+}
+
 // PutProto sets the given key to the protobuf-serialized byte string
 // of msg and the provided timestamp.
 func (mvcc *MVCC) PutProto(key Key, timestamp proto.Timestamp, txn *proto.Transaction, msg gogoproto.Message) error {
@@ -97,7 +236,8 @@ func (mvcc *MVCC) PutProto(key Key, timestamp proto.Timestamp, txn *proto.Transa
 	}
 	value := proto.Value{Bytes: data}
 	value.InitChecksum(key)
-	return mvcc.Put(key, timestamp, value, txn)
+	_, err = mvcc.Put(key, timestamp, value, txn)
+	return err
 }
 
 // Get returns the value for the key specified in the request, while
@@ -116,86 +256,533 @@ func (mvcc *MVCC) PutProto(key Key, timestamp proto.Timestamp, txn *proto.Transa
 // keyA_Timestamp_0 : value of version_0
 // keyB : MVCCMetadata of keyB
 // ...
+//
+// If the txn buffer is enabled and txn has written key, the value is
+// read from the buffer instead.
+//
+// A version written with an expiration (see PutWithExpiration) is
+// treated as absent, as though deleted, by reads at or after its
+// expiration; reads at earlier timestamps see the value as usual.
 func (mvcc *MVCC) Get(key Key, timestamp proto.Timestamp, txn *proto.Transaction) (*proto.Value, error) {
+	return mvcc.get(key, timestamp, timestamp, txn)
+}
+
+// get implements Get, treating versions which have expired at now as
+// absent. now is the read timestamp, except for reads at
+// proto.MaxTimestamp by read-modify-write commands, which must see
+// the latest version in order to detect write intents, but judge its
+// expiration at the timestamp of their write: every expiring version
+// has expired at proto.MaxTimestamp.
+func (mvcc *MVCC) get(key Key, timestamp, now proto.Timestamp, txn *proto.Transaction) (*proto.Value, error) {
+	value, _, err := mvcc.getVisible(key, timestamp, now, txn)
+	return value, err
+}
+
+// getVisible implements get, additionally returning whether the
+// version visible at timestamp is a deletion tombstone or has expired
+// at now, as opposed to the key having no version visible at all. In
+// either case the returned value is nil.
+func (mvcc *MVCC) getVisible(key Key, timestamp, now proto.Timestamp, txn *proto.Transaction) (*proto.Value, bool, error) {
+	if _, err := timestamp.Sanitized(); err != nil {
+		return nil, false, err
+	}
 	binKey := encoding.EncodeBinary(nil, key)
+	if mvcc.buffer != nil && txn != nil {
+		if value, ok := mvcc.buffer.get(txn, binKey, timestamp, now); ok {
+			return value, value == nil, nil
+		}
+	}
+	valBytes, ts, err := mvcc.getVersion(key, binKey, timestamp, txn)
+	if err != nil || valBytes == nil {
+		return nil, false, err
+	}
+	// Unmarshal the mvcc value.
+	value := &proto.MVCCValue{}
+	if err := gogoproto.Unmarshal(valBytes, value); err != nil {
+		return nil, false, err
+	}
+	if expired(value, now) {
+		return nil, true, nil
+	}
+	// Set the timestamp if the value is not nil (i.e. not a deletion tombstone).
+	if value.Value != nil {
+		value.Value.Timestamp = &ts
+	} else if !value.Deleted {
+		log.Warningf("encountered MVCC value at key %q with a nil proto.Value but with !Deleted: %+v", key, value)
+	}
+	return value.Value, value.Value == nil, nil
+}
+
+// Exists returns whether a value for the key is visible at the given
+// timestamp, as Get would return a non-nil value. The encoded version
+// is inspected for a deletion tombstone without unmarshaling the
+// value, which makes Exists cheaper than Get for existence checks.
+// Write intents result in the same errors as for Get.
+func (mvcc *MVCC) Exists(key Key, timestamp proto.Timestamp, txn *proto.Transaction) (bool, error) {
+	if _, err := timestamp.Sanitized(); err != nil {
+		return false, err
+	}
+	binKey := encoding.EncodeBinary(nil, key)
+	if mvcc.buffer != nil && txn != nil {
+		if value, ok := mvcc.buffer.get(txn, binKey, timestamp, timestamp); ok {
+			return value != nil, nil
+		}
+	}
+	valBytes, _, err := mvcc.getVersion(key, binKey, timestamp, txn)
+	if err != nil || valBytes == nil {
+		return false, err
+	}
+	deleted, expiring, err := valueFlags(valBytes)
+	if err != nil || deleted || !expiring {
+		return !deleted, err
+	}
+	// The value has an expiration, which must be unmarshaled to check.
+	value := &proto.MVCCValue{}
+	if err := gogoproto.Unmarshal(valBytes, value); err != nil {
+		return false, err
+	}
+	return !expired(value, timestamp), nil
+}
+
+// expired returns whether the version has expired at timestamp now.
+func expired(value *proto.MVCCValue, now proto.Timestamp) bool {
+	return value.Expiration != nil && !now.Less(*value.Expiration)
+}
+
+// getVersion returns the encoded MVCCValue of the latest version of
+// the binary-encoded key which satisfies the timestamp, along with the
+// version's timestamp. Returns nil bytes if there is no such version,
+// and a write intent error if the latest version is visible and is an
+// intent of a transaction other than txn.
+func (mvcc *MVCC) getVersion(key, binKey Key, timestamp proto.Timestamp, txn *proto.Transaction) ([]byte, proto.Timestamp, error) {
 	meta := &proto.MVCCMetadata{}
 	ok, err := GetProto(mvcc.engine, binKey, meta)
 	if err != nil || !ok {
-		return nil, err
+		return nil, proto.Timestamp{}, err
 	}
 	// If the read timestamp is greater than the latest one, we can just
 	// fetch the value without a scan.
-	ts := proto.Timestamp{}
-	var valBytes []byte
 	if !timestamp.Less(meta.Timestamp) {
 		if meta.Txn != nil && (txn == nil || !bytes.Equal(meta.Txn.ID, txn.ID)) {
-			return nil, &writeIntentError{Txn: meta.Txn}
+			return nil, proto.Timestamp{}, &writeIntentError{Txn: meta.Txn}
 		}
 
 		latestKey := mvccEncodeKey(binKey, meta.Timestamp)
-		valBytes, err = mvcc.engine.Get(latestKey)
-		ts = meta.Timestamp
-	} else {
-		nextKey := mvccEncodeKey(binKey, timestamp)
-		// We use the PrefixEndKey(key) as the upper bound for scan.
-		// If there is no other version after nextKey, it won't return
-		// the value of the next key.
-		kvs, err := mvcc.engine.Scan(nextKey, PrefixEndKey(binKey), 1)
-		if len(kvs) == 0 {
-			return nil, err
+		valBytes, err := mvcc.engine.Get(latestKey)
+		if err == nil && valBytes == nil && mvcc.checks {
+			return nil, proto.Timestamp{}, util.Errorf("metadata for key %q references missing version at %+v", key, meta.Timestamp)
 		}
-		_, ts, _ = mvccDecodeKey(kvs[0].Key)
-		valBytes = kvs[0].Value
+		return valBytes, meta.Timestamp, err
 	}
-	if valBytes == nil {
-		return nil, nil
+	nextKey := mvccEncodeKey(binKey, timestamp)
+	// We use the prefix end of the encoded key as the upper bound
+	// for scan. If there is no other version after nextKey, it
+	// won't return the value of the next key.
+	kvs, err := mvcc.engine.Scan(nextKey, binKey.PrefixEnd(), 1)
+	if len(kvs) == 0 {
+		return nil, proto.Timestamp{}, err
 	}
-	// Unmarshal the mvcc value.
-	value := &proto.MVCCValue{}
-	if err := gogoproto.Unmarshal(valBytes, value); err != nil {
+	_, ts, _ := mvccDecodeKey(kvs[0].Key)
+	return kvs[0].Value, ts, nil
+}
+
+// valueFlags returns whether the encoded MVCCValue is a deletion
+// tombstone and whether it has an expiration. Only the top-level
+// fields are decoded; the embedded value and expiration, if any, are
+// skipped over rather than unmarshaled.
+func valueFlags(valBytes []byte) (deleted, expiring bool, err error) {
+	hasValue := false
+	for len(valBytes) > 0 {
+		tag, n := binary.Uvarint(valBytes)
+		if n <= 0 {
+			return false, false, util.Errorf("malformed MVCC value")
+		}
+		valBytes = valBytes[n:]
+		var skip uint64
+		switch wire := tag & 0x7; wire {
+		case 0: // varint
+			v, n := binary.Uvarint(valBytes)
+			if n <= 0 {
+				return false, false, util.Errorf("malformed MVCC value")
+			}
+			valBytes = valBytes[n:]
+			if tag>>3 == 1 {
+				deleted = v != 0
+			}
+		case 1: // fixed64
+			skip = 8
+		case 2: // length-delimited
+			l, n := binary.Uvarint(valBytes)
+			if n <= 0 {
+				return false, false, util.Errorf("malformed MVCC value")
+			}
+			valBytes = valBytes[n:]
+			skip = l
+			switch tag >> 3 {
+			case 2:
+				hasValue = true
+			case 3:
+				expiring = true
+			}
+		case 5: // fixed32
+			skip = 4
+		default:
+			return false, false, util.Errorf("unexpected wire type %d in MVCC value", wire)
+		}
+		if skip > uint64(len(valBytes)) {
+			return false, false, util.Errorf("malformed MVCC value")
+		}
+		valBytes = valBytes[skip:]
+	}
+	return deleted || !hasValue, expiring, nil
+}
+
+// GetIgnoringIntent returns the value for the key as Get does, but
+// treats a write intent of the transaction with ID ignoreTxnID as
+// though it had never been written: the latest version below the
+// intent which satisfies the timestamp is returned instead. Intents
+// of other transactions result in a write intent error, as for Get.
+func (mvcc *MVCC) GetIgnoringIntent(key Key, timestamp proto.Timestamp, ignoreTxnID []byte) (*proto.Value, error) {
+	binKey := encoding.EncodeBinary(nil, key)
+	meta := &proto.MVCCMetadata{}
+	ok, err := GetProto(mvcc.engine, binKey, meta)
+	if err != nil || !ok {
 		return nil, err
 	}
-	// Set the timestamp if the value is not nil (i.e. not a deletion tombstone).
-	if value.Value != nil {
-		value.Value.Timestamp = &ts
-	} else if !value.Deleted {
-		log.Warningf("encountered MVCC value at key %q with a nil proto.Value but with !Deleted: %+v", key, value)
+	// A read below the intent doesn't see it, so Get suffices; otherwise,
+	// read at the timestamp of the version below the intent.
+	if meta.Txn != nil && bytes.Equal(meta.Txn.ID, ignoreTxnID) && !timestamp.Less(meta.Timestamp) {
+		ts, ok, err := mvcc.versionBelow(binKey, meta.Timestamp)
+		if err != nil || !ok {
+			return nil, err
+		}
+		timestamp = ts
 	}
-	return value.Value, nil
+	return mvcc.Get(key, timestamp, nil)
+}
+
+// GetWithIntent returns the value for the key as Get does, but
+// rather than failing with a write intent error when the key has a
+// visible intent of another transaction, returns the latest committed
+// value below the intent along with the intent's transaction. The
+// returned transaction is nil if the read wasn't blocked by an intent.
+func (mvcc *MVCC) GetWithIntent(key Key, timestamp proto.Timestamp, txn *proto.Transaction) (*proto.Value, *proto.Transaction, error) {
+	value, err := mvcc.Get(key, timestamp, txn)
+	wiErr, ok := err.(*writeIntentError)
+	if !ok {
+		return value, nil, err
+	}
+	value, err = mvcc.GetIgnoringIntent(key, timestamp, wiErr.Txn.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, wiErr.Txn, nil
+}
+
+// GetMetadata returns the metadata of the key, which records the
+// timestamp of its latest version and, if that version is a write
+// intent, the intent's transaction. Returns false if the key has no
+// metadata, i.e. has never been written or has been garbage
+// collected. No version is read, so GetMetadata is cheaper than Get
+// for callers which need only the metadata.
+func (mvcc *MVCC) GetMetadata(key Key) (*proto.MVCCMetadata, bool, error) {
+	meta := &proto.MVCCMetadata{}
+	ok, err := GetProto(mvcc.engine, encoding.EncodeBinary(nil, key), meta)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return meta, true, nil
 }
 
 // Put sets the value for a specified key. It will save the value with
 // different versions according to its timestamp and update the key metadata.
 // We assume the range will check for an existing write intent before
-// executing any Put action at the MVCC level.
-func (mvcc *MVCC) Put(key Key, timestamp proto.Timestamp, value proto.Value, txn *proto.Transaction) error {
+// executing any Put action at the MVCC level. Returns the change in
+// MVCC stats resulting from the write.
+func (mvcc *MVCC) Put(key Key, timestamp proto.Timestamp, value proto.Value, txn *proto.Transaction) (MVCCStats, error) {
 	binKey := encoding.EncodeBinary(nil, key)
 	if value.Timestamp != nil && !value.Timestamp.Equal(timestamp) {
-		return util.Errorf(
+		return MVCCStats{}, util.Errorf(
 			"the timestamp %+v provided in value does not match the timestamp %+v in request",
 			value.Timestamp, timestamp)
 	}
-	return mvcc.putInternal(binKey, timestamp, proto.MVCCValue{Value: &value}, txn)
+	return mvcc.putInternal(binKey, timestamp, proto.MVCCValue{Value: &value}, txn, nil)
 }
 
-// Delete marks the key deleted and will not return in the next get response.
-func (mvcc *MVCC) Delete(key Key, timestamp proto.Timestamp, txn *proto.Transaction) error {
+// PutWithExpiration is like Put, but the value expires at the given
+// expiration, which must be later than timestamp. Reads at or after
+// the expiration see the key as absent, and once the expiration is
+// older than the GC threshold, the key is garbage collected as though
+// deleted. A later write to the key replaces the value along with its
+// expiration.
+func (mvcc *MVCC) PutWithExpiration(key Key, timestamp proto.Timestamp, value proto.Value, expiration proto.Timestamp,
+	txn *proto.Transaction) (MVCCStats, error) {
 	binKey := encoding.EncodeBinary(nil, key)
-	return mvcc.putInternal(binKey, timestamp, proto.MVCCValue{Deleted: true}, txn)
+	if value.Timestamp != nil && !value.Timestamp.Equal(timestamp) {
+		return MVCCStats{}, util.Errorf(
+			"the timestamp %+v provided in value does not match the timestamp %+v in request",
+			value.Timestamp, timestamp)
+	}
+	if !timestamp.Less(expiration) {
+		return MVCCStats{}, util.Errorf("expiration %+v of key %q is not after its timestamp %+v", expiration, key, timestamp)
+	}
+	return mvcc.putInternal(binKey, timestamp, proto.MVCCValue{Value: &value, Expiration: &expiration}, txn, nil)
 }
 
-// putInternal adds a new timestamped value to the specified key.
-// If value is nil, creates a deletion tombstone value.
-func (mvcc *MVCC) putInternal(key Key, timestamp proto.Timestamp, value proto.MVCCValue, txn *proto.Transaction) error {
-	if value.Value != nil && value.Value.Bytes != nil && value.Value.Integer != nil {
-		return util.Errorf("key %q value contains both a byte slice and an integer value: %+v", key, value)
+// PutIfChanged is like Put, except that it skips writing a new version
+// if the value is identical to the most recent committed value for the
+// key. Returns true if a new version was written. Transactional
+// writes, writes to keys with an outstanding write intent and writes
+// with timestamps older than the latest version always go through
+// Put, so that intent semantics and errors are preserved.
+func (mvcc *MVCC) PutIfChanged(key Key, timestamp proto.Timestamp, value proto.Value, txn *proto.Transaction) (bool, error) {
+	if txn == nil {
+		binKey := encoding.EncodeBinary(nil, key)
+		meta := &proto.MVCCMetadata{}
+		ok, err := GetProto(mvcc.engine, binKey, meta)
+		if err != nil {
+			return false, err
+		}
+		if ok && meta.Txn == nil && !timestamp.Less(meta.Timestamp) {
+			valBytes, _, err := mvcc.getVersion(key, binKey, meta.Timestamp, nil)
+			if err != nil {
+				return false, err
+			}
+			existVal := &proto.MVCCValue{}
+			if err := gogoproto.Unmarshal(valBytes, existVal); err != nil {
+				return false, err
+			}
+			// An expiring value is always rewritten, which clears its
+			// expiration.
+			if existVal.Value != nil && existVal.Expiration == nil && valuesEqual(existVal.Value, &value) {
+				return false, nil
+			}
+		}
+	}
+	_, err := mvcc.Put(key, timestamp, value, txn)
+	return true, err
+}
+
+// valuesEqual returns true if the byte slice and integer contents and
+// the tags of the two values are equal.
+func valuesEqual(a, b *proto.Value) bool {
+	if (a.Integer == nil) != (b.Integer == nil) || a.GetInteger() != b.GetInteger() {
+		return false
+	}
+	if len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	for i := range a.Tags {
+		if a.Tags[i].Key != b.Tags[i].Key || a.Tags[i].Value != b.Tags[i].Value {
+			return false
+		}
 	}
+	return bytes.Equal(a.Bytes, b.Bytes)
+}
 
+// PutBatch writes the supplied key/value pairs at timestamp in a
+// single batch. It is intended for bulk loading into an empty span of
+// the keyspace: each key's metadata is looked up only to verify that
+// the key doesn't exist yet, after which its metadata and value are
+// written directly. Returns an error without writing anything if any
+// key already has a value or an outstanding write intent.
+func (mvcc *MVCC) PutBatch(kvs []proto.KeyValue, timestamp proto.Timestamp) error {
+	if len(kvs) == 0 {
+		return nil
+	}
+	if _, err := timestamp.Sanitized(); err != nil {
+		return err
+	}
+	var batch []interface{}
+	meta := &proto.MVCCMetadata{Timestamp: timestamp}
+	for _, kv := range kvs {
+		if kv.Value.Timestamp != nil && !kv.Value.Timestamp.Equal(timestamp) {
+			return util.Errorf(
+				"the timestamp %+v provided in value for key %q does not match the timestamp %+v in request",
+				kv.Value.Timestamp, kv.Key, timestamp)
+		}
+		binKey := encoding.EncodeBinary(nil, kv.Key)
+		existing := &proto.MVCCMetadata{}
+		ok, err := GetProto(mvcc.engine, binKey, existing)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if existing.Txn != nil {
+				return &writeIntentError{Txn: existing.Txn}
+			}
+			return util.Errorf("key %q already exists", kv.Key)
+		}
+		metaPut, err := MakeBatchPutProto(binKey, meta)
+		if err != nil {
+			return err
+		}
+		value := kv.Value
+		value.Timestamp = nil
+		valuePut, err := MakeBatchPutProto(mvccEncodeKey(binKey, timestamp), &proto.MVCCValue{Value: &value})
+		if err != nil {
+			return err
+		}
+		batch = append(batch, metaPut, valuePut)
+	}
+	return mvcc.engine.WriteBatch(batch)
+}
+
+// IngestSorted writes the supplied keys with their byte slice values
+// at timestamp, for bulk import into keys which don't yet exist. The
+// keys must be sorted in strictly increasing order. Each key's
+// metadata is read to verify that none of the keys exists; any
+// key with an existing value or write intent fails the ingestion
+// before anything is written. Each key's metadata and version are
+// then written without further checks in batches of
+// ingestBatchSize keys. The batches are not applied atomically: on
+// an error writing a batch, the keys of preceding batches remain.
+func (mvcc *MVCC) IngestSorted(kvs []proto.RawKeyValue, timestamp proto.Timestamp) error {
+	if len(kvs) == 0 {
+		return nil
+	}
+	if _, err := timestamp.Sanitized(); err != nil {
+		return err
+	}
+	binKeys := make([]Key, len(kvs))
+	for i, kv := range kvs {
+		if i > 0 && !Key(kvs[i-1].Key).Less(kv.Key) {
+			return util.Errorf("keys to ingest are not sorted: %q does not follow %q", kv.Key, kvs[i-1].Key)
+		}
+		binKeys[i] = encoding.EncodeBinary(nil, kv.Key)
+	}
+
+	// Seek each key's metadata rather than scanning the span, which
+	// may hold any number of versions of keys not being written.
 	meta := &proto.MVCCMetadata{}
-	ok, err := GetProto(mvcc.engine, key, meta)
+	for i, binKey := range binKeys {
+		ok, err := GetProto(mvcc.engine, binKey, meta)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if meta.Txn != nil {
+			return &writeIntentError{Txn: meta.Txn}
+		}
+		return util.Errorf("cannot ingest key %q: key already exists", kvs[i].Key)
+	}
+
+	metaPut, err := MakeBatchPutProto(nil, &proto.MVCCMetadata{Timestamp: timestamp})
 	if err != nil {
 		return err
 	}
+	batch := make([]interface{}, 0, 2*ingestBatchSize)
+	for i, kv := range kvs {
+		valuePut, err := MakeBatchPutProto(mvccEncodeKey(binKeys[i], timestamp),
+			&proto.MVCCValue{Value: &proto.Value{Bytes: kv.Value}})
+		if err != nil {
+			return err
+		}
+		batch = append(batch, BatchPut{Key: binKeys[i], Value: metaPut.Value}, valuePut)
+		if len(batch) == cap(batch) {
+			if err := mvcc.engine.WriteBatch(batch); err != nil {
+				return err
+			}
+			batch = make([]interface{}, 0, 2*ingestBatchSize)
+		}
+	}
+	return mvcc.engine.WriteBatch(batch)
+}
+
+// Delete marks the key deleted and will not return in the next get
+// response. Returns the change in MVCC stats resulting from writing
+// the deletion tombstone.
+func (mvcc *MVCC) Delete(key Key, timestamp proto.Timestamp, txn *proto.Transaction) (MVCCStats, error) {
+	binKey := encoding.EncodeBinary(nil, key)
+	return mvcc.putInternal(binKey, timestamp, proto.MVCCValue{Deleted: true}, txn, nil)
+}
+
+// PreparePut is like Put, except that instead of writing the value it
+// returns the batch of engine writes, along with the change in MVCC
+// stats which results once the batch is written. This allows callers
+// to combine several MVCC writes with other writes, such as updates
+// to range metadata, into a single atomic engine.WriteBatch. The batch
+// is computed from the engine's current state, so each key should be
+// prepared at most once per batch. Transactional writes are not
+// recorded in the txn buffer; any write already buffered for the key
+// is discarded so that subsequent reads consult the engine.
+func (mvcc *MVCC) PreparePut(key Key, timestamp proto.Timestamp, value proto.Value, txn *proto.Transaction) ([]interface{}, MVCCStats, error) {
+	if value.Timestamp != nil && !value.Timestamp.Equal(timestamp) {
+		return nil, MVCCStats{}, util.Errorf(
+			"the timestamp %+v provided in value does not match the timestamp %+v in request",
+			value.Timestamp, timestamp)
+	}
+	return mvcc.prepareExternal(key, timestamp, proto.MVCCValue{Value: &value}, txn)
+}
+
+// PrepareDelete is like Delete, except that instead of writing the
+// deletion tombstone it returns the batch of engine writes. See
+// PreparePut.
+func (mvcc *MVCC) PrepareDelete(key Key, timestamp proto.Timestamp, txn *proto.Transaction) ([]interface{}, MVCCStats, error) {
+	return mvcc.prepareExternal(key, timestamp, proto.MVCCValue{Deleted: true}, txn)
+}
+
+// prepareExternal prepares a write to be batched by the caller,
+// removing any buffered write for the key from the txn buffer.
+func (mvcc *MVCC) prepareExternal(key Key, timestamp proto.Timestamp, value proto.MVCCValue, txn *proto.Transaction) ([]interface{}, MVCCStats, error) {
+	binKey := encoding.EncodeBinary(nil, key)
+	batch, ms, err := mvcc.prepareWrite(binKey, timestamp, value, txn, nil)
+	if err != nil {
+		return nil, MVCCStats{}, err
+	}
+	if mvcc.buffer != nil && txn != nil {
+		mvcc.buffer.remove(txn, binKey)
+	}
+	return batch, ms, nil
+}
+
+// putInternal adds a new timestamped value to the specified key.
+// If value is nil, creates a deletion tombstone value. Returns the
+// change in MVCC stats, accounting for the metadata update, the new
+// version and the removal of any replaced intent.
+func (mvcc *MVCC) putInternal(key Key, timestamp proto.Timestamp, value proto.MVCCValue, txn *proto.Transaction,
+	increments []proto.MVCCIncrementRecord) (MVCCStats, error) {
+	batch, ms, err := mvcc.prepareWrite(key, timestamp, value, txn, increments)
+	if err != nil {
+		return MVCCStats{}, err
+	}
+	if err := mvcc.engine.WriteBatch(batch); err != nil {
+		return MVCCStats{}, err
+	}
+	if mvcc.buffer != nil && txn != nil {
+		mvcc.buffer.put(txn, key, timestamp, &value)
+	}
+	return ms, nil
+}
+
+// prepareWrite returns the batch of engine writes which add a new
+// timestamped value to the specified key, along with the resulting
+// change in MVCC stats. Nothing is written to the engine. See
+// putInternal. The new metadata records increments, replacing any
+// increment records of the previous metadata.
+func (mvcc *MVCC) prepareWrite(key Key, timestamp proto.Timestamp, value proto.MVCCValue, txn *proto.Transaction,
+	increments []proto.MVCCIncrementRecord) ([]interface{}, MVCCStats, error) {
+	var ms MVCCStats
+	if value.Value != nil && value.Value.Bytes != nil && value.Value.Integer != nil {
+		return nil, ms, util.Errorf("key %q value contains both a byte slice and an integer value: %+v", key, value)
+	}
+	if _, err := timestamp.Sanitized(); err != nil {
+		return nil, ms, err
+	}
+
+	metaBytes, err := mvcc.engine.Get(key)
+	if err != nil {
+		return nil, ms, err
+	}
+	meta := &proto.MVCCMetadata{}
+	ok := metaBytes != nil
+	if ok {
+		if err := gogoproto.Unmarshal(metaBytes, meta); err != nil {
+			return nil, ms, err
+		}
+	}
 
 	// Use a batch because a put involves multiple writes.
 	var batch []interface{}
@@ -207,38 +794,51 @@ func (mvcc *MVCC) putInternal(key Key, timestamp proto.Timestamp, value proto.MV
 		// This should not happen since range should check the existing
 		// write intent before executing any Put action at MVCC level.
 		if meta.Txn != nil && (txn == nil || !bytes.Equal(meta.Txn.ID, txn.ID)) {
-			return &writeIntentError{Txn: meta.Txn}
+			return nil, ms, &writeIntentError{Txn: meta.Txn}
 		}
 
 		// We can update the current metadata only if both the timestamp
 		// and epoch of the new intent are greater than or equal to
-		// existing. If either of these conditions doesn't hold, it's
-		// likely the case that an older RPC is arriving out of order.
-		if !timestamp.Less(meta.Timestamp) && (meta.Txn == nil || txn.Epoch >= meta.Txn.Epoch) {
-			// If this is an intent and timestamps have changed, need to remove old version.
-			if meta.Txn != nil && !timestamp.Equal(meta.Timestamp) {
-				batch = append(batch, BatchDelete(mvccEncodeKey(key, meta.Timestamp)))
-			}
-			meta = &proto.MVCCMetadata{Txn: txn, Timestamp: timestamp}
-			batchPut, err := MakeBatchPutProto(key, meta)
+		// existing. In case we receive a Put request to update an old
+		// version, it must be an error since raft should handle any
+		// client retry from timeout.
+		if err := checkWriteOrder(meta, timestamp, txn); err != nil {
+			return nil, ms, err
+		}
+		// If this is an intent, the new version replaces the old one.
+		// If timestamps have changed, need to remove old version;
+		// otherwise, it's overwritten in place.
+		if meta.Txn != nil {
+			oldKey := mvccEncodeKey(key, meta.Timestamp)
+			oldBytes, err := mvcc.engine.Get(oldKey)
 			if err != nil {
-				return err
+				return nil, ms, err
 			}
-			batch = append(batch, batchPut)
-		} else {
-			// In case we receive a Put request to update an old version,
-			// it must be an error since raft should handle any client
-			// retry from timeout.
-			return &writeTooOldError{Timestamp: meta.Timestamp, Txn: meta.Txn}
+			if !timestamp.Equal(meta.Timestamp) {
+				batch = append(batch, BatchDelete(oldKey))
+			}
+			ms.KeyBytes -= int64(len(oldKey))
+			ms.ValBytes -= int64(len(oldBytes))
+			ms.ValCount--
 		}
+		meta = &proto.MVCCMetadata{Txn: txn, Timestamp: timestamp, Increments: increments}
+		batchPut, err := MakeBatchPutProto(key, meta)
+		if err != nil {
+			return nil, ms, err
+		}
+		batch = append(batch, batchPut)
+		ms.ValBytes += int64(len(batchPut.Value) - len(metaBytes))
 	} else { // In case the key metadata does not exist yet.
 		// Create key metadata.
-		meta = &proto.MVCCMetadata{Txn: txn, Timestamp: timestamp}
+		meta = &proto.MVCCMetadata{Txn: txn, Timestamp: timestamp, Increments: increments}
 		batchPut, err := MakeBatchPutProto(key, meta)
 		if err != nil {
-			return err
+			return nil, ms, err
 		}
 		batch = append(batch, batchPut)
+		ms.KeyBytes += int64(len(key))
+		ms.ValBytes += int64(len(batchPut.Value))
+		ms.KeyCount++
 	}
 
 	// Make sure to zero the redundant timestamp (timestamp is encoded
@@ -246,134 +846,539 @@ func (mvcc *MVCC) putInternal(key Key, timestamp proto.Timestamp, value proto.MV
 	if value.Value != nil {
 		value.Value.Timestamp = nil
 	}
-	batchPut, err := MakeBatchPutProto(mvccEncodeKey(key, timestamp), &value)
+	versionKey := mvccEncodeKey(key, timestamp)
+	batchPut, err := MakeBatchPutProto(versionKey, &value)
 	if err != nil {
-		return err
+		return nil, ms, err
 	}
 	batch = append(batch, batchPut)
-	return mvcc.engine.WriteBatch(batch)
+	ms.KeyBytes += int64(len(versionKey))
+	ms.ValBytes += int64(len(batchPut.Value))
+	ms.ValCount++
+	return batch, ms, nil
 }
 
 // Increment fetches the value for key, and assuming the value is an
 // "integer" type, increments it by inc and stores the new value. The
-// newly incremented value is returned.
-func (mvcc *MVCC) Increment(key Key, timestamp proto.Timestamp, txn *proto.Transaction, inc int64) (int64, error) {
+// newly incremented value is returned, along with the change in MVCC
+// stats. If the new value would overflow an int64, an
+// *IncrementOverflowError is returned.
+func (mvcc *MVCC) Increment(key Key, timestamp proto.Timestamp, txn *proto.Transaction, inc int64) (int64, MVCCStats, error) {
+	return mvcc.IncrementWithID(key, timestamp, txn, inc, nil)
+}
+
+// IncrementWithID is like Increment, but is idempotent for a non-nil
+// client-supplied id: the result of the increment is recorded in the
+// key's metadata, and a retry with the same id returns the recorded
+// result instead of incrementing again. Only the results of the most
+// recent maxIncrementRecords increments of each key are retained. A
+// Put or Delete of the key, or the abort of a transactional
+// increment, discards the key's records.
+func (mvcc *MVCC) IncrementWithID(key Key, timestamp proto.Timestamp, txn *proto.Transaction, inc int64, id []byte) (int64, MVCCStats, error) {
 	// Handle check for non-existence of key. In order to detect
 	// the potential write intent by another concurrent transaction
 	// with a newer timestamp, we need to use the max timestamp
-	// while reading.
-	value, err := mvcc.Get(key, proto.MaxTimestamp, txn)
+	// while reading. This must precede the lookup of increment
+	// records, which may have been written by an uncommitted intent.
+	value, err := mvcc.get(key, proto.MaxTimestamp, timestamp, txn)
 	if err != nil {
-		return 0, err
+		return 0, MVCCStats{}, err
 	}
 
+	// The key's increment records are retained by all increments.
+	meta := &proto.MVCCMetadata{}
+	if _, err := GetProto(mvcc.engine, encoding.EncodeBinary(nil, key), meta); err != nil {
+		return 0, MVCCStats{}, err
+	}
+	if id != nil {
+		for _, rec := range meta.Increments {
+			if bytes.Equal(rec.ID, id) {
+				return rec.Result, MVCCStats{}, nil
+			}
+		}
+	}
+	increments := meta.Increments
+
 	var int64Val int64
 	// If the value exists, verify it's an integer type not a byte slice.
 	if value != nil {
 		if value.Bytes != nil || value.Integer == nil {
-			return 0, util.Errorf("cannot increment key %q which already has a generic byte value: %+v", key, *value)
+			return 0, MVCCStats{}, util.Errorf("cannot increment key %q which already has a generic byte value: %+v", key, *value)
 		}
 		int64Val = value.GetInteger()
 	}
 
 	// Check for overflow and underflow.
 	if encoding.WillOverflow(int64Val, inc) {
-		return 0, util.Errorf("key %q with value %d incremented by %d results in overflow", key, int64Val, inc)
+		return 0, MVCCStats{}, &IncrementOverflowError{Key: key, Value: int64Val, Increment: inc}
 	}
 
 	if inc == 0 {
-		return int64Val, nil
+		return int64Val, MVCCStats{}, nil
 	}
 
 	r := int64Val + inc
 	value = &proto.Value{Integer: gogoproto.Int64(r)}
 	value.InitChecksum(key)
-	return r, mvcc.Put(key, timestamp, *value, txn)
+	if id != nil {
+		increments = append(increments, proto.MVCCIncrementRecord{ID: id, Result: r})
+		if len(increments) > maxIncrementRecords {
+			increments = increments[len(increments)-maxIncrementRecords:]
+		}
+	}
+	ms, err := mvcc.putInternal(encoding.EncodeBinary(nil, key), timestamp, proto.MVCCValue{Value: value}, txn, increments)
+	return r, ms, err
 }
 
 // ConditionalPut sets the value for a specified key only if
 // the expected value matches. If not, the return value contains
-// the actual value.
-func (mvcc *MVCC) ConditionalPut(key Key, timestamp proto.Timestamp, value proto.Value, expValue *proto.Value, txn *proto.Transaction) (*proto.Value, error) {
+// the actual value. Returns the change in MVCC stats resulting from
+// the write.
+func (mvcc *MVCC) ConditionalPut(key Key, timestamp proto.Timestamp, value proto.Value, expValue *proto.Value,
+	txn *proto.Transaction) (*proto.Value, MVCCStats, error) {
 	// Handle check for non-existence of key. In order to detect
 	// the potential write intent by another concurrent transaction
 	// with a newer timestamp, we need to use the max timestamp
 	// while reading.
-	existVal, err := mvcc.Get(key, proto.MaxTimestamp, txn)
+	existVal, err := mvcc.get(key, proto.MaxTimestamp, timestamp, txn)
 	if err != nil {
-		return nil, err
+		return nil, MVCCStats{}, err
+	}
+	if err := checkExpectedValue(key, existVal, expValue); err != nil {
+		return existVal, MVCCStats{}, err
+	}
+
+	ms, err := mvcc.Put(key, timestamp, value, txn)
+	return nil, ms, err
+}
+
+// PutIfAbsent sets the value for a specified key only if the key
+// doesn't already exist. Returns true if the value was written and
+// false if the key already existed; unlike ConditionalPut, an
+// existing key is not an error. As with ConditionalPut, the key is
+// read at the max timestamp in order to detect write intents laid
+// down by concurrent transactions with newer timestamps.
+func (mvcc *MVCC) PutIfAbsent(key Key, timestamp proto.Timestamp, value proto.Value, txn *proto.Transaction) (bool, error) {
+	existVal, err := mvcc.get(key, proto.MaxTimestamp, timestamp, txn)
+	if err != nil {
+		return false, err
+	}
+	if existVal != nil {
+		return false, nil
+	}
+	if _, err := mvcc.Put(key, timestamp, value, txn); err != nil {
+		return false, err
 	}
+	return true, nil
+}
 
+// checkExpectedValue returns an error if the existing value of key
+// doesn't match expValue: a nil expValue expects the key not to
+// exist, and otherwise the key must exist with the same byte slice or
+// integer value.
+func checkExpectedValue(key Key, existVal, expValue *proto.Value) error {
 	if expValue == nil && existVal != nil {
-		return existVal, util.Errorf("key %q already exists", key)
+		return util.Errorf("key %q already exists", key)
 	} else if expValue != nil {
 		// Handle check for existence when there is no key.
 		if existVal == nil {
-			return nil, util.Errorf("key %q does not exist", key)
+			return util.Errorf("key %q does not exist", key)
 		} else if expValue.Bytes != nil && !bytes.Equal(expValue.Bytes, existVal.Bytes) {
-			return existVal, util.Errorf("key %q does not match existing", key)
+			return util.Errorf("key %q does not match existing", key)
 		} else if expValue.Integer != nil && (existVal.Integer == nil || expValue.GetInteger() != existVal.GetInteger()) {
-			return existVal, util.Errorf("key %q does not match existing", key)
+			return util.Errorf("key %q does not match existing", key)
+		}
+	}
+	return nil
+}
+
+// A ConditionalPutEntry is a single conditional put in a batch passed
+// to ConditionalPutBatch: Value is written to Key only if the existing
+// value matches ExpValue, as for ConditionalPut.
+type ConditionalPutEntry struct {
+	Key      Key
+	Value    proto.Value
+	ExpValue *proto.Value
+}
+
+// ConditionalPutBatch performs the conditional puts of entries
+// atomically: the condition of every entry is checked first, and only
+// if all hold are the values written, in a single batch. Otherwise,
+// the error for the first entry whose condition doesn't hold is
+// returned and nothing is written. Each key may appear only once.
+// Returns the change in MVCC stats of all the writes.
+func (mvcc *MVCC) ConditionalPutBatch(entries []ConditionalPutEntry, timestamp proto.Timestamp,
+	txn *proto.Transaction) (MVCCStats, error) {
+	keySet := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		if _, ok := keySet[string(entry.Key)]; ok {
+			return MVCCStats{}, util.Errorf("key %q appears more than once in conditional put batch", entry.Key)
+		}
+		keySet[string(entry.Key)] = struct{}{}
+		if entry.Value.Timestamp != nil && !entry.Value.Timestamp.Equal(timestamp) {
+			return MVCCStats{}, util.Errorf(
+				"the timestamp %+v provided in value for key %q does not match the timestamp %+v in request",
+				entry.Value.Timestamp, entry.Key, timestamp)
+		}
+		// As with ConditionalPut, read at the max timestamp in order to
+		// detect write intents by concurrent transactions.
+		existVal, err := mvcc.get(entry.Key, proto.MaxTimestamp, timestamp, txn)
+		if err != nil {
+			return MVCCStats{}, err
+		}
+		if err := checkExpectedValue(entry.Key, existVal, entry.ExpValue); err != nil {
+			return MVCCStats{}, err
 		}
 	}
 
-	return nil, mvcc.Put(key, timestamp, value, txn)
+	var batch []interface{}
+	var ms MVCCStats
+	values := make([]proto.MVCCValue, len(entries))
+	for i, entry := range entries {
+		value := entry.Value
+		values[i] = proto.MVCCValue{Value: &value}
+		ops, entryMS, err := mvcc.prepareWrite(encoding.EncodeBinary(nil, entry.Key), timestamp, values[i], txn, nil)
+		if err != nil {
+			return MVCCStats{}, err
+		}
+		batch = append(batch, ops...)
+		ms.Add(entryMS)
+	}
+	if err := mvcc.engine.WriteBatch(batch); err != nil {
+		return MVCCStats{}, err
+	}
+	if mvcc.buffer != nil && txn != nil {
+		for i, entry := range entries {
+			mvcc.buffer.put(txn, encoding.EncodeBinary(nil, entry.Key), timestamp, &values[i])
+		}
+	}
+	return ms, nil
+}
+
+// ConditionalPutTS sets the value for a specified key only if the
+// timestamp of the currently visible version matches expectedTS; a
+// zero expectedTS expects the key not to exist. If not, the return
+// value contains the actual value, including its timestamp.
+func (mvcc *MVCC) ConditionalPutTS(key Key, timestamp, expectedTS proto.Timestamp, value proto.Value, txn *proto.Transaction) (*proto.Value, error) {
+	// As with ConditionalPut, read at the max timestamp in order to
+	// detect write intents by concurrent transactions.
+	existVal, err := mvcc.get(key, proto.MaxTimestamp, timestamp, txn)
+	if err != nil {
+		return nil, err
+	}
+
+	if existVal == nil {
+		if !expectedTS.Equal(proto.MinTimestamp) {
+			return nil, util.Errorf("key %q does not exist", key)
+		}
+	} else if !existVal.Timestamp.Equal(expectedTS) {
+		return existVal, util.Errorf("key %q has timestamp %+v; expected %+v", key, *existVal.Timestamp, expectedTS)
+	}
+
+	_, err = mvcc.Put(key, timestamp, value, txn)
+	return nil, err
 }
 
 // DeleteRange deletes the range of key/value pairs specified by
-// start and end keys. Specify max=0 for unbounded deletes.
-func (mvcc *MVCC) DeleteRange(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) (int64, error) {
+// start and end keys. Specify max=0 for unbounded deletes. Returns
+// the number of keys deleted and the change in MVCC stats.
+func (mvcc *MVCC) DeleteRange(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) (int64, MVCCStats, error) {
+	num, _, ms, err := mvcc.DeleteRangeReturningKeys(key, endKey, max, timestamp, txn)
+	return num, ms, err
+}
+
+// DeleteRangeReturningKeys is like DeleteRange, but additionally
+// returns the keys which were deleted, in order. The deletion
+// tombstones for all keys are written in a single batch, so either
+// all keys are deleted or, on error, none are.
+func (mvcc *MVCC) DeleteRangeReturningKeys(key Key, endKey Key, max int64, timestamp proto.Timestamp,
+	txn *proto.Transaction) (int64, []Key, MVCCStats, error) {
 	// In order to detect the potential write intent by another
 	// concurrent transaction with a newer timestamp, we need
-	// to use the max timestamp for scan.
-	kvs, err := mvcc.Scan(key, endKey, max, proto.MaxTimestamp, txn)
+	// to use the max timestamp for scan. Keys whose values have
+	// expired by the time of the delete are skipped.
+	var keys []Key
+	_, _, err := mvcc.iterate(key, endKey, max, proto.MaxTimestamp, timestamp, txn, false, false, func(key Key, _ *proto.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
 	if err != nil {
-		return 0, err
+		return 0, nil, MVCCStats{}, err
 	}
 
-	num := int64(0)
-	for _, kv := range kvs {
-		err = mvcc.Delete(kv.Key, timestamp, txn)
+	var batch []interface{}
+	var ms MVCCStats
+	for _, key := range keys {
+		binKey := encoding.EncodeBinary(nil, key)
+		ops, keyMS, err := mvcc.prepareWrite(binKey, timestamp, proto.MVCCValue{Deleted: true}, txn, nil)
 		if err != nil {
-			return num, err
+			return 0, nil, MVCCStats{}, err
+		}
+		batch = append(batch, ops...)
+		ms.Add(keyMS)
+	}
+	if len(batch) > 0 {
+		if err := mvcc.engine.WriteBatch(batch); err != nil {
+			return 0, nil, MVCCStats{}, err
 		}
-		num++
 	}
-	return num, nil
+	if mvcc.buffer != nil && txn != nil {
+		for _, key := range keys {
+			mvcc.buffer.put(txn, encoding.EncodeBinary(nil, key), timestamp, &proto.MVCCValue{Deleted: true})
+		}
+	}
+	return int64(len(keys)), keys, ms, nil
 }
 
 // Scan scans the key range specified by start key through end key up
 // to some maximum number of results. Specify max=0 for unbounded scans.
+// If the txn buffer is enabled, writes buffered for txn are merged
+// with the values read from the engine; see iterate.
 func (mvcc *MVCC) Scan(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) ([]proto.KeyValue, error) {
+	res, _, err := mvcc.ScanWithMaxBytes(key, endKey, max, 0, timestamp, txn)
+	return res, err
+}
+
+// ReverseScan is like Scan, but returns the values in descending key
+// order: up to max of the largest keys in the range from start key up
+// to (but not including) end key. Specify max=0 for unbounded scans.
+// The engine can only be scanned forwards, so the whole key range is
+// iterated and only the last max values retained.
+func (mvcc *MVCC) ReverseScan(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) ([]proto.KeyValue, error) {
+	res, _, _, err := mvcc.reverseScan(key, endKey, max, timestamp, txn, false)
+	return res, err
+}
+
+// ReverseScanStopAtIntent is like ReverseScan, except that a write
+// intent of another transaction ends the scan instead of failing it.
+// If the largest intent in the key range lies beneath the rows
+// returned, the scan stops at it: the rows above the intent are
+// returned along with the key just past the intent's, as the end key
+// at which to resume once the intent is resolved, and the intent's
+// transaction. Otherwise, the returned transaction is nil.
+func (mvcc *MVCC) ReverseScanStopAtIntent(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) ([]proto.KeyValue, Key, *proto.Transaction, error) {
+	return mvcc.reverseScan(key, endKey, max, timestamp, txn, true)
+}
+
+// reverseScan implements ReverseScan and ReverseScanStopAtIntent.
+// With stopAtIntent, each intent encountered discards the rows
+// beneath it, and iteration continues past it.
+func (mvcc *MVCC) reverseScan(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction,
+	stopAtIntent bool) ([]proto.KeyValue, Key, *proto.Transaction, error) {
+	res := []proto.KeyValue{}
+	var resumeKey Key
+	var intentTxn *proto.Transaction
+	for {
+		intentKey, txnI, err := mvcc.iterate(key, endKey, 0, timestamp, timestamp, txn, stopAtIntent, false, func(key Key, value *proto.Value) bool {
+			res = append(res, proto.KeyValue{Key: key, Value: *value})
+			if max != 0 && int64(len(res)) > max {
+				res = res[1:]
+			}
+			return true
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if txnI == nil {
+			break
+		}
+		res = res[:0]
+		resumeKey, intentTxn = NextKey(intentKey), txnI
+		key = resumeKey
+	}
+	// An intent beneath max rows doesn't end the scan.
+	if max != 0 && int64(len(res)) == max {
+		resumeKey, intentTxn = nil, nil
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res, resumeKey, intentTxn, nil
+}
+
+// ScanWithMaxBytes is like Scan, but additionally stops once the
+// accumulated size of the keys and values scanned exceeds maxBytes.
+// Specify maxBytes=0 for no byte limit. Whichever of max and maxBytes
+// is reached first ends the scan. If the byte limit ends the scan
+// before the end of the key range, the key at which the scan may be
+// resumed is returned; otherwise the returned key is nil.
+func (mvcc *MVCC) ScanWithMaxBytes(key Key, endKey Key, max, maxBytes int64, timestamp proto.Timestamp, txn *proto.Transaction) ([]proto.KeyValue, Key, error) {
+	res, resumeKey, _, err := mvcc.scan(key, endKey, max, maxBytes, timestamp, txn, false)
+	return res, resumeKey, err
+}
+
+// ScanStopAtIntent is like ScanWithMaxBytes, except that a write
+// intent of another transaction ends the scan instead of failing it.
+// If the scan stops at an intent, the rows preceding the intent are
+// returned along with the intent's key, as the key at which to resume
+// once the intent is resolved, and the intent's transaction.
+// Otherwise, the returned transaction is nil.
+func (mvcc *MVCC) ScanStopAtIntent(key Key, endKey Key, max, maxBytes int64, timestamp proto.Timestamp, txn *proto.Transaction) ([]proto.KeyValue, Key, *proto.Transaction, error) {
+	return mvcc.scan(key, endKey, max, maxBytes, timestamp, txn, true)
+}
+
+// scan implements ScanWithMaxBytes and ScanStopAtIntent.
+func (mvcc *MVCC) scan(key Key, endKey Key, max, maxBytes int64, timestamp proto.Timestamp, txn *proto.Transaction,
+	stopAtIntent bool) ([]proto.KeyValue, Key, *proto.Transaction, error) {
+	res := []proto.KeyValue{}
+	var size int64
+	resumeKey, intentTxn, err := mvcc.iterate(key, endKey, max, timestamp, timestamp, txn, stopAtIntent, false, func(key Key, value *proto.Value) bool {
+		res = append(res, proto.KeyValue{Key: key, Value: *value})
+		size += int64(len(key) + len(value.Bytes))
+		return maxBytes == 0 || size <= maxBytes
+	})
+	return res, resumeKey, intentTxn, err
+}
+
+// ScanStream is like Scan, but sends each key/value in the range to
+// ch as it is found rather than accumulating them, so that a large
+// range can be scanned in bounded memory. ch is closed once the scan
+// completes, successfully or not. ScanStream blocks until each value
+// has been received; the caller should receive from ch in another
+// goroutine. Scan is implemented over the same iteration, and remains
+// the more efficient choice for scans with a maximum result count.
+func (mvcc *MVCC) ScanStream(key, endKey Key, timestamp proto.Timestamp, txn *proto.Transaction, ch chan<- proto.KeyValue) error {
+	defer close(ch)
+	_, _, err := mvcc.iterate(key, endKey, 0, timestamp, timestamp, txn, false, false, func(key Key, value *proto.Value) bool {
+		ch <- proto.KeyValue{Key: key, Value: *value}
+		return true
+	})
+	return err
+}
+
+// A ScanEntry is a key returned by ScanWithTombstones, along with its
+// value or, if the key has been deleted, a flag marking it as such.
+// Deleted is needed to tell a deleted key from one whose value is
+// empty.
+type ScanEntry struct {
+	Key     Key
+	Value   proto.Value // Zero if Deleted
+	Deleted bool
+}
+
+// ScanWithTombstones is like Scan, but also returns an entry for each
+// key in the range whose version visible at timestamp is a deletion
+// tombstone, or has expired, marked Deleted; Scan omits such keys.
+// Keys with no version visible at timestamp are omitted, as by Scan.
+// Deleted entries count towards max. Together with scans at earlier
+// timestamps, this allows the changes to the range, including
+// deletions, to be reconstructed.
+func (mvcc *MVCC) ScanWithTombstones(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) ([]ScanEntry, error) {
+	res := []ScanEntry{}
+	_, _, err := mvcc.iterate(key, endKey, max, timestamp, timestamp, txn, false, true, func(key Key, value *proto.Value) bool {
+		if value == nil {
+			res = append(res, ScanEntry{Key: key, Deleted: true})
+		} else {
+			res = append(res, ScanEntry{Key: key, Value: *value})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ScanKeys is like Scan, but returns only the keys. Values are
+// decoded only to skip deletion tombstones; they are neither copied
+// nor returned, which makes ScanKeys suitable for counting keys.
+func (mvcc *MVCC) ScanKeys(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) ([]Key, error) {
+	var keys []Key
+	_, _, err := mvcc.iterate(key, endKey, max, timestamp, timestamp, txn, false, false, func(key Key, _ *proto.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys, err
+}
+
+// Count returns the number of keys in the range from start key up to
+// (but not including) end key which have values visible at timestamp,
+// counting no more than max keys. Specify max=0 for an unbounded
+// count. Neither the keys nor their values are accumulated.
+func (mvcc *MVCC) Count(key Key, endKey Key, max int64, timestamp proto.Timestamp, txn *proto.Transaction) (int64, error) {
+	var count int64
+	_, _, err := mvcc.iterate(key, endKey, max, timestamp, timestamp, txn, false, false, func(Key, *proto.Value) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+// iterate invokes f with each key in the range specified by start key
+// through end key which has a value visible at timestamp, along with
+// that value, up to some maximum number of keys. Specify max=0 for
+// unbounded iteration. If f returns false, the iteration stops and
+// the next key in the range, if any, is returned as the key at which
+// to resume. If stopAtIntent is true, a write intent of another
+// transaction also stops the iteration; the intent's key is returned
+// as the key at which to resume, along with the intent's transaction.
+// Values which have expired at now are skipped; see get. If
+// tombstones is true, keys whose visible version is a deletion
+// tombstone or has expired are not skipped, but passed to f with a nil
+// value.
+//
+// If the txn buffer is enabled, the writes buffered for txn in the
+// range are merged in key order with the keys read from the engine,
+// and take the place of the engine's version of the same key.
+func (mvcc *MVCC) iterate(key Key, endKey Key, max int64, timestamp, now proto.Timestamp, txn *proto.Transaction,
+	stopAtIntent, tombstones bool, f func(Key, *proto.Value) bool) (Key, *proto.Transaction, error) {
 	binKey := encoding.EncodeBinary(nil, key)
 	binEndKey := encoding.EncodeBinary(nil, endKey)
 	nextKey := binKey
 
-	res := []proto.KeyValue{}
+	var buffered []bufferedWrite
+	if mvcc.buffer != nil && txn != nil {
+		buffered = mvcc.buffer.scan(txn, binKey, binEndKey, timestamp, now)
+	}
+
+	var count int64
+	stopped := false
 	for {
 		kvs, err := mvcc.engine.Scan(nextKey, binEndKey, 1)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		// No more keys exists in the given range.
-		if len(kvs) == 0 {
+		if len(kvs) == 0 && len(buffered) == 0 {
 			break
 		}
 
-		remainder, currentKey := encoding.DecodeBinary(kvs[0].Key)
-		if len(remainder) != 0 {
-			return nil, util.Errorf("expected an MVCC metadata key: %s", kvs[0].Key)
-		}
-		value, err := mvcc.Get(currentKey, timestamp, txn)
-		if err != nil {
-			return res, err
+		// Take the next buffered write if it precedes (or replaces) the
+		// next key in the engine.
+		var currentKey Key
+		var value *proto.Value
+		var deleted bool
+		if len(buffered) > 0 && (len(kvs) == 0 || buffered[0].key.Compare(kvs[0].Key) <= 0) {
+			if currentKey, err = decodeMetaKey(buffered[0].key); err != nil {
+				return nil, nil, err
+			}
+			value, deleted = buffered[0].value, buffered[0].value == nil
+			buffered = buffered[1:]
+			if stopped {
+				return currentKey, nil, nil
+			}
+		} else {
+			if currentKey, err = decodeMetaKey(kvs[0].Key); err != nil {
+				return nil, nil, err
+			}
+			if stopped {
+				return currentKey, nil, nil
+			}
+			value, deleted, err = mvcc.getVisible(currentKey, timestamp, now, txn)
+			if wiErr, ok := err.(*writeIntentError); ok && stopAtIntent {
+				return currentKey, wiErr.Txn, nil
+			}
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 
-		if value != nil {
-			res = append(res, proto.KeyValue{Key: currentKey, Value: *value})
+		if value != nil || (deleted && tombstones) {
+			stopped = !f(currentKey, value)
+			count++
 		}
 
-		if max != 0 && max == int64(len(res)) {
+		if max != 0 && max == count {
 			break
 		}
 
@@ -392,15 +1397,69 @@ func (mvcc *MVCC) Scan(key Key, endKey Key, max int64, timestamp proto.Timestamp
 		// b<T=5>
 		// In this case, if we scan from "a"-"b", we wish to skip
 		// a<T=2> and a<T=1> and find "aa'.
-		nextKey = encoding.EncodeBinary(nil, NextKey(currentKey))
+		//
+		// This relies on the binary encoding being order-preserving:
+		// the encoding of currentKey.Next() differs from that of
+		// currentKey only after its final payload byte, where the
+		// terminator (0x00) is replaced by a byte with the high bit
+		// set. It therefore sorts after every versioned key of
+		// currentKey and, as no key sorts between currentKey and
+		// currentKey.Next(), before the metadata key of any other
+		// key (e.g. "a\x00" following "a").
+		nextKey = encoding.EncodeBinary(nil, Key(currentKey).Next())
 	}
 
-	return res, nil
+	return nil, nil, nil
+}
+
+// CheckConsistency examines the metadata of each key in the range
+// from key to endKey and returns the keys whose metadata references
+// a latest version which does not exist. Such keys read as absent
+// (see EnableConsistencyChecks) and can be repaired by deleting the
+// dangling metadata key.
+func (mvcc *MVCC) CheckConsistency(key, endKey Key) ([]Key, error) {
+	binEndKey := encoding.EncodeBinary(nil, endKey)
+	nextKey := encoding.EncodeBinary(nil, key)
+
+	var corrupt []Key
+	for {
+		kvs, err := mvcc.engine.Scan(nextKey, binEndKey, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		metaKey := kvs[0].Key
+		remainder, currentKey := encoding.DecodeBinary(metaKey)
+		nextKey = Key(metaKey[:len(metaKey)-len(remainder)]).PrefixEnd()
+		if len(remainder) != 0 {
+			// The key's versions sort after its metadata, so the
+			// metadata is missing altogether.
+			log.Warningf("version of key %q has no MVCC metadata", currentKey)
+			corrupt = append(corrupt, currentKey)
+			continue
+		}
+		meta := &proto.MVCCMetadata{}
+		if err := gogoproto.Unmarshal(kvs[0].Value, meta); err != nil {
+			return nil, err
+		}
+		valBytes, err := mvcc.engine.Get(mvccEncodeKey(metaKey, meta.Timestamp))
+		if err != nil {
+			return nil, err
+		}
+		if valBytes == nil {
+			log.Warningf("metadata for key %q references missing version at %+v", currentKey, meta.Timestamp)
+			corrupt = append(corrupt, currentKey)
+		}
+	}
+	return corrupt, nil
 }
 
 // ResolveWriteIntent either commits or aborts (rolls back) an extant
 // write intent for a given txn according to commit parameter.
-// ResolveWriteIntent will skip write intents of other txns.
+// ResolveWriteIntent will skip write intents of other txns. Returns
+// the change in MVCC stats.
 //
 // Transaction epochs deserve a bit of explanation. The epoch for a
 // transaction is incremented on transaction retry. Transaction retry
@@ -418,21 +1477,33 @@ func (mvcc *MVCC) Scan(key Key, endKey Key, max int64, timestamp proto.Timestamp
 // committed in the event the transaction succeeds (all those with
 // epoch matching the commit epoch), and which intents get aborted,
 // even if the transaction succeeds.
-func (mvcc *MVCC) ResolveWriteIntent(key Key, txn *proto.Transaction, commit bool) error {
+func (mvcc *MVCC) ResolveWriteIntent(key Key, txn *proto.Transaction, commit bool) (MVCCStats, error) {
+	var ms MVCCStats
 	if txn == nil {
-		return util.Error("no txn specified")
+		return ms, util.Error("no txn specified")
+	}
+	if _, err := txn.Timestamp.Sanitized(); err != nil {
+		return ms, err
 	}
 
 	binKey := encoding.EncodeBinary(nil, key)
-	meta := &proto.MVCCMetadata{}
-	ok, err := GetProto(mvcc.engine, binKey, meta)
+	if mvcc.buffer != nil {
+		mvcc.buffer.remove(txn, binKey)
+	}
+	metaBytes, err := mvcc.engine.Get(binKey)
 	if err != nil {
-		return err
+		return ms, err
+	}
+	meta := &proto.MVCCMetadata{}
+	if metaBytes != nil {
+		if err := gogoproto.Unmarshal(metaBytes, meta); err != nil {
+			return ms, err
+		}
 	}
 	// For cases where there's no write intent to resolve, or one exists
 	// which we can't resolve, this is a noop.
-	if !ok || meta.Txn == nil || !bytes.Equal(meta.Txn.ID, txn.ID) {
-		return nil
+	if metaBytes == nil || meta.Txn == nil || !bytes.Equal(meta.Txn.ID, txn.ID) {
+		return ms, nil
 	}
 	// If we're committing the intent and the txn epochs match, the
 	// intent value is good to go and we just set meta.Txn to nil.
@@ -442,11 +1513,12 @@ func (mvcc *MVCC) ResolveWriteIntent(key Key, txn *proto.Transaction, commit boo
 		// Use a write batch because we may have multiple puts.
 		var batch []interface{}
 		origTimestamp := meta.Timestamp
-		batchPut, err := MakeBatchPutProto(binKey, &proto.MVCCMetadata{Timestamp: txn.Timestamp})
+		batchPut, err := MakeBatchPutProto(binKey, &proto.MVCCMetadata{Timestamp: txn.Timestamp, Increments: meta.Increments})
 		if err != nil {
-			return err
+			return ms, err
 		}
 		batch = append(batch, batchPut)
+		ms.ValBytes += int64(len(batchPut.Value) - len(metaBytes))
 		// If timestamp of value changed, need to rewrite versioned value.
 		// TODO(spencer,tobias): think about a new merge operator for
 		// updating key of intent value to new timestamp instead of
@@ -456,12 +1528,16 @@ func (mvcc *MVCC) ResolveWriteIntent(key Key, txn *proto.Transaction, commit boo
 			newKey := mvccEncodeKey(binKey, txn.Timestamp)
 			valBytes, err := mvcc.engine.Get(origKey)
 			if err != nil {
-				return err
+				return ms, err
 			}
 			batch = append(batch, BatchDelete(origKey))
 			batch = append(batch, BatchPut(proto.RawKeyValue{Key: newKey, Value: valBytes}))
+			ms.KeyBytes += int64(len(newKey) - len(origKey))
 		}
-		return mvcc.engine.WriteBatch(batch)
+		if err := mvcc.engine.WriteBatch(batch); err != nil {
+			return MVCCStats{}, err
+		}
+		return ms, nil
 	}
 
 	// If not committing (this can be the case if commit=true, but the
@@ -475,42 +1551,115 @@ func (mvcc *MVCC) ResolveWriteIntent(key Key, txn *proto.Transaction, commit boo
 
 	// First clear the intent value.
 	latestKey := mvccEncodeKey(binKey, meta.Timestamp)
+	latestBytes, err := mvcc.engine.Get(latestKey)
+	if err != nil {
+		return ms, err
+	}
 	batch = append(batch, BatchDelete(latestKey))
+	ms.KeyBytes -= int64(len(latestKey))
+	ms.ValBytes -= int64(len(latestBytes))
+	ms.ValCount--
 
-	// Compute the next possible mvcc value for this key.
-	nextKey := NextKey(latestKey)
-	// Compute the last possible mvcc value for this key.
-	endScanKey := encoding.EncodeBinary(nil, NextKey(key))
-	kvs, err := mvcc.engine.Scan(nextKey, endScanKey, 1)
+	ts, ok, err := mvcc.versionBelow(binKey, meta.Timestamp)
 	if err != nil {
-		return err
+		return MVCCStats{}, err
 	}
 	// If there is no other version, we should just clean up the key entirely.
-	if len(kvs) == 0 {
+	if !ok {
 		batch = append(batch, BatchDelete(binKey))
+		ms.KeyBytes -= int64(len(binKey))
+		ms.ValBytes -= int64(len(metaBytes))
+		ms.KeyCount--
 	} else {
-		_, ts, isValue := mvccDecodeKey(kvs[0].Key)
-		if !isValue {
-			return util.Errorf("expected an MVCC value key: %s", kvs[0].Key)
-		}
 		// Update the keyMetadata with the next version.
 		batchPut, err := MakeBatchPutProto(binKey, &proto.MVCCMetadata{Timestamp: ts})
 		if err != nil {
-			return err
+			return MVCCStats{}, err
 		}
 		batch = append(batch, batchPut)
+		ms.ValBytes += int64(len(batchPut.Value) - len(metaBytes))
 	}
 
-	return mvcc.engine.WriteBatch(batch)
+	if err := mvcc.engine.WriteBatch(batch); err != nil {
+		return MVCCStats{}, err
+	}
+	return ms, nil
+}
+
+// versionBelow returns the timestamp of the most recent version of
+// the binary-encoded key which is older than the version at the given
+// timestamp. Returns false if there is no such version.
+func (mvcc *MVCC) versionBelow(binKey Key, timestamp proto.Timestamp) (proto.Timestamp, bool, error) {
+	// Scan from the next possible mvcc value for this key to the last.
+	nextKey := mvccEncodeKey(binKey, timestamp).Next()
+	kvs, err := mvcc.engine.Scan(nextKey, binKey.PrefixEnd(), 1)
+	if err != nil || len(kvs) == 0 {
+		return proto.Timestamp{}, false, err
+	}
+	_, ts, isValue := mvccDecodeKey(kvs[0].Key)
+	if !isValue {
+		return proto.Timestamp{}, false, util.Errorf("expected an MVCC value key: %s", kvs[0].Key)
+	}
+	return ts, true, nil
+}
+
+// IntentsForTxn returns the keys from key to endKey which hold a
+// write intent of the transaction with ID txnID, omitting keys with
+// no intent or the intent of another transaction. Specify max=0 to
+// return all such keys. The keys can be passed to ResolveWriteIntent
+// to commit or abort the transaction.
+func (mvcc *MVCC) IntentsForTxn(key, endKey Key, txnID []byte, max int64) ([]Key, error) {
+	binEndKey := encoding.EncodeBinary(nil, endKey)
+	nextKey := encoding.EncodeBinary(nil, key)
+
+	var keys []Key
+	for {
+		kvs, err := mvcc.engine.Scan(nextKey, binEndKey, 1)
+		if err != nil {
+			return nil, err
+		}
+		// No more keys exists in the given range.
+		if len(kvs) == 0 {
+			break
+		}
+
+		currentKey, err := decodeMetaKey(kvs[0].Key)
+		if err != nil {
+			return nil, err
+		}
+		meta := &proto.MVCCMetadata{}
+		if err := gogoproto.Unmarshal(kvs[0].Value, meta); err != nil {
+			return nil, err
+		}
+		if meta.Txn != nil && bytes.Equal(meta.Txn.ID, txnID) {
+			keys = append(keys, currentKey)
+			if max != 0 && int64(len(keys)) == max {
+				break
+			}
+		}
+
+		// Skip the versions of currentKey; refer to iterate for details.
+		nextKey = encoding.EncodeBinary(nil, Key(currentKey).Next())
+	}
+	return keys, nil
 }
 
 // ResolveWriteIntentRange commits or aborts (rolls back) the range of
 // write intents specified by start and end keys for a given txn
 // according to commit parameter. ResolveWriteIntentRange will skip
 // write intents of other txns. Specify max=0 for unbounded resolves.
-func (mvcc *MVCC) ResolveWriteIntentRange(key Key, endKey Key, max int64, txn *proto.Transaction, commit bool) (int64, error) {
+// Returns the number of keys processed without error, which includes
+// keys with no intent of txn, and the keys which could not be
+// resolved, so that they can be retried. If stopOnError is true, the
+// first key which can't be resolved ends the resolution with its
+// error; otherwise such keys are logged and skipped, and don't count
+// towards max. The change in MVCC stats of the resolved intents is
+// returned along with them.
+func (mvcc *MVCC) ResolveWriteIntentRange(key Key, endKey Key, max int64, txn *proto.Transaction, commit,
+	stopOnError bool) (int64, []Key, MVCCStats, error) {
+	var ms MVCCStats
 	if txn == nil {
-		return 0, util.Error("no txn specified")
+		return 0, nil, ms, util.Error("no txn specified")
 	}
 
 	binKey := encoding.EncodeBinary(nil, key)
@@ -518,24 +1667,30 @@ func (mvcc *MVCC) ResolveWriteIntentRange(key Key, endKey Key, max int64, txn *p
 	nextKey := binKey
 
 	num := int64(0)
+	var failed []Key
 	for {
 		kvs, err := mvcc.engine.Scan(nextKey, binEndKey, 1)
 		if err != nil {
-			return num, err
+			return num, failed, ms, err
 		}
 		// No more keys exists in the given range.
 		if len(kvs) == 0 {
 			break
 		}
 
-		remainder, currentKey := encoding.DecodeBinary(kvs[0].Key)
-		if len(remainder) != 0 {
-			return 0, util.Errorf("expected an MVCC metadata key: %s", kvs[0].Key)
+		currentKey, err := decodeMetaKey(kvs[0].Key)
+		if err != nil {
+			return 0, failed, ms, err
 		}
-		err = mvcc.ResolveWriteIntent(currentKey, txn, commit)
+		keyMS, err := mvcc.ResolveWriteIntent(currentKey, txn, commit)
 		if err != nil {
+			failed = append(failed, currentKey)
+			if stopOnError {
+				return num, failed, ms, util.Errorf("failed to resolve intent for key %q: %s", currentKey, err)
+			}
 			log.Warningf("failed to resolve intent for key %q: %v", currentKey, err)
 		} else {
+			ms.Add(keyMS)
 			num++
 			if max != 0 && max == num {
 				break
@@ -544,10 +1699,10 @@ func (mvcc *MVCC) ResolveWriteIntentRange(key Key, endKey Key, max int64, txn *p
 
 		// In order to efficiently skip the possibly long list of
 		// old versions for this key; refer to Scan for details.
-		nextKey = encoding.EncodeBinary(nil, NextKey(currentKey))
+		nextKey = encoding.EncodeBinary(nil, Key(currentKey).Next())
 	}
 
-	return num, nil
+	return num, failed, ms, nil
 }
 
 // a splitSampleItem wraps a key along with an aggregate over key range
@@ -557,13 +1712,158 @@ type splitSampleItem struct {
 	sizeBefore int
 }
 
+// GarbageCollectRange removes old versions of the keys in the span
+// from key to endKey, applying the same version-trimming logic as
+// the GarbageCollector with keepTimestamp as the expiration: each
+// key's versions older than keepTimestamp are removed, except for its
+// most recent version. Keys whose most recent version is a deletion
+// tombstone older than keepTimestamp are removed altogether, along
+// with their metadata (see filterVersions). Keys with write intents
+// are skipped. At most max keys are examined; specify max=0 for no
+// limit. Deletions are written in a single batch. Returns the number
+// of versions removed and the change in MVCC stats.
+func (mvcc *MVCC) GarbageCollectRange(key, endKey Key, keepTimestamp proto.Timestamp, max int64) (int64, MVCCStats, error) {
+	binEndKey := encoding.EncodeBinary(nil, endKey)
+	nextKey := encoding.EncodeBinary(nil, key)
+
+	var batch []interface{}
+	var removed, examined int64
+	var ms MVCCStats
+	for max == 0 || examined < max {
+		kvs, err := mvcc.engine.Scan(nextKey, binEndKey, 1)
+		if err != nil {
+			return 0, MVCCStats{}, err
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		metaKey := kvs[0].Key
+		nextKey = Key(metaKey).PrefixEnd()
+		examined++
+
+		// Read the metadata and all versions of the key.
+		versions, err := mvcc.engine.Scan(metaKey, nextKey, 0)
+		if err != nil {
+			return 0, MVCCStats{}, err
+		}
+		meta := &proto.MVCCMetadata{}
+		if err := gogoproto.Unmarshal(versions[0].Value, meta); err != nil {
+			return 0, MVCCStats{}, err
+		}
+		if meta.Txn != nil {
+			continue
+		}
+		keys := make([]Key, len(versions))
+		values := make([][]byte, len(versions))
+		for i, kv := range versions {
+			keys[i], values[i] = kv.Key, kv.Value
+		}
+		for i, del := range filterVersions(keys, values, keepTimestamp) {
+			if del {
+				batch = append(batch, BatchDelete(keys[i]))
+				ms.KeyBytes -= int64(len(keys[i]))
+				ms.ValBytes -= int64(len(values[i]))
+				if i > 0 {
+					ms.ValCount--
+					removed++
+				} else {
+					ms.KeyCount--
+				}
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := mvcc.engine.WriteBatch(batch); err != nil {
+			return 0, MVCCStats{}, err
+		}
+	}
+	return removed, ms, nil
+}
+
+// DeleteVersion deletes the version of key at versionTS, leaving the
+// metadata and all other versions untouched. It is intended for repair,
+// e.g. of a version known to be corrupt. The most recent version,
+// which the metadata references, may not be deleted, nor may a write
+// intent. Returns an error if the key or the version does not exist.
+func (mvcc *MVCC) DeleteVersion(key Key, versionTS proto.Timestamp) error {
+	binKey := encoding.EncodeBinary(nil, key)
+	meta := &proto.MVCCMetadata{}
+	ok, err := GetProto(mvcc.engine, binKey, meta)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return util.Errorf("key %q does not exist", key)
+	}
+	if meta.Timestamp.Equal(versionTS) {
+		if meta.Txn != nil {
+			return util.Errorf("version %+v of key %q is a write intent", versionTS, key)
+		}
+		return util.Errorf("version %+v of key %q is the most recent version", versionTS, key)
+	}
+	versionKey := mvccEncodeKey(binKey, versionTS)
+	valBytes, err := mvcc.engine.Get(versionKey)
+	if err != nil {
+		return err
+	}
+	if valBytes == nil {
+		return util.Errorf("key %q has no version at %+v", key, versionTS)
+	}
+	return mvcc.engine.Clear(versionKey)
+}
+
+// KeyStats returns the storage footprint of a single key by walking
+// its metadata and version chain. totalBytes is the size of the keys
+// and values of the metadata and all versions; liveBytes counts only
+// the metadata and the latest version, and only if that version is
+// not a deletion tombstone. A write intent is the latest version and
+// is reported via hasIntent. All results are zero if the key has no
+// metadata.
+func (mvcc *MVCC) KeyStats(key Key) (liveBytes, totalBytes int64, numVersions int, hasIntent bool, err error) {
+	binKey := encoding.EncodeBinary(nil, key)
+	kvs, err := mvcc.engine.Scan(binKey, Key(binKey).PrefixEnd(), 0)
+	if err != nil || len(kvs) == 0 {
+		return 0, 0, 0, false, err
+	}
+	if !bytes.Equal(kvs[0].Key, binKey) {
+		return 0, 0, 0, false, util.Errorf("expected metadata for key %q; found %q", key, kvs[0].Key)
+	}
+	meta := &proto.MVCCMetadata{}
+	if err := gogoproto.Unmarshal(kvs[0].Value, meta); err != nil {
+		return 0, 0, 0, false, err
+	}
+	for _, kv := range kvs {
+		totalBytes += int64(len(kv.Key) + len(kv.Value))
+	}
+	liveBytes = int64(len(kvs[0].Key) + len(kvs[0].Value))
+	if len(kvs) > 1 {
+		deleted, _, err := valueFlags(kvs[1].Value)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		if !deleted {
+			liveBytes += int64(len(kvs[1].Key) + len(kvs[1].Value))
+		}
+	}
+	return liveBytes, totalBytes, len(kvs) - 1, meta.Txn != nil, nil
+}
+
 // FindSplitKey suggests a split key from the given user-space key range that
 // aims to roughly cut into half the total number of bytes used (in raw key and
 // value byte strings) in both subranges. It will operate on a snapshot of the
 // underlying engine if a snapshotID is given, and in that case may safely be
 // invoked in a goroutine.
-// TODO(Tobias): leverage the work done here anyways to gather stats.
 func (mvcc *MVCC) FindSplitKey(key Key, endKey Key, snapshotID string) (Key, error) {
+	splitKey, _, err := mvcc.FindSplitKeyWithStats(key, endKey, snapshotID)
+	return splitKey, err
+}
+
+// FindSplitKeyWithStats is like FindSplitKey, but additionally returns
+// the sizes and counts of the keys and versions in the key range, as
+// measured by the same scan. This spares callers deciding whether to
+// split a second scan of the range to learn its size. The stats are
+// returned even if the range is empty and no split key is found.
+func (mvcc *MVCC) FindSplitKeyWithStats(key Key, endKey Key, snapshotID string) (Key, MVCCStats, error) {
 	rs := util.NewWeightedReservoirSample(splitReservoirSize, nil)
 	h := rs.Heap.(*util.WeightedValueHeap)
 
@@ -574,21 +1874,29 @@ func (mvcc *MVCC) FindSplitKey(key Key, endKey Key, snapshotID string) (Key, err
 	binStartKey := encoding.EncodeBinary(nil, key)
 	binEndKey := encoding.EncodeBinary(nil, endKey)
 	totalSize := 0
+	var ms MVCCStats
 	err := iterateRangeSnapshot(mvcc.engine, binStartKey, binEndKey,
 		splitScanRowCount, snapshotID, func(kvs []proto.RawKeyValue) error {
 			for _, kv := range kvs {
 				byteCount := len(kv.Key) + len(kv.Value)
 				rs.ConsiderWeighted(splitSampleItem{kv.Key, totalSize}, float64(byteCount)/normalize)
 				totalSize += byteCount
+				ms.KeyBytes += int64(len(kv.Key))
+				ms.ValBytes += int64(len(kv.Value))
+				if _, _, isValue := mvccDecodeKey(kv.Key); isValue {
+					ms.ValCount++
+				} else {
+					ms.KeyCount++
+				}
 			}
 			return nil
 		})
 	if err != nil {
-		return nil, err
+		return nil, MVCCStats{}, err
 	}
 
 	if totalSize == 0 {
-		return nil, util.Errorf("the range is empty")
+		return nil, ms, util.Errorf("the range is empty")
 	}
 
 	// Inspect the sample to get the closest candidate that has sizeBefore >= totalSize/2.
@@ -610,9 +1918,105 @@ func (mvcc *MVCC) FindSplitKey(key Key, endKey Key, snapshotID string) (Key, err
 	decodedKey, _, _ := mvccDecodeKey(candidate.Key)
 	rest, humanKey := encoding.DecodeBinary(decodedKey)
 	if len(rest) > 0 {
-		return nil, util.Errorf("corrupt key encountered")
+		return nil, ms, util.Errorf("corrupt key encountered")
+	}
+	return humanKey, ms, nil
+}
+
+// RangeChecksum returns a SHA-256 digest of the contents of the key
+// range from key to endKey as of the given timestamp. For each key in
+// the range, the latest version at or below the timestamp is folded
+// into the digest, in key order, along with its timestamp and whether
+// it's a write intent; deletion tombstones are included, whereas
+// versions above the timestamp and versions superseded by later ones
+// are not. Replicas which have applied the same writes up to the
+// timestamp therefore compute the same digest regardless of writes
+// applied since, and comparing their digests reveals divergence.
+//
+// The range is read from a snapshot of the underlying engine, created
+// for the purpose and released on return, so RangeChecksum may safely
+// be invoked in a goroutine while writes continue.
+func (mvcc *MVCC) RangeChecksum(key, endKey Key, timestamp proto.Timestamp) ([]byte, error) {
+	snapshotIDNum, err := Increment(mvcc.engine, KeyLocalSnapshotIDGenerator, 1)
+	if err != nil {
+		return nil, err
+	}
+	snapshotID := strconv.FormatInt(snapshotIDNum, 10)
+	if err := mvcc.engine.CreateSnapshot(snapshotID); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := mvcc.engine.ReleaseSnapshot(snapshotID); err != nil {
+			log.Warningf("failed to release snapshot %s: %v", snapshotID, err)
+		}
+	}()
+
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	writeBytes := func(b []byte) {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(b)))])
+		h.Write(b)
+	}
+	var metaKey Key
+	meta := &proto.MVCCMetadata{}
+	done := true // Whether the current key's visible version has been folded in
+	err = iterateRangeSnapshot(mvcc.engine, encoding.EncodeBinary(nil, key), encoding.EncodeBinary(nil, endKey),
+		splitScanRowCount, snapshotID, func(kvs []proto.RawKeyValue) error {
+			for _, kv := range kvs {
+				encKey, ts, isValue := mvccDecodeKey(kv.Key)
+				if !isValue {
+					metaKey = encKey
+					meta.Reset()
+					if err := gogoproto.Unmarshal(kv.Value, meta); err != nil {
+						return err
+					}
+					done = false
+					continue
+				}
+				// Skip superseded versions, versions above the timestamp
+				// and versions without metadata.
+				if done || timestamp.Less(ts) || !bytes.Equal(encKey, metaKey) {
+					continue
+				}
+				done = true
+				_, decodedKey := encoding.DecodeBinary(encKey)
+				writeBytes(decodedKey)
+				h.Write(buf[:binary.PutVarint(buf[:], ts.WallTime)])
+				h.Write(buf[:binary.PutVarint(buf[:], int64(ts.Logical))])
+				if meta.Txn != nil && ts.Equal(meta.Timestamp) {
+					h.Write([]byte{1})
+				} else {
+					h.Write([]byte{0})
+				}
+				writeBytes(kv.Value)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// decodeMetaKey decodes encKey, a key read from the engine by a scan
+// which expects to encounter only MVCC metadata keys, as it skips
+// past the versions of each key it visits. The binary-encoded key of
+// MVCC metadata decodes with nothing remaining, whereas version keys
+// have the encoded timestamp remaining. Returns an error for version
+// keys and for keys which are not validly encoded at all, rather than
+// panicking as DecodeBinary does; the stack of such a panic is logged.
+func decodeMetaKey(encKey []byte) (key Key, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("%s", debug.Stack())
+			key, err = nil, util.Errorf("malformed MVCC key %q: %v", encKey, r)
+		}
+	}()
+	remainder, decoded := encoding.DecodeBinary(encKey)
+	if len(remainder) != 0 {
+		return nil, util.Errorf("expected an MVCC metadata key: %q", encKey)
 	}
-	return humanKey, nil
+	return decoded, nil
 }
 
 // mvccEncodeKey makes a timestamped key which is the concatenation of
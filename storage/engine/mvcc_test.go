@@ -118,7 +118,7 @@ func TestMVCCGetNotExist(t *testing.T) {
 func TestMVCCPutWithBadValue(t *testing.T) {
 	mvcc := createTestMVCC(t)
 	badValue := proto.Value{Bytes: []byte("a"), Integer: gogoproto.Int64(1)}
-	err := mvcc.Put(testKey1, makeTS(0, 0), badValue, nil)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), badValue, nil)
 	if err == nil {
 		t.Fatal("expected an error putting a value with both byte slice and integer components")
 	}
@@ -126,7 +126,7 @@ func TestMVCCPutWithBadValue(t *testing.T) {
 
 func TestMVCCPutWithTxn(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,7 +145,7 @@ func TestMVCCPutWithTxn(t *testing.T) {
 
 func TestMVCCPutWithoutTxn(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, nil)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -164,7 +164,7 @@ func TestMVCCPutWithoutTxn(t *testing.T) {
 
 func TestMVCCUpdateExistingKey(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, nil)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -178,7 +178,7 @@ func TestMVCCUpdateExistingKey(t *testing.T) {
 			value1.Bytes, value.Bytes)
 	}
 
-	err = mvcc.Put(testKey1, makeTS(2, 0), value2, nil)
+	_, err = mvcc.Put(testKey1, makeTS(2, 0), value2, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -204,19 +204,560 @@ func TestMVCCUpdateExistingKey(t *testing.T) {
 	}
 }
 
+// countVersions returns the number of versioned values stored for key.
+func countVersions(t *testing.T, mvcc *MVCC, key Key) int {
+	binKey := encoding.EncodeBinary(nil, key)
+	kvs, err := mvcc.engine.Scan(binKey, PrefixEndKey(binKey), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first key is the metadata key.
+	return len(kvs) - 1
+}
+
+// TestMVCCPutIfChanged verifies that repeated puts of an unchanged
+// value don't grow the version chain, but changed values, integer
+// values and transactional writes still write new versions.
+func TestMVCCPutIfChanged(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	for i := int64(1); i <= 3; i++ {
+		wrote, err := mvcc.PutIfChanged(testKey1, makeTS(i, 0), value1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wrote != (i == 1) {
+			t.Errorf("%d: expected write=%t; got %t", i, i == 1, wrote)
+		}
+	}
+	if count := countVersions(t, mvcc, testKey1); count != 1 {
+		t.Errorf("expected 1 version; got %d", count)
+	}
+	value, err := mvcc.Get(testKey1, makeTS(4, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value.Bytes, value1.Bytes) || !value.Timestamp.Equal(makeTS(1, 0)) {
+		t.Errorf("unexpected value: %+v", value)
+	}
+
+	// A changed value writes a new version.
+	if wrote, err := mvcc.PutIfChanged(testKey1, makeTS(4, 0), value2, nil); !wrote || err != nil {
+		t.Errorf("expected new version to be written: %t, %v", wrote, err)
+	}
+	// Integer values are compared too.
+	intValue := proto.Value{Integer: gogoproto.Int64(1)}
+	for i := int64(5); i <= 6; i++ {
+		if _, err := mvcc.PutIfChanged(testKey1, makeTS(i, 0), intValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := countVersions(t, mvcc, testKey1); count != 3 {
+		t.Errorf("expected 3 versions; got %d", count)
+	}
+
+	// A transactional write always lays down an intent.
+	if wrote, err := mvcc.PutIfChanged(testKey1, makeTS(7, 0), intValue, txn1); !wrote || err != nil {
+		t.Errorf("expected transactional write: %t, %v", wrote, err)
+	}
+	if _, err := mvcc.Get(testKey1, makeTS(8, 0), nil); err == nil {
+		t.Error("expected write intent error")
+	}
+	// Writing over another transaction's intent returns an error.
+	if _, err := mvcc.PutIfChanged(testKey1, makeTS(8, 0), intValue, nil); err == nil {
+		t.Error("expected write intent error")
+	}
+	// Rewriting the intent in the same transaction doesn't add versions.
+	if _, err := mvcc.PutIfChanged(testKey1, makeTS(8, 0), intValue, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if count := countVersions(t, mvcc, testKey1); count != 4 {
+		t.Errorf("expected 4 versions; got %d", count)
+	}
+}
+
+// TestMVCCPutWithTags verifies that a value's tags are stored and
+// returned with it, and that a change to the tags alone is a change.
+func TestMVCCPutWithTags(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	tagged := proto.Value{
+		Bytes: []byte("testValue1"),
+		Tags:  []proto.ValueTag{{Key: "content-type", Value: "text/plain"}},
+	}
+	tagged.InitChecksum(testKey1)
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), tagged, nil); err != nil {
+		t.Fatal(err)
+	}
+	value, err := mvcc.Get(testKey1, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, ok := value.GetTag("content-type"); !ok || tag != "text/plain" {
+		t.Errorf("expected content-type tag; got %+v", value)
+	}
+	if err := value.Verify(testKey1); err != nil {
+		t.Error(err)
+	}
+	// Untagged values are returned without tags.
+	if _, err := mvcc.Put(testKey2, makeTS(1, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if value, err = mvcc.Get(testKey2, makeTS(2, 0), nil); err != nil || len(value.Tags) != 0 {
+		t.Errorf("expected untagged value; got %+v, %v", value, err)
+	}
+
+	// Only the tags differ, but a new version is written.
+	retagged := proto.Value{
+		Bytes: tagged.Bytes,
+		Tags:  []proto.ValueTag{{Key: "content-type", Value: "application/octet-stream"}},
+	}
+	if wrote, err := mvcc.PutIfChanged(testKey1, makeTS(3, 0), retagged, nil); !wrote || err != nil {
+		t.Errorf("expected new version to be written: %t, %v", wrote, err)
+	}
+}
+
+// TestMVCCPutWithExpiration verifies that a value written with an
+// expiration is visible to reads before the expiration and absent at
+// and after it, and that read-modify-write commands judge expiration
+// at their write timestamp.
+func TestMVCCPutWithExpiration(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.PutWithExpiration(testKey1, makeTS(2, 0), value1, makeTS(2, 0), nil); err == nil {
+		t.Error("expected error writing a value which expires at its timestamp")
+	}
+	if _, err := mvcc.PutWithExpiration(testKey1, makeTS(1, 0), value1, makeTS(5, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ts     proto.Timestamp
+		expGet bool
+	}{
+		{makeTS(1, 0), true},
+		{makeTS(4, 9), true},
+		{makeTS(5, 0), false},
+		{makeTS(6, 0), false},
+	} {
+		value, err := mvcc.Get(testKey1, test.ts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (value != nil) != test.expGet {
+			t.Errorf("get at %+v: expected value %t; got %+v", test.ts, test.expGet, value)
+		}
+		exists, err := mvcc.Exists(testKey1, test.ts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != test.expGet {
+			t.Errorf("exists at %+v: expected %t; got %t", test.ts, test.expGet, exists)
+		}
+		kvs, err := mvcc.Scan(testKey1, testKey4, 0, test.ts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(kvs) == 1) != test.expGet {
+			t.Errorf("scan at %+v: expected value %t; got %+v", test.ts, test.expGet, kvs)
+		}
+	}
+
+	// Incrementing an expired value starts from zero, while
+	// incrementing before the expiration replaces the value and its
+	// expiration.
+	intValue := proto.Value{Integer: gogoproto.Int64(5)}
+	for _, key := range []Key{testKey2, testKey3} {
+		if _, err := mvcc.PutWithExpiration(key, makeTS(1, 0), intValue, makeTS(5, 0), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, _, err := mvcc.Increment(testKey2, makeTS(3, 0), nil, 1); err != nil || r != 6 {
+		t.Errorf("expected 6 incrementing before expiration; got %d, %v", r, err)
+	}
+	if r, _, err := mvcc.Increment(testKey3, makeTS(6, 0), nil, 1); err != nil || r != 1 {
+		t.Errorf("expected 1 incrementing after expiration; got %d, %v", r, err)
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(10, 0), nil); err != nil || value == nil || value.GetInteger() != 6 {
+		t.Errorf("expected incremented value not to expire; got %+v, %v", value, err)
+	}
+
+	// A conditional put expecting no value succeeds on an expired key.
+	if _, _, err := mvcc.ConditionalPut(testKey1, makeTS(6, 0), value2, nil, nil); err != nil {
+		t.Errorf("expected conditional put over expired value to succeed: %v", err)
+	}
+
+	// Deleting a range skips keys whose values have expired.
+	if _, err := mvcc.PutWithExpiration(testKey4, makeTS(7, 0), value4, makeTS(8, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if num, _, err := mvcc.DeleteRange(testKey1, KeyMax, 0, makeTS(9, 0), nil); err != nil || num != 3 {
+		t.Errorf("expected 3 keys deleted; got %d, %v", num, err)
+	}
+}
+
+// TestMVCCPreparePut verifies that prepared puts and deletes write
+// nothing until the caller writes their batches, which may be combined
+// with other writes, and report the same stats as Put and Delete.
+func TestMVCCPreparePut(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.Put(testKey2, makeTS(1, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	putBatch, putMS, err := mvcc.PreparePut(testKey1, makeTS(2, 0), value1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delBatch, delMS, err := mvcc.PrepareDelete(testKey2, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := mvcc.Get(testKey1, makeTS(2, 0), nil); err != nil || value != nil {
+		t.Fatalf("expected no value before writing the batch; got %+v, %v", value, err)
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(2, 0), nil); err != nil || value == nil {
+		t.Fatalf("expected value before writing the batch; got %+v, %v", value, err)
+	}
+
+	rawKey := Key("\x00raw")
+	batch := append(append(putBatch, delBatch...), BatchPut{Key: rawKey, Value: []byte("stats")})
+	if err := mvcc.engine.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := mvcc.Get(testKey1, makeTS(2, 0), nil); err != nil || value == nil || !bytes.Equal(value.Bytes, value1.Bytes) {
+		t.Errorf("expected %q; got %+v, %v", value1.Bytes, value, err)
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(2, 0), nil); err != nil || value != nil {
+		t.Errorf("expected key to be deleted; got %+v, %v", value, err)
+	}
+	if raw, err := mvcc.engine.Get(rawKey); err != nil || !bytes.Equal(raw, []byte("stats")) {
+		t.Errorf("expected raw write to be applied; got %q, %v", raw, err)
+	}
+
+	// The stats match those of the equivalent auto-writing methods.
+	expMVCC := createTestMVCC(t)
+	if _, err := expMVCC.Put(testKey2, makeTS(1, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	expPutMS, err := expMVCC.Put(testKey1, makeTS(2, 0), value1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expDelMS, err := expMVCC.Delete(testKey2, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if putMS != expPutMS || delMS != expDelMS {
+		t.Errorf("expected stats %+v, %+v; got %+v, %+v", expPutMS, expDelMS, putMS, delMS)
+	}
+}
+
+// TestMVCCPutBatch verifies bulk writes into an empty keyspace and
+// the rejection of batches containing keys which already exist or
+// have write intents.
+func TestMVCCPutBatch(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	kvs := []proto.KeyValue{
+		{Key: testKey2, Value: value2},
+		{Key: testKey1, Value: value1},
+		{Key: testKey3, Value: value3},
+	}
+	if err := mvcc.PutBatch(kvs, makeTS(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range kvs {
+		value, err := mvcc.Get(kv.Key, makeTS(1, 0), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == nil || !bytes.Equal(value.Bytes, kv.Value.Bytes) {
+			t.Errorf("expected %q for key %q; got %+v", kv.Value.Bytes, kv.Key, value)
+		}
+		if count := countVersions(t, mvcc, kv.Key); count != 1 {
+			t.Errorf("expected 1 version of key %q; got %d", kv.Key, count)
+		}
+	}
+
+	// A batch containing an existing key is rejected outright.
+	kvs = []proto.KeyValue{
+		{Key: testKey4, Value: value4},
+		{Key: testKey1, Value: value4},
+	}
+	if err := mvcc.PutBatch(kvs, makeTS(2, 0)); err == nil {
+		t.Fatal("expected error writing existing key")
+	}
+	if value, err := mvcc.Get(testKey4, makeTS(2, 0), nil); err != nil || value != nil {
+		t.Errorf("expected no value for %q; got %+v, %v", testKey4, value, err)
+	}
+	if count := countVersions(t, mvcc, testKey1); count != 1 {
+		t.Errorf("expected 1 version of key %q; got %d", testKey1, count)
+	}
+
+	// A batch containing a key with an intent is rejected outright.
+	if _, err := mvcc.Put(testKey2, makeTS(3, 0), value1, txn1); err != nil {
+		t.Fatal(err)
+	}
+	newKey := Key("/db0")
+	kvs = []proto.KeyValue{
+		{Key: newKey, Value: value1},
+		{Key: testKey2, Value: value3},
+	}
+	if err := mvcc.PutBatch(kvs, makeTS(4, 0)); err == nil {
+		t.Fatal("expected write intent error")
+	}
+	if value, err := mvcc.Get(newKey, makeTS(4, 0), nil); err != nil || value != nil {
+		t.Errorf("expected no value for %q; got %+v, %v", newKey, value, err)
+	}
+
+	// Intents on keys within the batch's span but not in the batch
+	// don't matter.
+	kvs = []proto.KeyValue{
+		{Key: newKey, Value: value1},
+		{Key: Key("/db5"), Value: value1},
+	}
+	if err := mvcc.PutBatch(kvs, makeTS(4, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMVCCIngestSorted verifies that sorted keys are ingested across
+// several engine batches, and that unsorted input and keys which
+// already exist or hold intents are rejected before anything is
+// written.
+func TestMVCCIngestSorted(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	var kvs []proto.RawKeyValue
+	for i := 0; i < ingestBatchSize+10; i++ {
+		kvs = append(kvs, proto.RawKeyValue{
+			Key:   Key(fmt.Sprintf("/ingest/%05d", i)),
+			Value: []byte(strconv.Itoa(i)),
+		})
+	}
+	if err := mvcc.IngestSorted(kvs, makeTS(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, ingestBatchSize - 1, ingestBatchSize, len(kvs) - 1} {
+		value, err := mvcc.Get(kvs[i].Key, makeTS(1, 0), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == nil || !bytes.Equal(value.Bytes, kvs[i].Value) {
+			t.Errorf("expected %q for key %q; got %+v", kvs[i].Value, kvs[i].Key, value)
+		}
+	}
+	if value, err := mvcc.Get(kvs[0].Key, makeTS(0, 1), nil); err != nil || value != nil {
+		t.Errorf("expected no value before the ingest timestamp; got %+v, %v", value, err)
+	}
+
+	// Failed ingestions write none of their keys, including those which
+	// precede the offending key.
+	if _, err := mvcc.Put(Key("/other/b"), makeTS(1, 0), value1, txn1); err != nil {
+		t.Fatal(err)
+	}
+	newKeys := []proto.RawKeyValue{
+		{Key: Key("/other/a"), Value: []byte("a")},
+		{Key: Key("/other/c"), Value: []byte("c")},
+	}
+	testCases := []struct {
+		kvs       []proto.RawKeyValue
+		expErr    string
+		expIntent bool
+	}{
+		{[]proto.RawKeyValue{newKeys[1], newKeys[0]}, "not sorted", false},
+		{[]proto.RawKeyValue{newKeys[0], newKeys[0]}, "not sorted", false},
+		{[]proto.RawKeyValue{{Key: kvs[1].Key}, newKeys[0], newKeys[1]}, "already exists", false},
+		{[]proto.RawKeyValue{newKeys[0], {Key: Key("/other/b")}, newKeys[1]}, "", true},
+	}
+	for i, test := range testCases {
+		err := mvcc.IngestSorted(test.kvs, makeTS(2, 0))
+		if err == nil {
+			t.Errorf("%d: expected error", i)
+			continue
+		}
+		if _, ok := err.(*writeIntentError); ok != test.expIntent {
+			t.Errorf("%d: expected write intent error=%t; got %v", i, test.expIntent, err)
+		}
+		if !strings.Contains(err.Error(), test.expErr) {
+			t.Errorf("%d: expected error %q; got %v", i, test.expErr, err)
+		}
+		for _, kv := range newKeys {
+			if value, err := mvcc.Get(kv.Key, makeTS(2, 0), nil); err != nil || value != nil {
+				t.Errorf("%d: expected no value for %q; got %+v, %v", i, kv.Key, value, err)
+			}
+		}
+	}
+}
+
+// computeStats scans the entire engine and returns the MVCC stats
+// for its contents.
+func computeStats(t *testing.T, mvcc *MVCC) MVCCStats {
+	kvs, err := mvcc.engine.Scan(KeyMin, KeyMax, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ms MVCCStats
+	for _, kv := range kvs {
+		ms.KeyBytes += int64(len(kv.Key))
+		ms.ValBytes += int64(len(kv.Value))
+		if _, _, isValue := mvccDecodeKey(kv.Key); isValue {
+			ms.ValCount++
+		} else {
+			ms.KeyCount++
+		}
+	}
+	return ms
+}
+
+// TestMVCCPutStats verifies that the stats deltas returned by Put and
+// Delete sum to the stats of the engine contents, including when
+// intents are replaced at the same or a new timestamp.
+func TestMVCCPutStats(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	var ms MVCCStats
+	testCases := []struct {
+		key    Key
+		ts     proto.Timestamp
+		value  *proto.Value // nil for delete
+		txn    *proto.Transaction
+		expKey int64 // expected change in key count
+		expVal int64 // expected change in version count
+	}{
+		{testKey1, makeTS(1, 0), &value1, nil, 1, 1},
+		{testKey1, makeTS(2, 0), &value2, nil, 0, 1},
+		{testKey2, makeTS(1, 0), &value1, txn1, 1, 1},
+		// Replace intent at the same timestamp.
+		{testKey2, makeTS(1, 0), &value3, txn1, 0, 0},
+		// Replace intent at a newer timestamp.
+		{testKey2, makeTS(2, 0), &value4, txn1, 0, 0},
+		{testKey1, makeTS(3, 0), nil, nil, 0, 1},
+	}
+	for i, test := range testCases {
+		var delta MVCCStats
+		var err error
+		if test.value != nil {
+			delta, err = mvcc.Put(test.key, test.ts, *test.value, test.txn)
+		} else {
+			delta, err = mvcc.Delete(test.key, test.ts, test.txn)
+		}
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if delta.KeyCount != test.expKey || delta.ValCount != test.expVal {
+			t.Errorf("%d: expected key and version count changes %d, %d; got %+v",
+				i, test.expKey, test.expVal, delta)
+		}
+		ms.Add(delta)
+		if expMS := computeStats(t, mvcc); ms != expMS {
+			t.Errorf("%d: expected aggregated stats %+v; got %+v", i, expMS, ms)
+		}
+	}
+
+	// A failed write reports no change.
+	delta, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	if err == nil {
+		t.Fatal("expected error writing with an old timestamp")
+	}
+	if delta != (MVCCStats{}) {
+		t.Errorf("expected empty stats for failed write; got %+v", delta)
+	}
+}
+
+// TestMVCCMutationStats verifies that the stats deltas returned by
+// the remaining MVCC mutations sum to the stats of the engine
+// contents, including intent resolution and garbage collection.
+func TestMVCCMutationStats(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	var ms MVCCStats
+	testCases := []func() (MVCCStats, error){
+		func() (MVCCStats, error) {
+			_, ms, err := mvcc.ConditionalPut(testKey1, makeTS(1, 0), value1, nil, nil)
+			return ms, err
+		},
+		func() (MVCCStats, error) {
+			_, ms, err := mvcc.ConditionalPut(testKey1, makeTS(2, 0), value2, &value1, nil)
+			return ms, err
+		},
+		func() (MVCCStats, error) {
+			_, ms, err := mvcc.Increment(testKey2, makeTS(1, 0), nil, 5)
+			return ms, err
+		},
+		func() (MVCCStats, error) {
+			_, ms, err := mvcc.Increment(testKey2, makeTS(2, 0), nil, 2)
+			return ms, err
+		},
+		// Commit an intent at a pushed timestamp.
+		func() (MVCCStats, error) {
+			return mvcc.Put(testKey3, makeTS(1, 0), value1, txn1)
+		},
+		func() (MVCCStats, error) {
+			return mvcc.ResolveWriteIntent(testKey3, makeTxn(txn1, makeTS(3, 0)), true)
+		},
+		// Abort an intent above a previous version.
+		func() (MVCCStats, error) {
+			return mvcc.Put(testKey3, makeTS(4, 0), value2, txn2)
+		},
+		func() (MVCCStats, error) {
+			return mvcc.ResolveWriteIntent(testKey3, txn2, false)
+		},
+		// Abort an intent with no previous version.
+		func() (MVCCStats, error) {
+			return mvcc.Put(testKey4, makeTS(1, 0), value1, txn2)
+		},
+		func() (MVCCStats, error) {
+			_, _, ms, err := mvcc.ResolveWriteIntentRange(testKey4, KeyMax, 0, txn2, false, false)
+			return ms, err
+		},
+		func() (MVCCStats, error) {
+			_, ms, err := mvcc.DeleteRange(testKey1, testKey3, 0, makeTS(5, 0), nil)
+			return ms, err
+		},
+		func() (MVCCStats, error) {
+			_, ms, err := mvcc.GarbageCollectRange(KeyMin, KeyMax, makeTS(6, 0), 0)
+			return ms, err
+		},
+	}
+	for i, test := range testCases {
+		delta, err := test()
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		ms.Add(delta)
+		if expMS := computeStats(t, mvcc); ms != expMS {
+			t.Errorf("%d: expected aggregated stats %+v; got %+v", i, expMS, ms)
+		}
+	}
+}
+
+// TestMVCCNegativeTimestamp verifies that reads and writes at
+// timestamps with negative components return errors.
+func TestMVCCNegativeTimestamp(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []proto.Timestamp{makeTS(-1, 0), makeTS(1, -1)} {
+		if _, err := mvcc.Put(testKey1, ts, value2, nil); err == nil {
+			t.Errorf("expected error putting at %+v", ts)
+		}
+		if _, err := mvcc.Get(testKey1, ts, nil); err == nil {
+			t.Errorf("expected error getting at %+v", ts)
+		}
+		if _, err := mvcc.ResolveWriteIntent(testKey1, makeTxn(txn1, ts), true); err == nil {
+			t.Errorf("expected error resolving at %+v", ts)
+		}
+	}
+}
+
 func TestMVCCUpdateExistingKeyOldVersion(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 1), value1, nil)
+	_, err := mvcc.Put(testKey1, makeTS(1, 1), value1, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Earlier walltime.
-	err = mvcc.Put(testKey1, makeTS(0, 0), value2, nil)
+	_, err = mvcc.Put(testKey1, makeTS(0, 0), value2, nil)
 	if err == nil {
 		t.Fatal("expected error on old version")
 	}
 	// Earlier logical time.
-	err = mvcc.Put(testKey1, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey1, makeTS(1, 0), value2, nil)
 	if err == nil {
 		t.Fatal("expected error on old version")
 	}
@@ -224,12 +765,12 @@ func TestMVCCUpdateExistingKeyOldVersion(t *testing.T) {
 
 func TestMVCCUpdateExistingKeyInTxn(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = mvcc.Put(testKey1, makeTS(1, 0), value1, txn1)
+	_, err = mvcc.Put(testKey1, makeTS(1, 0), value1, txn1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -237,12 +778,12 @@ func TestMVCCUpdateExistingKeyInTxn(t *testing.T) {
 
 func TestMVCCUpdateExistingKeyDiffTxn(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = mvcc.Put(testKey1, makeTS(1, 0), value2, txn2)
+	_, err = mvcc.Put(testKey1, makeTS(1, 0), value2, txn2)
 	if err == nil {
 		t.Fatal("expected error on uncommitted write intent")
 	}
@@ -262,8 +803,8 @@ func TestMVCCGetNoMoreOldVersion(t *testing.T) {
 	// If we search for a<T=2>, the scan should not return "b".
 
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(3, 0), value1, nil)
-	err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err := mvcc.Put(testKey1, makeTS(3, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
 
 	value, err := mvcc.Get(testKey1, makeTS(2, 0), nil)
 	if err != nil {
@@ -276,7 +817,7 @@ func TestMVCCGetNoMoreOldVersion(t *testing.T) {
 
 func TestMVCCGetAndDelete(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
 	value, err := mvcc.Get(testKey1, makeTS(2, 0), nil)
 	if err != nil {
 		t.Fatal(err)
@@ -285,7 +826,7 @@ func TestMVCCGetAndDelete(t *testing.T) {
 		t.Fatal("the value should not be empty")
 	}
 
-	err = mvcc.Delete(testKey1, makeTS(3, 0), nil)
+	_, err = mvcc.Delete(testKey1, makeTS(3, 0), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -313,7 +854,7 @@ func TestMVCCGetAndDelete(t *testing.T) {
 
 func TestMVCCGetAndDeleteInTxn(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 0), value1, txn1)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, txn1)
 	value, err := mvcc.Get(testKey1, makeTS(2, 0), txn1)
 	if err != nil {
 		t.Fatal(err)
@@ -322,7 +863,7 @@ func TestMVCCGetAndDeleteInTxn(t *testing.T) {
 		t.Fatal("the value should not be empty")
 	}
 
-	err = mvcc.Delete(testKey1, makeTS(3, 0), txn1)
+	_, err = mvcc.Delete(testKey1, makeTS(3, 0), txn1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -346,7 +887,7 @@ func TestMVCCGetAndDeleteInTxn(t *testing.T) {
 
 func TestMVCCGetWriteIntentError(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -364,14 +905,14 @@ func TestMVCCGetWriteIntentError(t *testing.T) {
 
 func TestMVCCScan(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
-	err = mvcc.Put(testKey1, makeTS(2, 0), value4, nil)
-	err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
-	err = mvcc.Put(testKey2, makeTS(3, 0), value3, nil)
-	err = mvcc.Put(testKey3, makeTS(1, 0), value3, nil)
-	err = mvcc.Put(testKey3, makeTS(4, 0), value2, nil)
-	err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
-	err = mvcc.Put(testKey4, makeTS(5, 0), value1, nil)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey1, makeTS(2, 0), value4, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey2, makeTS(3, 0), value3, nil)
+	_, err = mvcc.Put(testKey3, makeTS(1, 0), value3, nil)
+	_, err = mvcc.Put(testKey3, makeTS(4, 0), value2, nil)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+	_, err = mvcc.Put(testKey4, makeTS(5, 0), value1, nil)
 
 	kvs, err := mvcc.Scan(testKey2, testKey4, 0, makeTS(1, 0), nil)
 	if err != nil {
@@ -419,252 +960,1501 @@ func TestMVCCScan(t *testing.T) {
 	}
 }
 
-func TestMVCCScanMaxNum(t *testing.T) {
+func TestMVCCReverseScan(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
-	err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
-	err = mvcc.Put(testKey3, makeTS(1, 0), value3, nil)
-	err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
-
-	kvs, err := mvcc.Scan(testKey2, testKey4, 1, makeTS(1, 0), nil)
-	if err != nil {
+	for _, kv := range []proto.KeyValue{
+		{Key: testKey1, Value: value1},
+		{Key: testKey2, Value: value2},
+		{Key: testKey3, Value: value3},
+		{Key: testKey4, Value: value4},
+	} {
+		if _, err := mvcc.Put(kv.Key, makeTS(1, 0), kv.Value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mvcc.Delete(testKey3, makeTS(2, 0), nil); err != nil {
 		t.Fatal(err)
 	}
-	if len(kvs) != 1 ||
-		!bytes.Equal(kvs[0].Key, testKey2) ||
-		!bytes.Equal(kvs[0].Value.Bytes, value2.Bytes) {
-		t.Fatal("the value should not be empty")
+
+	for i, test := range []struct {
+		key, endKey Key
+		max         int64
+		ts          proto.Timestamp
+		expKeys     []Key
+	}{
+		{testKey1, KeyMax, 0, makeTS(1, 0), []Key{testKey4, testKey3, testKey2, testKey1}},
+		{testKey1, KeyMax, 0, makeTS(2, 0), []Key{testKey4, testKey2, testKey1}},
+		{testKey1, KeyMax, 2, makeTS(1, 0), []Key{testKey4, testKey3}},
+		{testKey2, testKey4, 0, makeTS(1, 0), []Key{testKey3, testKey2}},
+		{testKey2, testKey4, 1, makeTS(2, 0), []Key{testKey2}},
+		{testKey4.Next(), KeyMax, 0, makeTS(1, 0), []Key{}},
+	} {
+		kvs, err := mvcc.ReverseScan(test.key, test.endKey, test.max, test.ts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []Key{}
+		for _, kv := range kvs {
+			keys = append(keys, Key(kv.Key))
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) {
+			t.Errorf("%d: expected keys %q; got %q", i, test.expKeys, keys)
+		}
 	}
 }
 
-func TestMVCCScanWithKeyPrefix(t *testing.T) {
+// TestMVCCReverseScanStopAtIntent verifies that a reverse scan stops
+// at the largest intent beneath the rows it returns, and resumes
+// just past the intent's key.
+func TestMVCCReverseScanStopAtIntent(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	// Let's say you have:
-	// a
-	// a<T=2>
-	// a<T=1>
-	// aa
-	// aa<T=3>
-	// aa<T=2>
-	// b
-	// b<T=5>
-	// In this case, if we scan from "a"-"b", we wish to skip
-	// a<T=2> and a<T=1> and find "aa'.
-	err := mvcc.Put(Key(encoding.EncodeString([]byte{}, "/a")), makeTS(1, 0), value1, nil)
-	err = mvcc.Put(Key(encoding.EncodeString([]byte{}, "/a")), makeTS(2, 0), value2, nil)
-	err = mvcc.Put(Key(encoding.EncodeString([]byte{}, "/aa")), makeTS(2, 0), value2, nil)
-	err = mvcc.Put(Key(encoding.EncodeString([]byte{}, "/aa")), makeTS(3, 0), value3, nil)
-	err = mvcc.Put(Key(encoding.EncodeString([]byte{}, "/b")), makeTS(1, 0), value3, nil)
-
-	kvs, err := mvcc.Scan(Key(encoding.EncodeString([]byte{}, "/a")),
-		Key(encoding.EncodeString([]byte{}, "/b")), 0, makeTS(2, 0), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if len(kvs) != 2 ||
-		!bytes.Equal(kvs[0].Key, Key(encoding.EncodeString([]byte{}, "/a"))) ||
-		!bytes.Equal(kvs[1].Key, Key(encoding.EncodeString([]byte{}, "/aa"))) ||
-		!bytes.Equal(kvs[0].Value.Bytes, value2.Bytes) ||
-		!bytes.Equal(kvs[1].Value.Bytes, value2.Bytes) {
-		t.Fatal("the value should not be empty")
+	for _, kv := range []struct {
+		key   Key
+		value proto.Value
+		txn   *proto.Transaction
+	}{
+		{testKey1, value1, nil},
+		{testKey2, value2, txn2},
+		{testKey3, value3, txn2},
+		{testKey4, value4, nil},
+	} {
+		if _, err := mvcc.Put(kv.key, makeTS(1, 0), kv.value, kv.txn); err != nil {
+			t.Fatal(err)
+		}
 	}
-}
 
-func TestMVCCScanInTxn(t *testing.T) {
-	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
-	err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
-	err = mvcc.Put(testKey3, makeTS(1, 0), value3, txn1)
-	err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+	// By default, the intents fail the scan.
+	if _, err := mvcc.ReverseScan(testKey1, KeyMax, 0, makeTS(1, 0), nil); err == nil {
+		t.Error("expected write intent error")
+	}
 
-	kvs, err := mvcc.Scan(testKey2, testKey4, 0, makeTS(1, 0), txn1)
+	// Otherwise, the scan stops at the largest intent.
+	kvs, resumeKey, intentTxn, err := mvcc.ReverseScanStopAtIntent(testKey1, KeyMax, 0, makeTS(1, 0), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(kvs) != 2 ||
-		!bytes.Equal(kvs[0].Key, testKey2) ||
-		!bytes.Equal(kvs[1].Key, testKey3) ||
-		!bytes.Equal(kvs[0].Value.Bytes, value2.Bytes) ||
-		!bytes.Equal(kvs[1].Value.Bytes, value3.Bytes) {
-		t.Fatal("the value should not be empty")
+	if len(kvs) != 1 || !bytes.Equal(kvs[0].Key, testKey4) {
+		t.Errorf("expected rows above intent; got %+v", kvs)
+	}
+	if !bytes.Equal(resumeKey, testKey3.Next()) {
+		t.Errorf("expected resume key %q; got %q", testKey3.Next(), resumeKey)
+	}
+	if intentTxn == nil || !bytes.Equal(intentTxn.ID, txn2.ID) {
+		t.Errorf("expected intent of txn %q; got %+v", txn2.ID, intentTxn)
 	}
 
-	kvs, err = mvcc.Scan(testKey2, testKey4, 0, makeTS(1, 0), nil)
-	if err == nil {
-		t.Fatal("expected error on uncommitted write intent")
+	// An intent beneath MaxResults rows doesn't end the scan.
+	kvs, resumeKey, intentTxn, err = mvcc.ReverseScanStopAtIntent(testKey1, KeyMax, 1, makeTS(1, 0), nil)
+	if err != nil || len(kvs) != 1 || resumeKey != nil || intentTxn != nil {
+		t.Errorf("expected limited scan to complete; got %+v, %q, %+v, %v", kvs, resumeKey, intentTxn, err)
+	}
+
+	// The intents' own transaction reads through them.
+	kvs, resumeKey, intentTxn, err = mvcc.ReverseScanStopAtIntent(testKey1, KeyMax, 0, makeTS(1, 0), txn2)
+	if err != nil || len(kvs) != 4 || resumeKey != nil || intentTxn != nil {
+		t.Errorf("expected complete scan; got %+v, %q, %+v, %v", kvs, resumeKey, intentTxn, err)
 	}
 }
 
-func TestMVCCDeleteRange(t *testing.T) {
+func TestMVCCScanMaxBytes(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
-	err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
-	err = mvcc.Put(testKey3, makeTS(1, 0), value3, nil)
-	err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
-
-	num, err := mvcc.DeleteRange(testKey2, testKey4, 0, makeTS(2, 0), nil)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey3, makeTS(1, 0), value3, nil)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if num != 2 {
+	rowSize := int64(len(testKey1) + len(value1.Bytes))
+
+	for i, test := range []struct {
+		max, maxBytes int64
+		expKeys       []Key
+		expResumeKey  Key
+	}{
+		// No limits.
+		{0, 0, []Key{testKey1, testKey2, testKey3, testKey4}, nil},
+		// The row which exceeds the byte limit is included.
+		{0, 1, []Key{testKey1}, testKey2},
+		{0, rowSize, []Key{testKey1, testKey2}, testKey3},
+		{0, 2*rowSize + 1, []Key{testKey1, testKey2, testKey3}, testKey4},
+		// The count limit ends the scan first.
+		{1, 2 * rowSize, []Key{testKey1}, nil},
+		// The byte limit is reached on the last key.
+		{0, 3*rowSize + 1, []Key{testKey1, testKey2, testKey3, testKey4}, nil},
+	} {
+		kvs, resumeKey, err := mvcc.ScanWithMaxBytes(testKey1, KeyMax, test.max, test.maxBytes, makeTS(1, 0), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []Key
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) {
+			t.Errorf("%d: expected keys %q; got %q", i, test.expKeys, keys)
+		}
+		if !bytes.Equal(resumeKey, test.expResumeKey) {
+			t.Errorf("%d: expected resume key %q; got %q", i, test.expResumeKey, resumeKey)
+		}
+	}
+}
+
+// TestMVCCScanStream verifies that streamed scans yield the same
+// results as Scan and that the channel is closed on completion, even
+// if the scan fails.
+func TestMVCCScanStream(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	for i, key := range []Key{testKey1, testKey2, testKey3} {
+		if _, err := mvcc.Put(key, makeTS(1, 0), value1, nil); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+	if _, err := mvcc.Put(testKey4, makeTS(1, 0), value2, txn1); err != nil {
+		t.Fatal(err)
+	}
+
+	expKVs, err := mvcc.Scan(testKey1, testKey4, 0, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan proto.KeyValue)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mvcc.ScanStream(testKey1, testKey4, makeTS(2, 0), nil, ch)
+	}()
+	var kvs []proto.KeyValue
+	for kv := range ch {
+		kvs = append(kvs, kv)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 3 || !reflect.DeepEqual(kvs, expKVs) {
+		t.Errorf("expected streamed scan to match %+v; got %+v", expKVs, kvs)
+	}
+
+	// The intent of txn1 fails the scan after the preceding keys are sent.
+	ch = make(chan proto.KeyValue, 10)
+	if err := mvcc.ScanStream(testKey1, KeyMax, makeTS(2, 0), nil, ch); err == nil {
+		t.Error("expected write intent error")
+	}
+	kvs = nil
+	for kv := range ch {
+		kvs = append(kvs, kv)
+	}
+	if len(kvs) != 3 {
+		t.Errorf("expected 3 key/values before the intent; got %+v", kvs)
+	}
+}
+
+func TestMVCCScanStopAtIntent(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey3, makeTS(1, 0), value3, txn2)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// By default, the intent fails the scan.
+	if _, err := mvcc.Scan(testKey1, KeyMax, 0, makeTS(1, 0), nil); err == nil {
+		t.Error("expected write intent error")
+	}
+
+	// Otherwise, the scan stops at the intent.
+	kvs, resumeKey, intentTxn, err := mvcc.ScanStopAtIntent(testKey1, KeyMax, 0, 0, makeTS(1, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || !bytes.Equal(kvs[0].Key, testKey1) || !bytes.Equal(kvs[1].Key, testKey2) {
+		t.Errorf("expected rows preceding intent; got %+v", kvs)
+	}
+	if !bytes.Equal(resumeKey, testKey3) {
+		t.Errorf("expected resume key %q; got %q", testKey3, resumeKey)
+	}
+	if intentTxn == nil || !bytes.Equal(intentTxn.ID, txn2.ID) {
+		t.Errorf("expected intent of txn %q; got %+v", txn2.ID, intentTxn)
+	}
+
+	// The byte limit may end the scan first.
+	kvs, resumeKey, intentTxn, err = mvcc.ScanStopAtIntent(testKey1, KeyMax, 0, 1, makeTS(1, 0), nil)
+	if err != nil || len(kvs) != 1 || !bytes.Equal(resumeKey, testKey2) || intentTxn != nil {
+		t.Errorf("expected byte limit to end scan; got %+v, %q, %+v, %v", kvs, resumeKey, intentTxn, err)
+	}
+
+	// The intent's own transaction reads through it.
+	kvs, resumeKey, intentTxn, err = mvcc.ScanStopAtIntent(testKey1, KeyMax, 0, 0, makeTS(1, 0), txn2)
+	if err != nil || len(kvs) != 4 || resumeKey != nil || intentTxn != nil {
+		t.Errorf("expected complete scan; got %+v, %q, %+v, %v", kvs, resumeKey, intentTxn, err)
+	}
+
+	// Once the intent is resolved, the scan may be resumed.
+	if _, err := mvcc.ResolveWriteIntent(testKey3, makeTxn(txn2, makeTS(1, 0)), true); err != nil {
+		t.Fatal(err)
+	}
+	kvs, resumeKey, intentTxn, err = mvcc.ScanStopAtIntent(testKey3, KeyMax, 0, 0, makeTS(1, 0), nil)
+	if err != nil || len(kvs) != 2 || resumeKey != nil || intentTxn != nil {
+		t.Errorf("expected resumed scan to complete; got %+v, %q, %+v, %v", kvs, resumeKey, intentTxn, err)
+	}
+}
+
+func TestMVCCScanKeys(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Delete(testKey2, makeTS(2, 0), nil)
+	_, err = mvcc.Put(testKey3, makeTS(3, 0), value3, nil)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		timestamp proto.Timestamp
+		max       int64
+		expKeys   []Key
+	}{
+		{makeTS(1, 0), 0, []Key{testKey1, testKey2, testKey4}},
+		{makeTS(2, 0), 0, []Key{testKey1, testKey4}},
+		{makeTS(3, 0), 0, []Key{testKey1, testKey3, testKey4}},
+		{makeTS(3, 0), 2, []Key{testKey1, testKey3}},
+	} {
+		keys, err := mvcc.ScanKeys(testKey1, KeyMax, test.max, test.timestamp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) {
+			t.Errorf("%d: expected keys %q; got %q", i, test.expKeys, keys)
+		}
+		count, err := mvcc.Count(testKey1, KeyMax, test.max, test.timestamp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != int64(len(test.expKeys)) {
+			t.Errorf("%d: expected count %d; got %d", i, len(test.expKeys), count)
+		}
+	}
+}
+
+// TestMVCCScanWithTombstones verifies that deleted keys are returned
+// marked as deleted, and are distinguished from keys with empty values.
+func TestMVCCScanWithTombstones(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey2, makeTS(1, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Delete(testKey2, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey3, makeTS(1, 0), proto.Value{Bytes: []byte{}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Delete(testKey4, makeTS(3, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		timestamp  proto.Timestamp
+		max        int64
+		expKeys    []Key
+		expDeleted []bool
+	}{
+		{makeTS(1, 0), 0, []Key{testKey1, testKey2, testKey3}, []bool{false, false, false}},
+		{makeTS(2, 0), 0, []Key{testKey1, testKey2, testKey3}, []bool{false, true, false}},
+		{makeTS(3, 0), 0, []Key{testKey1, testKey2, testKey3, testKey4}, []bool{false, true, false, true}},
+		{makeTS(3, 0), 2, []Key{testKey1, testKey2}, []bool{false, true}},
+	} {
+		entries, err := mvcc.ScanWithTombstones(testKey1, KeyMax, test.max, test.timestamp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, deleted := []Key{}, []bool{}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+			deleted = append(deleted, e.Deleted)
+			if e.Deleted && (e.Value.Bytes != nil || e.Value.Timestamp != nil) {
+				t.Errorf("%d: expected zero value for deleted key %q; got %+v", i, e.Key, e.Value)
+			}
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) || !reflect.DeepEqual(deleted, test.expDeleted) {
+			t.Errorf("%d: expected keys %q deleted %v; got %q deleted %v", i, test.expKeys, test.expDeleted, keys, deleted)
+		}
+	}
+
+	// Scan omits the deleted keys but returns the empty value.
+	kvs, err := mvcc.Scan(testKey1, KeyMax, 0, makeTS(3, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || !bytes.Equal(kvs[1].Key, testKey3) {
+		t.Errorf("expected scan to return %q and %q; got %+v", testKey1, testKey3, kvs)
+	}
+}
+
+func TestDecodeMetaKey(t *testing.T) {
+	binKey := encoding.EncodeBinary(nil, testKey1)
+	emptyKey := encoding.EncodeBinary(nil, Key{})
+	testCases := []struct {
+		encKey []byte
+		expKey Key
+		ok     bool
+	}{
+		{binKey, testKey1, true},
+		{emptyKey, Key{}, true},
+		{mvccEncodeKey(binKey, makeTS(1, 0)), nil, false},
+		{mvccEncodeKey(emptyKey, makeTS(1, 1)), nil, false},
+		{append(append([]byte(nil), binKey...), 'x'), nil, false},
+		{[]byte{}, nil, false},
+		{[]byte("abc"), nil, false},
+		{binKey[:len(binKey)-1], nil, false},
+	}
+	for i, test := range testCases {
+		key, err := decodeMetaKey(test.encKey)
+		if test.ok != (err == nil) {
+			t.Errorf("%d: expected ok=%t; got error %v", i, test.ok, err)
+			continue
+		}
+		if test.ok && !bytes.Equal(key, test.expKey) {
+			t.Errorf("%d: expected key %q; got %q", i, test.expKey, key)
+		}
+	}
+}
+
+// TestMVCCScanRejectsNonMetaKeys verifies that Scan and
+// ResolveWriteIntentRange fail, rather than misinterpret the key or
+// panic, on encountering a version key without metadata or a corrupt
+// key where MVCC metadata is expected.
+func TestMVCCScanRejectsNonMetaKeys(t *testing.T) {
+	binKey2 := encoding.EncodeBinary(nil, testKey2)
+	badKeys := [][]byte{
+		mvccEncodeKey(binKey2, makeTS(1, 0)),
+		binKey2[:len(binKey2)-1],
+	}
+	for i, badKey := range badKeys {
+		mvcc := createTestMVCC(t)
+		if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := mvcc.engine.Put(badKey, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mvcc.Scan(testKey1, KeyMax, 0, makeTS(2, 0), nil); err == nil {
+			t.Errorf("%d: expected scan over %q to fail", i, badKey)
+		}
+		if _, _, _, err := mvcc.ResolveWriteIntentRange(testKey1, KeyMax, 0, txn1, true, false); err == nil {
+			t.Errorf("%d: expected intent resolution over %q to fail", i, badKey)
+		}
+		// Scans which end before the bad key succeed.
+		kvs, err := mvcc.Scan(testKey1, testKey1.Next(), 0, makeTS(2, 0), nil)
+		if err != nil || len(kvs) != 1 {
+			t.Errorf("%d: expected one value scanning before bad key; got %+v, %v", i, kvs, err)
+		}
+	}
+}
+
+func TestMVCCCheckConsistency(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey2, makeTS(2, 0), value3, nil)
+	_, err = mvcc.Put(testKey3, makeTS(1, 0), value3, nil)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := mvcc.CheckConsistency(KeyMin, KeyMax); err != nil || len(keys) != 0 {
+		t.Fatalf("expected no corrupt keys; got %q, %v", keys, err)
+	}
+
+	// Remove the latest version of testKey2 and the metadata of testKey3.
+	binKey2 := encoding.EncodeBinary(nil, testKey2)
+	if err := mvcc.engine.Clear(mvccEncodeKey(binKey2, makeTS(2, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if err := mvcc.engine.Clear(encoding.EncodeBinary(nil, testKey3)); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := mvcc.CheckConsistency(KeyMin, KeyMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []Key{testKey2, testKey3}) {
+		t.Errorf("expected corrupt keys %q; got %q", []Key{testKey2, testKey3}, keys)
+	}
+
+	// Without consistency checks the dangling metadata reads as absent.
+	if value, err := mvcc.Get(testKey2, makeTS(3, 0), nil); err != nil || value != nil {
+		t.Errorf("expected nil value; got %+v, %v", value, err)
+	}
+	mvcc.EnableConsistencyChecks()
+	if _, err := mvcc.Get(testKey2, makeTS(3, 0), nil); err == nil {
+		t.Error("expected error reading dangling metadata")
+	}
+	if _, err := mvcc.Scan(testKey1, KeyMax, 0, makeTS(3, 0), nil); err == nil {
+		t.Error("expected error scanning dangling metadata")
+	}
+}
+
+func TestMVCCScanMaxNum(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey3, makeTS(1, 0), value3, nil)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+
+	kvs, err := mvcc.Scan(testKey2, testKey4, 1, makeTS(1, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 ||
+		!bytes.Equal(kvs[0].Key, testKey2) ||
+		!bytes.Equal(kvs[0].Value.Bytes, value2.Bytes) {
 		t.Fatal("the value should not be empty")
 	}
-	kvs, _ := mvcc.Scan(KeyMin, KeyMax, 0, makeTS(2, 0), nil)
+}
+
+func TestMVCCScanWithKeyPrefix(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	// Let's say you have:
+	// a
+	// a<T=2>
+	// a<T=1>
+	// aa
+	// aa<T=3>
+	// aa<T=2>
+	// b
+	// b<T=5>
+	// In this case, if we scan from "a"-"b", we wish to skip
+	// a<T=2> and a<T=1> and find "aa'.
+	_, err := mvcc.Put(Key(encoding.EncodeString([]byte{}, "/a")), makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(Key(encoding.EncodeString([]byte{}, "/a")), makeTS(2, 0), value2, nil)
+	_, err = mvcc.Put(Key(encoding.EncodeString([]byte{}, "/aa")), makeTS(2, 0), value2, nil)
+	_, err = mvcc.Put(Key(encoding.EncodeString([]byte{}, "/aa")), makeTS(3, 0), value3, nil)
+	_, err = mvcc.Put(Key(encoding.EncodeString([]byte{}, "/b")), makeTS(1, 0), value3, nil)
+
+	kvs, err := mvcc.Scan(Key(encoding.EncodeString([]byte{}, "/a")),
+		Key(encoding.EncodeString([]byte{}, "/b")), 0, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(kvs) != 2 ||
-		!bytes.Equal(kvs[0].Key, testKey1) ||
-		!bytes.Equal(kvs[1].Key, testKey4) ||
-		!bytes.Equal(kvs[0].Value.Bytes, value1.Bytes) ||
-		!bytes.Equal(kvs[1].Value.Bytes, value4.Bytes) {
+		!bytes.Equal(kvs[0].Key, Key(encoding.EncodeString([]byte{}, "/a"))) ||
+		!bytes.Equal(kvs[1].Key, Key(encoding.EncodeString([]byte{}, "/aa"))) ||
+		!bytes.Equal(kvs[0].Value.Bytes, value2.Bytes) ||
+		!bytes.Equal(kvs[1].Value.Bytes, value2.Bytes) {
+		t.Fatal("the value should not be empty")
+	}
+}
+
+// TestMVCCScanAdjacentKeys verifies that skipping past the old
+// versions of a key neither drops nor double-returns keys which share
+// a prefix with it, including keys with only versions newer than the
+// read timestamp.
+func TestMVCCScanAdjacentKeys(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	keys := []Key{
+		Key("a"),
+		Key("a\x00"),
+		Key("a\x00\x00"),
+		Key("a\x01"),
+		Key("aa"),
+		Key("b"),
+	}
+	// Write two versions of each key. "a\x00" and "aa" have only
+	// versions newer than the read timestamps below.
+	for i, key := range keys {
+		ts := int64(1)
+		if i == 1 || i == 4 {
+			ts = 5
+		}
+		if _, err := mvcc.Put(key, makeTS(ts, 0), value1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mvcc.Put(key, makeTS(ts+1, 0), value2, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		start, end Key
+		timestamp  proto.Timestamp
+		expKeys    []Key
+		expValue   proto.Value
+	}{
+		{Key("a"), Key("b"), makeTS(1, 0), []Key{Key("a"), Key("a\x00\x00"), Key("a\x01")}, value1},
+		{Key("a"), Key("b"), makeTS(3, 0), []Key{Key("a"), Key("a\x00\x00"), Key("a\x01")}, value2},
+		{Key("a"), KeyMax, makeTS(6, 0), keys, value2},
+		{Key("a\x00"), Key("a\x01"), makeTS(6, 0), []Key{Key("a\x00"), Key("a\x00\x00")}, value2},
+		{Key("a"), Key("a\x00"), makeTS(2, 0), []Key{Key("a")}, value2},
+		// The last key in the range is the final key in the engine.
+		{Key("aa"), NextKey(Key("b")), makeTS(6, 0), []Key{Key("aa"), Key("b")}, value2},
+		{Key("b"), NextKey(Key("b")), makeTS(1, 0), []Key{Key("b")}, value1},
+	}
+	for i, test := range testCases {
+		kvs, err := mvcc.Scan(test.start, test.end, 0, test.timestamp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) != len(test.expKeys) {
+			t.Errorf("%d: expected %d keys; got %d: %+v", i, len(test.expKeys), len(kvs), kvs)
+			continue
+		}
+		for j, kv := range kvs {
+			if !bytes.Equal(kv.Key, test.expKeys[j]) {
+				t.Errorf("%d: expected key %q at %d; got %q", i, test.expKeys[j], j, kv.Key)
+			}
+			if !bytes.Equal(kv.Value.Bytes, test.expValue.Bytes) {
+				t.Errorf("%d: expected value %q at %d; got %q", i, test.expValue.Bytes, j, kv.Value.Bytes)
+			}
+		}
+	}
+}
+
+// TestMVCCScanMaxKey verifies scanning over keys at the top of the
+// key space, which are composed of 0xff bytes.
+func TestMVCCScanMaxKey(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	keys := []Key{Key("\xfe"), Key("\xfe\xff"), Key("\xff"), Key("\xff\x00"), Key("\xff\xff")}
+	for _, key := range keys {
+		if _, err := mvcc.Put(key, makeTS(1, 0), value1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mvcc.Put(key, makeTS(2, 0), value2, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kvs, err := mvcc.Scan(Key("\xfe"), NextKey(Key("\xff\xff")), 0, makeTS(1, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != len(keys) {
+		t.Fatalf("expected %d keys; got %d: %+v", len(keys), len(kvs), kvs)
+	}
+	for i, kv := range kvs {
+		if !bytes.Equal(kv.Key, keys[i]) || !bytes.Equal(kv.Value.Bytes, value1.Bytes) {
+			t.Errorf("%d: expected %q=%q; got %q=%q", i, keys[i], value1.Bytes, kv.Key, kv.Value.Bytes)
+		}
+	}
+	// KeyMax is an exclusive end key.
+	if kvs, err = mvcc.Scan(Key("\xfe"), KeyMax, 0, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 {
+		t.Errorf("expected 2 keys before KeyMax; got %d: %+v", len(kvs), kvs)
+	}
+}
+
+func TestMVCCScanInTxn(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey3, makeTS(1, 0), value3, txn1)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+
+	kvs, err := mvcc.Scan(testKey2, testKey4, 0, makeTS(1, 0), txn1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 ||
+		!bytes.Equal(kvs[0].Key, testKey2) ||
+		!bytes.Equal(kvs[1].Key, testKey3) ||
+		!bytes.Equal(kvs[0].Value.Bytes, value2.Bytes) ||
+		!bytes.Equal(kvs[1].Value.Bytes, value3.Bytes) {
 		t.Fatal("the value should not be empty")
 	}
 
-	num, err = mvcc.DeleteRange(testKey4, KeyMax, 0, makeTS(2, 0), nil)
+	kvs, err = mvcc.Scan(testKey2, testKey4, 0, makeTS(1, 0), nil)
+	if err == nil {
+		t.Fatal("expected error on uncommitted write intent")
+	}
+}
+
+// TestMVCCTxnBuffer verifies that a transaction reads its own
+// buffered writes, that scans merge buffered writes with committed
+// values, and that buffered writes are dropped on resolution.
+func TestMVCCTxnBuffer(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	mvcc.EnableTxnBuffer()
+	txn := makeTxn(txn1, makeTS(2, 0))
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey2, makeTS(2, 0), value2, txn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey3, makeTS(2, 0), value3, txn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Delete(testKey3, makeTS(2, 0), txn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey4, makeTS(1, 0), value4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, err := mvcc.Scan(testKey1, KeyMax, 0, makeTS(2, 0), txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expKVs := []proto.KeyValue{
+		{Key: testKey1, Value: value1},
+		{Key: testKey2, Value: value2},
+		{Key: testKey4, Value: value4},
+	}
+	if len(kvs) != len(expKVs) {
+		t.Fatalf("expected %d values; got %+v", len(expKVs), kvs)
+	}
+	for i, kv := range kvs {
+		if !bytes.Equal(kv.Key, expKVs[i].Key) || !bytes.Equal(kv.Value.Bytes, expKVs[i].Value.Bytes) {
+			t.Errorf("%d: expected %q=%q; got %q=%q", i, expKVs[i].Key, expKVs[i].Value.Bytes, kv.Key, kv.Value.Bytes)
+		}
+	}
+
+	// Remove the intent's metadata from the engine; the buffered write
+	// is still visible to the transaction, but only at its epoch and at
+	// or after its timestamp.
+	if err := mvcc.engine.Clear(encoding.EncodeBinary(nil, testKey2)); err != nil {
+		t.Fatal(err)
+	}
+	value, err := mvcc.Get(testKey2, makeTS(3, 0), txn)
+	if err != nil || value == nil || !bytes.Equal(value.Bytes, value2.Bytes) {
+		t.Fatalf("expected buffered value %q; got %+v, %v", value2.Bytes, value, err)
+	}
+	if !value.Timestamp.Equal(makeTS(2, 0)) {
+		t.Errorf("expected buffered value timestamp %+v; got %+v", makeTS(2, 0), value.Timestamp)
+	}
+	kvs, err = mvcc.Scan(testKey1, KeyMax, 0, makeTS(3, 0), txn)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if num != 1 {
-		t.Fatal("the value should not be empty")
+	if len(kvs) != len(expKVs) || !bytes.Equal(kvs[1].Key, testKey2) {
+		t.Errorf("expected scan to include buffered write to %q; got %+v", testKey2, kvs)
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(3, 0), makeTxn(txn1e2, makeTS(2, 0))); err != nil || value != nil {
+		t.Errorf("expected no value for a later epoch; got %+v, %v", value, err)
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(1, 0), txn); err != nil || value != nil {
+		t.Errorf("expected no value before the write's timestamp; got %+v, %v", value, err)
+	}
+
+	// Resolving an intent removes its buffered write.
+	if _, err := mvcc.ResolveWriteIntent(testKey3, txn, true); err != nil {
+		t.Fatal(err)
+	}
+	if entries := mvcc.buffer.txns[string(txn.ID)]; len(entries) != 1 {
+		t.Errorf("expected one buffered write after resolution; got %+v", entries)
+	}
+	mvcc.DiscardTxnBuffer(txn)
+	if len(mvcc.buffer.txns) != 0 {
+		t.Errorf("expected empty buffer after discard; got %+v", mvcc.buffer.txns)
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(3, 0), txn); err != nil || value != nil {
+		t.Errorf("expected no value after discard; got %+v, %v", value, err)
+	}
+}
+
+// TestTxnBufferMaxEntries verifies that writes to new keys aren't
+// buffered once the buffer is full, while buffered writes may still
+// be replaced.
+func TestTxnBufferMaxEntries(t *testing.T) {
+	b := newTxnBuffer()
+	value := &proto.MVCCValue{Value: &value1}
+	for i := 0; i < maxTxnBufferEntries; i++ {
+		b.put(txn1, encoding.EncodeBinary(nil, Key(fmt.Sprintf("%05d", i))), makeTS(1, 0), value)
+	}
+	full := encoding.EncodeBinary(nil, Key("full"))
+	b.put(txn2, full, makeTS(1, 0), value)
+	if _, ok := b.get(txn2, full, makeTS(1, 0), makeTS(1, 0)); ok {
+		t.Error("expected write to a full buffer not to be buffered")
+	}
+	first := encoding.EncodeBinary(nil, Key("00000"))
+	b.put(txn1, first, makeTS(1, 0), &proto.MVCCValue{Value: &value2})
+	if v, ok := b.get(txn1, first, makeTS(1, 0), makeTS(1, 0)); !ok || !bytes.Equal(v.Bytes, value2.Bytes) {
+		t.Errorf("expected buffered write to be replaced; got %+v, %t", v, ok)
+	}
+
+	// Removing a write makes room for another.
+	b.remove(txn1, first)
+	b.put(txn2, full, makeTS(1, 0), value)
+	if _, ok := b.get(txn2, full, makeTS(1, 0), makeTS(1, 0)); !ok {
+		t.Error("expected write to be buffered after removal")
+	}
+	b.discard(txn1)
+	if b.size != 1 {
+		t.Errorf("expected 1 buffered write after discard; got %d", b.size)
+	}
+}
+
+func TestMVCCDeleteRange(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey3, makeTS(1, 0), value3, nil)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+
+	num, _, err := mvcc.DeleteRange(testKey2, testKey4, 0, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 {
+		t.Fatal("the value should not be empty")
+	}
+	kvs, _ := mvcc.Scan(KeyMin, KeyMax, 0, makeTS(2, 0), nil)
+	if len(kvs) != 2 ||
+		!bytes.Equal(kvs[0].Key, testKey1) ||
+		!bytes.Equal(kvs[1].Key, testKey4) ||
+		!bytes.Equal(kvs[0].Value.Bytes, value1.Bytes) ||
+		!bytes.Equal(kvs[1].Value.Bytes, value4.Bytes) {
+		t.Fatal("the value should not be empty")
+	}
+
+	num, _, err = mvcc.DeleteRange(testKey4, KeyMax, 0, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 1 {
+		t.Fatal("the value should not be empty")
+	}
+	kvs, _ = mvcc.Scan(KeyMin, KeyMax, 0, makeTS(2, 0), nil)
+	if len(kvs) != 1 ||
+		!bytes.Equal(kvs[0].Key, testKey1) ||
+		!bytes.Equal(kvs[0].Value.Bytes, value1.Bytes) {
+		t.Fatal("the value should not be empty")
+	}
+
+	num, _, err = mvcc.DeleteRange(KeyMin, testKey2, 0, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 1 {
+		t.Fatal("the value should not be empty")
+	}
+	kvs, _ = mvcc.Scan(KeyMin, KeyMax, 0, makeTS(2, 0), nil)
+	if len(kvs) != 0 {
+		t.Fatal("the value should be empty")
+	}
+}
+
+// TestMVCCDeleteRangeReturningKeys verifies that the deleted keys are
+// returned and that a failure deleting any key leaves all keys intact.
+func TestMVCCDeleteRangeReturningKeys(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	for _, key := range []Key{testKey1, testKey2, testKey3, testKey4} {
+		if _, err := mvcc.Put(key, makeTS(1, 0), value1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	num, keys, _, err := mvcc.DeleteRangeReturningKeys(testKey2, KeyMax, 2, makeTS(2, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 || !reflect.DeepEqual(keys, []Key{testKey2, testKey3}) {
+		t.Errorf("expected 2 deleted keys %q, %q; got %d %q", testKey2, testKey3, num, keys)
+	}
+
+	// testKey4 has a version newer than the deletion, so deleting
+	// testKey1 through testKey4 fails and testKey1 remains.
+	if _, err := mvcc.Put(testKey4, makeTS(4, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := mvcc.DeleteRangeReturningKeys(testKey1, KeyMax, 0, makeTS(3, 0), nil); err == nil {
+		t.Fatal("expected error deleting key with newer version")
+	}
+	kvs, err := mvcc.Scan(KeyMin, KeyMax, 0, makeTS(3, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || !bytes.Equal(kvs[0].Key, testKey1) || !bytes.Equal(kvs[1].Key, testKey4) {
+		t.Errorf("expected keys %q, %q to remain; got %+v", testKey1, testKey4, kvs)
+	}
+}
+
+func TestMVCCDeleteRangeFailed(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, txn1)
+	_, err = mvcc.Put(testKey3, makeTS(1, 0), value3, txn1)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+
+	_, _, err = mvcc.DeleteRange(testKey2, testKey4, 0, makeTS(1, 0), nil)
+	if err == nil {
+		t.Fatal("expected error on uncommitted write intent")
+	}
+
+	_, _, err = mvcc.DeleteRange(testKey2, testKey4, 0, makeTS(1, 0), txn1)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMVCCDeleteRangeConcurrentTxn(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
+	_, err = mvcc.Put(testKey2, makeTS(1, 0), value2, txn1)
+	_, err = mvcc.Put(testKey3, makeTS(2, 0), value3, txn2)
+	_, err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+
+	_, _, err = mvcc.DeleteRange(testKey2, testKey4, 0, makeTS(1, 0), txn1)
+	if err == nil {
+		t.Fatal("expected error on uncommitted write intent")
+	}
+}
+
+func TestMVCCConditionalPut(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	actualVal, _, err := mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, &value2, nil)
+	if err == nil {
+		t.Fatal("expected error on key not exists")
+	}
+	if actualVal != nil {
+		t.Fatalf("expected missing actual value: %v", actualVal)
+	}
+
+	// Verify the difference between missing value and empty value.
+	actualVal, _, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, &valueEmpty, nil)
+	if err == nil {
+		t.Fatal("expected error on key not exists")
+	}
+	if actualVal != nil {
+		t.Fatalf("expected missing actual value: %v", actualVal)
+	}
+
+	// Do a conditional put with expectation that the value is completely missing; will succeed.
+	_, _, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, nil, nil)
+	if err != nil {
+		t.Fatalf("expected success with condition that key doesn't yet exist: %v", err)
+	}
+
+	// Another conditional put expecting value missing will fail, now that value1 is written.
+	actualVal, _, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, nil, nil)
+	if err == nil {
+		t.Fatal("expected error on key already exists")
+	}
+	if !bytes.Equal(actualVal.Bytes, value1.Bytes) {
+		t.Fatalf("the value %s in get result does not match the value %s in request",
+			actualVal.Bytes, value1.Bytes)
+	}
+
+	// Conditional put expecting wrong value2, will fail.
+	actualVal, _, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, &value2, nil)
+	if err == nil {
+		t.Fatal("expected error on key does not match")
+	}
+	if !bytes.Equal(actualVal.Bytes, value1.Bytes) {
+		t.Fatalf("the value %s in get result does not match the value %s in request",
+			actualVal.Bytes, value1.Bytes)
+	}
+
+	// Move to a empty value. Will succeed.
+	_, _, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), valueEmpty, &value1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Now move to value2 from expected empty value.
+	_, _, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value2, &valueEmpty, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Verify we get value2 as expected.
+	value, err := mvcc.Get(testKey1, makeTS(0, 0), nil)
+	if !bytes.Equal(value2.Bytes, value.Bytes) {
+		t.Fatalf("the value %s in get result does not match the value %s in request",
+			value1.Bytes, value.Bytes)
+	}
+}
+
+// TestMVCCPutIfAbsent verifies that PutIfAbsent writes only keys which
+// don't yet exist, and that it detects the intent of a transaction
+// with a newer timestamp.
+func TestMVCCPutIfAbsent(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	ok, err := mvcc.PutIfAbsent(testKey1, makeTS(1, 0), value1, nil)
+	if !ok || err != nil {
+		t.Fatalf("expected write of absent key: %t, %v", ok, err)
+	}
+	// The key now exists, so a second write is skipped without error.
+	ok, err = mvcc.PutIfAbsent(testKey1, makeTS(2, 0), value2, nil)
+	if ok || err != nil {
+		t.Fatalf("expected no write of existing key: %t, %v", ok, err)
+	}
+	value, err := mvcc.Get(testKey1, makeTS(3, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value.Bytes, value1.Bytes) {
+		t.Fatalf("the value %s in get result does not match the value %s in request",
+			value.Bytes, value1.Bytes)
+	}
+
+	// An intent with a newer timestamp is detected.
+	if _, err := mvcc.Put(testKey2, makeTS(2, 0), value1, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err = mvcc.PutIfAbsent(testKey2, makeTS(1, 0), value2, nil); err == nil {
+		t.Fatal("expected write intent error")
+	}
+	if ok {
+		t.Fatal("expected no write on write intent error")
+	}
+}
+
+// TestMVCCConditionalPutBatch verifies that a batch of conditional
+// puts is written only if every condition holds, and otherwise fails
+// without writing any of its values. The stats of a batch are those
+// of the same puts made individually.
+func TestMVCCConditionalPutBatch(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second entry expects testKey3 to exist, so nothing is written.
+	_, err := mvcc.ConditionalPutBatch([]ConditionalPutEntry{
+		{Key: testKey2, Value: value2},
+		{Key: testKey3, Value: value3, ExpValue: &value3},
+	}, makeTS(2, 0), nil)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected error on key not exists; got %v", err)
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(2, 0), nil); err != nil || value != nil {
+		t.Fatalf("expected no value written for %q; got %+v, %v", testKey2, value, err)
+	}
+
+	// Duplicate keys are rejected.
+	_, err = mvcc.ConditionalPutBatch([]ConditionalPutEntry{
+		{Key: testKey2, Value: value2},
+		{Key: testKey2, Value: value3},
+	}, makeTS(2, 0), nil)
+	if err == nil {
+		t.Fatal("expected error on duplicate keys")
+	}
+
+	// All conditions hold, so all values are written.
+	ms, err := mvcc.ConditionalPutBatch([]ConditionalPutEntry{
+		{Key: testKey1, Value: value4, ExpValue: &value1},
+		{Key: testKey2, Value: value2},
+		{Key: testKey3, Value: value3},
+	}, makeTS(2, 0), txn1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expMVCC := createTestMVCC(t)
+	if _, err := expMVCC.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	var expMS MVCCStats
+	for _, kv := range []struct {
+		key   Key
+		value proto.Value
+	}{{testKey1, value4}, {testKey2, value2}, {testKey3, value3}} {
+		putMS, err := expMVCC.Put(kv.key, makeTS(2, 0), kv.value, txn1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS.Add(putMS)
+	}
+	if !reflect.DeepEqual(ms, expMS) {
+		t.Errorf("expected stats %+v; got %+v", expMS, ms)
+	}
+	for key, expValue := range map[string]proto.Value{"/db1": value4, "/db2": value2, "/db3": value3} {
+		value, err := mvcc.Get(Key(key), makeTS(2, 0), txn1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == nil || !bytes.Equal(value.Bytes, expValue.Bytes) {
+			t.Errorf("expected value %q for key %q; got %+v", expValue.Bytes, key, value)
+		}
+	}
+	// The values were written as intents of the transaction.
+	if _, err := mvcc.Get(testKey2, makeTS(2, 0), nil); err == nil {
+		t.Error("expected write intent error")
+	}
+}
+
+func TestMVCCConditionalPutTS(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	// Expecting a version when the key doesn't exist will fail.
+	actualVal, err := mvcc.ConditionalPutTS(testKey1, makeTS(1, 0), makeTS(1, 0), value1, nil)
+	if err == nil {
+		t.Fatal("expected error on key not exists")
+	}
+	if actualVal != nil {
+		t.Fatalf("expected missing actual value: %v", actualVal)
+	}
+	// Expecting a zero timestamp when the key doesn't exist will succeed.
+	if _, err := mvcc.ConditionalPutTS(testKey1, makeTS(1, 0), makeTS(0, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the version back, as a caller doing optimistic concurrency would.
+	ok, ts, err := mvcc.GetProtoTS(testKey1, makeTS(2, 0), nil, nil)
+	if !ok || err != nil {
+		t.Fatalf("expected to find key: %t, %v", ok, err)
+	}
+	if !ts.Equal(makeTS(1, 0)) {
+		t.Fatalf("expected timestamp %+v; got %+v", makeTS(1, 0), ts)
+	}
+
+	// Expecting a zero timestamp or the wrong version now fails and
+	// returns the existing value and its timestamp.
+	for _, expTS := range []proto.Timestamp{makeTS(0, 0), makeTS(0, 1), makeTS(2, 0)} {
+		actualVal, err = mvcc.ConditionalPutTS(testKey1, makeTS(3, 0), expTS, value2, nil)
+		if err == nil {
+			t.Fatalf("expected error on timestamp %+v not matching", expTS)
+		}
+		if actualVal == nil || !bytes.Equal(actualVal.Bytes, value1.Bytes) {
+			t.Fatalf("expected actual value %q; got %+v", value1.Bytes, actualVal)
+		}
+		if !actualVal.Timestamp.Equal(makeTS(1, 0)) {
+			t.Fatalf("expected actual timestamp %+v; got %+v", makeTS(1, 0), actualVal.Timestamp)
+		}
+	}
+
+	// Expecting the version read succeeds.
+	if _, err := mvcc.ConditionalPutTS(testKey1, makeTS(3, 0), ts, value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	value, err := mvcc.Get(testKey1, makeTS(3, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value.Bytes, value2.Bytes) {
+		t.Fatalf("the value %s in get result does not match the value %s in request",
+			value.Bytes, value2.Bytes)
+	}
+
+	// A write intent by another transaction is detected even though
+	// it is newer than the expected version.
+	if _, err := mvcc.Put(testKey1, makeTS(5, 0), value3, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.ConditionalPutTS(testKey1, makeTS(4, 0), makeTS(3, 0), value1, nil); err == nil {
+		t.Fatal("expected error on write intent")
+	}
+}
+
+func TestMVCCResolveTxn(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	value, err := mvcc.Get(testKey1, makeTS(0, 0), txn1)
+	if !bytes.Equal(value1.Bytes, value.Bytes) {
+		t.Fatalf("the value %s in get result does not match the value %s in request",
+			value1.Bytes, value.Bytes)
+	}
+
+	// Resolve will write with txn1's timestamp which is 0,0.
+	_, err = mvcc.ResolveWriteIntent(testKey1, txn1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = mvcc.Get(testKey1, makeTS(0, 0), nil)
+	if !bytes.Equal(value1.Bytes, value.Bytes) {
+		t.Fatalf("the value %s in get result does not match the value %s in request",
+			value1.Bytes, value.Bytes)
+	}
+}
+
+// TestMVCCGetIgnoringIntent verifies that the intent of the ignored
+// transaction is skipped in favor of the latest committed version
+// below it, while intents of other transactions still conflict.
+func TestMVCCGetIgnoringIntent(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey1, makeTS(2, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey1, makeTS(3, 0), value3, txn1); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		ts       proto.Timestamp
+		expValue *proto.Value
+	}{
+		{makeTS(0, 0), nil},
+		{makeTS(1, 0), &value1},
+		{makeTS(2, 0), &value2},
+		{makeTS(3, 0), &value2},
+		{makeTS(4, 0), &value2},
+	}
+	for i, test := range testCases {
+		value, err := mvcc.GetIgnoringIntent(testKey1, test.ts, txn1.ID)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if test.expValue == nil {
+			if value != nil {
+				t.Errorf("%d: expected no value; got %+v", i, value)
+			}
+		} else if value == nil || !bytes.Equal(value.Bytes, test.expValue.Bytes) {
+			t.Errorf("%d: expected value %q; got %+v", i, test.expValue.Bytes, value)
+		}
+	}
+
+	// An intent of another transaction is not ignored.
+	if _, err := mvcc.GetIgnoringIntent(testKey1, makeTS(4, 0), txn2.ID); err == nil {
+		t.Error("expected write intent error reading past txn1's intent")
+	}
+
+	// An intent on a key with no other versions reads as absent.
+	if _, err := mvcc.Put(testKey2, makeTS(1, 0), value1, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := mvcc.GetIgnoringIntent(testKey2, makeTS(2, 0), txn1.ID); value != nil || err != nil {
+		t.Errorf("expected no value; got %+v, %v", value, err)
+	}
+}
+
+func TestMVCCGetMetadata(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, ok, err := mvcc.GetMetadata(testKey1); ok || err != nil {
+		t.Fatalf("expected no metadata; got %t, %v", ok, err)
+	}
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	meta, ok, err := mvcc.GetMetadata(testKey1)
+	if !ok || err != nil || !meta.Timestamp.Equal(makeTS(1, 0)) || meta.Txn != nil {
+		t.Fatalf("expected committed metadata at %+v; got %+v, %t, %v", makeTS(1, 0), meta, ok, err)
+	}
+	if _, err := mvcc.Put(testKey1, makeTS(2, 0), value2, txn1); err != nil {
+		t.Fatal(err)
+	}
+	meta, ok, err = mvcc.GetMetadata(testKey1)
+	if !ok || err != nil || !meta.Timestamp.Equal(makeTS(2, 0)) || meta.Txn == nil ||
+		!bytes.Equal(meta.Txn.ID, txn1.ID) {
+		t.Fatalf("expected intent of txn1 at %+v; got %+v, %t, %v", makeTS(2, 0), meta, ok, err)
+	}
+}
+
+func TestMVCCGetWithIntent(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey1, makeTS(2, 0), value2, txn1); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		ts       proto.Timestamp
+		txn      *proto.Transaction
+		expValue *proto.Value
+		expTxn   *proto.Transaction
+	}{
+		{makeTS(0, 0), nil, nil, nil},
+		{makeTS(1, 0), nil, &value1, nil},
+		{makeTS(2, 0), nil, &value1, txn1},
+		{makeTS(3, 0), txn2, &value1, txn1},
+		{makeTS(3, 0), txn1, &value2, nil},
+	}
+	for i, test := range testCases {
+		value, intentTxn, err := mvcc.GetWithIntent(testKey1, test.ts, test.txn)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if test.expValue == nil {
+			if value != nil {
+				t.Errorf("%d: expected no value; got %+v", i, value)
+			}
+		} else if value == nil || !bytes.Equal(value.Bytes, test.expValue.Bytes) {
+			t.Errorf("%d: expected value %q; got %+v", i, test.expValue.Bytes, value)
+		}
+		if test.expTxn == nil {
+			if intentTxn != nil {
+				t.Errorf("%d: expected no intent txn; got %+v", i, intentTxn)
+			}
+		} else if intentTxn == nil || !bytes.Equal(intentTxn.ID, test.expTxn.ID) {
+			t.Errorf("%d: expected intent txn %+v; got %+v", i, test.expTxn, intentTxn)
+		}
+	}
+
+	// Get still fails with a write intent error.
+	if _, err := mvcc.Get(testKey1, makeTS(3, 0), nil); err == nil {
+		t.Error("expected write intent error from Get")
+	}
+}
+
+// TestMVCCExists verifies that Exists agrees with Get, including for
+// deletion tombstones and write intents.
+func TestMVCCExists(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Delete(testKey1, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey1, makeTS(3, 0), valueEmpty, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		ts     proto.Timestamp
+		exists bool
+	}{
+		{makeTS(0, 0), false},
+		{makeTS(1, 0), true},
+		{makeTS(2, 0), false},
+		{makeTS(3, 0), true},
+		{makeTS(4, 0), true},
+	}
+	for i, test := range testCases {
+		exists, err := mvcc.Exists(testKey1, test.ts, nil)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if exists != test.exists {
+			t.Errorf("%d: expected exists=%t; got %t", i, test.exists, exists)
+		}
+		value, err := mvcc.Get(testKey1, test.ts, nil)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if (value != nil) != exists {
+			t.Errorf("%d: Exists disagrees with Get value %+v", i, value)
+		}
+	}
+	if exists, err := mvcc.Exists(testKey2, makeTS(1, 0), nil); exists || err != nil {
+		t.Errorf("expected missing key not to exist; got %t, %v", exists, err)
+	}
+
+	// Intents result in the same errors as for Get.
+	if _, err := mvcc.Put(testKey2, makeTS(1, 0), value1, txn1); err != nil {
+		t.Fatal(err)
+	}
+	_, getErr := mvcc.Get(testKey2, makeTS(2, 0), nil)
+	_, existsErr := mvcc.Exists(testKey2, makeTS(2, 0), nil)
+	if _, ok := existsErr.(*writeIntentError); !ok || existsErr.Error() != getErr.Error() {
+		t.Errorf("expected write intent error %v; got %v", getErr, existsErr)
+	}
+	if exists, err := mvcc.Exists(testKey2, makeTS(2, 0), txn1); !exists || err != nil {
+		t.Errorf("expected txn1 to see its intent; got %t, %v", exists, err)
+	}
+	if exists, err := mvcc.Exists(testKey2, makeTS(0, 0), txn2); exists || err != nil {
+		t.Errorf("expected no value below the intent; got %t, %v", exists, err)
+	}
+}
+
+// TestMVCCDeleteVersion verifies that a single historical version can
+// be deleted without disturbing the metadata or the other versions,
+// and that the most recent version and intents cannot be.
+func TestMVCCDeleteVersion(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	for i, value := range []proto.Value{value1, value2, value3} {
+		if _, err := mvcc.Put(testKey1, makeTS(int64(i+1), 0), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	binKey := encoding.EncodeBinary(nil, testKey1)
+	metaBytes, err := mvcc.engine.Get(binKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mvcc.DeleteVersion(testKey1, makeTS(2, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if count := countVersions(t, mvcc, testKey1); count != 2 {
+		t.Errorf("expected 2 versions; got %d", count)
+	}
+	if newMetaBytes, err := mvcc.engine.Get(binKey); err != nil || !bytes.Equal(newMetaBytes, metaBytes) {
+		t.Errorf("expected metadata to be untouched; got %v", err)
+	}
+	// Reads at the deleted version see the version below it.
+	for ts, expValue := range map[int64]proto.Value{1: value1, 2: value1, 3: value3} {
+		value, err := mvcc.Get(testKey1, makeTS(ts, 0), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == nil || !bytes.Equal(value.Bytes, expValue.Bytes) {
+			t.Errorf("expected %q at %d; got %+v", expValue.Bytes, ts, value)
+		}
+	}
+
+	// A missing version or key, the most recent version and an intent
+	// may not be deleted.
+	if err := mvcc.DeleteVersion(testKey1, makeTS(2, 0)); err == nil {
+		t.Error("expected error deleting missing version")
+	}
+	if err := mvcc.DeleteVersion(testKey2, makeTS(1, 0)); err == nil {
+		t.Error("expected error deleting version of missing key")
 	}
-	kvs, _ = mvcc.Scan(KeyMin, KeyMax, 0, makeTS(2, 0), nil)
-	if len(kvs) != 1 ||
-		!bytes.Equal(kvs[0].Key, testKey1) ||
-		!bytes.Equal(kvs[0].Value.Bytes, value1.Bytes) {
-		t.Fatal("the value should not be empty")
+	if err := mvcc.DeleteVersion(testKey1, makeTS(3, 0)); err == nil {
+		t.Error("expected error deleting most recent version")
 	}
-
-	num, err = mvcc.DeleteRange(KeyMin, testKey2, 0, makeTS(2, 0), nil)
-	if err != nil {
+	if _, err := mvcc.Put(testKey1, makeTS(4, 0), value4, txn1); err != nil {
 		t.Fatal(err)
 	}
-	if num != 1 {
-		t.Fatal("the value should not be empty")
+	if err := mvcc.DeleteVersion(testKey1, makeTS(4, 0)); err == nil {
+		t.Error("expected error deleting intent")
 	}
-	kvs, _ = mvcc.Scan(KeyMin, KeyMax, 0, makeTS(2, 0), nil)
-	if len(kvs) != 0 {
-		t.Fatal("the value should be empty")
+	if count := countVersions(t, mvcc, testKey1); count != 3 {
+		t.Errorf("expected 3 versions; got %d", count)
 	}
 }
 
-func TestMVCCDeleteRangeFailed(t *testing.T) {
+// TestMVCCKeyStats verifies the footprint reported for a single key
+// against a scan of the engine, as versions, tombstones and intents
+// are written.
+func TestMVCCKeyStats(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
-	err = mvcc.Put(testKey2, makeTS(1, 0), value2, txn1)
-	err = mvcc.Put(testKey3, makeTS(1, 0), value3, txn1)
-	err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
+	// Another key, whose versions must not be counted.
+	if _, err := mvcc.Put(testKey2, makeTS(1, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if live, total, versions, intent, err := mvcc.KeyStats(testKey1); live != 0 || total != 0 ||
+		versions != 0 || intent || err != nil {
+		t.Fatalf("expected no stats for missing key; got %d, %d, %d, %t, %v", live, total, versions, intent, err)
+	}
 
-	_, err = mvcc.DeleteRange(testKey2, testKey4, 0, makeTS(1, 0), nil)
-	if err == nil {
-		t.Fatal("expected error on uncommitted write intent")
+	testCases := []struct {
+		write     func() error
+		live      bool
+		hasIntent bool
+	}{
+		{func() error { _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); return err }, true, false},
+		{func() error { _, err := mvcc.Put(testKey1, makeTS(2, 0), value2, nil); return err }, true, false},
+		{func() error { _, err := mvcc.Delete(testKey1, makeTS(3, 0), nil); return err }, false, false},
+		{func() error { _, err := mvcc.Put(testKey1, makeTS(4, 0), value3, txn1); return err }, true, true},
 	}
+	for i, test := range testCases {
+		if err := test.write(); err != nil {
+			t.Fatal(err)
+		}
+		binKey := encoding.EncodeBinary(nil, testKey1)
+		kvs, err := mvcc.engine.Scan(binKey, Key(binKey).PrefixEnd(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expTotal int64
+		for _, kv := range kvs {
+			expTotal += int64(len(kv.Key) + len(kv.Value))
+		}
+		expLive := int64(len(kvs[0].Key) + len(kvs[0].Value))
+		if test.live {
+			expLive += int64(len(kvs[1].Key) + len(kvs[1].Value))
+		}
 
-	_, err = mvcc.DeleteRange(testKey2, testKey4, 0, makeTS(1, 0), txn1)
-	if err != nil {
-		t.Fatal(err)
+		live, total, versions, intent, err := mvcc.KeyStats(testKey1)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if live != expLive || total != expTotal || versions != i+1 || intent != test.hasIntent {
+			t.Errorf("%d: expected %d, %d, %d, %t; got %d, %d, %d, %t",
+				i, expLive, expTotal, i+1, test.hasIntent, live, total, versions, intent)
+		}
 	}
 }
 
-func TestMVCCDeleteRangeConcurrentTxn(t *testing.T) {
+// TestMVCCIncrementOverflow verifies that increments which would
+// overflow or underflow return an IncrementOverflowError describing
+// the current value and the increment, and leave the value unchanged.
+func TestMVCCIncrementOverflow(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil)
-	err = mvcc.Put(testKey2, makeTS(1, 0), value2, txn1)
-	err = mvcc.Put(testKey3, makeTS(2, 0), value3, txn2)
-	err = mvcc.Put(testKey4, makeTS(1, 0), value4, nil)
-
-	_, err = mvcc.DeleteRange(testKey2, testKey4, 0, makeTS(1, 0), txn1)
-	if err == nil {
-		t.Fatal("expected error on uncommitted write intent")
+	if _, _, err := mvcc.Increment(testKey1, makeTS(1, 0), nil, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := mvcc.Increment(testKey1, makeTS(2, 0), nil, 1)
+	if oErr, ok := err.(*IncrementOverflowError); !ok || !bytes.Equal(oErr.Key, testKey1) ||
+		oErr.Value != math.MaxInt64 || oErr.Increment != 1 {
+		t.Errorf("expected IncrementOverflowError; got %v", err)
+	}
+	if _, _, err := mvcc.Increment(testKey2, makeTS(1, 0), nil, math.MinInt64); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mvcc.Increment(testKey2, makeTS(2, 0), nil, -1)
+	if _, ok := err.(*IncrementOverflowError); !ok {
+		t.Errorf("expected IncrementOverflowError on underflow; got %v", err)
+	}
+	if r, _, err := mvcc.Increment(testKey1, makeTS(3, 0), nil, 0); err != nil || r != math.MaxInt64 {
+		t.Errorf("expected value to be unchanged; got %d, %v", r, err)
 	}
 }
 
-func TestMVCCConditionalPut(t *testing.T) {
+// TestMVCCIncrementWithID verifies that a retried increment returns
+// the original result without incrementing again, that only recent
+// increments are remembered, and that a committed transactional
+// increment keeps its record while an aborted one doesn't.
+func TestMVCCIncrementWithID(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	actualVal, err := mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, &value2, nil)
-	if err == nil {
-		t.Fatal("expected error on key not exists")
-	}
-	if actualVal != nil {
-		t.Fatalf("expected missing actual value: %v", actualVal)
+	incr := func(ts proto.Timestamp, txn *proto.Transaction, id string) int64 {
+		r, _, err := mvcc.IncrementWithID(testKey1, ts, txn, 1, []byte(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
 	}
-
-	// Verify the difference between missing value and empty value.
-	actualVal, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, &valueEmpty, nil)
-	if err == nil {
-		t.Fatal("expected error on key not exists")
+	if r := incr(makeTS(1, 0), nil, "a"); r != 1 {
+		t.Fatalf("expected 1; got %d", r)
 	}
-	if actualVal != nil {
-		t.Fatalf("expected missing actual value: %v", actualVal)
+	if r := incr(makeTS(2, 0), nil, "a"); r != 1 {
+		t.Errorf("expected retry to return 1; got %d", r)
 	}
-
-	// Do a conditional put with expectation that the value is completely missing; will succeed.
-	_, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, nil, nil)
-	if err != nil {
-		t.Fatalf("expected success with condition that key doesn't yet exist: %v", err)
+	if r := incr(makeTS(2, 0), nil, "b"); r != 2 {
+		t.Errorf("expected 2; got %d", r)
 	}
-
-	// Another conditional put expecting value missing will fail, now that value1 is written.
-	actualVal, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, nil, nil)
-	if err == nil {
-		t.Fatal("expected error on key already exists")
+	// Increments without an ID always apply.
+	if r, _, err := mvcc.Increment(testKey1, makeTS(3, 0), nil, 1); r != 3 || err != nil {
+		t.Errorf("expected 3; got %d, %v", r, err)
 	}
-	if !bytes.Equal(actualVal.Bytes, value1.Bytes) {
-		t.Fatalf("the value %s in get result does not match the value %s in request",
-			actualVal.Bytes, value1.Bytes)
+	if r := incr(makeTS(4, 0), nil, "b"); r != 2 {
+		t.Errorf("expected retry to return 2; got %d", r)
 	}
 
-	// Conditional put expecting wrong value2, will fail.
-	actualVal, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value1, &value2, nil)
-	if err == nil {
-		t.Fatal("expected error on key does not match")
+	// After maxIncrementRecords more increments, "a" is forgotten.
+	for i := 0; i < maxIncrementRecords; i++ {
+		incr(makeTS(5, int32(i)), nil, fmt.Sprintf("c%d", i))
 	}
-	if !bytes.Equal(actualVal.Bytes, value1.Bytes) {
-		t.Fatalf("the value %s in get result does not match the value %s in request",
-			actualVal.Bytes, value1.Bytes)
+	expected := int64(3 + maxIncrementRecords + 1)
+	if r := incr(makeTS(6, 0), nil, "a"); r != expected {
+		t.Errorf("expected forgotten increment to apply with result %d; got %d", expected, r)
 	}
 
-	// Move to a empty value. Will succeed.
-	_, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), valueEmpty, &value1, nil)
-	if err != nil {
-		t.Fatal(err)
+	// A committed transactional increment keeps its record.
+	txn := makeTxn(txn1, makeTS(7, 0))
+	if r := incr(makeTS(7, 0), txn, "d"); r != expected+1 {
+		t.Errorf("expected %d; got %d", expected+1, r)
 	}
-	// Now move to value2 from expected empty value.
-	_, err = mvcc.ConditionalPut(testKey1, makeTS(0, 0), value2, &valueEmpty, nil)
-	if err != nil {
+	if _, err := mvcc.ResolveWriteIntent(testKey1, txn, true); err != nil {
 		t.Fatal(err)
 	}
-	// Verify we get value2 as expected.
-	value, err := mvcc.Get(testKey1, makeTS(0, 0), nil)
-	if !bytes.Equal(value2.Bytes, value.Bytes) {
-		t.Fatalf("the value %s in get result does not match the value %s in request",
-			value1.Bytes, value.Bytes)
-	}
-}
-
-func TestMVCCResolveTxn(t *testing.T) {
-	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
-	value, err := mvcc.Get(testKey1, makeTS(0, 0), txn1)
-	if !bytes.Equal(value1.Bytes, value.Bytes) {
-		t.Fatalf("the value %s in get result does not match the value %s in request",
-			value1.Bytes, value.Bytes)
+	if r := incr(makeTS(8, 0), nil, "d"); r != expected+1 {
+		t.Errorf("expected retry to return %d; got %d", expected+1, r)
 	}
 
-	// Resolve will write with txn1's timestamp which is 0,0.
-	err = mvcc.ResolveWriteIntent(testKey1, txn1, true)
-	if err != nil {
+	// An aborted transactional increment is applied again on retry.
+	txn = makeTxn(txn2, makeTS(9, 0))
+	incr(makeTS(9, 0), txn, "e")
+	if _, err := mvcc.ResolveWriteIntent(testKey1, txn, false); err != nil {
 		t.Fatal(err)
 	}
+	if r := incr(makeTS(10, 0), nil, "e"); r != expected+2 {
+		t.Errorf("expected %d; got %d", expected+2, r)
+	}
 
-	value, err = mvcc.Get(testKey1, makeTS(0, 0), nil)
-	if !bytes.Equal(value1.Bytes, value.Bytes) {
-		t.Fatalf("the value %s in get result does not match the value %s in request",
-			value1.Bytes, value.Bytes)
+	// A retry doesn't see a record written by another txn's intent.
+	txn = makeTxn(txn2, makeTS(11, 0))
+	incr(makeTS(11, 0), txn, "f")
+	if _, _, err := mvcc.IncrementWithID(testKey1, makeTS(12, 0), nil, 1, []byte("f")); err == nil {
+		t.Error("expected write intent error on retry")
+	} else if _, ok := err.(*writeIntentError); !ok {
+		t.Errorf("expected write intent error; got %v", err)
 	}
 }
 
 func TestMVCCAbortTxn(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
-	err = mvcc.ResolveWriteIntent(testKey1, txn1, false)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	_, err = mvcc.ResolveWriteIntent(testKey1, txn1, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -684,10 +2474,10 @@ func TestMVCCAbortTxn(t *testing.T) {
 
 func TestMVCCAbortTxnWithPreviousVersion(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, nil)
-	err = mvcc.Put(testKey1, makeTS(1, 0), value2, nil)
-	err = mvcc.Put(testKey1, makeTS(2, 0), value3, txn1)
-	err = mvcc.ResolveWriteIntent(testKey1, txn1, false)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, nil)
+	_, err = mvcc.Put(testKey1, makeTS(1, 0), value2, nil)
+	_, err = mvcc.Put(testKey1, makeTS(2, 0), value3, txn1)
+	_, err = mvcc.ResolveWriteIntent(testKey1, txn1, false)
 
 	meta, err := mvcc.engine.Get(encoding.EncodeBinary(nil, testKey1))
 	if err != nil {
@@ -713,27 +2503,27 @@ func TestMVCCAbortTxnWithPreviousVersion(t *testing.T) {
 func TestMVCCWriteWithDiffTimestampsAndEpochs(t *testing.T) {
 	mvcc := createTestMVCC(t)
 	// Start with epoch 1.
-	if err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1); err != nil {
+	if _, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1); err != nil {
 		t.Fatal(err)
 	}
 	// Now write with greater timestamp and epoch 2.
-	if err := mvcc.Put(testKey1, makeTS(1, 0), value2, txn1e2); err != nil {
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value2, txn1e2); err != nil {
 		t.Fatal(err)
 	}
 	// Try a write with an earlier timestamp.
-	if err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1e2); err == nil {
+	if _, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1e2); err == nil {
 		t.Fatal("expected write too old error")
 	}
 	// Try a write with an earlier epoch.
-	if err := mvcc.Put(testKey1, makeTS(1, 0), value1, txn1); err == nil {
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, txn1); err == nil {
 		t.Fatal("expected write too old error")
 	}
 	// Try a write with different value using both later timestamp and epoch.
-	if err := mvcc.Put(testKey1, makeTS(1, 0), value3, txn1e2); err != nil {
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value3, txn1e2); err != nil {
 		t.Fatal(err)
 	}
 	// Resolve the intent.
-	if err := mvcc.ResolveWriteIntent(testKey1, makeTxn(txn1e2, makeTS(1, 0)), true); err != nil {
+	if _, err := mvcc.ResolveWriteIntent(testKey1, makeTxn(txn1e2, makeTS(1, 0)), true); err != nil {
 		t.Fatal(err)
 	}
 	// Attempt to read older timestamp; should fail.
@@ -755,11 +2545,70 @@ func TestMVCCWriteWithDiffTimestampsAndEpochs(t *testing.T) {
 	}
 }
 
+// TestMVCCWriteOrderViolations verifies each ordering of write
+// timestamp and txn epoch relative to an existing version, and that
+// rejected writes report the specific violation.
+func TestMVCCWriteOrderViolations(t *testing.T) {
+	txn1e0 := &proto.Transaction{ID: []byte("Txn1"), Epoch: 0}
+	testCases := []struct {
+		existingTxn *proto.Transaction // nil for a committed version
+		writeTS     proto.Timestamp
+		writeTxn    *proto.Transaction
+		expErr      string // empty for success
+	}{
+		// Existing intent at timestamp (1, 0), epoch 1.
+		{txn1, makeTS(0, 0), txn1e0, "txn epoch 0 older than epoch 1"},
+		{txn1, makeTS(1, 0), txn1e0, "txn epoch 0 older than epoch 1"},
+		{txn1, makeTS(2, 0), txn1e0, "txn epoch 0 older than epoch 1"},
+		{txn1, makeTS(0, 0), txn1, "older than existing intent"},
+		{txn1, makeTS(1, 0), txn1, ""},
+		{txn1, makeTS(2, 0), txn1, ""},
+		{txn1, makeTS(0, 0), txn1e2, "older than existing intent"},
+		{txn1, makeTS(1, 0), txn1e2, ""},
+		{txn1, makeTS(2, 0), txn1e2, ""},
+		// Existing committed version at timestamp (1, 0).
+		{nil, makeTS(0, 0), nil, "older than existing version"},
+		{nil, makeTS(1, 0), nil, ""},
+		{nil, makeTS(2, 0), nil, ""},
+		{nil, makeTS(0, 0), txn1, "older than existing version"},
+		{nil, makeTS(2, 0), txn1, ""},
+	}
+	for i, test := range testCases {
+		mvcc := createTestMVCC(t)
+		if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, test.existingTxn); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		_, err := mvcc.Put(testKey1, test.writeTS, value2, test.writeTxn)
+		if test.expErr == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+			continue
+		}
+		wErr, ok := err.(*writeTooOldError)
+		if !ok {
+			t.Errorf("%d: expected write too old error; got %v", i, err)
+			continue
+		}
+		if !strings.Contains(wErr.Error(), test.expErr) {
+			t.Errorf("%d: expected error containing %q; got %q", i, test.expErr, wErr)
+		}
+		if wErr.StaleEpoch != strings.Contains(test.expErr, "epoch") {
+			t.Errorf("%d: unexpected stale epoch flag in %+v", i, wErr)
+		}
+		// The existing version is unchanged.
+		value, err := mvcc.Get(testKey1, makeTS(3, 0), test.existingTxn)
+		if err != nil || value == nil || !bytes.Equal(value.Bytes, value1.Bytes) {
+			t.Errorf("%d: expected existing value to remain; got %+v, %v", i, value, err)
+		}
+	}
+}
+
 func TestMVCCResolveWithDiffEpochs(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
-	err = mvcc.Put(testKey2, makeTS(0, 0), value2, txn1e2)
-	num, err := mvcc.ResolveWriteIntentRange(testKey1, NextKey(testKey2), 2, txn1e2, true)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	_, err = mvcc.Put(testKey2, makeTS(0, 0), value2, txn1e2)
+	num, _, _, err := mvcc.ResolveWriteIntentRange(testKey1, NextKey(testKey2), 2, txn1e2, true, false)
 	if num != 2 {
 		t.Errorf("expected 2 rows resolved; got %d", num)
 	}
@@ -781,7 +2630,7 @@ func TestMVCCResolveWithDiffEpochs(t *testing.T) {
 
 func TestMVCCResolveWithUpdatedTimestamp(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
 	value, err := mvcc.Get(testKey1, makeTS(1, 0), txn1)
 	if !bytes.Equal(value1.Bytes, value.Bytes) {
 		t.Fatalf("the value %s in get result does not match the value %s in request",
@@ -790,7 +2639,7 @@ func TestMVCCResolveWithUpdatedTimestamp(t *testing.T) {
 
 	// Resolve with a higher commit timestamp -- this should rewrite the
 	// intent when making it permanent.
-	err = mvcc.ResolveWriteIntent(testKey1, makeTxn(txn1, makeTS(1, 0)), true)
+	_, err = mvcc.ResolveWriteIntent(testKey1, makeTxn(txn1, makeTS(1, 0)), true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -813,21 +2662,21 @@ func TestMVCCResolveTxnNoOps(t *testing.T) {
 	mvcc := createTestMVCC(t)
 
 	// Resolve a non existent key; noop.
-	err := mvcc.ResolveWriteIntent(testKey1, txn1, true)
+	_, err := mvcc.ResolveWriteIntent(testKey1, txn1, true)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Add key and resolve despite there being no intent.
-	err = mvcc.Put(testKey1, makeTS(0, 0), value1, nil)
-	err = mvcc.ResolveWriteIntent(testKey1, txn2, true)
+	_, err = mvcc.Put(testKey1, makeTS(0, 0), value1, nil)
+	_, err = mvcc.ResolveWriteIntent(testKey1, txn2, true)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Write intent and resolve with different txn.
-	err = mvcc.Put(testKey1, makeTS(1, 0), value2, txn1)
-	err = mvcc.ResolveWriteIntent(testKey1, txn2, true)
+	_, err = mvcc.Put(testKey1, makeTS(1, 0), value2, txn1)
+	_, err = mvcc.ResolveWriteIntent(testKey1, txn2, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -835,17 +2684,17 @@ func TestMVCCResolveTxnNoOps(t *testing.T) {
 
 func TestMVCCResolveTxnRange(t *testing.T) {
 	mvcc := createTestMVCC(t)
-	err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
-	err = mvcc.Put(testKey2, makeTS(0, 0), value2, nil)
-	err = mvcc.Put(testKey3, makeTS(0, 0), value3, txn2)
-	err = mvcc.Put(testKey4, makeTS(0, 0), value4, txn1)
+	_, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1)
+	_, err = mvcc.Put(testKey2, makeTS(0, 0), value2, nil)
+	_, err = mvcc.Put(testKey3, makeTS(0, 0), value3, txn2)
+	_, err = mvcc.Put(testKey4, makeTS(0, 0), value4, txn1)
 
-	num, err := mvcc.ResolveWriteIntentRange(testKey1, NextKey(testKey4), 0, txn1, true)
+	num, failed, _, err := mvcc.ResolveWriteIntentRange(testKey1, NextKey(testKey4), 0, txn1, true, false)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if num != 4 {
-		t.Fatalf("expected all keys to process for resolution, even though 2 are noops; got %d", num)
+	if num != 4 || len(failed) != 0 {
+		t.Fatalf("expected all keys to process for resolution, even though 2 are noops; got %d, failed %q", num, failed)
 	}
 
 	value, err := mvcc.Get(testKey1, makeTS(0, 0), nil)
@@ -873,6 +2722,304 @@ func TestMVCCResolveTxnRange(t *testing.T) {
 	}
 }
 
+// TestMVCCIntentsForTxn verifies that only the keys holding intents
+// of the specified transaction are returned, up to max.
+func TestMVCCIntentsForTxn(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, err := mvcc.Put(testKey1, makeTS(0, 0), value1, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey2, makeTS(0, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey3, makeTS(0, 0), value3, txn2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey4, makeTS(0, 0), value4, txn1); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		txnID   []byte
+		max     int64
+		expKeys []Key
+	}{
+		{txn1.ID, 0, []Key{testKey1, testKey4}},
+		{txn1.ID, 1, []Key{testKey1}},
+		{txn2.ID, 0, []Key{testKey3}},
+		{[]byte("Txn3"), 0, nil},
+	}
+	for i, test := range testCases {
+		keys, err := mvcc.IntentsForTxn(testKey1, NextKey(testKey4), test.txnID, test.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, test.expKeys) {
+			t.Errorf("%d: expected keys %q; got %q", i, test.expKeys, keys)
+		}
+	}
+
+	// Once resolved, the intents are no longer returned.
+	for _, key := range []Key{testKey1, testKey4} {
+		if _, err := mvcc.ResolveWriteIntent(key, txn1, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := mvcc.IntentsForTxn(testKey1, NextKey(testKey4), txn1.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no intents after resolution; got %q", keys)
+	}
+}
+
+// TestMVCCGarbageCollectRange verifies that old versions are removed
+// across a key span, keeping each key's most recent live version and
+// skipping keys with write intents.
+func TestMVCCGarbageCollectRange(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	// testKey1 has three versions.
+	for i, value := range []proto.Value{value1, value2, value3} {
+		if _, err := mvcc.Put(testKey1, makeTS(int64(i+1), 0), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// testKey2 has been deleted.
+	if _, err := mvcc.Put(testKey2, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Delete(testKey2, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	// testKey3 has an old version beneath a write intent.
+	if _, err := mvcc.Put(testKey3, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey3, makeTS(2, 0), value2, txn1); err != nil {
+		t.Fatal(err)
+	}
+	// testKey4 has a single old version.
+	if _, err := mvcc.Put(testKey4, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Limit the first pass to testKey1.
+	removed, _, err := mvcc.GarbageCollectRange(testKey1, KeyMax, makeTS(3, 0), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 versions removed; got %d", removed)
+	}
+	if removed, _, err = mvcc.GarbageCollectRange(testKey1, KeyMax, makeTS(3, 0), 0); err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 versions removed; got %d", removed)
+	}
+
+	if value, err := mvcc.Get(testKey1, makeTS(3, 0), nil); err != nil || value == nil || !bytes.Equal(value.Bytes, value3.Bytes) {
+		t.Errorf("expected latest version of %q to remain; got %+v, %v", testKey1, value, err)
+	}
+	if value, err := mvcc.Get(testKey1, makeTS(2, 0), nil); err != nil || value != nil {
+		t.Errorf("expected old versions of %q to be removed; got %+v, %v", testKey1, value, err)
+	}
+	if metaBytes, err := mvcc.engine.Get(encoding.EncodeBinary(nil, testKey2)); err != nil || metaBytes != nil {
+		t.Errorf("expected deleted key %q to be removed; got %q, %v", testKey2, metaBytes, err)
+	}
+	if value, err := mvcc.Get(testKey3, makeTS(1, 0), nil); err != nil || value == nil || !bytes.Equal(value.Bytes, value1.Bytes) {
+		t.Errorf("expected versions of %q beneath intent to remain; got %+v, %v", testKey3, value, err)
+	}
+	if value, err := mvcc.Get(testKey4, makeTS(1, 0), nil); err != nil || value == nil || !bytes.Equal(value.Bytes, value1.Bytes) {
+		t.Errorf("expected only version of %q to remain; got %+v, %v", testKey4, value, err)
+	}
+}
+
+// TestMVCCResolveTxnRangeFailures verifies that keys whose intents
+// can't be resolved are returned, and that resolution either skips
+// them or stops at the first, according to stopOnError.
+func TestMVCCResolveTxnRangeFailures(t *testing.T) {
+	for _, stopOnError := range []bool{false, true} {
+		mvcc := createTestMVCC(t)
+		for _, key := range []Key{testKey1, testKey2, testKey3, testKey4} {
+			if _, err := mvcc.Put(key, makeTS(0, 0), value1, txn1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Corrupt the metadata of keys 2 and 4 so that their intents can't be resolved.
+		for _, key := range []Key{testKey2, testKey4} {
+			if err := mvcc.engine.Put(encoding.EncodeBinary(nil, key), []byte("garbage")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		num, failed, _, err := mvcc.ResolveWriteIntentRange(testKey1, NextKey(testKey4), 0, txn1, true, stopOnError)
+		expNum, expFailed := int64(2), []Key{testKey2, testKey4}
+		if stopOnError {
+			if err == nil {
+				t.Errorf("stopOnError=%t: expected error", stopOnError)
+			}
+			expNum, expFailed = 1, []Key{testKey2}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if num != expNum || !reflect.DeepEqual(failed, expFailed) {
+			t.Errorf("stopOnError=%t: expected %d resolved and %q failed; got %d and %q",
+				stopOnError, expNum, expFailed, num, failed)
+		}
+		// Key 1 is resolved either way; key 3 only if resolution continued past key 2.
+		if value, err := mvcc.Get(testKey1, makeTS(0, 0), nil); err != nil || value == nil {
+			t.Errorf("stopOnError=%t: expected key 1 to be committed; got %+v, %v", stopOnError, value, err)
+		}
+		_, err = mvcc.Get(testKey3, makeTS(0, 0), nil)
+		if _, ok := err.(*writeIntentError); ok != stopOnError {
+			t.Errorf("stopOnError=%t: unexpected intent state of key 3: %v", stopOnError, err)
+		}
+	}
+}
+
+// TestMVCCGarbageCollectTombstones verifies that a key whose most
+// recent version is a deletion tombstone is removed altogether, with
+// its metadata, only once the tombstone is older than the keep
+// timestamp, and that a tombstone beneath a live value is collected
+// like any other version.
+func TestMVCCGarbageCollectTombstones(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	// testKey1 has been deleted.
+	if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Delete(testKey1, makeTS(3, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	// testKey2 has been deleted and rewritten.
+	if _, err := mvcc.Put(testKey2, makeTS(1, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Delete(testKey2, makeTS(2, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mvcc.Put(testKey2, makeTS(3, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tombstone of testKey1 is not older than the keep timestamp; only
+	// the value beneath it is removed. The tombstone of testKey2 and the
+	// value beneath it are removed.
+	removed, _, err := mvcc.GarbageCollectRange(testKey1, KeyMax, makeTS(3, 0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("expected 3 versions removed; got %d", removed)
+	}
+	kvs, err := mvcc.engine.Scan(encoding.EncodeBinary(nil, testKey1), PrefixEndKey(encoding.EncodeBinary(nil, testKey1)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 {
+		t.Errorf("expected metadata and tombstone of %q to remain; got %d entries", testKey1, len(kvs))
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(3, 0), nil); err != nil || value == nil || !bytes.Equal(value.Bytes, value2.Bytes) {
+		t.Errorf("expected latest version of %q to remain; got %+v, %v", testKey2, value, err)
+	}
+	if value, err := mvcc.Get(testKey2, makeTS(2, 0), nil); err != nil || value != nil {
+		t.Errorf("expected tombstone of %q to be removed; got %+v, %v", testKey2, value, err)
+	}
+
+	// Once the tombstone expires, testKey1 leaves nothing behind.
+	if removed, _, err = mvcc.GarbageCollectRange(testKey1, KeyMax, makeTS(4, 0), 0); err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 version removed; got %d", removed)
+	}
+	kvs, err = mvcc.engine.Scan(encoding.EncodeBinary(nil, testKey1), PrefixEndKey(encoding.EncodeBinary(nil, testKey1)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 0 {
+		t.Errorf("expected deleted key %q to be removed; got %d entries", testKey1, len(kvs))
+	}
+}
+
+func TestMVCCRangeChecksum(t *testing.T) {
+	populate := func(mvcc *MVCC) {
+		if _, err := mvcc.Put(testKey1, makeTS(1, 0), value1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mvcc.Put(testKey2, makeTS(1, 0), value2, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mvcc.Put(testKey1, makeTS(2, 0), value3, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checksum := func(mvcc *MVCC, key, endKey Key, ts proto.Timestamp) []byte {
+		sum, err := mvcc.RangeChecksum(key, endKey, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	a, b := createTestMVCC(t), createTestMVCC(t)
+	populate(a)
+	populate(b)
+	sum1 := checksum(a, KeyMin, KeyMax, makeTS(1, 0))
+	sum2 := checksum(a, KeyMin, KeyMax, makeTS(2, 0))
+	if !bytes.Equal(sum1, checksum(b, KeyMin, KeyMax, makeTS(1, 0))) ||
+		!bytes.Equal(sum2, checksum(b, KeyMin, KeyMax, makeTS(2, 0))) {
+		t.Fatal("expected replicas with the same writes to have the same checksums")
+	}
+	if bytes.Equal(sum1, sum2) {
+		t.Error("expected checksums at different timestamps to differ")
+	}
+	if bytes.Equal(sum2, checksum(a, KeyMin, testKey2, makeTS(2, 0))) {
+		t.Error("expected checksum of a subrange to differ")
+	}
+	if !bytes.Equal(checksum(a, testKey3, KeyMax, makeTS(2, 0)), checksum(a, testKey4, KeyMax, makeTS(2, 0))) {
+		t.Error("expected checksums of empty ranges to be equal")
+	}
+
+	// Writes above the timestamp don't affect the checksum.
+	if _, err := b.Put(testKey3, makeTS(3, 0), value3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Delete(testKey2, makeTS(3, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sum2, checksum(b, KeyMin, KeyMax, makeTS(2, 0))) {
+		t.Error("expected writes above the timestamp not to affect the checksum")
+	}
+	if bytes.Equal(sum2, checksum(b, KeyMin, KeyMax, makeTS(3, 0))) {
+		t.Error("expected writes at the timestamp to affect the checksum")
+	}
+
+	// Divergent values, and intents vs. committed values, are detected.
+	c, d := createTestMVCC(t), createTestMVCC(t)
+	populate(c)
+	populate(d)
+	if _, err := c.Put(testKey3, makeTS(3, 0), value1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Put(testKey3, makeTS(3, 0), value1, txn1); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(checksum(c, KeyMin, KeyMax, makeTS(3, 0)), checksum(d, KeyMin, KeyMax, makeTS(3, 0))) {
+		t.Error("expected an intent to change the checksum")
+	}
+	if _, err := b.Put(testKey3, makeTS(4, 0), value2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(testKey3, makeTS(4, 0), value4, nil); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(checksum(b, testKey3, KeyMax, makeTS(4, 0)), checksum(c, testKey3, KeyMax, makeTS(4, 0))) {
+		t.Error("expected divergent values to change the checksum")
+	}
+}
+
 func TestFindSplitKey(t *testing.T) {
 	mvcc := createTestMVCC(t)
 	// Generate a reservoir worth of KeyValues, each containing targetLength
@@ -885,7 +3032,7 @@ func TestFindSplitKey(t *testing.T) {
 		v := strings.Repeat("X", 10-len(k))
 		val := proto.Value{Bytes: []byte(v)}
 		// Write the key and value through MVCC.
-		if err := mvcc.Put([]byte(k), makeTS(0, 0), val, nil); err != nil {
+		if _, err := mvcc.Put([]byte(k), makeTS(0, 0), val, nil); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -899,3 +3046,37 @@ func TestFindSplitKey(t *testing.T) {
 		t.Fatalf("wanted key #%d+-1, but got %d (diff %d)", ind+diff, ind, diff)
 	}
 }
+
+// TestFindSplitKeyWithStats verifies that the stats returned with the
+// split key match those accumulated from the writes to the range.
+func TestFindSplitKeyWithStats(t *testing.T) {
+	mvcc := createTestMVCC(t)
+	if _, ms, err := mvcc.FindSplitKeyWithStats(KeyMin, KeyMax, ""); err == nil || ms != (MVCCStats{}) {
+		t.Errorf("expected error and empty stats for empty range; got %+v, %v", ms, err)
+	}
+
+	var expMS MVCCStats
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		for j := 1; j <= i%3+1; j++ {
+			ms, err := mvcc.Put(k, makeTS(int64(j), 0), value1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expMS.Add(ms)
+		}
+	}
+	splitKey, ms, err := mvcc.FindSplitKeyWithStats(KeyMin, KeyMax, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms != expMS {
+		t.Errorf("expected stats %+v; got %+v", expMS, ms)
+	}
+	if ms.KeyCount != 10 || ms.ValCount != 19 {
+		t.Errorf("expected 10 keys and 19 versions; got %+v", ms)
+	}
+	if humanSplitKey, err := mvcc.FindSplitKey(KeyMin, KeyMax, ""); err != nil || !bytes.Equal(humanSplitKey, splitKey) {
+		t.Errorf("expected split key %q; got %q, %v", splitKey, humanSplitKey, err)
+	}
+}
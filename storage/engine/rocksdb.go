@@ -34,6 +34,8 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"syscall"
 	"unsafe"
@@ -65,15 +67,20 @@ type RocksDB struct {
 
 	attrs      proto.Attributes // Attributes for this engine
 	dir        string           // The data directory
+	maxSize    int64            // Capacity cap in bytes; 0 for the whole disk
 	gcTimeouts func() (minTxnTS, minRCacheTS int64)
 }
 
-// NewRocksDB allocates and returns a new RocksDB object.
-func NewRocksDB(attrs proto.Attributes, dir string) *RocksDB {
+// NewRocksDB allocates and returns a new RocksDB object. If maxSize
+// is non-zero, the reported capacity of the store is capped at
+// maxSize bytes, e.g. so that a store does not fill a disk shared
+// with other applications.
+func NewRocksDB(attrs proto.Attributes, dir string, maxSize int64) *RocksDB {
 	return &RocksDB{
 		snapshots: map[string]*C.rocksdb_snapshot_t{},
 		attrs:     attrs,
 		dir:       dir,
+		maxSize:   maxSize,
 	}
 }
 
@@ -487,7 +494,11 @@ func (r *RocksDB) WriteBatch(cmds []interface{}) error {
 }
 
 // Capacity queries the underlying file system for disk capacity
-// information.
+// information. The bytes used are the size of the files in the data
+// directory. If the store has a maximum size below the disk's
+// capacity, the capacity is the maximum size and the available space
+// is the lesser of the disk's free space and the maximum size less
+// the bytes used.
 func (r *RocksDB) Capacity() (StoreCapacity, error) {
 	var fs syscall.Statfs_t
 	var capacity StoreCapacity
@@ -496,6 +507,27 @@ func (r *RocksDB) Capacity() (StoreCapacity, error) {
 	}
 	capacity.Capacity = int64(fs.Bsize) * int64(fs.Blocks)
 	capacity.Available = int64(fs.Bsize) * int64(fs.Bavail)
+	if err := filepath.Walk(r.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			capacity.Used += info.Size()
+		}
+		return nil
+	}); err != nil {
+		return capacity, err
+	}
+	if r.maxSize == 0 || r.maxSize >= capacity.Capacity {
+		return capacity, nil
+	}
+	capacity.Capacity = r.maxSize
+	if avail := r.maxSize - capacity.Used; avail < capacity.Available {
+		capacity.Available = avail
+	}
+	if capacity.Available < 0 {
+		capacity.Available = 0
+	}
 	return capacity, nil
 }
 
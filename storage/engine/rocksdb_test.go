@@ -63,7 +63,7 @@ func encodeTransaction(timestamp proto.Timestamp, t *testing.T) []byte {
 func TestRocksDBCompaction(t *testing.T) {
 	gob.Register(proto.Timestamp{})
 	loc := util.CreateTempDirectory()
-	rocksdb := NewRocksDB(proto.Attributes{Attrs: []string{"ssd"}}, loc)
+	rocksdb := NewRocksDB(proto.Attributes{Attrs: []string{"ssd"}}, loc, 0)
 	rocksdb.SetGCTimeouts(func() (minTxnTS, minRCacheTS int64) {
 		minTxnTS = 1
 		minRCacheTS = 2
@@ -115,3 +115,32 @@ func TestRocksDBCompaction(t *testing.T) {
 		t.Errorf("expected keys %s, got keys %s", expKeys, keys)
 	}
 }
+
+// TestRocksDBCapacityMaxSize verifies that the capacity of a RocksDB
+// engine is capped at its maximum size, with the files in its data
+// directory counted against the available space.
+func TestRocksDBCapacityMaxSize(t *testing.T) {
+	loc := util.CreateTempDirectory()
+	const maxSize = 1 << 30
+	rocksdb := NewRocksDB(proto.Attributes{Attrs: []string{"ssd"}}, loc, maxSize)
+	if err := rocksdb.Start(); err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	defer func(t *testing.T) {
+		rocksdb.Stop()
+		if err := rocksdb.Destroy(); err != nil {
+			t.Errorf("could not delete rocksdb db at %s: %v", loc, err)
+		}
+	}(t)
+
+	capacity, err := rocksdb.Capacity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity.Capacity != maxSize {
+		t.Errorf("expected capacity %d; got %d", maxSize, capacity.Capacity)
+	}
+	if capacity.Available >= maxSize || capacity.Available <= 0 {
+		t.Errorf("expected available space below capacity %d; got %d", maxSize, capacity.Available)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package engine
+
+import (
+	"sort"
+	"sync"
+
+	gogoproto "code.google.com/p/gogoprotobuf/proto"
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// maxTxnBufferEntries is the maximum number of writes held in a
+// txnBuffer across all transactions. Once it is reached, writes to
+// further keys are no longer buffered and are read from the engine.
+const maxTxnBufferEntries = 10000
+
+// A txnBufferEntry is the most recent value written to a key by a
+// transaction, along with the epoch and timestamp of the write.
+type txnBufferEntry struct {
+	epoch     int32
+	timestamp proto.Timestamp
+	value     *proto.MVCCValue
+}
+
+// A txnBuffer holds the values written by each ongoing transaction,
+// keyed by transaction ID and then by encoded key. Writes are still
+// made to the engine as intents; the buffer allows a transaction to
+// read its own writes without an engine roundtrip. An entry is
+// removed when its intent is resolved and a transaction's entries
+// are discarded altogether when the transaction ends.
+type txnBuffer struct {
+	sync.Mutex
+	txns map[string]map[string]txnBufferEntry
+	size int // Number of entries across all transactions
+}
+
+func newTxnBuffer() *txnBuffer {
+	return &txnBuffer{
+		txns: map[string]map[string]txnBufferEntry{},
+	}
+}
+
+// put records value as the latest write by txn to the encoded key.
+// If the buffer is full and txn has no write buffered for the key,
+// the write is not recorded.
+func (b *txnBuffer) put(txn *proto.Transaction, key Key, timestamp proto.Timestamp, value *proto.MVCCValue) {
+	b.Lock()
+	defer b.Unlock()
+	entries, ok := b.txns[string(txn.ID)]
+	if _, exists := entries[string(key)]; !exists {
+		if b.size >= maxTxnBufferEntries {
+			return
+		}
+		b.size++
+	}
+	if !ok {
+		entries = map[string]txnBufferEntry{}
+		b.txns[string(txn.ID)] = entries
+	}
+	entries[string(key)] = txnBufferEntry{
+		epoch:     txn.Epoch,
+		timestamp: timestamp,
+		value:     gogoproto.Clone(value).(*proto.MVCCValue),
+	}
+}
+
+// get returns the value written by txn to the encoded key if one is
+// buffered for txn's current epoch and is visible at the read
+// timestamp. Returns false otherwise, in which case the caller must
+// read from the engine. The returned value, if not nil, is a copy
+// with its timestamp set; it is nil if the write was a deletion or
+// has expired at now.
+func (b *txnBuffer) get(txn *proto.Transaction, key Key, timestamp, now proto.Timestamp) (*proto.Value, bool) {
+	b.Lock()
+	defer b.Unlock()
+	entry, ok := b.txns[string(txn.ID)][string(key)]
+	if !ok {
+		return nil, false
+	}
+	return entry.read(txn, timestamp, now)
+}
+
+// A bufferedWrite is a write returned by txnBuffer.scan.
+type bufferedWrite struct {
+	key   Key          // Encoded key
+	value *proto.Value // Nil if the write was a deletion or has expired
+}
+
+type bufferedWrites []bufferedWrite
+
+func (bw bufferedWrites) Len() int           { return len(bw) }
+func (bw bufferedWrites) Swap(i, j int)      { bw[i], bw[j] = bw[j], bw[i] }
+func (bw bufferedWrites) Less(i, j int) bool { return bw[i].key.Less(bw[j].key) }
+
+// scan returns the writes by txn to the encoded keys from key up to
+// (but not including) endKey which get would return, sorted by key.
+func (b *txnBuffer) scan(txn *proto.Transaction, key, endKey Key, timestamp, now proto.Timestamp) []bufferedWrite {
+	b.Lock()
+	defer b.Unlock()
+	var writes bufferedWrites
+	for k, entry := range b.txns[string(txn.ID)] {
+		if k < string(key) || k >= string(endKey) {
+			continue
+		}
+		if value, ok := entry.read(txn, timestamp, now); ok {
+			writes = append(writes, bufferedWrite{key: Key(k), value: value})
+		}
+	}
+	sort.Sort(writes)
+	return writes
+}
+
+// read returns the entry's value as seen by txn reading at timestamp,
+// or false if the entry was written at a different epoch or isn't
+// visible at timestamp.
+func (e txnBufferEntry) read(txn *proto.Transaction, timestamp, now proto.Timestamp) (*proto.Value, bool) {
+	if e.epoch != txn.Epoch || timestamp.Less(e.timestamp) {
+		return nil, false
+	}
+	if e.value.Value == nil || expired(e.value, now) {
+		return nil, true
+	}
+	value := gogoproto.Clone(e.value.Value).(*proto.Value)
+	ts := e.timestamp
+	value.Timestamp = &ts
+	return value, true
+}
+
+// remove removes the write by txn to the encoded key, if any.
+func (b *txnBuffer) remove(txn *proto.Transaction, key Key) {
+	b.Lock()
+	defer b.Unlock()
+	entries, ok := b.txns[string(txn.ID)]
+	if !ok {
+		return
+	}
+	if _, ok := entries[string(key)]; ok {
+		b.size--
+	}
+	delete(entries, string(key))
+	if len(entries) == 0 {
+		delete(b.txns, string(txn.ID))
+	}
+}
+
+// discard removes all writes buffered for txn.
+func (b *txnBuffer) discard(txn *proto.Transaction) {
+	b.Lock()
+	defer b.Unlock()
+	b.size -= len(b.txns[string(txn.ID)])
+	delete(b.txns, string(txn.ID))
+}
@@ -179,7 +179,8 @@ func (p PrefixConfigMap) MatchesByPrefix(key engine.Key) []*PrefixConfig {
 }
 
 // VisitPrefixes invokes the visitor function for each prefix overlapped
-// by the specified key range [start, end).
+// by the specified key range [start, end). If the visitor returns an
+// error, iteration stops and the error is returned.
 func (p PrefixConfigMap) VisitPrefixes(start, end engine.Key,
 	visitor func(start, end engine.Key, config interface{}) error) error {
 	comp := bytes.Compare(start, end)
@@ -197,7 +198,7 @@ func (p PrefixConfigMap) VisitPrefixes(start, end engine.Key,
 		})
 	}
 
-	if startIdx > len(p) || endIdx > len(p) {
+	if startIdx == 0 {
 		return util.Errorf("start and/or end keys (%q, %q) fall outside prefix range; "+
 			"startIdx: %d, endIdx: %d, len(p): %d", start, end, startIdx, endIdx, len(p))
 	}
@@ -206,7 +207,9 @@ func (p PrefixConfigMap) VisitPrefixes(start, end engine.Key,
 		return visitor(start, end, p[startIdx-1].Config)
 	}
 	for i := startIdx; i < endIdx; i++ {
-		visitor(start, p[i].Prefix, p[i-1].Config)
+		if err := visitor(start, p[i].Prefix, p[i-1].Config); err != nil {
+			return err
+		}
 		if bytes.Equal(p[i].Prefix, end) {
 			return nil
 		}
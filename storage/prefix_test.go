@@ -23,6 +23,7 @@ import (
 	"testing"
 
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
@@ -286,3 +287,28 @@ func TestSplitRangeByPrefixes(t *testing.T) {
 		}
 	}
 }
+
+// TestVisitPrefixesError verifies that visitor errors are returned
+// and stop iteration, and that keys outside the prefix range are
+// rejected.
+func TestVisitPrefixesError(t *testing.T) {
+	pcc := buildTestPrefixConfigMap()
+	var visited int
+	err := pcc.VisitPrefixes(engine.KeyMin, engine.KeyMax, func(start, end engine.Key, config interface{}) error {
+		visited++
+		if config == config2 {
+			return util.Errorf("config2")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Error("expected visitor error to be returned")
+	}
+	if visited != 2 {
+		t.Errorf("expected iteration to stop after 2 visits; got %d", visited)
+	}
+	if err := (PrefixConfigMap{}).VisitPrefixes(engine.Key("a"), engine.Key("b"),
+		func(start, end engine.Key, config interface{}) error { return nil }); err == nil {
+		t.Error("expected error visiting prefixes of empty config map")
+	}
+}
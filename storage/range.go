@@ -49,6 +49,11 @@ func init() {
 	gob.Register(proto.Transaction{})
 }
 
+// EnableTxnBuffers causes new ranges to buffer the writes of ongoing
+// transactions in memory, so that transactions read their own writes
+// without an engine roundtrip. See engine.MVCC.EnableTxnBuffer.
+var EnableTxnBuffers bool
+
 // ttlClusterIDGossip is time-to-live for cluster ID. The cluster ID
 // serves as the sentinel gossip key which informs a node whether or
 // not it's connected to the primary gossip network and not just a
@@ -57,6 +62,15 @@ func init() {
 // the first range gossips it.
 const ttlClusterIDGossip = 30 * time.Second
 
+// The range leader closes timestamps every closedTimestampInterval,
+// each time promising to accept no more writes at or below a
+// timestamp trailing its clock by closedTimestampLag. Replicas serve
+// historical reads at or below the closed timestamp.
+const (
+	closedTimestampInterval = 1 * time.Second
+	closedTimestampLag      = 5 * time.Second
+)
+
 // configPrefixes describes administrative configuration maps
 // affecting ranges of the key-value map by key prefix.
 var configPrefixes = []struct {
@@ -72,24 +86,27 @@ var configPrefixes = []struct {
 
 // The following are the method names supported by the KV API.
 const (
-	Contains              = "Contains"
-	Get                   = "Get"
-	Put                   = "Put"
-	ConditionalPut        = "ConditionalPut"
-	Increment             = "Increment"
-	Scan                  = "Scan"
-	Delete                = "Delete"
-	DeleteRange           = "DeleteRange"
-	BeginTransaction      = "BeginTransaction"
-	EndTransaction        = "EndTransaction"
-	AccumulateTS          = "AccumulateTS"
-	ReapQueue             = "ReapQueue"
-	EnqueueUpdate         = "EnqueueUpdate"
-	EnqueueMessage        = "EnqueueMessage"
-	InternalRangeLookup   = "InternalRangeLookup"
-	InternalHeartbeatTxn  = "InternalHeartbeatTxn"
-	InternalResolveIntent = "InternalResolveIntent"
-	InternalSnapshotCopy  = "InternalSnapshotCopy"
+	Contains               = "Contains"
+	Get                    = "Get"
+	Put                    = "Put"
+	ConditionalPut         = "ConditionalPut"
+	Increment              = "Increment"
+	Scan                   = "Scan"
+	Count                  = "Count"
+	Delete                 = "Delete"
+	DeleteRange            = "DeleteRange"
+	BeginTransaction       = "BeginTransaction"
+	EndTransaction         = "EndTransaction"
+	AccumulateTS           = "AccumulateTS"
+	ReapQueue              = "ReapQueue"
+	EnqueueUpdate          = "EnqueueUpdate"
+	EnqueueMessage         = "EnqueueMessage"
+	InternalRangeLookup    = "InternalRangeLookup"
+	InternalHeartbeatTxn   = "InternalHeartbeatTxn"
+	InternalResolveIntent  = "InternalResolveIntent"
+	InternalCloseTimestamp = "InternalCloseTimestamp"
+	InternalSnapshotCopy   = "InternalSnapshotCopy"
+	AdminSplit             = "AdminSplit"
 )
 
 // readMethods specifies the set of methods which read and return data.
@@ -99,6 +116,7 @@ var readMethods = map[string]struct{}{
 	ConditionalPut:       struct{}{},
 	Increment:            struct{}{},
 	Scan:                 struct{}{},
+	Count:                struct{}{},
 	ReapQueue:            struct{}{},
 	InternalRangeLookup:  struct{}{},
 	InternalSnapshotCopy: struct{}{},
@@ -106,18 +124,28 @@ var readMethods = map[string]struct{}{
 
 // writeMethods specifies the set of methods which write data.
 var writeMethods = map[string]struct{}{
-	Put:                   struct{}{},
-	ConditionalPut:        struct{}{},
-	Increment:             struct{}{},
-	Delete:                struct{}{},
-	DeleteRange:           struct{}{},
-	EndTransaction:        struct{}{},
-	AccumulateTS:          struct{}{},
-	ReapQueue:             struct{}{},
-	EnqueueUpdate:         struct{}{},
-	EnqueueMessage:        struct{}{},
-	InternalHeartbeatTxn:  struct{}{},
-	InternalResolveIntent: struct{}{},
+	Put:                    struct{}{},
+	ConditionalPut:         struct{}{},
+	Increment:              struct{}{},
+	Delete:                 struct{}{},
+	DeleteRange:            struct{}{},
+	EndTransaction:         struct{}{},
+	AccumulateTS:           struct{}{},
+	ReapQueue:              struct{}{},
+	EnqueueUpdate:          struct{}{},
+	EnqueueMessage:         struct{}{},
+	InternalHeartbeatTxn:   struct{}{},
+	InternalResolveIntent:  struct{}{},
+	InternalCloseTimestamp: struct{}{},
+	AdminSplit:             struct{}{},
+}
+
+// txnRecordMethods specifies the set of methods which operate on
+// transaction records instead of MVCC data. Their timestamps are
+// neither checked against nor added to the timestamp cache.
+var txnRecordMethods = map[string]struct{}{
+	EndTransaction:       struct{}{},
+	InternalHeartbeatTxn: struct{}{},
 }
 
 // NeedReadPerm returns true if the specified method requires read permissions.
@@ -160,13 +188,19 @@ type Range struct {
 	allocator *allocator     // Makes allocation decisions
 	gossip    *gossip.Gossip // Range may gossip based on contents
 	rm        RangeManager   // Makes some store methods available
+	clock     *hlc.Clock     // Closes timestamps while leader
 	raft      chan *Cmd      // Raft commands
 	closer    chan struct{}  // Channel for closing the range
 
-	sync.RWMutex                 // Protects readQ, tsCache & respCache.
+	sync.RWMutex                 // Protects readQ, tsCache, respCache, closed & closing.
 	readQ        *ReadQueue      // Reads queued behind pending writes
 	tsCache      *TimestampCache // Most recent timestamps for keys / key ranges
 	respCache    *ResponseCache  // Provides idempotence for retries
+	closed       proto.Timestamp // Closed timestamp applied via Raft
+	closing      proto.Timestamp // Closed timestamp promised as leader
+
+	statsMu sync.Mutex       // Protects stats
+	stats   engine.MVCCStats // Running totals of MVCC stats deltas
 }
 
 // NewRange initializes the range using the given metadata. The range will have
@@ -183,14 +217,31 @@ func NewRange(meta *proto.RangeMetadata, clock *hlc.Clock, eng engine.Engine,
 		gossip:    gossip,
 		raft:      make(chan *Cmd, 10), // TODO(spencer): remove
 		rm:        rm,
+		clock:     clock,
 		closer:    make(chan struct{}),
 		readQ:     NewReadQueue(),
 		tsCache:   NewTimestampCache(clock),
 		respCache: NewResponseCache(meta.RangeID, eng),
 	}
+	if EnableTxnBuffers {
+		r.mvcc.EnableTxnBuffer()
+	}
+	// The closed timestamp is persisted, so that a restarted replica
+	// serves the same historical reads and, as leader, keeps the
+	// promises it made before the restart.
+	if _, err := engine.GetProto(eng, makeClosedTimestampKey(meta.RangeID), &r.closed); err != nil {
+		log.Errorf("unable to read closed timestamp of range %d: %v", meta.RangeID, err)
+	}
+	r.closing = r.closed
 	return r
 }
 
+// makeClosedTimestampKey returns the key under which the closed
+// timestamp of the range with the given ID is stored.
+func makeClosedTimestampKey(rangeID int64) engine.Key {
+	return engine.MakeKey(engine.KeyLocalRangeClosedTimestampPrefix, engine.Key(strconv.FormatInt(rangeID, 10)))
+}
+
 // Start begins gossiping and starts the raft command processing
 // loop in a goroutine.
 func (r *Range) Start() {
@@ -198,6 +249,7 @@ func (r *Range) Start() {
 	r.maybeGossipFirstRange()
 	r.maybeGossipConfigs()
 	go r.processRaft() // TODO(spencer): remove
+	go r.startClosingTimestamps()
 	// Only start gossiping if this range is the first range.
 	if r.IsFirstRange() {
 		go r.startGossip()
@@ -243,7 +295,7 @@ func (r *Range) EnqueueCmd(cmd *Cmd) error {
 func (r *Range) ReadOnlyCmd(method string, args proto.Request, reply proto.Response) error {
 	header := args.Header()
 	r.Lock()
-	r.tsCache.Add(header.Key, header.EndKey, header.Timestamp)
+	r.recordRead(header)
 	var wg sync.WaitGroup
 	r.readQ.AddRead(header.Key, header.EndKey, &wg)
 	r.Unlock()
@@ -264,13 +316,36 @@ func (r *Range) ReadOnlyCmd(method string, args proto.Request, reply proto.Respo
 	// timestamps. This is because the read-timestamp-cache prevents it
 	// for the active leader and leadership changes force the
 	// read-timestamp-cache to reset its high water mark.
-	if !r.IsLeader() {
+	//
+	// Historical reads at or below the closed timestamp are exempt, as
+	// no more writes beneath it will be accepted; otherwise, they too
+	// must be served by the leader.
+	if !r.IsLeader() && !r.canServeHistorical(header) {
 		// TODO(spencer): when we happen to know the leader, fill it in here via replica.
 		return &proto.NotLeaderError{}
 	}
 	return r.executeCmd(method, args, reply)
 }
 
+// canServeHistorical returns whether the read with the given header
+// is a historical read at or below the closed timestamp, which this
+// replica may serve whether or not it's the leader.
+func (r *Range) canServeHistorical(header *proto.RequestHeader) bool {
+	return header.Historical && header.Txn == nil &&
+		!r.ClosedTimestamp().Less(header.Timestamp)
+}
+
+// recordRead registers the key span read by a command at the
+// command's timestamp in the timestamp cache. MVCC does not track
+// reads, so every read served by the range must be recorded here
+// before it executes; a subsequent write to any key in the span then
+// finds the read via GetMax and is pushed past it. For a scan, the
+// whole requested span is recorded, even if fewer keys are returned.
+// Requires r.Lock.
+func (r *Range) recordRead(header *proto.RequestHeader) {
+	r.tsCache.Add(header.Key, header.EndKey, header.Timestamp)
+}
+
 // ReadWriteCmd first consults the response cache to determine whether
 // this command has already been sent to the range. If a response is
 // found, it's returned immediately and not submitted to raft. Next,
@@ -304,18 +379,26 @@ func (r *Range) ReadWriteCmd(method string, args proto.Request, reply proto.Resp
 	// returns, the updated timestamp will inform the final commit
 	// timestamp.
 	r.Lock() // Protect access to timestamp cache and read queue.
-	if ts := r.tsCache.GetMax(header.Key, header.EndKey); header.Timestamp.Less(ts) {
-		if glog.V(1) {
-			glog.Infof("Overriding existing timestamp %s with %s", header.Timestamp, ts)
+	if _, ok := txnRecordMethods[method]; !ok {
+		// Writes at or below the closed timestamp are moved past it;
+		// historical reads may already have been served there.
+		if !r.closing.Less(header.Timestamp) {
+			header.Timestamp = r.closing
+			header.Timestamp.Logical++
 		}
-		ts.Logical++ // increment logical component by one to differentiate.
-		// Update the request timestamp.
-		header.Timestamp = ts
+		if ts := r.tsCache.GetMax(header.Key, header.EndKey); header.Timestamp.Less(ts) {
+			if glog.V(1) {
+				glog.Infof("Overriding existing timestamp %s with %s", header.Timestamp, ts)
+			}
+			ts.Logical++ // increment logical component by one to differentiate.
+			// Update the request timestamp.
+			header.Timestamp = ts
+		}
+		// Just as for reads, we update the timestamp cache with the
+		// timestamp of this write. This ensures a strictly higher timestamp
+		// for successive writes to the same key or key range.
+		r.tsCache.Add(header.Key, header.EndKey, header.Timestamp)
 	}
-	// Just as for reads, we update the timestamp cache with the
-	// timestamp of this write. This ensures a strictly higher timestamp
-	// for successive writes to the same key or key range.
-	r.tsCache.Add(header.Key, header.EndKey, header.Timestamp)
 
 	// The next step is to add the write to the read queue to inform
 	// subsequent reads that there is a pending write. Reads which
@@ -390,6 +473,51 @@ func (r *Range) startGossip() {
 	}
 }
 
+// startClosingTimestamps periodically closes a timestamp trailing the
+// clock by closedTimestampLag while this replica is the raft leader.
+func (r *Range) startClosingTimestamps() {
+	ticker := time.NewTicker(closedTimestampInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if r.IsLeader() {
+				ts := r.clock.Now()
+				ts.WallTime -= closedTimestampLag.Nanoseconds()
+				if err := r.closeTimestamp(ts); err != nil {
+					log.Errorf("unable to close timestamp %s: %v", ts, err)
+				}
+			}
+		case <-r.closer:
+			return
+		}
+	}
+}
+
+// closeTimestamp promises, as leader, to accept no more writes at or
+// below ts and publishes ts as the closed timestamp via Raft. Writes
+// accepted before the promise may still be beneath ts, so the closed
+// timestamp is only proposed once they have completed.
+func (r *Range) closeTimestamp(ts proto.Timestamp) error {
+	r.Lock()
+	if !r.closing.Less(ts) {
+		r.Unlock()
+		return nil
+	}
+	r.closing = ts
+	var wg sync.WaitGroup
+	r.readQ.AddRead(engine.KeyMin, engine.KeyMax, &wg)
+	r.Unlock()
+	wg.Wait()
+
+	return r.EnqueueCmd(&Cmd{
+		Method: InternalCloseTimestamp,
+		Args:   &proto.InternalCloseTimestampRequest{RequestHeader: proto.RequestHeader{Timestamp: ts}},
+		Reply:  &proto.InternalCloseTimestampResponse{},
+		done:   make(chan error, 1),
+	})
+}
+
 // maybeGossipClusterID gossips the cluster ID if this range is
 // the start of the key space and the raft leader.
 func (r *Range) maybeGossipClusterID() {
@@ -477,6 +605,8 @@ func (r *Range) executeCmd(method string, args proto.Request, reply proto.Respon
 		r.DeleteRange(args.(*proto.DeleteRangeRequest), reply.(*proto.DeleteRangeResponse))
 	case Scan:
 		r.Scan(args.(*proto.ScanRequest), reply.(*proto.ScanResponse))
+	case Count:
+		r.Count(args.(*proto.CountRequest), reply.(*proto.CountResponse))
 	case EndTransaction:
 		r.EndTransaction(args.(*proto.EndTransactionRequest), reply.(*proto.EndTransactionResponse))
 	case AccumulateTS:
@@ -493,8 +623,12 @@ func (r *Range) executeCmd(method string, args proto.Request, reply proto.Respon
 		r.InternalHeartbeatTxn(args.(*proto.InternalHeartbeatTxnRequest), reply.(*proto.InternalHeartbeatTxnResponse))
 	case InternalResolveIntent:
 		r.InternalResolveIntent(args.(*proto.InternalResolveIntentRequest), reply.(*proto.InternalResolveIntentResponse))
+	case InternalCloseTimestamp:
+		r.InternalCloseTimestamp(args.(*proto.InternalCloseTimestampRequest), reply.(*proto.InternalCloseTimestampResponse))
 	case InternalSnapshotCopy:
 		r.InternalSnapshotCopy(args.(*proto.InternalSnapshotCopyRequest), reply.(*proto.InternalSnapshotCopyResponse))
+	case AdminSplit:
+		r.AdminSplit(args.(*proto.AdminSplitRequest), reply.(*proto.AdminSplitResponse))
 	default:
 		return util.Errorf("unrecognized command type: %s", method)
 	}
@@ -502,6 +636,12 @@ func (r *Range) executeCmd(method string, args proto.Request, reply proto.Respon
 	// Propagate the request timestamp (which may have changed).
 	reply.Header().Timestamp = args.Header().Timestamp
 
+	// Reads report the closed timestamp, bounding the staleness of the
+	// data read.
+	if IsReadOnly(method) {
+		reply.Header().ClosedTimestamp = r.ClosedTimestamp()
+	}
+
 	// Add this command's result to the response cache if this is a
 	// read/write method. This must be done as part of the execution of
 	// raft commands so that every replica maintains the same responses
@@ -536,10 +676,36 @@ func (r *Range) Get(args *proto.GetRequest, reply *proto.GetResponse) {
 	reply.SetGoError(err)
 }
 
+// Stats returns the running totals of the MVCC stats deltas reported
+// by writes to this range since it was initialized.
+func (r *Range) Stats() engine.MVCCStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
+// addStats adds the MVCC stats delta ms to the range's running totals.
+func (r *Range) addStats(ms engine.MVCCStats) {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	r.stats.Add(ms)
+}
+
+// ClosedTimestamp returns the closed timestamp applied to this
+// replica: all writes at or below it have been applied, and the
+// leader accepts no more. It's the zero timestamp if no timestamp
+// has yet been closed.
+func (r *Range) ClosedTimestamp() proto.Timestamp {
+	r.RLock()
+	defer r.RUnlock()
+	return r.closed
+}
+
 // Put sets the value for a specified key.
 func (r *Range) Put(args *proto.PutRequest, reply *proto.PutResponse) {
-	err := r.mvcc.Put(args.Key, args.Timestamp, args.Value, args.Txn)
+	ms, err := r.mvcc.Put(args.Key, args.Timestamp, args.Value, args.Txn)
 	if err == nil {
+		r.addStats(ms)
 		r.updateGossipConfigs(args.Key)
 	}
 	reply.SetGoError(err)
@@ -549,8 +715,9 @@ func (r *Range) Put(args *proto.PutRequest, reply *proto.PutResponse) {
 // the expected value matches. If not, the return value contains
 // the actual value.
 func (r *Range) ConditionalPut(args *proto.ConditionalPutRequest, reply *proto.ConditionalPutResponse) {
-	val, err := r.mvcc.ConditionalPut(args.Key, args.Timestamp, args.Value, args.ExpValue, args.Txn)
+	val, ms, err := r.mvcc.ConditionalPut(args.Key, args.Timestamp, args.Value, args.ExpValue, args.Txn)
 	if err == nil {
+		r.addStats(ms)
 		r.updateGossipConfigs(args.Key)
 	}
 	reply.ActualValue = val
@@ -573,30 +740,82 @@ func (r *Range) updateGossipConfigs(key engine.Key) {
 // returns the newly incremented value (encoded as varint64). If no value
 // exists for the key, zero is incremented.
 func (r *Range) Increment(args *proto.IncrementRequest, reply *proto.IncrementResponse) {
-	val, err := r.mvcc.Increment(args.Key, args.Timestamp, args.Txn, args.Increment)
+	val, ms, err := r.mvcc.IncrementWithID(args.Key, args.Timestamp, args.Txn, args.Increment, args.ID)
+	if err == nil {
+		r.addStats(ms)
+	}
 	reply.NewValue = val
 	reply.SetGoError(err)
 }
 
 // Delete deletes the key and value specified by key.
 func (r *Range) Delete(args *proto.DeleteRequest, reply *proto.DeleteResponse) {
-	reply.SetGoError(r.mvcc.Delete(args.Key, args.Timestamp, args.Txn))
+	ms, err := r.mvcc.Delete(args.Key, args.Timestamp, args.Txn)
+	if err == nil {
+		r.addStats(ms)
+	}
+	reply.SetGoError(err)
 }
 
 // DeleteRange deletes the range of key/value pairs specified by
 // start and end keys.
 func (r *Range) DeleteRange(args *proto.DeleteRangeRequest, reply *proto.DeleteRangeResponse) {
-	num, err := r.mvcc.DeleteRange(args.Key, args.EndKey, args.MaxEntriesToDelete, args.Timestamp, args.Txn)
+	num, ms, err := r.mvcc.DeleteRange(args.Key, args.EndKey, args.MaxEntriesToDelete, args.Timestamp, args.Txn)
+	if err == nil {
+		r.addStats(ms)
+	}
 	reply.NumDeleted = num
 	reply.SetGoError(err)
 }
 
 // Scan scans the key range specified by start key through end key up
-// to some maximum number of results. The last key of the iteration is
-// returned with the reply.
+// to some maximum number of results and, optionally, bytes. If the
+// byte limit ends the scan early, the key at which to resume is
+// returned with the reply. With StopAtIntent, a write intent ends
+// the scan instead of failing it (see MVCC.ScanStopAtIntent). A
+// reverse scan returns the rows in descending key order.
 func (r *Range) Scan(args *proto.ScanRequest, reply *proto.ScanResponse) {
-	kvs, err := r.mvcc.Scan(args.Key, args.EndKey, args.MaxResults, args.Timestamp, args.Txn)
+	if args.Reverse {
+		if args.MaxBytes > 0 {
+			reply.SetGoError(util.Errorf("reverse scans don't support MaxBytes"))
+			return
+		}
+		if args.StopAtIntent {
+			kvs, resumeKey, intentTxn, err := r.mvcc.ReverseScanStopAtIntent(args.Key, args.EndKey, args.MaxResults,
+				args.Timestamp, args.Txn)
+			reply.Rows = kvs
+			reply.ResumeKey = resumeKey
+			reply.IntentTxn = intentTxn
+			reply.SetGoError(err)
+			return
+		}
+		kvs, err := r.mvcc.ReverseScan(args.Key, args.EndKey, args.MaxResults, args.Timestamp, args.Txn)
+		reply.Rows = kvs
+		reply.SetGoError(err)
+		return
+	}
+	if args.StopAtIntent {
+		kvs, resumeKey, intentTxn, err := r.mvcc.ScanStopAtIntent(args.Key, args.EndKey, args.MaxResults,
+			args.MaxBytes, args.Timestamp, args.Txn)
+		reply.Rows = kvs
+		reply.ResumeKey = resumeKey
+		reply.IntentTxn = intentTxn
+		reply.SetGoError(err)
+		return
+	}
+	kvs, resumeKey, err := r.mvcc.ScanWithMaxBytes(args.Key, args.EndKey, args.MaxResults, args.MaxBytes,
+		args.Timestamp, args.Txn)
 	reply.Rows = kvs
+	reply.ResumeKey = resumeKey
+	reply.SetGoError(err)
+}
+
+// Count counts the keys with values in the key range specified by
+// start key through end key, up to args.MaxResults if non-zero.
+// Neither keys nor values are returned.
+func (r *Range) Count(args *proto.CountRequest, reply *proto.CountResponse) {
+	count, err := r.mvcc.Count(args.Key, args.EndKey, args.MaxResults, args.Timestamp, args.Txn)
+	reply.Count = count
 	reply.SetGoError(err)
 }
 
@@ -634,6 +853,18 @@ func (r *Range) EndTransaction(args *proto.EndTransactionRequest, reply *proto.E
 			// than the transaction timestamp.
 			reply.SetGoError(proto.NewTransactionStatusError(existTxn, fmt.Sprintf("timestamp regression: %+v", args.Txn.Timestamp)))
 			return
+		} else if args.Commit && isTxnExpired(existTxn, args.Timestamp) {
+			// The coordinator failed to heartbeat the transaction within
+			// the expiration window, so other transactions may already
+			// consider it abandoned. Abort the record instead.
+			existTxn.Status = proto.ABORTED
+			if err := engine.PutProto(r.engine, key, existTxn); err != nil {
+				reply.SetGoError(err)
+				return
+			}
+			r.mvcc.DiscardTxnBuffer(existTxn)
+			reply.SetGoError(proto.NewTransactionStatusError(existTxn, "expired"))
+			return
 		}
 		// Use the persisted transaction record as final transaction.
 		gogoproto.Merge(reply.Txn, existTxn)
@@ -665,6 +896,8 @@ func (r *Range) EndTransaction(args *proto.EndTransactionRequest, reply *proto.E
 		reply.SetGoError(err)
 		return
 	}
+	// The transaction has ended; its buffered writes are no longer needed.
+	r.mvcc.DiscardTxnBuffer(reply.Txn)
 }
 
 // AccumulateTS is used internally to aggregate statistics over key
@@ -720,7 +953,11 @@ func (r *Range) EnqueueMessage(args *proto.EnqueueMessageRequest, reply *proto.E
 // nodes can aggressively cache RangeDescriptors which are likely to be desired
 // by their current workload.
 func (r *Range) InternalRangeLookup(args *proto.InternalRangeLookupRequest, reply *proto.InternalRangeLookupResponse) {
-	if err := engine.ValidateRangeMetaKey(args.Key); err != nil {
+	// The last range's metadata is stored under the metadata key of
+	// KeyMax, which only a reverse lookup may request.
+	if err := engine.ValidateRangeMetaKey(args.Key); err != nil &&
+		!(args.Reverse && bytes.HasPrefix(args.Key, engine.KeyMetaPrefix) &&
+			bytes.Equal(args.Key[len(engine.KeyMeta1Prefix):], engine.KeyMax)) {
 		reply.SetGoError(err)
 		return
 	}
@@ -734,9 +971,13 @@ func (r *Range) InternalRangeLookup(args *proto.InternalRangeLookupRequest, repl
 
 	// We want to search for the metadata key just greater than args.Key.  Scan
 	// for both the requested key and the keys immediately afterwards, up to
-	// MaxRanges.
+	// MaxRanges. A reverse lookup includes args.Key itself, which is the
+	// metadata key of the range ending at the requested key.
 	metaPrefix := args.Key[:len(engine.KeyMeta1Prefix)]
 	nextKey := engine.NextKey(args.Key)
+	if args.Reverse {
+		nextKey = args.Key
+	}
 	kvs, err := r.mvcc.Scan(nextKey, engine.PrefixEndKey(metaPrefix), rangeCount, args.Timestamp, args.Txn)
 	if err != nil {
 		reply.SetGoError(err)
@@ -787,11 +1028,20 @@ func (r *Range) InternalHeartbeatTxn(args *proto.InternalHeartbeatTxnRequest, re
 		gogoproto.Merge(&txn, args.Txn)
 	}
 	if txn.Status == proto.PENDING {
-		if txn.LastHeartbeat == nil {
-			txn.LastHeartbeat = &proto.Timestamp{}
-		}
-		if txn.LastHeartbeat.Less(args.Header().Timestamp) {
-			*txn.LastHeartbeat = args.Header().Timestamp
+		// If the coordinator has been silent for longer than the
+		// expiration window, it's presumed to have failed; abort the
+		// transaction so the heartbeating coordinator (if any) resolves
+		// its intents rather than continuing on.
+		if ok && isTxnExpired(&txn, args.Header().Timestamp) {
+			txn.Status = proto.ABORTED
+			r.mvcc.DiscardTxnBuffer(&txn)
+		} else {
+			if txn.LastHeartbeat == nil {
+				txn.LastHeartbeat = &proto.Timestamp{}
+			}
+			if txn.LastHeartbeat.Less(args.Header().Timestamp) {
+				*txn.LastHeartbeat = args.Header().Timestamp
+			}
 		}
 		if err := engine.PutProto(r.engine, key, &txn); err != nil {
 			reply.SetGoError(err)
@@ -801,12 +1051,59 @@ func (r *Range) InternalHeartbeatTxn(args *proto.InternalHeartbeatTxnRequest, re
 	reply.Txn = &txn
 }
 
-// InternalResolveIntent updates the transaction status and heartbeat
-// timestamp after receiving transaction heartbeat messages from
-// coordinator.  The range will return the current status for this
-// transaction to the coordinator.
+// isTxnExpired returns true if the transaction's last heartbeat (or
+// its timestamp if it has never been heartbeat) is more than
+// TxnExpiration older than now.
+func isTxnExpired(txn *proto.Transaction, now proto.Timestamp) bool {
+	lastActive := txn.Timestamp
+	if txn.LastHeartbeat != nil && lastActive.Less(*txn.LastHeartbeat) {
+		lastActive = *txn.LastHeartbeat
+	}
+	return lastActive.WallTime+TxnExpiration.Nanoseconds() < now.WallTime
+}
+
+// InternalResolveIntent resolves the write intent(s) belonging to the
+// transaction specified in the header, committing or aborting them
+// according to args.Commit. If an end key is specified, all intents
+// in the key range are resolved; keys whose intents can't be resolved
+// are skipped, and result in an error once the others are resolved so
+// that the request is retried.
 func (r *Range) InternalResolveIntent(args *proto.InternalResolveIntentRequest, reply *proto.InternalResolveIntentResponse) {
-	reply.SetGoError(r.mvcc.ResolveWriteIntent(args.Key, args.Txn, args.Commit))
+	if len(args.EndKey) == 0 || bytes.Equal(args.Key, args.EndKey) {
+		ms, err := r.mvcc.ResolveWriteIntent(args.Key, args.Txn, args.Commit)
+		if err == nil {
+			r.addStats(ms)
+		}
+		reply.SetGoError(err)
+		return
+	}
+	_, failed, ms, err := r.mvcc.ResolveWriteIntentRange(args.Key, args.EndKey, 0, args.Txn, args.Commit, false)
+	if err == nil {
+		r.addStats(ms)
+	}
+	if err == nil && len(failed) > 0 {
+		err = util.Errorf("failed to resolve intents for %d key(s), starting with %q", len(failed), failed[0])
+	}
+	reply.SetGoError(err)
+}
+
+// InternalCloseTimestamp persists the request timestamp as the
+// range's closed timestamp and advances the closed timestamp applied
+// to this replica. Closed timestamps never regress.
+func (r *Range) InternalCloseTimestamp(args *proto.InternalCloseTimestampRequest, reply *proto.InternalCloseTimestampResponse) {
+	r.Lock()
+	defer r.Unlock()
+	if !r.closed.Less(args.Timestamp) {
+		return
+	}
+	if err := engine.PutProto(r.engine, makeClosedTimestampKey(r.Meta.RangeID), &args.Timestamp); err != nil {
+		reply.SetGoError(err)
+		return
+	}
+	r.closed = args.Timestamp
+	if r.closing.Less(r.closed) {
+		r.closing = r.closed
+	}
 }
 
 // createSnapshot creates a new snapshot, named using an internal counter.
@@ -846,3 +1143,43 @@ func (r *Range) InternalSnapshotCopy(args *proto.InternalSnapshotCopyRequest, re
 	reply.SnapshotId = args.SnapshotId
 	reply.SetGoError(err)
 }
+
+// AdminSplit divides the range into two ranges at args.SplitKey. If
+// no split key is specified, the range's median key, as determined
+// by FindSplitKey, is used. The split key must fall within the range
+// and may not be its start key. AdminSplit is a write command, so it
+// is executed by the leader via the range's Raft command queue, in
+// order with the range's other writes. The range metadata and the
+// addressing records of both ranges are updated together (see
+// Store.SplitRange). On success, the descriptors of the shortened
+// original range and of the new range are returned.
+func (r *Range) AdminSplit(args *proto.AdminSplitRequest, reply *proto.AdminSplitResponse) {
+	splitKey := engine.Key(args.SplitKey)
+	if len(splitKey) == 0 {
+		snapshotID, err := r.createSnapshot()
+		if err != nil {
+			reply.SetGoError(err)
+			return
+		}
+		splitKey, err = r.mvcc.FindSplitKey(r.Meta.StartKey, r.Meta.EndKey, snapshotID)
+		if releaseErr := r.engine.ReleaseSnapshot(snapshotID); releaseErr != nil {
+			log.Errorf("unable to release snapshot %s: %v", snapshotID, releaseErr)
+		}
+		if err != nil {
+			reply.SetGoError(util.Errorf("unable to determine split key: %v", err))
+			return
+		}
+	}
+	if !r.ContainsKey(splitKey) || bytes.Equal(splitKey, r.Meta.StartKey) {
+		reply.SetGoError(util.Errorf("split key %q must fall within range %q-%q and not equal its start key",
+			splitKey, r.Meta.StartKey, r.Meta.EndKey))
+		return
+	}
+	newRng, err := r.rm.SplitRange(r, splitKey, args.Timestamp)
+	if err != nil {
+		reply.SetGoError(err)
+		return
+	}
+	reply.Left = r.Meta.RangeDescriptor
+	reply.Right = newRng.Meta.RangeDescriptor
+}
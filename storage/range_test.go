@@ -19,6 +19,7 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
 	"reflect"
 	"regexp"
 	"sync"
@@ -285,6 +286,21 @@ func putArgs(key, value []byte, rangeID int64) (*proto.PutRequest, *proto.PutRes
 	return args, reply
 }
 
+// adminSplitArgs returns an AdminSplitRequest and AdminSplitResponse
+// pair addressed to the default replica for the specified key and
+// split key.
+func adminSplitArgs(key, splitKey []byte, rangeID int64) (*proto.AdminSplitRequest, *proto.AdminSplitResponse) {
+	args := &proto.AdminSplitRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:     key,
+			Replica: proto.Replica{RangeID: rangeID},
+		},
+		SplitKey: splitKey,
+	}
+	reply := &proto.AdminSplitResponse{}
+	return args, reply
+}
+
 // incrementArgs returns an IncrementRequest and IncrementResponse pair
 // addressed to the default replica for the specified key / value.
 func incrementArgs(key []byte, inc int64, rangeID int64) (*proto.IncrementRequest, *proto.IncrementResponse) {
@@ -476,6 +492,170 @@ func TestRangeUseTSCache(t *testing.T) {
 	}
 }
 
+// TestRangeClosedTimestamp verifies that reads report the closed
+// timestamp, that writes beneath it are moved past it, and that it is
+// recovered when the range is restarted.
+func TestRangeClosedTimestamp(t *testing.T) {
+	rng, mc, clock, _ := createTestRangeWithClock(t)
+	defer rng.Stop()
+
+	gArgs, gReply := getArgs([]byte("a"), 0)
+	gArgs.Timestamp = clock.Now()
+	if err := rng.ReadOnlyCmd("Get", gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	if !gReply.ClosedTimestamp.Equal(proto.MinTimestamp) {
+		t.Errorf("expected zero closed timestamp before any was closed; got %+v", gReply.ClosedTimestamp)
+	}
+
+	*mc = hlc.ManualClock(5)
+	closed := proto.Timestamp{WallTime: 2}
+	if err := rng.closeTimestamp(closed); err != nil {
+		t.Fatal(err)
+	}
+	gArgs, gReply = getArgs([]byte("a"), 0)
+	gArgs.Timestamp = clock.Now()
+	if err := rng.ReadOnlyCmd("Get", gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	if !gReply.ClosedTimestamp.Equal(closed) {
+		t.Errorf("expected closed timestamp %+v; got %+v", closed, gReply.ClosedTimestamp)
+	}
+
+	// A write beneath the closed timestamp is moved past it.
+	pArgs, pReply := putArgs([]byte("b"), []byte("value"), 0)
+	pArgs.Timestamp = proto.Timestamp{WallTime: 1}
+	if err := rng.ReadWriteCmd("Put", pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	if !closed.Less(pReply.Timestamp) {
+		t.Errorf("expected write to be moved past %+v; got %+v", closed, pReply.Timestamp)
+	}
+
+	// Closed timestamps never regress.
+	if err := rng.closeTimestamp(proto.Timestamp{WallTime: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if ts := rng.ClosedTimestamp(); !ts.Equal(closed) {
+		t.Errorf("expected closed timestamp %+v; got %+v", closed, ts)
+	}
+
+	// A restarted range recovers the closed timestamp.
+	restarted := NewRange(rng.Meta, clock, rng.engine, nil, nil, nil)
+	if ts := restarted.ClosedTimestamp(); !ts.Equal(closed) {
+		t.Errorf("expected recovered closed timestamp %+v; got %+v", closed, ts)
+	}
+}
+
+// TestRangeCanServeHistorical verifies that a replica may serve a
+// historical read only at or below the closed timestamp.
+func TestRangeCanServeHistorical(t *testing.T) {
+	rng, _, _, _ := createTestRangeWithClock(t)
+	defer rng.Stop()
+
+	closed := proto.Timestamp{WallTime: 2}
+	if err := rng.closeTimestamp(closed); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		header proto.RequestHeader
+		ok     bool
+	}{
+		{proto.RequestHeader{Timestamp: proto.Timestamp{WallTime: 1}, Historical: true}, true},
+		{proto.RequestHeader{Timestamp: closed, Historical: true}, true},
+		{proto.RequestHeader{Timestamp: proto.Timestamp{WallTime: 3}, Historical: true}, false},
+		{proto.RequestHeader{Timestamp: proto.Timestamp{WallTime: 1}}, false},
+		{proto.RequestHeader{Timestamp: proto.Timestamp{WallTime: 1}, Historical: true, Txn: &proto.Transaction{}}, false},
+	}
+	for i, test := range testCases {
+		if ok := rng.canServeHistorical(&test.header); ok != test.ok {
+			t.Errorf("%d: expected %t; got %t", i, test.ok, ok)
+		}
+	}
+}
+
+// TestRangeHistoricalReadPushesWrite verifies that a write beneath a
+// historical read served at the closed timestamp is pushed past the
+// read, even though a replica serving the read records it in its own
+// timestamp cache only.
+func TestRangeHistoricalReadPushesWrite(t *testing.T) {
+	rng, _, clock, _ := createTestRangeWithClock(t)
+	defer rng.Stop()
+
+	closed := proto.Timestamp{WallTime: 2}
+	if err := rng.closeTimestamp(closed); err != nil {
+		t.Fatal(err)
+	}
+	gArgs, gReply := getArgs([]byte("a"), 0)
+	gArgs.Timestamp = closed
+	gArgs.Historical = true
+	if !rng.canServeHistorical(&gArgs.RequestHeader) {
+		t.Fatalf("expected historical read at %+v to be servable", closed)
+	}
+	if err := rng.ReadOnlyCmd(Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	// Reset the timestamp cache, as a leader would not have seen a
+	// read served by a follower.
+	rng.Lock()
+	rng.tsCache = NewTimestampCache(clock)
+	rng.Unlock()
+
+	pArgs, pReply := putArgs([]byte("a"), []byte("value"), 0)
+	pArgs.Timestamp = proto.Timestamp{WallTime: 1}
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	if !closed.Less(pReply.Timestamp) {
+		t.Errorf("expected write to be pushed past read at %+v; got %+v", closed, pReply.Timestamp)
+	}
+}
+
+// TestRangeScanPushesWrite verifies that a scan registers its entire
+// key span in the timestamp cache, so that a later write beneath the
+// read timestamp to any key in the span is pushed past the read.
+func TestRangeScanPushesWrite(t *testing.T) {
+	rng, mc, clock, _ := createTestRangeWithClock(t)
+	defer rng.Stop()
+	*mc = hlc.ManualClock((1 * time.Second).Nanoseconds())
+	readTS := clock.Now()
+	sArgs := &proto.ScanRequest{
+		RequestHeader: proto.RequestHeader{
+			Key:       engine.Key("a"),
+			EndKey:    engine.Key("c"),
+			Timestamp: readTS,
+		},
+	}
+	if err := rng.ReadOnlyCmd(Scan, sArgs, &proto.ScanResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if ts := rng.tsCache.GetMax(engine.Key("b"), nil); !ts.Equal(readTS) {
+		t.Errorf("expected read of \"b\" registered at %+v; got %+v", readTS, ts)
+	}
+
+	// A write to a key within the scanned span, even one which holds no
+	// value, is pushed past the read.
+	pArgs, pReply := putArgs([]byte("b"), []byte("value"), 0)
+	pArgs.Timestamp = proto.Timestamp{WallTime: 1}
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	if !readTS.Less(pReply.Timestamp) {
+		t.Errorf("expected write timestamp to be pushed past %+v; got %+v", readTS, pReply.Timestamp)
+	}
+
+	// A write outside the span is not.
+	pArgs, pReply = putArgs([]byte("c"), []byte("value"), 0)
+	pArgs.Timestamp = proto.Timestamp{WallTime: 1}
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	if readTS.Less(pReply.Timestamp) {
+		t.Errorf("expected write outside the scanned span not to be pushed; got %+v", pReply.Timestamp)
+	}
+}
+
 // TestRangeIdempotence verifies that a retry increment with
 // same client command ID receives same reply.
 func TestRangeIdempotence(t *testing.T) {
@@ -528,6 +708,28 @@ func TestRangeIdempotence(t *testing.T) {
 	}
 }
 
+// TestRangeIncrementWithID verifies that increments carrying the same
+// ID are applied once, even with different client command IDs.
+func TestRangeIncrementWithID(t *testing.T) {
+	rng, _, clock, _ := createTestRangeWithClock(t)
+	defer rng.Stop()
+
+	for i, expected := range []int64{1, 1, 2} {
+		args, reply := incrementArgs([]byte("a"), 1, 0)
+		args.Timestamp = clock.Now()
+		args.CmdID = proto.ClientCmdID{WallTime: 1, Random: int64(i + 1)}
+		if i < 2 {
+			args.ID = []byte("inc1")
+		}
+		if err := rng.ReadWriteCmd("Increment", args, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.NewValue != expected {
+			t.Errorf("%d: expected %d; got %d", i, expected, reply.NewValue)
+		}
+	}
+}
+
 // TestRangeSnapshot.
 func TestRangeSnapshot(t *testing.T) {
 	rng, _, clock, _ := createTestRangeWithClock(t)
@@ -708,6 +910,39 @@ func TestEndTransactionAfterHeartbeat(t *testing.T) {
 	}
 }
 
+// TestEndTransactionExpired verifies that a pending transaction which
+// has not been heartbeat within TxnExpiration can no longer be
+// committed, and that a subsequent heartbeat finds it aborted.
+func TestEndTransactionExpired(t *testing.T) {
+	rng, mc, clock, _ := createTestRangeWithClock(t)
+	defer rng.Stop()
+
+	txn := NewTransaction([]byte("a"), 1, proto.SNAPSHOT, clock)
+	hbArgs, hbReply := heartbeatArgs(txn, 0)
+	hbArgs.Timestamp = txn.Timestamp
+	if err := rng.ReadWriteCmd("InternalHeartbeatTxn", hbArgs, hbReply); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the clock past the expiration and attempt to commit.
+	*mc = hlc.ManualClock(TxnExpiration.Nanoseconds() + 1)
+	args, reply := endTxnArgs(txn, true, 0)
+	args.Timestamp = clock.Now()
+	err := rng.ReadWriteCmd("EndTransaction", args, reply)
+	if matched, _ := regexp.MatchString("txn {.*}: expired", fmt.Sprint(err)); !matched {
+		t.Errorf("expected expiration error; got %v", err)
+	}
+
+	hbArgs, hbReply = heartbeatArgs(txn, 0)
+	hbArgs.Timestamp = clock.Now()
+	if err := rng.ReadWriteCmd("InternalHeartbeatTxn", hbArgs, hbReply); err != nil {
+		t.Fatal(err)
+	}
+	if hbReply.Txn.Status != proto.ABORTED {
+		t.Errorf("expected expired transaction to be aborted; got %s", hbReply.Txn.Status)
+	}
+}
+
 // TestEndTransactionWithPushedTimestamp verifies that txn can be
 // ended (both commit or abort) correctly when the commit timestamp is
 // greater than the transaction timestamp, depending on the isolation
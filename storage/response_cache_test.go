@@ -171,7 +171,7 @@ func TestResponseCacheClear(t *testing.T) {
 // garbage collected periodically.
 func TestResponseCacheGC(t *testing.T) {
 	loc := util.CreateTempDirectory()
-	rocksdb := engine.NewRocksDB(proto.Attributes{Attrs: []string{"ssd"}}, loc)
+	rocksdb := engine.NewRocksDB(proto.Attributes{Attrs: []string{"ssd"}}, loc, 0)
 	if err := rocksdb.Start(); err != nil {
 		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
 	}
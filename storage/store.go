@@ -25,11 +25,13 @@ import (
 	"sync"
 	"time"
 
+	gogoproto "code.google.com/p/gogoprotobuf/proto"
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 const (
@@ -38,6 +40,15 @@ const (
 	// GCResponseCacheExpiration is the expiration duration for response
 	// cache entries.
 	GCResponseCacheExpiration = 1 * time.Hour
+	// DefaultHeartbeatInterval is how often heartbeats are sent from the
+	// transaction coordinator to a live transaction. These keep it from
+	// being considered abandoned. If a transaction fails to be heartbeat
+	// within TxnExpiration, it's presumed its coordinator has failed.
+	DefaultHeartbeatInterval = 5 * time.Second
+	// TxnExpiration is the duration after the last heartbeat (or the
+	// transaction timestamp if never heartbeat) after which a pending
+	// transaction record is considered expired.
+	TxnExpiration = 2 * DefaultHeartbeatInterval
 )
 
 // rangeMetadataKeyPrefix and hexadecimal-formatted range ID.
@@ -219,16 +230,139 @@ func (s *Store) GetRanges() RangeSlice {
 	// using a listener for a store's range changes.
 }
 
+// RangeCounts returns the number of ranges instantiated by the store
+// and the number of ranges whose metadata is stored in its engine.
+// The store is serving all of its ranges when the two are equal.
+func (s *Store) RangeCounts() (loaded, stored int, err error) {
+	kvs, err := s.engine.Scan(engine.KeyLocalRangeMetadataPrefix,
+		engine.PrefixEndKey(engine.KeyLocalRangeMetadataPrefix), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, kv := range kvs {
+		// Skip other keys sharing the prefix, such as the range ID
+		// generator.
+		suffix := bytes.TrimPrefix(kv.Key, engine.KeyLocalRangeMetadataPrefix)
+		if _, err := strconv.ParseInt(string(suffix), 10, 64); err == nil {
+			stored++
+		}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.ranges), stored, nil
+}
+
 // CreateRange allocates a new range ID and stores range metadata.
 // On success, returns the new range.
 func (s *Store) CreateRange(startKey, endKey engine.Key, replicas []proto.Replica) (*Range, error) {
-	rangeID, err := engine.Increment(s.engine, engine.KeyLocalRangeIDGenerator, 1)
+	rangeID, err := s.allocateRangeID()
+	if err != nil {
+		return nil, err
+	}
+	return s.createRange(rangeID, startKey, endKey, replicas)
+}
+
+// SplitRange shortens rng to end at splitKey and creates a new range
+// spanning from splitKey to rng's original end key. The new range is
+// replicated on the same stores as rng. The replicas of both ranges
+// are normalized. The metadata of both ranges and their addressing
+// records, written at timestamp, are updated in a single engine
+// batch, so the addressing records never disagree with the ranges.
+// The ranges holding the addressing records must be on this store.
+// On success, returns the new range.
+func (s *Store) SplitRange(rng *Range, splitKey engine.Key, timestamp proto.Timestamp) (*Range, error) {
+	rangeID, err := s.allocateRangeID()
 	if err != nil {
 		return nil, err
 	}
+	left := gogoproto.Clone(rng.Meta).(*proto.RangeMetadata)
+	right := &proto.RangeMetadata{
+		ClusterID: left.ClusterID,
+		RangeID:   rangeID,
+		RangeDescriptor: proto.RangeDescriptor{
+			StartKey: splitKey,
+			EndKey:   left.EndKey,
+			Replicas: append([]proto.Replica(nil), left.Replicas...),
+		},
+	}
+	for i := range right.Replicas {
+		right.Replicas[i].RangeID = rangeID
+	}
+	left.EndKey = splitKey
+	left.NormalizeReplicas()
+	right.NormalizeReplicas()
+
+	var batch []interface{}
+	// Addressing ranges whose stats change once the batch is written.
+	var addrRngs []*Range
+	var addrStats []engine.MVCCStats
+	for _, meta := range []*proto.RangeMetadata{left, right} {
+		metaPut, err := engine.MakeBatchPutProto(makeRangeKey(meta.RangeID), meta)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, metaPut)
+
+		key := engine.RangeMetadataLookupKey(&meta.RangeDescriptor)
+		addrRng := s.lookupRange(key)
+		if addrRng == nil {
+			return nil, util.Errorf("range addressing record %q is not on this store", key)
+		}
+		data, err := gogoproto.Marshal(&meta.RangeDescriptor)
+		if err != nil {
+			return nil, err
+		}
+		value := proto.Value{Bytes: data}
+		value.InitChecksum(key)
+		addrBatch, ms, err := addrRng.mvcc.PreparePut(key, timestamp, value, nil)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, addrBatch...)
+		addrRngs = append(addrRngs, addrRng)
+		addrStats = append(addrStats, ms)
+	}
+	if err := s.engine.WriteBatch(batch); err != nil {
+		return nil, err
+	}
+	for i, addrRng := range addrRngs {
+		addrRng.addStats(addrStats[i])
+	}
+
+	rng.Lock()
+	rng.Meta = left
+	rng.Unlock()
+	return s.startRange(right), nil
+}
+
+// lookupRange returns the range on this store containing key, or nil
+// if there is none.
+func (s *Store) lookupRange(key engine.Key) *Range {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, rng := range s.ranges {
+		if rng.ContainsKey(key) {
+			return rng
+		}
+	}
+	return nil
+}
+
+// allocateRangeID returns a new, unused range ID.
+func (s *Store) allocateRangeID() (int64, error) {
+	rangeID, err := engine.Increment(s.engine, engine.KeyLocalRangeIDGenerator, 1)
+	if err != nil {
+		return 0, err
+	}
 	if ok, _ := engine.GetProto(s.engine, makeRangeKey(rangeID), nil); ok {
-		return nil, util.Error("newly allocated range ID already in use")
+		return 0, util.Error("newly allocated range ID already in use")
 	}
+	return rangeID, nil
+}
+
+// createRange stores metadata for a range with the specified ID and
+// starts it.
+func (s *Store) createRange(rangeID int64, startKey, endKey engine.Key, replicas []proto.Replica) (*Range, error) {
 	// RangeMetadata is stored local to this store only. It is neither
 	// replicated via raft nor available via the global kv store.
 	meta := &proto.RangeMetadata{
@@ -237,19 +371,25 @@ func (s *Store) CreateRange(startKey, endKey engine.Key, replicas []proto.Replic
 		RangeDescriptor: proto.RangeDescriptor{
 			StartKey: startKey,
 			EndKey:   endKey,
-			Replicas: replicas,
+			Replicas: append([]proto.Replica(nil), replicas...),
 		},
 	}
-	err = engine.PutProto(s.engine, makeRangeKey(rangeID), meta)
-	if err != nil {
+	meta.NormalizeReplicas()
+	if err := engine.PutProto(s.engine, makeRangeKey(rangeID), meta); err != nil {
 		return nil, err
 	}
+	return s.startRange(meta), nil
+}
+
+// startRange starts a range with the specified, already stored,
+// metadata and adds it to the store.
+func (s *Store) startRange(meta *proto.RangeMetadata) *Range {
 	rng := NewRange(meta, s.clock, s.engine, s.allocator, s.gossip, s)
 	rng.Start()
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.ranges[rangeID] = rng
-	return rng, nil
+	s.ranges[meta.RangeID] = rng
+	return rng
 }
 
 // Attrs returns the attributes of the underlying store.
@@ -284,11 +424,19 @@ func (s *Store) Descriptor(nodeDesc *NodeDescriptor) (*StoreDescriptor, error) {
 func (s *Store) ExecuteCmd(method string, args proto.Request, reply proto.Response) error {
 	// If the request has a zero timestamp, initialize to this node's clock.
 	header := args.Header()
+	if header.TraceID != 0 && log.V(2) {
+		log.Infof("trace %d: executing %s on range %d", header.TraceID, method, header.Replica.RangeID)
+	}
 	if header.Timestamp.WallTime == 0 && header.Timestamp.Logical == 0 {
 		// Update the incoming timestamp.
 		now := s.clock.Now()
 		args.Header().Timestamp = now
 	} else {
+		// Reject out-of-bounds timestamps before they reach the
+		// timestamp cache or MVCC.
+		if _, err := header.Timestamp.Sanitized(); err != nil {
+			return err
+		}
 		// Otherwise, update our clock with the incoming request. This
 		// advances the local node's clock to a high water mark from
 		// amongst all nodes with which it has interacted. The update is
@@ -325,4 +473,5 @@ func (s *Store) ExecuteCmd(method string, args proto.Request, reply proto.Respon
 // TODO(Tobias): add necessary operations as we need them.
 type RangeManager interface {
 	CreateRange(startKey, endKey engine.Key, replicas []proto.Replica) (*Range, error)
+	SplitRange(rng *Range, splitKey engine.Key, timestamp proto.Timestamp) (*Range, error)
 }
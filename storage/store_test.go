@@ -24,6 +24,7 @@ import (
 	"testing"
 	"time"
 
+	gogoproto "code.google.com/p/gogoprotobuf/proto"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/hlc"
@@ -240,3 +241,142 @@ func TestStoreExecuteCmdOutOfRange(t *testing.T) {
 		t.Error("expected key to be out of range")
 	}
 }
+
+// createTestAddressingRange creates a range on store holding the
+// meta2 addressing records of the store's other ranges, and returns
+// its ID.
+func createTestAddressingRange(t *testing.T, store *Store) int64 {
+	rng, err := store.CreateRange(engine.KeyMeta2Prefix, engine.KeyMetaMax, []proto.Replica{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rng.Meta.RangeID
+}
+
+// getRangeAddressing reads the range descriptor addressed by the
+// meta2 record for key from the range with the given ID.
+func getRangeAddressing(t *testing.T, store *Store, key engine.Key, rangeID int64) *proto.RangeDescriptor {
+	args, reply := getArgs(engine.MakeKey(engine.KeyMeta2Prefix, key), rangeID)
+	if err := store.ExecuteCmd(Get, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Value == nil {
+		return nil
+	}
+	desc := &proto.RangeDescriptor{}
+	if err := gogoproto.Unmarshal(reply.Value.Bytes, desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// TestStoreAdminSplit verifies that a range can be split at a key
+// within it, that its addressing records are updated with it and
+// that keys are then served by the new range.
+func TestStoreAdminSplit(t *testing.T) {
+	store, mc := createTestStore(t)
+	defer store.Close()
+	*mc = hlc.ManualClock(1)
+	addrRangeID := createTestAddressingRange(t, store)
+
+	pArgs, pReply := putArgs([]byte("m"), []byte("value"), 1)
+	if err := store.ExecuteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+
+	// Split keys outside the range or equal to its start key fail.
+	for _, key := range []string{"0", "a", "z"} {
+		args, reply := adminSplitArgs([]byte("a"), []byte(key), 1)
+		if err := store.ExecuteCmd(AdminSplit, args, reply); err == nil {
+			t.Errorf("expected error splitting at key %q", key)
+		}
+	}
+
+	args, reply := adminSplitArgs([]byte("m"), []byte("m"), 1)
+	if err := store.ExecuteCmd(AdminSplit, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply.Left.StartKey, engine.Key("a")) || !bytes.Equal(reply.Left.EndKey, engine.Key("m")) {
+		t.Errorf("unexpected left range %+v", reply.Left)
+	}
+	if !bytes.Equal(reply.Right.StartKey, engine.Key("m")) || !bytes.Equal(reply.Right.EndKey, engine.Key("z")) {
+		t.Errorf("unexpected right range %+v", reply.Right)
+	}
+	newRangeID := addrRangeID + 1
+	if len(reply.Right.Replicas) != 1 || reply.Right.Replicas[0].RangeID != newRangeID {
+		t.Errorf("expected new range replica with range ID %d; got %+v", newRangeID, reply.Right.Replicas)
+	}
+
+	// The addressing records of both ranges were written with the split.
+	for _, desc := range []*proto.RangeDescriptor{&reply.Left, &reply.Right} {
+		if addr := getRangeAddressing(t, store, desc.EndKey, addrRangeID); addr == nil || !addr.Equal(desc) {
+			t.Errorf("expected addressing record %+v; got %+v", desc, addr)
+		}
+	}
+
+	// The split key is no longer served by the original range.
+	gArgs, gReply := getArgs([]byte("m"), 1)
+	if err := store.ExecuteCmd(Get, gArgs, gReply); err == nil {
+		t.Error("expected key to be out of range")
+	}
+	gArgs, gReply = getArgs([]byte("m"), newRangeID)
+	if err := store.ExecuteCmd(Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	if gReply.Value == nil || !bytes.Equal(gReply.Value.Bytes, []byte("value")) {
+		t.Errorf("expected value from new range; got %+v", gReply.Value)
+	}
+}
+
+// TestStoreAdminSplitWithoutAddressing verifies that a split fails,
+// leaving the range unchanged, if the range's addressing records
+// can't be updated with it.
+func TestStoreAdminSplitWithoutAddressing(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Close()
+
+	args, reply := adminSplitArgs([]byte("m"), []byte("m"), 1)
+	if err := store.ExecuteCmd(AdminSplit, args, reply); err == nil {
+		t.Fatal("expected error splitting without addressing range")
+	}
+	rng, err := store.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rng.Meta.EndKey, engine.Key("z")) {
+		t.Errorf("expected range to remain unsplit; got %+v", rng.Meta)
+	}
+	if loaded, stored, err := store.RangeCounts(); err != nil || loaded != 1 || stored != 1 {
+		t.Errorf("expected a single range; got %d loaded, %d stored: %v", loaded, stored, err)
+	}
+}
+
+// TestStoreSplitRangeNormalizesReplicas verifies that both ranges
+// resulting from a split have normalized replicas.
+func TestStoreSplitRangeNormalizesReplicas(t *testing.T) {
+	store, _ := createTestStore(t)
+	defer store.Close()
+	createTestAddressingRange(t, store)
+
+	rng, err := store.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng.Lock()
+	rng.Meta.Replicas = []proto.Replica{
+		{NodeID: 2, StoreID: 1, RangeID: 1},
+		{NodeID: 1, StoreID: 1, RangeID: 1},
+		{NodeID: 2, StoreID: 1, RangeID: 1},
+	}
+	rng.Unlock()
+	newRng, err := store.SplitRange(rng, engine.Key("m"), store.clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*Range{rng, newRng} {
+		replicas := r.Meta.Replicas
+		if len(replicas) != 2 || replicas[0].NodeID != 1 || replicas[1].NodeID != 2 {
+			t.Errorf("range %d: expected normalized replicas; got %+v", r.Meta.RangeID, replicas)
+		}
+	}
+}
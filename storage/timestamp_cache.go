@@ -49,6 +49,12 @@ func (rk rangeKey) Compare(b interval.Comparable) int {
 // or key ranges and the timestamps at which they were most recently
 // read or written.
 //
+// Every read served by a range must Add its key span and timestamp
+// before executing, and every write must consult GetMax over its key
+// span before executing. A write whose timestamp is not greater than
+// that of a registered read of any of its keys is pushed to a higher
+// timestamp, so a read is never invalidated by a write beneath it.
+//
 // The cache also maintains a high-water mark which is the most
 // recently evicted entry's timestamp. This value always ratchets
 // with monotonic increases. The high water mark is initialized to
@@ -78,6 +84,24 @@ func (tc *TimestampCache) Clear(clock *hlc.Clock) {
 	tc.latest = tc.highWater
 }
 
+// ClearRange removes all entries overlapping the span of keys from
+// start to end, leaving entries for other spans intact. Entries which
+// only partially overlap the span are removed in their entirety. To
+// ensure no timestamp information is lost, the high water mark is
+// ratcheted up to the maximum timestamp of the removed entries. If
+// end is nil, the span covers the start key only.
+func (tc *TimestampCache) ClearRange(start, end engine.Key) {
+	if end == nil {
+		end = engine.NextKey(start)
+	}
+	for _, v := range tc.cache.DelOverlaps(rangeKey(start), rangeKey(end)) {
+		ts := v.(proto.Timestamp)
+		if tc.highWater.Less(ts) {
+			tc.highWater = ts
+		}
+	}
+}
+
 // Add the specified timestamp to the cache as covering the range of
 // keys from start to end. If end is nil, the range covers the start
 // key only.
@@ -196,3 +196,49 @@ func TestTimestampCacheClear(t *testing.T) {
 		t.Error("expected \"a\" to have cleared timestamp")
 	}
 }
+
+// TestTimestampCacheClearRange verifies that clearing a span removes
+// only the overlapping entries and ratchets the high water mark to
+// the maximum removed timestamp.
+func TestTimestampCacheClearRange(t *testing.T) {
+	manual := hlc.ManualClock(0)
+	clock := hlc.NewClock(manual.UnixNano)
+	clock.SetMaxDrift(maxClockSkew)
+	tc := NewTimestampCache(clock)
+
+	manual = hlc.ManualClock(maxClockSkew.Nanoseconds() + 1)
+	aTS := clock.Now()
+	tc.Add(engine.Key("a"), nil, aTS)
+	manual = hlc.ManualClock(maxClockSkew.Nanoseconds() + 2)
+	cdTS := clock.Now()
+	tc.Add(engine.Key("c"), engine.Key("e"), cdTS)
+	manual = hlc.ManualClock(maxClockSkew.Nanoseconds() + 3)
+	fTS := clock.Now()
+	tc.Add(engine.Key("f"), nil, fTS)
+	manual = hlc.ManualClock(maxClockSkew.Nanoseconds() + 4)
+	zTS := clock.Now()
+	tc.Add(engine.Key("z"), nil, zTS)
+
+	// Clear a span partially overlapping "c"-"e" and including "f".
+	tc.ClearRange(engine.Key("d"), engine.Key("g"))
+
+	// Entries for "a" and "z" survive; "a" is now below the ratcheted
+	// high water mark.
+	if ts := tc.GetMax(engine.Key("z"), nil); !ts.Equal(zTS) {
+		t.Errorf("expected \"z\" to have zTS timestamp; got %+v", ts)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "f", "y"} {
+		if ts := tc.GetMax(engine.Key(key), nil); !ts.Equal(fTS) {
+			t.Errorf("expected %q to have the high water fTS timestamp; got %+v", key, ts)
+		}
+	}
+
+	// Clearing a span with no entries leaves the cache unchanged.
+	tc.ClearRange(engine.Key("m"), engine.Key("n"))
+	if ts := tc.GetMax(engine.Key("z"), nil); !ts.Equal(zTS) {
+		t.Errorf("expected \"z\" to have zTS timestamp; got %+v", ts)
+	}
+	if ts := tc.GetMax(engine.Key("m"), nil); !ts.Equal(fTS) {
+		t.Errorf("expected \"m\" to have the high water fTS timestamp; got %+v", ts)
+	}
+}
@@ -59,7 +59,8 @@ func (db *structuredDB) PutSchema(s *Schema) error {
 func (db *structuredDB) DeleteSchema(s *Schema) error {
 	return (<-db.kvDB.Delete(&proto.DeleteRequest{
 		RequestHeader: proto.RequestHeader{
-			Key: engine.MakeKey(engine.KeySchemaPrefix, engine.Key(s.Key)),
+			Key:  engine.MakeKey(engine.KeySchemaPrefix, engine.Key(s.Key)),
+			User: storage.UserRoot,
 		},
 	})).GoError()
 }
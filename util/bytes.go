@@ -0,0 +1,54 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"strconv"
+	"strings"
+)
+
+// byteUnits maps the suffixes accepted by ParseBytes to multipliers.
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"B", 1},
+}
+
+// ParseBytes parses a human-readable byte size: a non-negative
+// integer, optionally followed by one of the binary units B, KiB,
+// MiB, GiB or TiB. For example, "500GiB" is 500 * 2^30 bytes.
+func ParseBytes(s string) (int64, error) {
+	num, multiplier := s, int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			num, multiplier = strings.TrimSuffix(s, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 63)
+	if err != nil {
+		return 0, Errorf("invalid byte size %q", s)
+	}
+	if int64(n) > (1<<63-1)/multiplier {
+		return 0, Errorf("byte size %q overflows", s)
+	}
+	return int64(n) * multiplier, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	testCases := []struct {
+		s       string
+		expSize int64
+		expErr  bool
+	}{
+		{"0", 0, false},
+		{"1000", 1000, false},
+		{"1000B", 1000, false},
+		{"1KiB", 1 << 10, false},
+		{"64MiB", 64 << 20, false},
+		{"500GiB", 500 << 30, false},
+		{"2TiB", 2 << 40, false},
+		{"", 0, true},
+		{"GiB", 0, true},
+		{"-1", 0, true},
+		{"1.5GiB", 0, true},
+		{"1GB", 0, true},
+		{"/mnt/ssd01", 0, true},
+		{"9999999TiB", 0, true},
+	}
+	for i, test := range testCases {
+		size, err := ParseBytes(test.s)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		} else if size != test.expSize {
+			t.Errorf("%d: expected %d bytes; got %d", i, test.expSize, size)
+		}
+	}
+}
@@ -314,6 +314,15 @@ func (oc *OrderedCache) Floor(key interface{}) (k, v interface{}, ok bool) {
 	return
 }
 
+// Do invokes f on each cache entry in key order. Unlike Get, it does
+// not affect the eviction ordering of the entries.
+func (oc *OrderedCache) Do(f func(k, v interface{})) {
+	oc.llrb.Do(func(e llrb.Comparable) (done bool) {
+		f(e.(*entry).key, e.(*entry).value)
+		return
+	})
+}
+
 // IntervalCache is a cache which supports querying of intervals which
 // match a key or range of keys. It is backed by an interval tree. See
 // comments in UnorderedCache for more details on cache functionality.
@@ -407,3 +416,15 @@ func (ic *IntervalCache) GetOverlaps(start, end interval.Comparable) []interface
 	}
 	return values
 }
+
+// DelOverlaps removes all entries which overlap the specified
+// interval and returns their values.
+func (ic *IntervalCache) DelOverlaps(start, end interval.Comparable) []interface{} {
+	es := ic.tree.Get(ic.NewKey(start, end).(*intervalKey))
+	values := make([]interface{}, len(es))
+	for i, e := range es {
+		values[i] = e.(*entry).value
+		ic.Del(e.(*entry).key)
+	}
+	return values
+}
@@ -275,6 +275,26 @@ func TestIntervalCacheOverlap(t *testing.T) {
 	}
 }
 
+func TestIntervalCacheDelOverlaps(t *testing.T) {
+	ic := NewIntervalCache(CacheConfig{Policy: CacheLRU, ShouldEvict: noEviction})
+	ic.Add(ic.NewKey(rangeKey("a"), rangeKey("c")), 1)
+	ic.Add(ic.NewKey(rangeKey("c"), rangeKey("e")), 2)
+	ic.Add(ic.NewKey(rangeKey("b"), rangeKey("g")), 3)
+	ic.Add(ic.NewKey(rangeKey("g"), rangeKey("i")), 4)
+
+	expValues := []interface{}{3, 2}
+	if vs := ic.DelOverlaps(rangeKey("d"), rangeKey("g")); !reflect.DeepEqual(expValues, vs) {
+		t.Errorf("expected deleted values %+v, got %+v", expValues, vs)
+	}
+	if ic.Len() != 2 {
+		t.Errorf("expected 2 remaining entries; got %d", ic.Len())
+	}
+	expValues = []interface{}{1, 4}
+	if vs := ic.GetOverlaps(rangeKey("a"), rangeKey("z")); !reflect.DeepEqual(expValues, vs) {
+		t.Errorf("expected remaining values %+v, got %+v", expValues, vs)
+	}
+}
+
 func TestIntervalCacheClear(t *testing.T) {
 	ic := NewIntervalCache(CacheConfig{Policy: CacheLRU, ShouldEvict: noEviction})
 	key1 := ic.NewKey(rangeKey("a"), rangeKey("c"))